@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/guntars-lemps/gospeccy/formats"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const autosnapPrefix = "autosnap-"
+
+// Returns the directory where automatic snapshots are saved:
+// the settings directory of the loaded program if there is one,
+// otherwise $HOME/.config/gospeccy/autosnap
+func autosnapDir() (string, error) {
+	dir, err := spectrum.ProgramSettingsDir()
+	if err == nil {
+		return dir, nil
+	}
+
+	dir = path.Join(spectrum.DefaultUserDir, "autosnap")
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// Saves a timestamped Z80 snapshot and deletes the oldest automatic snapshots
+// so that at most 'keep' snapshots are retained
+func autosnap(app *spectrum.Application, speccy *spectrum.Spectrum48k, keep uint) error {
+	ch := make(chan *formats.FullSnapshot)
+	speccy.CommandChannel <- spectrum.Cmd_MakeSnapshot{ch}
+	data, err := (<-ch).EncodeZ80()
+	if err != nil {
+		return err
+	}
+
+	dir, err := autosnapDir()
+	if err != nil {
+		return err
+	}
+
+	fileName := path.Join(dir, autosnapPrefix+time.Now().Format("20060102-150405")+".z80")
+	err = ioutil.WriteFile(fileName, data, 0600)
+	if err != nil {
+		return err
+	}
+	if app.Verbose {
+		app.PrintfMsg("wrote automatic snapshot \"%s\"", fileName)
+	}
+
+	// The timestamp format makes the lexicographic order chronological
+	old, err := filepath.Glob(path.Join(dir, autosnapPrefix+"*.z80"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(old)
+	for len(old) > int(keep) {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+
+	return nil
+}
+
+// Periodically saves snapshots of the emulated machine.
+// This function should run in a separate goroutine.
+func autosnapLoop(app *spectrum.Application, speccy *spectrum.Spectrum48k, interval time.Duration, keep uint) {
+	evtLoop := app.NewEventLoop()
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-evtLoop.Pause:
+			ticker.Stop()
+			spectrum.Drain(ticker)
+			evtLoop.Pause <- 0
+
+		case <-evtLoop.Terminate:
+			// Terminate this Go routine
+			if app.Verbose {
+				app.PrintfMsg("autosnap loop: exit")
+			}
+			evtLoop.Terminate <- 0
+			return
+
+		case <-ticker.C:
+			if err := autosnap(app, speccy, keep); err != nil {
+				app.PrintfMsg("autosnap: %s", err)
+			}
+		}
+	}
+}
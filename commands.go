@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/guntars-lemps/gospeccy/interpreter"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Reads commands from the specified file (or from the standard input if the path is "-")
+// and passes them to the interpreter, one line at a time.
+// The commands are executed one after another, interleaved with commands typed in the console.
+func runCommands(app *spectrum.Application, path string) {
+	var r io.Reader
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			app.PrintfMsg("%s", err)
+			return
+		}
+		defer file.Close()
+		r = file
+	}
+
+	sourceName := path
+	if path == "-" {
+		sourceName = "stdin"
+	}
+
+	in := bufio.NewReader(r)
+	for {
+		line, err := in.ReadString('\n')
+
+		if app.TerminationInProgress() || app.Terminated() {
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if (line != "") && !strings.HasPrefix(line, "//") {
+			if runErr := interpreter.GetInterpreter().RunFrom(sourceName, line); runErr != nil {
+				app.PrintfMsg("%s", runErr)
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				app.PrintfMsg("%s", err)
+			}
+			return
+		}
+	}
+}
+
+// A command-line flag which can be specified multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, "; ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Runs the Go script read from 'scriptPath' (if not empty), and then each of the code snippets.
+// Errors are reported. If 'strict' is true, the first error stops the execution and is returned.
+func runStartupCode(app *spectrum.Application, scriptPath string, snippets []string, strict bool) error {
+	intp := interpreter.GetInterpreter()
+
+	if scriptPath != "" {
+		code, err := ioutil.ReadFile(scriptPath)
+		if err == nil {
+			if strings.TrimSpace(string(code)) != "" {
+				err = intp.Run(string(code))
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %s", scriptPath, err)
+			app.PrintfMsg("%s", err)
+			if strict {
+				return err
+			}
+		}
+	}
+
+	for _, code := range snippets {
+		if app.TerminationInProgress() || app.Terminated() {
+			return nil
+		}
+
+		if strings.TrimSpace(code) == "" {
+			continue
+		}
+
+		if err := intp.Run(code); err != nil {
+			err = fmt.Errorf("-exec=%q: %s", code, err)
+			app.PrintfMsg("%s", err)
+			if strict {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
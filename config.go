@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// The configuration file sets the default values of the command-line options,
+// the options given on the command-line override them.
+//
+// Each line has the form "NAME = VALUE", or "NAME VALUE", where NAME is the name
+// of a command-line option without the leading dash. Double quotes around the value
+// are removed. A boolean option without a value is set to true.
+// Empty lines and lines starting with '#' are ignored. For example:
+//
+//	# Twice the size, no sound
+//	scale = 2
+//	audio = false
+//	fullscreen
+//	joystick-type = sinclair1
+
+// Returns the path of the default configuration file, $HOME/.config/gospeccy/config
+func defaultConfigPath() string {
+	return path.Join(spectrum.DefaultUserDir, "config")
+}
+
+// Returns the value of the -config option. The command-line is parsed
+// only after the configuration file has been applied.
+func configPathFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if (name == "config") && (i+1 < len(args)) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return defaultConfigPath()
+}
+
+// Sets the options in 'flags' to the values from the configuration file.
+// A missing file, or an empty path, is not an error. Unknown options are reported as warnings,
+// invalid values of known options as errors.
+func applyConfigFile(filePath string, flags *flag.FlagSet) (warnings []string, err error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return applyConfig(file, filePath, flags)
+}
+
+func applyConfig(r io.Reader, fileName string, flags *flag.FlagSet) (warnings []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value := line, ""
+		if i := strings.IndexAny(line, "= \t"); i >= 0 {
+			name = strings.TrimSpace(line[:i])
+			value = strings.TrimSpace(line[i+1:])
+			value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+		}
+		name = strings.TrimLeft(name, "-")
+		if (len(value) >= 2) && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+			value = value[1 : len(value)-1]
+		}
+
+		f := flags.Lookup(name)
+		if f == nil {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: unknown option \"%s\", ignored", fileName, lineNumber, name))
+			continue
+		}
+		if boolFlag, ok := f.Value.(interface {
+			IsBoolFlag() bool
+		}); ok && boolFlag.IsBoolFlag() && (value == "") {
+			value = "true"
+		}
+		if err := flags.Set(name, value); err != nil {
+			return warnings, fmt.Errorf("%s:%d: invalid value \"%s\" of option \"%s\": %s", fileName, lineNumber, value, name, err)
+		}
+	}
+
+	return warnings, scanner.Err()
+}
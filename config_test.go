@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	scale := flags.Uint("scale", 1, "")
+	audio := flags.Bool("audio", true, "")
+	joystick := flags.String("joystick-type", "kempston", "")
+	fullscreen := flags.Bool("fullscreen", false, "")
+
+	config := "# comment\n\nscale = 2\naudio false\n-joystick-type=\"fuller\"\nno-such-option = 1\nfullscreen\n"
+	warnings, err := applyConfig(strings.NewReader(config), "config", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*scale != 2) || *audio || (*joystick != "fuller") || !*fullscreen {
+		t.Errorf("unexpected values: %d, %v, %s, %v", *scale, *audio, *joystick, *fullscreen)
+	}
+	if (len(warnings) != 1) || !strings.Contains(warnings[0], "config:6:") {
+		t.Errorf("expected a warning about line 6, got %v", warnings)
+	}
+
+	// The command-line overrides the configuration file
+	if err := flags.Parse([]string{"-scale=3"}); err != nil {
+		t.Fatal(err)
+	}
+	if (*scale != 3) || *audio {
+		t.Errorf("unexpected values after parsing the command-line: %d, %v", *scale, *audio)
+	}
+
+	if _, err := applyConfig(strings.NewReader("scale = big\n"), "config", flags); err == nil {
+		t.Errorf("expected an error for an invalid value")
+	}
+}
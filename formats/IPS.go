@@ -0,0 +1,97 @@
+package formats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ips_header = []byte("PATCH")
+	ips_footer = []byte("EOF")
+)
+
+// A single record of an IPS patch.
+// RLE records are expanded when the patch is decoded.
+type IPSRecord struct {
+	Offset uint
+	Data   []byte
+}
+
+// A patch in the IPS format
+type IPS struct {
+	Records []IPSRecord
+}
+
+func NewIPS(data []byte) (*IPS, error) {
+	if !bytes.HasPrefix(data, ips_header) {
+		return nil, errors.New("invalid IPS header")
+	}
+
+	ips := &IPS{}
+
+	pos := len(ips_header)
+	for {
+		if pos+3 > len(data) {
+			return nil, errors.New("truncated IPS data")
+		}
+		if bytes.Equal(data[pos:pos+3], ips_footer) {
+			break
+		}
+
+		offset := (uint(data[pos]) << 16) | (uint(data[pos+1]) << 8) | uint(data[pos+2])
+		pos += 3
+
+		if pos+2 > len(data) {
+			return nil, errors.New("truncated IPS data")
+		}
+		size := int(joinBytes(data[pos], data[pos+1]))
+		pos += 2
+
+		var recordData []byte
+		if size == 0 {
+			// RLE record: 2-byte run length followed by the value to repeat
+			if pos+3 > len(data) {
+				return nil, errors.New("truncated IPS data")
+			}
+			runLength := int(joinBytes(data[pos], data[pos+1]))
+			recordData = bytes.Repeat(data[pos+2:pos+3], runLength)
+			pos += 3
+		} else {
+			if pos+size > len(data) {
+				return nil, errors.New("truncated IPS data")
+			}
+			recordData = data[pos : pos+size]
+			pos += size
+		}
+
+		ips.Records = append(ips.Records, IPSRecord{offset, recordData})
+	}
+
+	return ips, nil
+}
+
+// Applies the patch to 'target'.
+// If any of the records does not fit into 'target', the target is left unmodified
+// and the returned error lists the out-of-range records.
+func (ips *IPS) Apply(target []byte) error {
+	var outOfRange []string
+	for i, record := range ips.Records {
+		if record.Offset+uint(len(record.Data)) > uint(len(target)) {
+			outOfRange = append(outOfRange, fmt.Sprintf("record %d (offset 0x%x, length %d)", i, record.Offset, len(record.Data)))
+		}
+	}
+	if len(outOfRange) > 0 {
+		msg := fmt.Sprintf("IPS patch does not fit into %d bytes:", len(target))
+		for _, s := range outOfRange {
+			msg += "\n  " + s
+		}
+		return errors.New(msg)
+	}
+
+	for _, record := range ips.Records {
+		copy(target[record.Offset:], record.Data)
+	}
+
+	return nil
+}
@@ -0,0 +1,362 @@
+package formats
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// RZX input recordings.
+//
+// An RZX file contains a snapshot of the machine followed by the input recording:
+// for each frame, the number of opcode fetches until the interrupt
+// and the values returned by the IN instructions executed in the frame.
+// Only the snapshot and the input recording blocks which follow it are read,
+// a second snapshot (used by emulators to mark rollback points) ends the recording.
+
+const (
+	rzx_BLOCK_CREATOR   = 0x10
+	rzx_BLOCK_SNAPSHOT  = 0x30
+	rzx_BLOCK_RECORDING = 0x80
+)
+
+// Flags of the snapshot and input recording blocks
+const (
+	rzx_SNAPSHOT_EXTERNAL    = 0x01
+	rzx_SNAPSHOT_COMPRESSED  = 0x02
+	rzx_RECORDING_PROTECTED  = 0x01
+	rzx_RECORDING_COMPRESSED = 0x02
+)
+
+// An IN count of 0xFFFF means that the frame repeats the IN values of the previous frame
+const rzx_REPEAT_FRAME = 0xffff
+
+var rzxSignature = []byte("RZX!")
+
+// The version of the RZX format written by 'Encode'
+const (
+	rzx_VERSION_MAJOR = 0
+	rzx_VERSION_MINOR = 13
+)
+
+type RZXFrame struct {
+	// The number of opcode fetches (increments of the R register) from the beginning
+	// of the frame until the interrupt which ends the frame
+	FetchCount uint16
+
+	// The values returned by the IN instructions, in the order they were executed
+	InValues []byte
+}
+
+type RZX struct {
+	// The name of the program which created the recording, or an empty string
+	Creator string
+
+	// The state of the machine at the start of the recording
+	Snapshot Snapshot
+
+	// The T-state counter at the start of the recording,
+	// the first frame is shorter than the others
+	TStates uint32
+
+	Frames []RZXFrame
+}
+
+func IsRZX(data []byte) bool {
+	return bytes.HasPrefix(data, rzxSignature)
+}
+
+func NewRZX(data []byte) (*RZX, error) {
+	rzx := &RZX{}
+
+	err := rzx.read(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return rzx, nil
+}
+
+func rzxError(format string, a ...interface{}) error {
+	return errors.New("RZX: " + fmt.Sprintf(format, a...))
+}
+
+func inflate(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (rzx *RZX) read(data []byte) error {
+	if !IsRZX(data) || (len(data) < 10) {
+		return rzxError("invalid signature")
+	}
+
+	pos := 10
+	for pos < len(data) {
+		if pos+5 > len(data) {
+			return rzxError("truncated block header at offset %d", pos)
+		}
+		id := data[pos]
+		length := int(binary.LittleEndian.Uint32(data[pos+1:]))
+		if (length < 5) || (pos+length > len(data)) {
+			return rzxError("invalid length of block 0x%02x at offset %d", id, pos)
+		}
+		block := data[pos+5 : pos+length]
+		pos += length
+
+		switch id {
+		case rzx_BLOCK_CREATOR:
+			if len(block) >= 20 {
+				rzx.Creator = strings.TrimRight(string(block[0:20]), "\x00 ")
+			}
+
+		case rzx_BLOCK_SNAPSHOT:
+			if rzx.Snapshot != nil {
+				// A rollback point, the recording continues from a different state
+				pos = len(data)
+				break
+			}
+			snapshot, err := readRZXSnapshot(block)
+			if err != nil {
+				return err
+			}
+			rzx.Snapshot = snapshot
+
+		case rzx_BLOCK_RECORDING:
+			if rzx.Snapshot == nil {
+				return rzxError("the input recording is not preceded by a snapshot")
+			}
+			if err := rzx.readRecording(block); err != nil {
+				return err
+			}
+
+		default:
+			// Security information and unknown blocks are skipped
+		}
+	}
+
+	if rzx.Snapshot == nil {
+		return rzxError("no snapshot found")
+	}
+	if len(rzx.Frames) == 0 {
+		return rzxError("no input recording found")
+	}
+
+	return nil
+}
+
+func readRZXSnapshot(block []byte) (Snapshot, error) {
+	if len(block) < 12 {
+		return nil, rzxError("truncated snapshot block")
+	}
+
+	flags := binary.LittleEndian.Uint32(block[0:])
+	ext := "." + strings.ToLower(strings.TrimRight(string(block[4:8]), "\x00 "))
+	length := binary.LittleEndian.Uint32(block[8:])
+	data := block[12:]
+
+	if (flags & rzx_SNAPSHOT_EXTERNAL) != 0 {
+		return nil, rzxError("external snapshots are not supported")
+	}
+	if (flags & rzx_SNAPSHOT_COMPRESSED) != 0 {
+		var err error
+		data, err = inflate(data)
+		if err != nil {
+			return nil, rzxError("snapshot: %s", err)
+		}
+	}
+	if uint32(len(data)) != length {
+		return nil, rzxError("snapshot: expected %d bytes, got %d", length, len(data))
+	}
+
+	format := formatByExtension(ext)
+	if (format == nil) || ((format.Format != FORMAT_SNA) && (format.Format != FORMAT_Z80)) {
+		return nil, rzxError("unsupported snapshot format \"%s\"", ext)
+	}
+
+	return SnapshotData(data).Decode(format.Format)
+}
+
+func (rzx *RZX) readRecording(block []byte) error {
+	if len(block) < 13 {
+		return rzxError("truncated input recording block")
+	}
+
+	numFrames := int(binary.LittleEndian.Uint32(block[0:]))
+	tstates := binary.LittleEndian.Uint32(block[5:])
+	flags := binary.LittleEndian.Uint32(block[9:])
+	data := block[13:]
+
+	if (flags & rzx_RECORDING_PROTECTED) != 0 {
+		return rzxError("encrypted input recordings are not supported")
+	}
+	if (flags & rzx_RECORDING_COMPRESSED) != 0 {
+		var err error
+		data, err = inflate(data)
+		if err != nil {
+			return rzxError("input recording: %s", err)
+		}
+	}
+
+	if len(rzx.Frames) == 0 {
+		rzx.TStates = tstates
+	}
+
+	pos := 0
+	for i := 0; i < numFrames; i++ {
+		if pos+4 > len(data) {
+			return rzxError("truncated input recording frame %d", len(rzx.Frames))
+		}
+		frame := RZXFrame{FetchCount: binary.LittleEndian.Uint16(data[pos:])}
+		inCount := int(binary.LittleEndian.Uint16(data[pos+2:]))
+		pos += 4
+
+		if inCount == rzx_REPEAT_FRAME {
+			if len(rzx.Frames) > 0 {
+				frame.InValues = rzx.Frames[len(rzx.Frames)-1].InValues
+			}
+		} else {
+			if pos+inCount > len(data) {
+				return rzxError("truncated input recording frame %d", len(rzx.Frames))
+			}
+			frame.InValues = data[pos : pos+inCount]
+			pos += inCount
+		}
+
+		rzx.Frames = append(rzx.Frames, frame)
+	}
+
+	return nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func appendRZXBlock(data []byte, id byte, block []byte) []byte {
+	var header [5]byte
+	header[0] = id
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(header)+len(block)))
+
+	data = append(data, header[:]...)
+	return append(data, block...)
+}
+
+// Encodes the snapshot of the recording. A 48k snapshot is stored in the SNA format,
+// a 128k snapshot in the Z80 format. Returns the data and the file extension of the format.
+func (rzx *RZX) encodeSnapshot() ([]byte, string, error) {
+	s := FullSnapshot{
+		Cpu: rzx.Snapshot.CpuState(),
+		Ula: rzx.Snapshot.UlaState(),
+		Mem: *rzx.Snapshot.Memory(),
+	}
+	if ay, ok := rzx.Snapshot.(AYSnapshot); ok {
+		s.AY, s.AYPresent = ay.AYState()
+	}
+	if s128, ok := rzx.Snapshot.(Snapshot128); ok {
+		s.Mem128 = s128.Memory128()
+	}
+	if issue2, ok := rzx.Snapshot.(Issue2Snapshot); ok {
+		s.Issue2 = issue2.Issue2Emulation()
+	}
+
+	if s.Mem128 != nil {
+		data, err := s.EncodeZ80()
+		return data, "z80", err
+	}
+
+	data, err := s.EncodeSNA()
+	return data, "sna", err
+}
+
+// Encodes the recording into an RZX file.
+// The snapshot is stored in the SNA or the Z80 format and, like the input recording, compressed.
+// A frame with the same IN values as the previous frame is stored as a repeated frame.
+func (rzx *RZX) Encode() ([]byte, error) {
+	snapshot, ext, err := rzx.encodeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	data := append([]byte{}, rzxSignature...)
+	data = append(data, rzx_VERSION_MAJOR, rzx_VERSION_MINOR, 0, 0, 0, 0)
+
+	// Creator
+	{
+		var block [24]byte
+		copy(block[0:20], rzx.Creator)
+		data = appendRZXBlock(data, rzx_BLOCK_CREATOR, block[:])
+	}
+
+	// Snapshot
+	{
+		compressed, err := deflate(snapshot)
+		if err != nil {
+			return nil, err
+		}
+
+		block := make([]byte, 12, 12+len(compressed))
+		binary.LittleEndian.PutUint32(block[0:], rzx_SNAPSHOT_COMPRESSED)
+		copy(block[4:8], ext)
+		binary.LittleEndian.PutUint32(block[8:], uint32(len(snapshot)))
+		data = appendRZXBlock(data, rzx_BLOCK_SNAPSHOT, append(block, compressed...))
+	}
+
+	// Input recording
+	{
+		var frames []byte
+		for i, frame := range rzx.Frames {
+			var header [4]byte
+			binary.LittleEndian.PutUint16(header[0:], frame.FetchCount)
+
+			repeated := (i > 0) && (len(frame.InValues) > 0) && bytes.Equal(frame.InValues, rzx.Frames[i-1].InValues)
+			if repeated {
+				binary.LittleEndian.PutUint16(header[2:], rzx_REPEAT_FRAME)
+			} else {
+				if len(frame.InValues) >= rzx_REPEAT_FRAME {
+					return nil, rzxError("too many IN values in frame %d", i)
+				}
+				binary.LittleEndian.PutUint16(header[2:], uint16(len(frame.InValues)))
+			}
+
+			frames = append(frames, header[:]...)
+			if !repeated {
+				frames = append(frames, frame.InValues...)
+			}
+		}
+
+		compressed, err := deflate(frames)
+		if err != nil {
+			return nil, err
+		}
+
+		block := make([]byte, 13, 13+len(compressed))
+		binary.LittleEndian.PutUint32(block[0:], uint32(len(rzx.Frames)))
+		binary.LittleEndian.PutUint32(block[5:], rzx.TStates)
+		binary.LittleEndian.PutUint32(block[9:], rzx_RECORDING_COMPRESSED)
+		data = appendRZXBlock(data, rzx_BLOCK_RECORDING, append(block, compressed...))
+	}
+
+	return data, nil
+}
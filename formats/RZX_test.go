@@ -0,0 +1,166 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func rzxBlock(id byte, body []byte) []byte {
+	block := make([]byte, 5, 5+len(body))
+	block[0] = id
+	binary.LittleEndian.PutUint32(block[1:], uint32(5+len(body)))
+	return append(block, body...)
+}
+
+func mustDeflate(t *testing.T, data []byte) []byte {
+	compressed, err := deflate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
+
+// Returns an RZX file with a compressed SNA snapshot and three frames.
+// The third frame repeats the IN values of the second frame.
+func makeRZX(t *testing.T, compressFrames bool) []byte {
+	sna := makeSNA()
+
+	snapshot := make([]byte, 12)
+	binary.LittleEndian.PutUint32(snapshot[0:], rzx_SNAPSHOT_COMPRESSED)
+	copy(snapshot[4:], "sna\x00")
+	binary.LittleEndian.PutUint32(snapshot[8:], uint32(len(sna)))
+	snapshot = append(snapshot, mustDeflate(t, sna)...)
+
+	frames := []byte{
+		10, 0, 0, 0,
+		200, 1, 2, 0, 0xbf, 0xfe,
+		50, 0, 0xff, 0xff,
+	}
+	recording := make([]byte, 13)
+	binary.LittleEndian.PutUint32(recording[0:], 3)
+	binary.LittleEndian.PutUint32(recording[5:], 1234)
+	if compressFrames {
+		binary.LittleEndian.PutUint32(recording[9:], rzx_RECORDING_COMPRESSED)
+		frames = mustDeflate(t, frames)
+	}
+	recording = append(recording, frames...)
+
+	creator := make([]byte, 24)
+	copy(creator, "Test")
+
+	data := append([]byte("RZX!"), 0, 13, 0, 0, 0, 0)
+	data = append(data, rzxBlock(rzx_BLOCK_CREATOR, creator)...)
+	data = append(data, rzxBlock(rzx_BLOCK_SNAPSHOT, snapshot)...)
+	data = append(data, rzxBlock(rzx_BLOCK_RECORDING, recording)...)
+	return data
+}
+
+func TestRZX(t *testing.T) {
+	for _, compressFrames := range []bool{false, true} {
+		program, err := ReadProgramFrom(bytes.NewReader(makeRZX(t, compressFrames)), "rzx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rzx, ok := program.(*RZX)
+		if !ok {
+			t.Fatalf("expected an RZX, got %T", program)
+		}
+
+		if rzx.Creator != "Test" {
+			t.Errorf("expected the creator \"Test\", got \"%s\"", rzx.Creator)
+		}
+		if rzx.Snapshot.CpuState().PC != 0x8123 {
+			t.Errorf("expected PC 0x8123, got 0x%04x", rzx.Snapshot.CpuState().PC)
+		}
+		if rzx.TStates != 1234 {
+			t.Errorf("expected 1234 T-states, got %d", rzx.TStates)
+		}
+
+		expected := []RZXFrame{
+			{10, []byte{}},
+			{456, []byte{0xbf, 0xfe}},
+			{50, []byte{0xbf, 0xfe}},
+		}
+		if len(rzx.Frames) != len(expected) {
+			t.Fatalf("expected %d frames, got %d", len(expected), len(rzx.Frames))
+		}
+		for i, frame := range rzx.Frames {
+			if (frame.FetchCount != expected[i].FetchCount) || !bytes.Equal(frame.InValues, expected[i].InValues) {
+				t.Errorf("frame %d: expected %v, got %v", i, expected[i], frame)
+			}
+		}
+	}
+
+	if _, err := NewRZX(makeRZX(t, false)[:40]); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestRZX_Encode(t *testing.T) {
+	sna, err := SnapshotData(makeSNA()).DecodeSNA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := &RZX{
+		Creator:  "GoSpeccy",
+		Snapshot: sna,
+		TStates:  100,
+		Frames: []RZXFrame{
+			{0, nil},
+			{1000, []byte{0xbf, 0xbf}},
+			{1001, []byte{0xbf, 0xbf}},
+			{999, []byte{0x1f}},
+		},
+	}
+
+	data, err := original.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rzx, err := NewRZX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if (rzx.Creator != original.Creator) || (rzx.TStates != original.TStates) {
+		t.Errorf("expected creator \"%s\" and %d T-states, got \"%s\" and %d", original.Creator, original.TStates, rzx.Creator, rzx.TStates)
+	}
+	if rzx.Snapshot.CpuState() != sna.CpuState() {
+		t.Errorf("expected CPU state %+v, got %+v", sna.CpuState(), rzx.Snapshot.CpuState())
+	}
+	if len(rzx.Frames) != len(original.Frames) {
+		t.Fatalf("expected %d frames, got %d", len(original.Frames), len(rzx.Frames))
+	}
+	for i, frame := range rzx.Frames {
+		expected := original.Frames[i]
+		if (frame.FetchCount != expected.FetchCount) || !bytes.Equal(frame.InValues, expected.InValues) {
+			t.Errorf("frame %d: expected %v, got %v", i, expected, frame)
+		}
+	}
+}
+
+func TestRZX_Encode128k(t *testing.T) {
+	original := &RZX{
+		Snapshot: makeFullSnapshot(true),
+		Frames:   []RZXFrame{{100, []byte{0xbf}}},
+	}
+
+	data, err := original.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rzx, err := NewRZX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s128, ok := rzx.Snapshot.(Snapshot128)
+	if !ok || (s128.Memory128() == nil) {
+		t.Fatalf("expected a 128k snapshot, got %T", rzx.Snapshot)
+	}
+	if *s128.Memory128() != *original.Snapshot.(*FullSnapshot).Mem128 {
+		t.Errorf("the 128k memory differs")
+	}
+}
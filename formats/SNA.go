@@ -63,14 +63,34 @@ func (data SnapshotData) DecodeSNA() (*SNA, error) {
 
 	s.cpu.Tstate = 0
 
-	// Start by executing RETN at address 0x72 in ROM
-	s.cpu.PC = 0x72
+	// The PC is on the stack. Pop it here, instead of executing a RETN,
+	// so that the registers are the same as when the snapshot was saved.
+	// The popped word itself remains in memory, like after a real RETN.
+	if (s.cpu.SP >= 0x4000) && (s.cpu.SP <= 0xfffe) {
+		s.cpu.PC = joinBytes(s.mem[s.cpu.SP-0x4000+1], s.mem[s.cpu.SP-0x4000])
+		s.cpu.SP += 2
+	} else {
+		// Start by executing RETN at address 0x72 in ROM
+		s.cpu.PC = 0x72
+	}
 
 	return &s, nil
 }
 
-// Turn snapshot into binary data (SNA format)
+// Turn snapshot into binary data (SNA format).
+//
+// The PC is pushed onto the stack, overwriting the two bytes below SP.
+// Saving a snapshot decoded by DecodeSNA reproduces the original file, except for:
+//
+//	byte 19: only bit 2 (IFF2) is saved
+//	byte 26: only bits 0-2 (border color) are saved
 func (s *FullSnapshot) EncodeSNA() ([]byte, error) {
+	// A 128k machine can be saved only if it is locked in the 48k mode:
+	// RAM bank 0 and the 48k BASIC ROM paged in, the normal screen displayed
+	if (s.Mem128 != nil) && ((s.Mem128.Paging & 0x3f) != 0x30) {
+		return nil, errors.New("the SNA format cannot store the state of a 128k machine, use the Z80 format")
+	}
+
 	var data [49179]byte
 
 	// Save registers
@@ -0,0 +1,64 @@
+package formats
+
+import "testing"
+
+// Builds an SNA snapshot with the PC 0x8123 pushed at address 0xff00.
+// Bytes 19 and 26 contain bits which are not preserved by EncodeSNA.
+func makeSNA() []byte {
+	data := make([]byte, 49179)
+	for i := 0; i < 27; i++ {
+		data[i] = byte(0x11 * i)
+	}
+	data[19] = 0xff
+	data[23] = 0x00 // SP
+	data[24] = 0xff
+	data[25] = 1
+	data[26] = 0xfa
+
+	for i := 27; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	data[0xff00-0x4000+27] = 0x23
+	data[0xff01-0x4000+27] = 0x81
+
+	return data
+}
+
+func TestSNA_RoundTrip(t *testing.T) {
+	original := makeSNA()
+
+	sna, err := SnapshotData(original).DecodeSNA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpu := sna.CpuState()
+	if cpu.PC != 0x8123 {
+		t.Errorf("expected PC 0x8123, got 0x%04x", cpu.PC)
+	}
+	if cpu.SP != 0xff02 {
+		t.Errorf("expected SP 0xff02, got 0x%04x", cpu.SP)
+	}
+
+	s := &FullSnapshot{Cpu: sna.CpuState(), Ula: sna.UlaState(), Mem: *sna.Memory()}
+	saved, err := s.EncodeSNA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(saved) != len(original) {
+		t.Fatalf("expected %d bytes, got %d", len(original), len(saved))
+	}
+	for i := range original {
+		mask := byte(0xff)
+		switch i {
+		case 19:
+			mask = 0x04
+		case 26:
+			mask = 0x07
+		}
+		if (saved[i] & mask) != (original[i] & mask) {
+			t.Errorf("byte %d: expected 0x%02x, got 0x%02x", i, original[i]&mask, saved[i]&mask)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package formats
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 const (
 	TAP_FILE_PROGRAM         = 0
@@ -101,6 +105,40 @@ func (tap *TAP) GetBlock(pos int) tapBlock {
 	return tap.blocks[pos]
 }
 
+// Returns the number of blocks in the TAP
+func (tap *TAP) NumBlocks() int {
+	return len(tap.blocks)
+}
+
+// Returns the payload of a standard tape block, that is: the block
+// without the leading flag byte and the trailing checksum byte.
+// The boolean result reports whether the block's checksum is valid.
+func BlockPayload(block []byte) (payload []byte, checksumOK bool) {
+	if len(block) < 2 {
+		return []byte{}, false
+	}
+	return block[1 : len(block)-1], checksum(block)
+}
+
+var tapFileTypeNames = []string{"Program", "Number array", "Character array", "Bytes"}
+
+// Decodes a standard header block, including the flag byte and the checksum.
+// Returns ok=false if the block is not a header.
+func DecodeHeader(block []byte) (fileType string, filename string, ok bool) {
+	if (len(block) != 19) || (block[0] != TAP_BLOCK_HEADER) {
+		return "", "", false
+	}
+
+	header := readBlock_header(block)
+	if int(header.tapType) < len(tapFileTypeNames) {
+		fileType = tapFileTypeNames[header.tapType]
+	} else {
+		fileType = fmt.Sprintf("Type %d", header.tapType)
+	}
+
+	return fileType, strings.TrimRight(header.filename, " "), true
+}
+
 func readBlock_header(data []byte) *tapBlockHeader {
 	header := new(tapBlockHeader)
 
@@ -0,0 +1,260 @@
+package formats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// The TZX blocks which are understood by the parser
+const (
+	TZX_BLOCK_STANDARD   = 0x10 // Standard speed data
+	TZX_BLOCK_TURBO      = 0x11 // Turbo speed data
+	TZX_BLOCK_PURE_TONE  = 0x12
+	TZX_BLOCK_PULSES     = 0x13 // Sequence of pulses of various lengths
+	TZX_BLOCK_PURE_DATA  = 0x14
+	TZX_BLOCK_PAUSE      = 0x20
+	TZX_BLOCK_TEXT       = 0x30 // Text description
+	tzx_BLOCK_GROUPSTART = 0x21
+	tzx_BLOCK_GROUPEND   = 0x22
+	tzx_BLOCK_MESSAGE    = 0x31
+	tzx_BLOCK_ARCHIVE    = 0x32
+	tzx_BLOCK_HARDWARE   = 0x33
+	tzx_BLOCK_CUSTOM     = 0x35
+	tzx_BLOCK_GLUE       = 0x5a
+)
+
+// The timings of the standard ROM loader, in T-states
+const (
+	TZX_STANDARD_PILOT_PULSE    = 2168
+	TZX_STANDARD_SYNC1          = 667
+	TZX_STANDARD_SYNC2          = 735
+	TZX_STANDARD_ZERO_PULSE     = 855
+	TZX_STANDARD_ONE_PULSE      = 1710
+	TZX_HEADER_PILOT_PULSES     = 8063 // Pilot tone before a block with flag byte < 128
+	TZX_DATA_PILOT_PULSES       = 3223
+	TZX_STANDARD_PAUSE_MILLIS   = 1000
+	TZX_TSTATES_PER_MILLISECOND = 3500
+)
+
+var tzxSignature = []byte("ZXTape!\x1a")
+
+// A block of a TZX file which carries a signal or a description.
+// Blocks which only carry other information are skipped by the parser.
+//
+// The signal of a block consists of a pilot tone, a sequence of pulses and data,
+// followed by a pause. Each of these parts can be empty.
+type TZXBlock struct {
+	ID byte
+
+	// The length of a pilot tone pulse, and the number of pulses
+	PilotPulse, PilotPulses uint16
+
+	// The sync pulses of blocks 0x10 and 0x11, or the pulses of block 0x13
+	SyncPulses []uint16
+
+	// The lengths of the two pulses encoding a 0 bit and a 1 bit
+	ZeroPulse, OnePulse uint16
+
+	// Data bits are played starting from the most significant bit.
+	// Only the first 'UsedBitsInLastByte' bits of the last byte are played.
+	Data               []byte
+	UsedBitsInLastByte byte
+
+	// The silence after the block, in milliseconds
+	Pause uint16
+
+	// The description in case of block 0x30
+	Text string
+}
+
+type TZX struct {
+	MajorVersion, MinorVersion byte
+
+	blocks []TZXBlock
+}
+
+// Returns whether the data starts with the TZX signature
+func IsTZX(data []byte) bool {
+	return bytes.HasPrefix(data, tzxSignature)
+}
+
+func NewTZX(data []byte) (*TZX, error) {
+	tzx := &TZX{}
+
+	err := tzx.read(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return tzx, nil
+}
+
+func (tzx *TZX) GetBlock(pos int) *TZXBlock {
+	return &tzx.blocks[pos]
+}
+
+// Returns the number of blocks in the TZX
+func (tzx *TZX) NumBlocks() int {
+	return len(tzx.blocks)
+}
+
+func readWord(data []byte) uint16 {
+	return joinBytes(data[1], data[0])
+}
+
+func readWords(data []byte, n int) []uint16 {
+	words := make([]uint16, n)
+	for i := range words {
+		words[i] = readWord(data[2*i:])
+	}
+	return words
+}
+
+// Returns the number of bytes following the block ID,
+// given at least the first 'tzx_headerLengths[id]' of them
+func tzxBlockLength(id byte, data []byte) int {
+	switch id {
+	case TZX_BLOCK_STANDARD:
+		return 0x04 + int(readWord(data[2:]))
+	case TZX_BLOCK_TURBO:
+		return 0x12 + int(readWord(data[15:])) + int(data[17])<<16
+	case TZX_BLOCK_PURE_TONE:
+		return 0x04
+	case TZX_BLOCK_PULSES:
+		return 0x01 + 2*int(data[0])
+	case TZX_BLOCK_PURE_DATA:
+		return 0x0a + int(readWord(data[7:])) + int(data[9])<<16
+	case TZX_BLOCK_PAUSE:
+		return 0x02
+	case TZX_BLOCK_TEXT, tzx_BLOCK_GROUPSTART:
+		return 0x01 + int(data[0])
+	case tzx_BLOCK_GROUPEND:
+		return 0
+	case tzx_BLOCK_MESSAGE:
+		return 0x02 + int(data[1])
+	case tzx_BLOCK_ARCHIVE:
+		return 0x02 + int(readWord(data))
+	case tzx_BLOCK_HARDWARE:
+		return 0x01 + 3*int(data[0])
+	case tzx_BLOCK_CUSTOM:
+		return 0x14 + int(readWord(data[16:])) + int(readWord(data[18:]))<<16
+	case tzx_BLOCK_GLUE:
+		return 0x09
+	}
+
+	panic("unknown TZX block")
+}
+
+// The number of bytes following the block ID which determine the length of the block
+var tzx_headerLengths = map[byte]int{
+	TZX_BLOCK_STANDARD:   0x04,
+	TZX_BLOCK_TURBO:      0x12,
+	TZX_BLOCK_PURE_TONE:  0x04,
+	TZX_BLOCK_PULSES:     0x01,
+	TZX_BLOCK_PURE_DATA:  0x0a,
+	TZX_BLOCK_PAUSE:      0x02,
+	TZX_BLOCK_TEXT:       0x01,
+	tzx_BLOCK_GROUPSTART: 0x01,
+	tzx_BLOCK_GROUPEND:   0x00,
+	tzx_BLOCK_MESSAGE:    0x02,
+	tzx_BLOCK_ARCHIVE:    0x02,
+	tzx_BLOCK_HARDWARE:   0x01,
+	tzx_BLOCK_CUSTOM:     0x14,
+	tzx_BLOCK_GLUE:       0x09,
+}
+
+// Decodes a block, given the bytes following the block ID.
+// Returns nil if the block does not carry a signal or a description.
+func readTZXBlock(id byte, data []byte) *TZXBlock {
+	block := &TZXBlock{ID: id, UsedBitsInLastByte: 8}
+
+	switch id {
+	case TZX_BLOCK_STANDARD:
+		block.Pause = readWord(data[0:])
+		block.Data = data[0x04:]
+		block.PilotPulse = TZX_STANDARD_PILOT_PULSE
+		if (len(block.Data) > 0) && (block.Data[0] >= 128) {
+			block.PilotPulses = TZX_DATA_PILOT_PULSES
+		} else {
+			block.PilotPulses = TZX_HEADER_PILOT_PULSES
+		}
+		block.SyncPulses = []uint16{TZX_STANDARD_SYNC1, TZX_STANDARD_SYNC2}
+		block.ZeroPulse = TZX_STANDARD_ZERO_PULSE
+		block.OnePulse = TZX_STANDARD_ONE_PULSE
+
+	case TZX_BLOCK_TURBO:
+		block.PilotPulse = readWord(data[0x00:])
+		block.SyncPulses = readWords(data[0x02:], 2)
+		block.ZeroPulse = readWord(data[0x06:])
+		block.OnePulse = readWord(data[0x08:])
+		block.PilotPulses = readWord(data[0x0a:])
+		block.UsedBitsInLastByte = data[0x0c]
+		block.Pause = readWord(data[0x0d:])
+		block.Data = data[0x12:]
+
+	case TZX_BLOCK_PURE_TONE:
+		block.PilotPulse = readWord(data[0x00:])
+		block.PilotPulses = readWord(data[0x02:])
+
+	case TZX_BLOCK_PULSES:
+		block.SyncPulses = readWords(data[0x01:], int(data[0]))
+
+	case TZX_BLOCK_PURE_DATA:
+		block.ZeroPulse = readWord(data[0x00:])
+		block.OnePulse = readWord(data[0x02:])
+		block.UsedBitsInLastByte = data[0x04]
+		block.Pause = readWord(data[0x05:])
+		block.Data = data[0x0a:]
+
+	case TZX_BLOCK_PAUSE:
+		block.Pause = readWord(data)
+
+	case TZX_BLOCK_TEXT:
+		block.Text = string(data[0x01:])
+
+	default:
+		return nil
+	}
+
+	if (block.UsedBitsInLastByte == 0) || (block.UsedBitsInLastByte > 8) {
+		block.UsedBitsInLastByte = 8
+	}
+
+	return block
+}
+
+func (tzx *TZX) read(data []byte) error {
+	if !IsTZX(data) || (len(data) < len(tzxSignature)+2) {
+		return errors.New("invalid TZX header")
+	}
+
+	tzx.MajorVersion = data[len(tzxSignature)]
+	tzx.MinorVersion = data[len(tzxSignature)+1]
+
+	pos := len(tzxSignature) + 2
+	for pos < len(data) {
+		id := data[pos]
+		pos++
+
+		headerLength, known := tzx_headerLengths[id]
+		if !known {
+			return fmt.Errorf("unsupported TZX block 0x%02x", id)
+		}
+		if pos+headerLength > len(data) {
+			return errors.New("invalid TZX data")
+		}
+
+		blockLength := tzxBlockLength(id, data[pos:])
+		if pos+blockLength > len(data) {
+			return errors.New("invalid TZX data")
+		}
+
+		if block := readTZXBlock(id, data[pos:pos+blockLength]); block != nil {
+			tzx.blocks = append(tzx.blocks, *block)
+		}
+		pos += blockLength
+	}
+
+	return nil
+}
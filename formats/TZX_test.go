@@ -0,0 +1,102 @@
+package formats
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func makeTZX() []byte {
+	data := append([]byte("ZXTape!\x1a"), 1, 20)
+
+	// Text description
+	data = append(data, TZX_BLOCK_TEXT, 5)
+	data = append(data, "Hello"...)
+
+	// Archive info, skipped by the parser
+	data = append(data, tzx_BLOCK_ARCHIVE, 3, 0, 0, 0, 0)
+
+	// Standard speed data: a data block with a pause of 2000 ms
+	data = append(data, TZX_BLOCK_STANDARD, 0xd0, 0x07, 3, 0, 0xff, 0x12, 0xed)
+
+	// Turbo speed data
+	data = append(data, TZX_BLOCK_TURBO,
+		0x00, 0x01, // Pilot pulse
+		0x10, 0x00, 0x20, 0x00, // Sync pulses
+		0x30, 0x00, 0x60, 0x00, // Zero and one pulses
+		0x05, 0x00, // Pilot pulses
+		4,          // Used bits in the last byte
+		0x00, 0x00, // Pause
+		2, 0, 0, // Data length
+		0xaa, 0xf0)
+
+	data = append(data, TZX_BLOCK_PURE_TONE, 0x40, 0x00, 0x03, 0x00)
+	data = append(data, TZX_BLOCK_PULSES, 2, 0x11, 0x00, 0x22, 0x00)
+	data = append(data, TZX_BLOCK_PURE_DATA, 0x30, 0x00, 0x60, 0x00, 8, 0x64, 0x00, 1, 0, 0, 0x81)
+	data = append(data, TZX_BLOCK_PAUSE, 0xe8, 0x03)
+
+	return data
+}
+
+func TestTZX_Blocks(t *testing.T) {
+	tzx, err := NewTZX(makeTZX())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TZXBlock{
+		{ID: TZX_BLOCK_TEXT, UsedBitsInLastByte: 8, Text: "Hello"},
+		{
+			ID:          TZX_BLOCK_STANDARD,
+			PilotPulse:  TZX_STANDARD_PILOT_PULSE,
+			PilotPulses: TZX_DATA_PILOT_PULSES,
+			SyncPulses:  []uint16{TZX_STANDARD_SYNC1, TZX_STANDARD_SYNC2},
+			ZeroPulse:   TZX_STANDARD_ZERO_PULSE, OnePulse: TZX_STANDARD_ONE_PULSE,
+			Data: []byte{0xff, 0x12, 0xed}, UsedBitsInLastByte: 8,
+			Pause: 2000,
+		},
+		{
+			ID:         TZX_BLOCK_TURBO,
+			PilotPulse: 0x100, PilotPulses: 5,
+			SyncPulses: []uint16{0x10, 0x20},
+			ZeroPulse:  0x30, OnePulse: 0x60,
+			Data: []byte{0xaa, 0xf0}, UsedBitsInLastByte: 4,
+		},
+		{ID: TZX_BLOCK_PURE_TONE, PilotPulse: 0x40, PilotPulses: 3, UsedBitsInLastByte: 8},
+		{ID: TZX_BLOCK_PULSES, SyncPulses: []uint16{0x11, 0x22}, UsedBitsInLastByte: 8},
+		{ID: TZX_BLOCK_PURE_DATA, ZeroPulse: 0x30, OnePulse: 0x60, Data: []byte{0x81}, UsedBitsInLastByte: 8, Pause: 100},
+		{ID: TZX_BLOCK_PAUSE, UsedBitsInLastByte: 8, Pause: 1000},
+	}
+
+	if tzx.NumBlocks() != len(expected) {
+		t.Fatalf("expected %d blocks, got %d", len(expected), tzx.NumBlocks())
+	}
+	for i := range expected {
+		if block := tzx.GetBlock(i); !reflect.DeepEqual(*block, expected[i]) {
+			t.Errorf("block %d: expected %+v, got %+v", i, expected[i], *block)
+		}
+	}
+}
+
+func TestTZX_ReadProgram(t *testing.T) {
+	// The format is detected by the signature, not by the extension
+	program, err := ReadProgramFrom(bytes.NewReader(makeTZX()), "tap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isTZX := program.(*TZX); !isTZX {
+		t.Errorf("expected a TZX, got %T", program)
+	}
+
+	// Truncated block
+	data := makeTZX()
+	if _, err := NewTZX(data[:len(data)-1]); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// Unsupported block
+	data = append(makeTZX(), 0x19)
+	if _, err := NewTZX(data); err == nil {
+		t.Errorf("expected an error")
+	}
+}
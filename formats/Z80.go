@@ -12,6 +12,12 @@ type Z80 struct {
 	doubleInterruptFrequency bool
 	videoSynchronization     byte // 0..3
 	joystick                 byte // 0..3
+
+	ay        AYState
+	ayPresent bool
+
+	// nil in 48k mode
+	mem128 *Memory128
 }
 
 const (
@@ -114,9 +120,6 @@ func (data SnapshotData) readHeader_v1(s *Z80) error {
 	if s.samRom {
 		return errors.New("unsupported feature: SamRom")
 	}
-	if s.issue2_emulation {
-		return errors.New("unsupported feature: Issue 2 emulation")
-	}
 
 	return nil
 }
@@ -195,21 +198,27 @@ func (data SnapshotData) decodeZ80_v2() (*Z80, error) {
 		// 48k
 	case 1:
 		// 48k + If.1
+	case 3:
+		// 128k
+		s.mem128 = &Memory128{Paging: data[35]}
+	case 4:
+		// 128k + If.1
+		s.mem128 = &Memory128{Paging: data[35]}
 	default:
 		return nil, errors.New("read Z80 snapshot version 2.01: unsupported hardware mode")
 	}
 
-	// data[35]: no meaning in 48k mode
+	// data[35]: last write to port 0x7FFD in 128k mode, no meaning in 48k mode
 	// data[36]: no meaning in 48k mode
 
+	// In 128k mode, the bit selects a Spectrum +2, which is compatible with the 128k
 	var modifyHardware bool = ((data[37] >> 7) != 0)
-	if modifyHardware {
+	if modifyHardware && (s.mem128 == nil) {
 		return nil, errors.New("read Z80 snapshot version 2.01: unsupported hardware mode")
 	}
 
 	// rest of data[37]: ignored
-	// data[38]: ignored
-	// data[39..54]: ignored
+	data.readAYState(&s)
 
 	// Memory blocks
 	{
@@ -249,25 +258,39 @@ func (data SnapshotData) decodeZ80_v3() (*Z80, error) {
 		// 48k
 	case 1:
 		// 48k + If.1
+	case 4:
+		// 128k
+		s.mem128 = &Memory128{Paging: data[35]}
+	case 5:
+		// 128k + If.1
+		s.mem128 = &Memory128{Paging: data[35]}
+	case 6:
+		// 128k + M.G.T., the MGT ROM must not be paged in
+		s.mem128 = &Memory128{Paging: data[35]}
+	case 12:
+		// Spectrum +2
+		s.mem128 = &Memory128{Paging: data[35]}
+	case 7, 9, 13:
+		return nil, errors.New("read Z80 snapshot version 3.0x: +2A, +3 and Pentagon snapshots are not supported")
 	default:
 		return nil, errors.New("read Z80 snapshot version 3.0x: unsupported hardware mode")
 	}
 
-	// data[35]: no meaning in 48k mode
+	// data[35]: last write to port 0x7FFD in 128k mode, no meaning in 48k mode
 	// data[36]: no meaning in 48k mode
 
+	// In 128k mode, the bit selects a Spectrum +2, which is compatible with the 128k
 	var modifyHardware bool = ((data[37] >> 7) != 0)
-	if modifyHardware {
+	if modifyHardware && (s.mem128 == nil) {
 		return nil, errors.New("read Z80 snapshot version 3.0x: unsupported hardware mode")
 	}
 
 	// rest of data[37]: ignored
-	// data[38]: ignored
-	// data[39..54]: ignored
+	data.readAYState(&s)
 
 	tstate_low := uint(data[55]) | (uint(data[56]) << 8)
 	tstate_hi := uint(data[57] & 0x03)
-	const T4 = TStatesPerFrame / 4
+	T4 := z80_tstatesPerFrame(&s) / 4
 	s.cpu.Tstate = ((tstate_hi-3)%4)*T4 + (T4 - (tstate_low % T4) - 1)
 
 	// data[58]: always ignored
@@ -312,6 +335,19 @@ func (data SnapshotData) decodeZ80_v3() (*Z80, error) {
 	return &s, nil
 }
 
+// Reads the AY state from the extended header of a version 2.01 or 3.0x snapshot.
+// In 48k mode, the state is valid only if bit 2 of data[37] is set.
+// A 128k machine always has the AY chip.
+func (data SnapshotData) readAYState(s *Z80) {
+	if (s.mem128 == nil) && ((data[37] & 0x04) == 0) {
+		return
+	}
+
+	s.ay.SelectedRegister = data[38] & 0x0f
+	copy(s.ay.Registers[:], data[39:55])
+	s.ayPresent = true
+}
+
 func z80_loadMemBlocks(s *Z80, data []byte) error {
 	pages := make(map[byte]([]byte))
 
@@ -346,6 +382,10 @@ func z80_loadMemBlocks(s *Z80, data []byte) error {
 		return errors.New("invalid Z80 snapshot")
 	}
 
+	if s.mem128 != nil {
+		return z80_loadBanks(s, pages)
+	}
+
 	if len(pages) != 3 {
 		return errors.New("invalid Z80 snapshot")
 	}
@@ -379,6 +419,35 @@ func z80_loadMemBlocks(s *Z80, data []byte) error {
 	return nil
 }
 
+// In 128k mode, pages 3..10 contain RAM banks 0..7
+func z80_loadBanks(s *Z80, pages map[byte]([]byte)) error {
+	if len(pages) != 8 {
+		return errors.New("invalid Z80 snapshot")
+	}
+
+	for page, pageData := range pages {
+		if (page < 3) || (page > 10) || (len(pageData) != 0x4000) {
+			return errors.New("invalid Z80 snapshot")
+		}
+		copy(s.mem128.Banks[page-3][:], pageData)
+	}
+
+	// The 48k view of the memory: banks 5 and 2, and the bank paged in at 0xc000
+	copy(s.mem[0x0000:0x4000], s.mem128.Banks[5][:])
+	copy(s.mem[0x4000:0x8000], s.mem128.Banks[2][:])
+	copy(s.mem[0x8000:0xc000], s.mem128.Banks[s.mem128.Paging&0x07][:])
+
+	return nil
+}
+
+// Returns the number of T-states per frame of the machine stored in the snapshot
+func z80_tstatesPerFrame(s *Z80) uint {
+	if s.mem128 != nil {
+		return TStatesPerFrame128
+	}
+	return TStatesPerFrame
+}
+
 func z80_decompress(in []byte) []byte {
 	// The input is decompressed in 2 phases:
 	//  1. Determine output size
@@ -430,6 +499,132 @@ func z80_decompress(in []byte) []byte {
 	return out
 }
 
+// Encodes the snapshot as a version 3.0x Z80 snapshot.
+// 128k snapshots are saved in hardware mode 4 (128k).
+func (s *FullSnapshot) EncodeZ80() ([]byte, error) {
+	data := make([]byte, _Z80_V3_HEADER_SIZE)
+
+	// Version 1.xx header, PC is zero
+	data[0] = s.Cpu.A
+	data[1] = s.Cpu.F
+	data[2] = s.Cpu.C
+	data[3] = s.Cpu.B
+	data[4] = s.Cpu.L
+	data[5] = s.Cpu.H
+	data[8] = byte(s.Cpu.SP & 0xff)
+	data[9] = byte(s.Cpu.SP >> 8)
+	data[10] = s.Cpu.I
+	data[11] = s.Cpu.R & 0x7f
+	data[12] = (s.Cpu.R >> 7) | ((s.Ula.Border & 0x07) << 1)
+	data[13] = s.Cpu.E
+	data[14] = s.Cpu.D
+	data[15] = s.Cpu.C_
+	data[16] = s.Cpu.B_
+	data[17] = s.Cpu.E_
+	data[18] = s.Cpu.D_
+	data[19] = s.Cpu.L_
+	data[20] = s.Cpu.H_
+	data[21] = s.Cpu.A_
+	data[22] = s.Cpu.F_
+	data[23] = byte(s.Cpu.IY & 0xff)
+	data[24] = byte(s.Cpu.IY >> 8)
+	data[25] = byte(s.Cpu.IX & 0xff)
+	data[26] = byte(s.Cpu.IX >> 8)
+	data[27] = s.Cpu.IFF1
+	data[28] = s.Cpu.IFF2
+	data[29] = s.Cpu.IM & 0x03
+	if s.Issue2 {
+		data[29] |= 0x04
+	}
+
+	// Extended header
+	data[30] = 54
+	data[32] = byte(s.Cpu.PC & 0xff)
+	data[33] = byte(s.Cpu.PC >> 8)
+
+	tstatesPerFrame := uint(TStatesPerFrame)
+	if s.Mem128 != nil {
+		data[34] = 4
+		data[35] = s.Mem128.Paging
+		tstatesPerFrame = TStatesPerFrame128
+	}
+
+	if s.AYPresent {
+		data[37] = 0x04
+		data[38] = s.AY.SelectedRegister
+		copy(data[39:55], s.AY.Registers[:])
+	}
+
+	// The T-state counter: the quarter of the frame, and the T-states until the end of the quarter
+	T4 := tstatesPerFrame / 4
+	tstate := s.Cpu.Tstate % tstatesPerFrame
+	tstate_low := T4 - 1 - (tstate % T4)
+	tstate_hi := ((tstate / T4) + 3) % 4
+	data[55] = byte(tstate_low & 0xff)
+	data[56] = byte(tstate_low >> 8)
+	data[57] = byte(tstate_hi)
+
+	// Memory blocks
+	if s.Mem128 != nil {
+		for bank := range s.Mem128.Banks {
+			data = z80_appendMemBlock(data, byte(bank+3), s.Mem128.Banks[bank][:])
+		}
+	} else {
+		data = z80_appendMemBlock(data, 8, s.Mem[0x0000:0x4000])
+		data = z80_appendMemBlock(data, 4, s.Mem[0x4000:0x8000])
+		data = z80_appendMemBlock(data, 5, s.Mem[0x8000:0xc000])
+	}
+
+	return data, nil
+}
+
+// Appends a memory block containing the 16k page 'pageData'.
+// The page is stored uncompressed if the compression would not make it smaller.
+func z80_appendMemBlock(data []byte, page byte, pageData []byte) []byte {
+	block := z80_compress(pageData)
+	length := len(block)
+	if length >= len(pageData) {
+		block = pageData
+		length = 0xFFFF
+	}
+
+	data = append(data, byte(length&0xff), byte(length>>8), page)
+	return append(data, block...)
+}
+
+// The inverse of z80_decompress.
+// A run of at least 5 equal bytes, or of at least 2 bytes 0xED, is replaced by ED ED count value.
+// The byte following a single 0xED is never part of a run.
+func z80_compress(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+
+	i := 0
+	for i < len(in) {
+		value := in[i]
+
+		count := 1
+		for (i+count < len(in)) && (in[i+count] == value) && (count < 255) {
+			count++
+		}
+
+		if (count >= 5) || ((value == 0xED) && (count >= 2)) {
+			out = append(out, 0xED, 0xED, byte(count), value)
+			i += count
+			continue
+		}
+
+		out = append(out, value)
+		i++
+
+		if (value == 0xED) && (i < len(in)) {
+			out = append(out, in[i])
+			i++
+		}
+	}
+
+	return out
+}
+
 func (s *Z80) CpuState() CpuState {
 	return s.cpu
 }
@@ -441,3 +636,15 @@ func (s *Z80) UlaState() UlaState {
 func (s *Z80) Memory() *[48 * 1024]byte {
 	return &s.mem
 }
+
+func (s *Z80) AYState() (AYState, bool) {
+	return s.ay, s.ayPresent
+}
+
+func (s *Z80) Memory128() *Memory128 {
+	return s.mem128
+}
+
+func (s *Z80) Issue2Emulation() bool {
+	return s.issue2_emulation
+}
@@ -0,0 +1,301 @@
+package formats
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Builds a version 3.0x snapshot of a 48k machine with uncompressed memory
+func makeZ80_v3(ay *AYState) []byte {
+	data := make([]byte, _Z80_V3_HEADER_SIZE)
+	data[30] = 54
+	data[32] = 0x00 // PC
+	data[33] = 0x80
+
+	if ay != nil {
+		data[37] = 0x04
+		data[38] = ay.SelectedRegister
+		copy(data[39:55], ay.Registers[:])
+	}
+
+	for _, page := range []byte{8, 4, 5} {
+		data = append(data, 0xff, 0xff, page)
+		data = append(data, make([]byte, 0x4000)...)
+	}
+
+	return data
+}
+
+func TestZ80_AYState(t *testing.T) {
+	var expected AYState
+	expected.SelectedRegister = 7
+	for i := range expected.Registers {
+		expected.Registers[i] = byte(0x10 + i)
+	}
+
+	s, err := SnapshotData(makeZ80_v3(&expected)).DecodeZ80()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ay, present := s.AYState()
+	if !present {
+		t.Fatal("the AY state is missing")
+	}
+	if ay != expected {
+		t.Errorf("expected %v, got %v", expected, ay)
+	}
+
+	s, err = SnapshotData(makeZ80_v3(nil)).DecodeZ80()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, present := s.AYState(); present {
+		t.Error("AY state present in a snapshot without AY")
+	}
+}
+
+// A version 1.xx snapshot with compressed memory.
+// The memory is filled with 0x55, except for the first byte of the screen.
+func makeZ80_v1() []byte {
+	data := make([]byte, _Z80_V1_HEADER_SIZE)
+	data[6] = 0x00 // PC
+	data[7] = 0x80
+	data[12] = 0x20 | (2 << 1) // Compressed, border 2
+
+	data = append(data, 0x01)
+	remaining := 48*1024 - 1
+	for remaining > 0 {
+		n := remaining
+		if n > 255 {
+			n = 255
+		}
+		data = append(data, 0xed, 0xed, byte(n), 0x55)
+		remaining -= n
+	}
+
+	return append(data, 0x00, 0xed, 0xed, 0x00)
+}
+
+func TestZ80_v1(t *testing.T) {
+	s, err := SnapshotData(makeZ80_v1()).DecodeZ80()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.CpuState().PC != 0x8000 {
+		t.Errorf("expected PC 0x8000, got %#04x", s.CpuState().PC)
+	}
+	if s.UlaState().Border != 2 {
+		t.Errorf("expected border 2, got %d", s.UlaState().Border)
+	}
+
+	mem := s.Memory()
+	if (mem[0] != 0x01) || (mem[1] != 0x55) || (mem[len(mem)-1] != 0x55) {
+		t.Errorf("invalid memory contents")
+	}
+	if s.Issue2Emulation() {
+		t.Errorf("Issue 2 emulation set")
+	}
+}
+
+func TestZ80_Issue2(t *testing.T) {
+	data := makeZ80_v1()
+	data[29] |= 0x04
+
+	s, err := SnapshotData(data).DecodeZ80()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Issue2Emulation() {
+		t.Errorf("Issue 2 emulation not set")
+	}
+}
+
+// Builds a version 3.0x snapshot of a 128k machine with uncompressed memory.
+// Each RAM bank is filled with its number.
+func makeZ80_v3_128k(paging byte) []byte {
+	data := make([]byte, _Z80_V3_HEADER_SIZE)
+	data[30] = 54
+	data[32] = 0x00 // PC
+	data[33] = 0x80
+	data[34] = 4 // 128k
+	data[35] = paging
+	data[38] = 7 // AY register
+
+	for bank := byte(0); bank < 8; bank++ {
+		data = append(data, 0xff, 0xff, bank+3)
+		data = append(data, bytes.Repeat([]byte{bank}, 0x4000)...)
+	}
+
+	return data
+}
+
+func TestZ80_128k(t *testing.T) {
+	const paging = 0x08 | 0x03 // Shadow screen, bank 3 at 0xc000
+
+	s, err := SnapshotData(makeZ80_v3_128k(paging)).DecodeZ80()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem128 := s.Memory128()
+	if mem128 == nil {
+		t.Fatal("the 128k memory is missing")
+	}
+	if mem128.Paging != paging {
+		t.Errorf("expected paging 0x%02x, got 0x%02x", paging, mem128.Paging)
+	}
+	for bank := range mem128.Banks {
+		if (mem128.Banks[bank][0] != byte(bank)) || (mem128.Banks[bank][0x3fff] != byte(bank)) {
+			t.Errorf("invalid contents of bank %d", bank)
+		}
+	}
+
+	mem := s.Memory()
+	if (mem[0x0000] != 5) || (mem[0x4000] != 2) || (mem[0x8000] != 3) {
+		t.Errorf("invalid 48k view of the memory")
+	}
+
+	// In 128k mode, the AY state is present even if bit 2 of byte 37 is not set
+	ay, present := s.AYState()
+	if !present || (ay.SelectedRegister != 7) {
+		t.Errorf("invalid AY state %v (present: %v)", ay, present)
+	}
+}
+
+func TestZ80_48kSnapshotHasNo128kMemory(t *testing.T) {
+	s, err := SnapshotData(makeZ80_v3(nil)).DecodeZ80()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Memory128() != nil {
+		t.Error("128k memory present in a 48k snapshot")
+	}
+}
+
+// Fills 'mem' with data which exercises the compression:
+// runs of various lengths, single and repeated 0xED bytes, and random-looking bytes
+func fillTestMemory(mem []byte, seed int) {
+	for i := range mem {
+		switch (i / 300) % 4 {
+		case 0:
+			mem[i] = byte((i*7 + seed) ^ (i >> 3))
+		case 1:
+			mem[i] = byte(seed)
+		case 2:
+			if (i % 3) == 0 {
+				mem[i] = 0xED
+			} else {
+				mem[i] = byte(i)
+			}
+		case 3:
+			mem[i] = 0xED
+		}
+	}
+}
+
+func makeFullSnapshot(is128k bool) *FullSnapshot {
+	s := &FullSnapshot{}
+	s.Cpu = CpuState{
+		A: 0x01, F: 0x02, B: 0x03, C: 0x04, D: 0x05, E: 0x06, H: 0x07, L: 0x08,
+		A_: 0x11, F_: 0x12, B_: 0x13, C_: 0x14, D_: 0x15, E_: 0x16, H_: 0x17, L_: 0x18,
+		IX: 0x1234, IY: 0x5678, I: 0x3f, R: 0xa5, IFF1: 1, IFF2: 1, IM: 2,
+		SP: 0xfffe, PC: 0x8123,
+		Tstate: 12345,
+	}
+	s.Ula.Border = 6
+
+	s.AYPresent = true
+	s.AY.SelectedRegister = 14
+	for i := range s.AY.Registers {
+		s.AY.Registers[i] = byte(0x20 + i)
+	}
+
+	if is128k {
+		s.Mem128 = &Memory128{Paging: 0x0e}
+		for bank := range s.Mem128.Banks {
+			fillTestMemory(s.Mem128.Banks[bank][:], bank)
+		}
+		copy(s.Mem[0x0000:0x4000], s.Mem128.Banks[5][:])
+		copy(s.Mem[0x4000:0x8000], s.Mem128.Banks[2][:])
+		copy(s.Mem[0x8000:0xc000], s.Mem128.Banks[6][:])
+	} else {
+		fillTestMemory(s.Mem[:], 0)
+	}
+
+	return s
+}
+
+func testZ80_RoundTrip(t *testing.T, original *FullSnapshot) {
+	data, err := original.EncodeZ80()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := SnapshotData(data).DecodeZ80()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.CpuState() != original.Cpu {
+		t.Errorf("expected CPU state %v, got %v", original.Cpu, s.CpuState())
+	}
+	if s.UlaState() != original.Ula {
+		t.Errorf("expected ULA state %v, got %v", original.Ula, s.UlaState())
+	}
+	if *s.Memory() != original.Mem {
+		t.Errorf("the memory differs")
+	}
+	if ay, present := s.AYState(); !present || (ay != original.AY) {
+		t.Errorf("expected AY state %v, got %v (present: %v)", original.AY, ay, present)
+	}
+	if s.Issue2Emulation() != original.Issue2 {
+		t.Errorf("expected Issue 2 emulation %v, got %v", original.Issue2, s.Issue2Emulation())
+	}
+
+	switch mem128 := s.Memory128(); {
+	case original.Mem128 == nil:
+		if mem128 != nil {
+			t.Errorf("128k memory present in a 48k snapshot")
+		}
+	case mem128 == nil:
+		t.Errorf("the 128k memory is missing")
+	case *mem128 != *original.Mem128:
+		t.Errorf("the 128k memory differs")
+	}
+}
+
+func TestZ80_RoundTrip48k(t *testing.T) {
+	testZ80_RoundTrip(t, makeFullSnapshot(false))
+}
+
+func TestZ80_RoundTrip128k(t *testing.T) {
+	testZ80_RoundTrip(t, makeFullSnapshot(true))
+}
+
+func TestZ80_RoundTripIssue2(t *testing.T) {
+	s := makeFullSnapshot(false)
+	s.Issue2 = true
+	testZ80_RoundTrip(t, s)
+}
+
+func TestZ80_Compress(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{0xED},
+		{0xED, 0x00},
+		{0xED, 0xED},
+		{0x01, 0xED, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01},
+		{0xED, 0x05, 0x05, 0x05, 0x05, 0x05, 0xED},
+		bytes.Repeat([]byte{0x42}, 1000),
+		bytes.Repeat([]byte{0xED}, 600),
+	}
+
+	for _, in := range inputs {
+		compressed := z80_compress(in)
+		if out := z80_decompress(compressed); !bytes.Equal(out, in) {
+			t.Errorf("% x: compressed to % x, decompressed to % x", in, compressed, out)
+		}
+	}
+}
@@ -2,15 +2,20 @@
 package formats
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
+	"io"
 	"io/ioutil"
+	"os"
 	"path"
 	"strings"
 )
 
 const (
-	TStatesPerFrame = 69888
-	InterruptLength = 32
+	TStatesPerFrame    = 69888
+	TStatesPerFrame128 = 70908
+	InterruptLength    = 32
 )
 
 type CpuState struct {
@@ -34,10 +39,55 @@ type Snapshot interface {
 	Memory() *[48 * 1024]byte
 }
 
+// The state of the AY-3-8912 sound chip
+type AYState struct {
+	// The register selected by the last write to port 0xFFFD
+	SelectedRegister byte
+
+	Registers [16]byte
+}
+
+// Implemented by snapshots which can contain the state of the AY chip.
+// The boolean is false if the snapshot does not contain it.
+type AYSnapshot interface {
+	AYState() (AYState, bool)
+}
+
+// The memory of a 128k machine
+type Memory128 struct {
+	// The last value written to port 0x7FFD
+	Paging byte
+
+	Banks [8][0x4000]byte
+}
+
+// Implemented by snapshots which can contain the memory of a 128k machine.
+// The result is nil if the snapshot is a 48k one.
+type Snapshot128 interface {
+	Memory128() *Memory128
+}
+
+// Implemented by snapshots which record whether the machine is an Issue 2 Spectrum.
+// Issue 2 machines read the EAR bit of port 0xFE differently than later machines.
+type Issue2Snapshot interface {
+	Issue2Emulation() bool
+}
+
 type FullSnapshot struct {
 	Cpu CpuState
 	Ula UlaState
 	Mem [48 * 1024]byte
+
+	// The memory of a 128k machine, or nil.
+	// If not nil, 'Mem' contains the banks paged in at 0x4000..0xffff.
+	Mem128 *Memory128
+
+	// The state of the AY chip, valid only if 'AYPresent' is true
+	AY        AYState
+	AYPresent bool
+
+	// Whether the machine is an Issue 2 Spectrum
+	Issue2 bool
 }
 
 func (s *FullSnapshot) CpuState() CpuState {
@@ -52,6 +102,18 @@ func (s *FullSnapshot) Memory() *[48 * 1024]byte {
 	return &s.Mem
 }
 
+func (s *FullSnapshot) AYState() (AYState, bool) {
+	return s.AY, s.AYPresent
+}
+
+func (s *FullSnapshot) Memory128() *Memory128 {
+	return s.Mem128
+}
+
+func (s *FullSnapshot) Issue2Emulation() bool {
+	return s.Issue2
+}
+
 type SnapshotData []byte
 
 type Archive interface {
@@ -63,16 +125,58 @@ const (
 	FORMAT_SNA = iota
 	FORMAT_Z80
 	FORMAT_TAP
+	FORMAT_TZX
+	FORMAT_RZX
 )
 
 const (
 	ENCAPSULATION_NONE = iota
 	ENCAPSULATION_ZIP
+	ENCAPSULATION_GZIP
 )
 
 type FormatInfo struct {
 	Format        int
 	Encapsulation int
+
+	// Human-readable name of the format, for example "SNA"
+	Name string
+
+	// File name extensions, in lower-case and including the dot
+	Extensions []string
+
+	// Whether programs in this format can be loaded, and whether snapshots can be saved in it
+	CanRead, CanWrite bool
+}
+
+// The formats understood by this package.
+// Any of them can also be read from a ZIP archive or from a gzip-compressed file.
+var supportedFormats = []FormatInfo{
+	{Format: FORMAT_SNA, Name: "SNA", Extensions: []string{".sna"}, CanRead: true, CanWrite: true},
+	{Format: FORMAT_Z80, Name: "Z80", Extensions: []string{".z80"}, CanRead: true, CanWrite: true},
+	{Format: FORMAT_TAP, Name: "TAP", Extensions: []string{".tap"}, CanRead: true},
+	{Format: FORMAT_TZX, Name: "TZX", Extensions: []string{".tzx"}, CanRead: true},
+	{Format: FORMAT_RZX, Name: "RZX", Extensions: []string{".rzx"}, CanRead: true},
+}
+
+// Returns a description of each supported format
+func SupportedFormats() []FormatInfo {
+	formats := make([]FormatInfo, len(supportedFormats))
+	copy(formats, supportedFormats)
+	return formats
+}
+
+// Returns the supported format with the specified extension (including the dot), or nil
+func formatByExtension(ext string) *FormatInfo {
+	for i := range supportedFormats {
+		for _, formatExt := range supportedFormats[i].Extensions {
+			if ext == formatExt {
+				format := supportedFormats[i]
+				return &format
+			}
+		}
+	}
+	return nil
 }
 
 // Determines the format of the specified file based on its name,
@@ -85,15 +189,20 @@ func DetectFormat(filePath string) (*FormatInfo, error) {
 func detectFormat(filePath string, encapsulation int, allowEncapsulation bool) (*FormatInfo, error) {
 	ext := strings.ToLower(path.Ext(filePath))
 
-	switch ext {
-	case ".sna":
-		return &FormatInfo{FORMAT_SNA, encapsulation}, nil
-
-	case ".z80":
-		return &FormatInfo{FORMAT_Z80, encapsulation}, nil
+	if format := formatByExtension(ext); format != nil {
+		format.Encapsulation = encapsulation
+		return format, nil
+	}
 
-	case ".tap":
-		return &FormatInfo{FORMAT_TAP, encapsulation}, nil
+	switch ext {
+	case ".gz":
+		if encapsulation == ENCAPSULATION_NONE {
+			// The format of the compressed file is determined by its inner name,
+			// for example "game.tap" in case of "game.tap.gz"
+			return detectFormat(filePath[:len(filePath)-len(ext)], ENCAPSULATION_GZIP, false)
+		} else {
+			return nil, errors.New("unrecognized file format")
+		}
 
 	case ".zip":
 		if (encapsulation == ENCAPSULATION_NONE) && allowEncapsulation {
@@ -144,39 +253,86 @@ func (data SnapshotData) Decode(format int) (Snapshot, error) {
 	return nil, errors.New("unknown snapshot format")
 }
 
-func readZIP(filePath string) (interface{}, error) {
-	archive, err := ReadZipFile(filePath)
-	if err != nil {
-		return nil, err
+// Selects one of the program files found in a ZIP archive.
+// The function receives the names of the files in the archive which are in a supported format.
+// It should return one of the names, or an empty string if the user cancelled the selection.
+// It is called only if the archive contains several program files.
+type ZipEntryChooser func(names []string) (string, error)
+
+// Returns a ZipEntryChooser which selects the file with the specified name,
+// or nil if the name is empty
+func ZipEntryNamed(name string) ZipEntryChooser {
+	if name == "" {
+		return nil
+	}
+	return func(names []string) (string, error) {
+		return name, nil
 	}
+}
 
+// If 'choose' is nil and the archive contains several program files,
+// the returned error lists their names.
+func readZIP(archive *ZipArchive, choose ZipEntryChooser) (interface{}, error) {
 	var embeddedFile_index int
 	var embeddedFile_format *FormatInfo
 	{
-		n := 0
+		var indices []int
+		var names []string
+		var formats []*FormatInfo
 		for i, name := range archive.Filenames() {
 			format, err := detectFormat(name, ENCAPSULATION_ZIP, false)
 			if err == nil {
-				embeddedFile_index = i
-				embeddedFile_format = format
-				n++
+				indices = append(indices, i)
+				names = append(names, name)
+				formats = append(formats, format)
 			}
 		}
 
-		if n == 0 {
+		if len(names) == 0 {
 			return nil, errors.New("the archive does not contain any supported program files")
 		}
-		if n >= 2 {
-			return nil, errors.New("the archive contains multiple program files")
+
+		choice := 0
+		if len(names) >= 2 {
+			if choose == nil {
+				return nil, errors.New("the archive contains multiple program files, select one of: " + strings.Join(names, ", "))
+			}
+
+			name, err := choose(names)
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				return nil, errors.New("no program file has been selected from the archive")
+			}
+
+			choice = -1
+			for i := range names {
+				if names[i] == name {
+					choice = i
+					break
+				}
+			}
+			if choice == -1 {
+				return nil, errors.New("the archive does not contain the program file \"" + name + "\"")
+			}
 		}
+
+		embeddedFile_index = indices[choice]
+		embeddedFile_format = formats[choice]
 	}
 
-	var data []byte
-	data, err = archive.Read(embeddedFile_index)
+	data, err := archive.Read(embeddedFile_index)
 	if err != nil {
 		return nil, err
 	}
 
+	if IsTZX(data) {
+		return NewTZX(data)
+	}
+	if IsRZX(data) {
+		return NewRZX(data)
+	}
 	if embeddedFile_format.Format == FORMAT_TAP {
 		return NewTAP(data)
 	}
@@ -188,29 +344,118 @@ func readZIP(filePath string) (interface{}, error) {
 // Return the program and errors if any.
 // The file can be compressed.
 func ReadProgram(filePath string) (interface{}, error) {
-	ext := strings.ToLower(path.Ext(filePath))
+	return ReadProgramWith(filePath, nil)
+}
 
-	// ZIP archive
-	if ext == ".zip" {
-		return readZIP(filePath)
+// Like ReadProgram, 'choose' selects the program if the file is a ZIP archive
+func ReadProgramWith(filePath string, choose ZipEntryChooser) (interface{}, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ext := path.Ext(filePath)
+	if strings.ToLower(ext) == ".gz" {
+		// Use the extension of the inner name, if any
+		if innerExt := path.Ext(filePath[:len(filePath)-len(ext)]); innerExt != "" {
+			ext = innerExt
+		}
 	}
 
-	data, err := ioutil.ReadFile(filePath)
+	return ReadProgramFromWith(file, ext, choose)
+}
+
+// Returns whether the data starts with the gzip signature
+func isGzip(data []byte) bool {
+	return (len(data) >= 2) && (data[0] == 0x1f) && (data[1] == 0x8b)
+}
+
+// Decompresses gzip data.
+// Returns the decompressed data and the original file name stored in the gzip header, if any.
+func gunzip(data []byte) ([]byte, string, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	defer reader.Close()
 
-	var format *FormatInfo
-	format, err = detectFormat(filePath, ENCAPSULATION_NONE, false)
+	inflated, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return inflated, reader.Header.Name, nil
+}
+
+// Read a program from the specified reader.
+// The format is a file name extension, such as "sna" or ".tap".
+// TZX and RZX data is recognized by its signature regardless of the format.
+// Gzip-compressed data is recognized by its signature and decompressed in memory,
+// the format of the decompressed data is then determined by the file name stored
+// in the gzip header or, if there is none, by the format argument.
+// If the format is "zip", the program is extracted from the archive.
+func ReadProgramFrom(r io.Reader, format string) (interface{}, error) {
+	return ReadProgramFromWith(r, format, nil)
+}
+
+// Like ReadProgramFrom, 'choose' selects the program if the data is a ZIP archive
+func ReadProgramFromWith(r io.Reader, format string, choose ZipEntryChooser) (interface{}, error) {
+	ext := "." + strings.TrimPrefix(strings.ToLower(format), ".")
+
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
-	if format.Format == FORMAT_TAP {
+	// Gzip-compressed file
+	if isGzip(data) {
+		inflated, innerName, err := gunzip(data)
+		if err != nil {
+			return nil, err
+		}
+		data = inflated
+
+		if innerExt := strings.ToLower(path.Ext(innerName)); innerExt != "" {
+			ext = innerExt
+		}
+	}
+
+	// ZIP archive
+	if ext == ".zip" {
+		archive, err := ReadZip(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		return readZIP(archive, choose)
+	}
+
+	// TZX and RZX files are recognized by their signature
+	if IsTZX(data) {
+		return NewTZX(data)
+	}
+	if IsRZX(data) {
+		return NewRZX(data)
+	}
+
+	formatInfo, err := detectFormat(ext, ENCAPSULATION_NONE, false)
+	if err != nil {
+		return nil, err
+	}
+	if formatInfo.Format == FORMAT_TAP {
 		return NewTAP(data)
 	}
 
-	return SnapshotData(data).Decode(format.Format)
+	return SnapshotData(data).Decode(formatInfo.Format)
+}
+
+// Returns whether the program returned by ReadProgram is a tape
+func IsTape(program interface{}) bool {
+	switch program.(type) {
+	case *TAP, *TZX:
+		return true
+	}
+	return false
 }
 
 func splitWord(word uint16) (byte, byte) {
@@ -0,0 +1,155 @@
+package formats
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// A TAP file with one data block: flag 0xff, two bytes of data and the checksum
+var testTAP = []byte{4, 0, 0xff, 0x12, 0x34, 0xff ^ 0x12 ^ 0x34}
+
+func gzipData(t *testing.T, name string, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Name = name
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipData(t *testing.T, files map[string][]byte, order []string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range order {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadProgram_GzippedTAP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gospeccy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Without a name in the gzip header, the format is determined by "game.tap.gz"
+	filePath := path.Join(dir, "game.tap.gz")
+	if err := ioutil.WriteFile(filePath, gzipData(t, "", testTAP), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	program, err := ReadProgram(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap, ok := program.(*TAP)
+	if !ok {
+		t.Fatalf("expected a TAP, got %T", program)
+	}
+	if tap.NumBlocks() != 1 {
+		t.Errorf("expected 1 block, got %d", tap.NumBlocks())
+	}
+
+	// The name stored in the gzip header takes precedence over the format argument
+	program, err = ReadProgramFrom(bytes.NewReader(gzipData(t, "game.tap", testTAP)), "gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := program.(*TAP); !ok {
+		t.Errorf("expected a TAP, got %T", program)
+	}
+
+	format, err := DetectFormat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (format.Format != FORMAT_TAP) || (format.Encapsulation != ENCAPSULATION_GZIP) {
+		t.Errorf("expected a gzip-compressed TAP, got %+v", format)
+	}
+}
+
+func TestReadProgram_ZippedSNA(t *testing.T) {
+	files := map[string][]byte{
+		"readme.txt": []byte("Hello"),
+		"game.sna":   makeSNA(),
+		"game.tap":   testTAP,
+	}
+
+	// A single supported file in the archive
+	data := zipData(t, files, []string{"readme.txt", "game.sna"})
+	program, err := ReadProgramFrom(bytes.NewReader(data), "zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sna, ok := program.(*SNA)
+	if !ok {
+		t.Fatalf("expected an SNA, got %T", program)
+	}
+	if sna.CpuState().PC != 0x8123 {
+		t.Errorf("expected PC 0x8123, got 0x%04x", sna.CpuState().PC)
+	}
+
+	// Multiple supported files: without a chooser, the error lists them
+	data = zipData(t, files, []string{"readme.txt", "game.sna", "game.tap"})
+	_, err = ReadProgramFrom(bytes.NewReader(data), "zip")
+	if (err == nil) || !strings.Contains(err.Error(), "game.sna, game.tap") {
+		t.Errorf("expected an error listing the files, got %v", err)
+	}
+
+	// Multiple supported files: the chooser selects the TAP
+	var offered []string
+	choose := func(names []string) (string, error) {
+		offered = names
+		return "game.tap", nil
+	}
+	program, err = ReadProgramFromWith(bytes.NewReader(data), "zip", choose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := program.(*TAP); !ok {
+		t.Errorf("expected a TAP, got %T", program)
+	}
+	if len(offered) != 2 {
+		t.Errorf("expected 2 offered files, got %v", offered)
+	}
+
+	// The selection is cancelled
+	cancel := func(names []string) (string, error) {
+		return "", nil
+	}
+	if _, err := ReadProgramFromWith(bytes.NewReader(data), "zip", cancel); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// The file is selected by name
+	program, err = ReadProgramFromWith(bytes.NewReader(data), "zip", ZipEntryNamed("game.sna"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := program.(*SNA); !ok {
+		t.Errorf("expected an SNA, got %T", program)
+	}
+	if _, err := ReadProgramFromWith(bytes.NewReader(data), "zip", ZipEntryNamed("other.tap")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -71,7 +71,7 @@ func newApplication(verbose bool) *spectrum.Application {
 	return app
 }
 
-func newEmulationCore(app *spectrum.Application, acceleratedLoad bool) (*spectrum.Spectrum48k, error) {
+func newEmulationCore(app *spectrum.Application, acceleratedLoad bool, model spectrum.MachineModel) (*spectrum.Spectrum48k, error) {
 	romPath, err := spectrum.SystemRomPath("48.rom")
 	if err != nil {
 		return nil, err
@@ -87,11 +87,36 @@ func newEmulationCore(app *spectrum.Application, acceleratedLoad bool) (*spectru
 		speccy.TapeDrive().AcceleratedLoad = true
 	}
 
+	// The 128k ROM is optional unless the 128k model is selected,
+	// it allows switching the model later from the console
+	rom128, err := readROM128()
+	if err == nil {
+		speccy.CommandChannel <- spectrum.Cmd_SetROM{spectrum.MODEL_128K, rom128}
+	} else if model == spectrum.MODEL_128K {
+		return nil, err
+	}
+
+	if model != spectrum.MODEL_48K {
+		errChan := make(chan error)
+		speccy.CommandChannel <- spectrum.Cmd_SetMachineModel{model, errChan}
+		if err := <-errChan; err != nil {
+			return nil, err
+		}
+	}
+
 	env.Publish(speccy)
 
 	return speccy, nil
 }
 
+func readROM128() (*[0x8000]byte, error) {
+	romPath, err := spectrum.SystemRomPath("128.rom")
+	if err != nil {
+		return nil, err
+	}
+	return spectrum.ReadROM(romPath)
+}
+
 func ftpget_choice(app *spectrum.Application, matches []string, freeware []bool) (string, error) {
 	switch len(matches) {
 	case 0:
@@ -134,8 +159,20 @@ func ftpget_choice(app *spectrum.Application, matches []string, freeware []bool)
 	return url, nil
 }
 
+// Lets the user select which program to load from a ZIP archive containing several programs
+func zip_choice(app *spectrum.Application, names []string) (string, error) {
+	app.PrintfMsg("The archive contains multiple programs:")
+	freeware := make([]bool, len(names))
+	for i, name := range names {
+		app.PrintfMsg("  %d: %s", i, name)
+		freeware[i] = true
+	}
+
+	return ftpget_choice(app, names, freeware)
+}
+
 func wait(app *spectrum.Application) {
-	<-app.HasTerminated
+	app.Wait()
 
 	if app.Verbose {
 		var memstats runtime.MemStats
@@ -158,12 +195,44 @@ func exit(app *spectrum.Application) {
 var (
 	help            = flag.Bool("help", false, "Show usage")
 	acceleratedLoad = flag.Bool("accelerated-load", false, "Accelerated tape loading")
+	autoLoad        = flag.Bool("auto-load", true, "After loading a tape, type LOAD \"\" and start the tape once the machine is ready")
 	fps             = flag.Float64("fps", spectrum.DefaultFPS, "Frames per second")
 	verbose         = flag.Bool("verbose", false, "Enable debugging messages")
 	cpuProfile      = flag.String("hostcpu-profile", "", "Write host-CPU profile to the specified file (for 'pprof')")
+	machine         = flag.String("machine", "48", "The emulated machine: 48 or 128 (requires the 32K ROM file roms/128.rom)")
+	contended       = flag.Bool("contended", false, "Emulate the delays of the CPU caused by the ULA when it accesses contended memory or I/O ports, and the floating bus")
+	tapeSound       = flag.Bool("tape-sound", true, "Hear the tape while it is being loaded")
+	issue2          = flag.Bool("issue2", false, "Emulate an Issue 2 Spectrum, which some old games require to read the keyboard (Z80 snapshots set it)")
+	ulaTiming       = flag.String("ula-timing", "late", "ULA timing model of the 48k Spectrum: early or late")
+	autosnapPeriod  = flag.Duration("autosnap-interval", 0, "Periodically save a snapshot, for example every 10m (0: disabled)")
+	autosnapKeep    = flag.Uint("autosnap-keep", 10, "The number of automatic snapshots to keep")
+	manifestPath    = flag.String("manifest", "", "Append a line describing each loaded program to the specified file")
+	joystickType    = flag.String("joystick-type", "kempston", "The emulated joystick interface: kempston, fuller, sinclair1 (interface2), sinclair2 or cursor")
+	kempston        = flag.Bool("kempston", true, "Connect the Kempston joystick interface (port 0x1F), even if no joystick drives it")
+	joystick2Type   = flag.String("joystick2-type", "sinclair2", "The joystick interface driven by the second host joystick (player 2), see -joystick-type")
+	controls        = flag.String("controls", "kempston", "Map the joystick to keys: a preset name (qaop, cursor, opspace) or up,down,left,right,fire keys (\"kempston\" keeps a control on the Kempston port)")
+	threads         = flag.Int("threads", 0, "The number of OS threads executing Go code (0: $GOMAXPROCS, or at least 2)")
+	ay              = flag.Bool("ay", false, "Add the AY-3-8912 sound chip of the 128k Spectrum to the 48k model (ports 0xFFFD and 0xBFFD)")
+	palette         = flag.String("palette", "standard", "The display palette: standard, grayscale, green or custom")
+	paletteFile     = flag.String("palette-file", "", "Read the custom palette from the specified file (16 lines of R,G,B values)")
+	rewindSeconds   = flag.Float64("rewind-seconds", 30, "The length of the history kept for rewinding the emulation (0: disabled)")
+	runBasic        = flag.String("run", "", "Type the specified BASIC command after the machine boots to the prompt, for example -run=\"PRINT 2+2\"")
+	scriptPath      = flag.String("script", "", "Run the specified Go script after the program given on the command-line is loaded")
+	execStrict      = flag.Bool("exec-strict", false, "Exit if -script or -exec fails")
+	commandsPath    = flag.String("commands", "", "Execute console commands read from the specified file, one per line (-: standard input)")
+	httpAddress     = flag.String("http", "", "Serve the HTTP control API on the specified address, for example -http=:8080 (local connections only) or -http=0.0.0.0:8080")
+	recordInput     = flag.String("record-input", "", "Record the input into the specified RZX file, starting after the program given on the command-line is loaded")
+	configFile      = flag.String("config", defaultConfigPath(), "Read the default values of the options from the specified file, with lines such as \"scale = 2\"")
 	wos             = flag.String("wos", "", "Download from WorldOfSpectrum; you must provide a query regex (ex: -wos=jetsetwilly)")
 )
 
+// Code passed via -exec, in the order of appearance on the command-line
+var execCode stringList
+
+func init() {
+	flag.Var(&execCode, "exec", "Run the specified Go code after -script (can be repeated), for example -exec='poke(23560, 13)'")
+}
+
 func main() {
 	var init_waitGroup sync.WaitGroup
 	env.PublishName("init WaitGroup", &init_waitGroup)
@@ -178,6 +247,13 @@ func main() {
 		flag.PrintDefaults()
 	}
 
+	// The options given on the command-line override the configuration file
+	configWarnings, err := applyConfigFile(configPathFromArgs(os.Args[1:]), flag.CommandLine)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+
 	flag.Parse()
 
 	if *help == true {
@@ -187,10 +263,21 @@ func main() {
 
 	app := newApplication(*verbose)
 
+	for _, warning := range configWarnings {
+		app.PrintfMsg("%s", warning)
+	}
+	if app.Verbose && (*configFile != "") {
+		app.PrintfMsg("configuration file: %s", *configFile)
+	}
+
 	// Use at least 2 OS threads.
 	// This helps to prevent audio buffer underflows
-	// in case rendering is consuming too much CPU.
-	if (os.Getenv("GOMAXPROCS") == "") && (runtime.GOMAXPROCS(-1) < 2) {
+	// in case rendering is consuming too much CPU (a larger -audio-buffer helps as well).
+	// On a single-core machine, -threads=1 may perform better
+	// because the emulation and the rendering do not compete for the CPU.
+	if *threads > 0 {
+		runtime.GOMAXPROCS(*threads)
+	} else if (os.Getenv("GOMAXPROCS") == "") && (runtime.GOMAXPROCS(-1) < 2) {
 		runtime.GOMAXPROCS(2)
 	}
 	if app.Verbose {
@@ -201,13 +288,77 @@ func main() {
 	handler := handler_SIGTERM{app}
 	spectrum.InstallSignalHandler(&handler)
 
-	speccy, err := newEmulationCore(app, *acceleratedLoad)
+	timing, err := spectrum.ParseUlaTiming(*ulaTiming)
 	if err != nil {
 		app.PrintfMsg("%s", err)
 		exit(app)
 		return
 	}
 
+	joystickMode, err := spectrum.ParseJoystickMode(*joystickType)
+	if err != nil {
+		app.PrintfMsg("%s", err)
+		exit(app)
+		return
+	}
+	joystick2Mode, err := spectrum.ParseJoystickMode(*joystick2Type)
+	if err != nil {
+		app.PrintfMsg("%s", err)
+		exit(app)
+		return
+	}
+
+	model, err := spectrum.ParseMachineModel(*machine)
+	if err != nil {
+		app.PrintfMsg("%s", err)
+		exit(app)
+		return
+	}
+
+	speccy, err := newEmulationCore(app, *acceleratedLoad, model)
+	if err != nil {
+		app.PrintfMsg("%s", err)
+		exit(app)
+		return
+	}
+	speccy.CommandChannel <- spectrum.Cmd_SetUlaTiming{timing}
+	speccy.CommandChannel <- spectrum.Cmd_SetContention{*contended}
+	speccy.CommandChannel <- spectrum.Cmd_SetTapeSound{*tapeSound}
+	speccy.CommandChannel <- spectrum.Cmd_SetIssue2{*issue2}
+	speccy.CommandChannel <- spectrum.Cmd_SetKempston{*kempston}
+	speccy.CommandChannel <- spectrum.Cmd_SetAY{*ay}
+	speccy.CommandChannel <- spectrum.Cmd_SetRewindBuffer{float32(*rewindSeconds)}
+
+	if *paletteFile != "" {
+		_, err := spectrum.LoadCustomPalette(*paletteFile)
+		if err != nil {
+			app.PrintfMsg("%s", err)
+			exit(app)
+			return
+		}
+	}
+	{
+		palette, err := spectrum.FindPalette(*palette)
+		if err != nil {
+			app.PrintfMsg("%s", err)
+			exit(app)
+			return
+		}
+		speccy.CommandChannel <- spectrum.Cmd_SetPalette{palette}
+	}
+
+	if *manifestPath != "" {
+		manifest, err := os.OpenFile(*manifestPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			app.PrintfMsg("%s", err)
+			exit(app)
+			return
+		}
+		defer manifest.Close()
+
+		speccy.CommandChannel <- spectrum.Cmd_SetManifest{manifest}
+	}
+
 	interpreter.Init(app, flag.Arg(0), speccy)
 
 	if app.TerminationInProgress() || app.Terminated() {
@@ -218,7 +369,7 @@ func main() {
 	// Optional: Read and categorize the contents
 	//           of the file specified on the command-line
 	var program_orNil interface{} = nil
-	var programName string
+	var programName, programPath string
 	if flag.Arg(0) != "" {
 		file := flag.Arg(0)
 		programName = file
@@ -231,12 +382,16 @@ func main() {
 			return
 		}
 
-		program_orNil, err = formats.ReadProgram(path)
+		// Only a program given on the command-line is selected from a ZIP archive interactively
+		program_orNil, err = formats.ReadProgramWith(path, func(names []string) (string, error) {
+			return zip_choice(app, names)
+		})
 		if err != nil {
 			app.PrintfMsg("%s", err)
 			exit(app)
 			return
 		}
+		programPath = path
 	}
 
 	// Wait until modules are initialized
@@ -251,13 +406,26 @@ func main() {
 	// Set the FPS
 	speccy.CommandChannel <- spectrum.Cmd_SetFPS{float32(*fps), nil}
 
+	if *autosnapPeriod > 0 {
+		go autosnapLoop(app, speccy, *autosnapPeriod, *autosnapKeep)
+	}
+
+	if *httpAddress != "" {
+		err := startHTTPServer(app, speccy, *httpAddress)
+		if err != nil {
+			app.PrintfMsg("%s", err)
+			exit(app)
+			return
+		}
+	}
+
 	// Optional: Load the program specified on the command-line
 	if program_orNil != nil {
 		program := program_orNil
 
-		if _, isTAP := program.(*formats.TAP); isTAP {
+		if formats.IsTape(program) {
 			romLoaded := make(chan (<-chan bool))
-			speccy.CommandChannel <- spectrum.Cmd_Reset{romLoaded}
+			speccy.CommandChannel <- spectrum.Cmd_Reset{romLoaded, spectrum.RESET_HARD}
 			<-(<-romLoaded)
 		}
 
@@ -269,6 +437,63 @@ func main() {
 			exit(app)
 			return
 		}
+
+		spectrum.SetLoadedProgramPath(programPath)
+
+		if formats.IsTape(program) && *autoLoad {
+			go func() {
+				if err := speccy.AutoLoadTape(); err != nil {
+					app.PrintfMsg("%s", err)
+				}
+			}()
+		}
+	}
+
+	if *recordInput != "" {
+		err := speccy.RecordInput(*recordInput)
+		if err != nil {
+			app.PrintfMsg("%s", err)
+			exit(app)
+			return
+		}
+	}
+
+	speccy.Joystick.SetMode(joystickMode)
+	speccy.Joystick2.SetMode(joystick2Mode)
+
+	// Look up the preset after the program is loaded, so that its own presets are found.
+	// A preset overrides -joystick-type.
+	if *controls != "kempston" {
+		preset, err := spectrum.FindControlPreset(*controls)
+		if err != nil {
+			app.PrintfMsg("%s", err)
+			exit(app)
+			return
+		}
+		speccy.Joystick.SetControls(preset)
+	}
+
+	if (*scriptPath != "") || (len(execCode) > 0) {
+		err := runStartupCode(app, *scriptPath, execCode, *execStrict)
+		if err != nil {
+			exit(app)
+			return
+		}
+	}
+
+	if *runBasic != "" {
+		// Check the line now rather than when the editor is ready
+		_, err := spectrum.BasicLineInput(*runBasic, spectrum.BASIC_EDITOR_48K)
+		if err != nil {
+			app.PrintfMsg("%s", err)
+			exit(app)
+			return
+		}
+		go typeAtPrompt(app, speccy, *runBasic)
+	}
+
+	if *commandsPath != "" {
+		go runCommands(app, *commandsPath)
 	}
 
 	wait(app)
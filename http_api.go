@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/guntars-lemps/gospeccy/formats"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"image/png"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// HTTP control API.
+//
+// The endpoints translate the requests into commands sent to the emulation core:
+//
+//	POST /load?path=PATH         Load a program from a file on the host
+//	POST /load?format=EXT        Load a program sent in the request body, for example format=tap
+//	                             A ZIP archive containing several programs requires the parameter entry=NAME
+//	POST /key?code=N[&action=A]  Press (the default), or hold down or release a key given by its logical code (KEY_*)
+//	GET  /peek?address=N[&count=N]
+//	POST /poke?address=N&value=N
+//	GET  /registers
+//	GET  /screenshot             A PNG image of the screen, without the border
+//	POST /reset[?mode=hard]
+//	GET  /stream                 A WebSocket streaming the screen and receiving key events, see 'screenStream'
+//
+// Numbers can be decimal, or hexadecimal with the "0x" prefix.
+// The peek and registers queries return JSON, errors are returned as plain text.
+//
+// Requests sent by web pages of other sites are rejected,
+// so that a page open in a browser on the same machine cannot control the emulator.
+
+type httpAPI struct {
+	app    *spectrum.Application
+	speccy *spectrum.Spectrum48k
+
+	// The host part of the address the server listens on
+	host string
+}
+
+// Starts serving the HTTP API on the specified address, such as ":8080".
+// If the address does not specify a host, the server accepts only local connections.
+// The server is stopped when the application terminates.
+func startHTTPServer(app *spectrum.Application, speccy *spectrum.Spectrum48k, address string) error {
+	address = listenAddress(address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	api := &httpAPI{app, speccy, host}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/load", api.post(api.load))
+	mux.HandleFunc("/key", api.post(api.key))
+	mux.HandleFunc("/peek", api.get(api.peek))
+	mux.HandleFunc("/poke", api.post(api.poke))
+	mux.HandleFunc("/registers", api.get(api.registers))
+	mux.HandleFunc("/screenshot", api.get(api.screenshot))
+	mux.HandleFunc("/reset", api.post(api.reset))
+	mux.HandleFunc("/stream", api.get(api.stream))
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if (err != nil) && !app.TerminationInProgress() && !app.Terminated() {
+			app.PrintfMsg("http: %s", err)
+		}
+	}()
+
+	evtLoop := app.NewEventLoop()
+	go func() {
+		<-evtLoop.Pause
+		listener.Close()
+		evtLoop.Pause <- 0
+
+		<-evtLoop.Terminate
+		if app.Verbose {
+			app.PrintfMsg("http server: exit")
+		}
+		evtLoop.Terminate <- 0
+	}()
+
+	if app.Verbose {
+		app.PrintfMsg("http: listening on %s", listener.Addr())
+	}
+	return nil
+}
+
+// Returns the address to listen on. An address without a host is bound to the loopback interface.
+func listenAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if (err == nil) && (host == "") {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return address
+}
+
+// Returns false if the request was sent by a web page of another site.
+// Browsers send the Origin header with cross-origin requests and with WebSocket handshakes,
+// other clients usually do not send it.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return (u.Host != "") && strings.EqualFold(u.Host, r.Host)
+}
+
+// Returns false if the Host header of the request names a host other than this machine.
+//
+// A web page can make its own domain name resolve to 127.0.0.1 (DNS rebinding).
+// Its requests then have the same origin as the server, but their Host header
+// contains the domain name of the page. The accepted hosts are the loopback names
+// and addresses, and the host of the listen address. A server listening on all interfaces
+// also accepts any IP address, since a page cannot rebind an IP address.
+func (api *httpAPI) knownHost(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// No port
+		host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+	}
+
+	if strings.EqualFold(host, "localhost") || ((api.host != "") && strings.EqualFold(host, api.host)) {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	listenIP := net.ParseIP(api.host)
+	return (listenIP != nil) && listenIP.IsUnspecified()
+}
+
+type httpHandler func(w http.ResponseWriter, r *http.Request) error
+
+// Rejects requests with a method other than 'method', requests from other sites,
+// requests addressed to an unknown host, and requests received while the application is terminating.
+// An error returned by the handler is sent to the client.
+func (api *httpAPI) handle(method string, h httpHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		if !api.knownHost(r) {
+			http.Error(w, "unknown host \""+r.Host+"\"", http.StatusForbidden)
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if api.app.TerminationInProgress() || api.app.Terminated() {
+			http.Error(w, "the emulator is terminating", http.StatusServiceUnavailable)
+			return
+		}
+
+		if err := h(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+func (api *httpAPI) get(h httpHandler) http.HandlerFunc {
+	return api.handle("GET", h)
+}
+
+func (api *httpAPI) post(h httpHandler) http.HandlerFunc {
+	return api.handle("POST", h)
+}
+
+// Returns the value of the query parameter 'name' as an unsigned number of at most 'bits' bits.
+// If the parameter is missing, the default value is returned, or an error if 'def' is negative.
+func uintParam(r *http.Request, name string, bits int, def int) (uint64, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		if def < 0 {
+			return 0, fmt.Errorf("missing parameter \"%s\"", name)
+		}
+		return uint64(def), nil
+	}
+
+	value, err := strconv.ParseUint(s, 0, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value of parameter \"%s\": %s", name, s)
+	}
+	return value, nil
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(value)
+}
+
+func (api *httpAPI) load(w http.ResponseWriter, r *http.Request) error {
+	var program interface{}
+	var name string
+	choose := formats.ZipEntryNamed(r.URL.Query().Get("entry"))
+
+	if file := r.URL.Query().Get("path"); file != "" {
+		path, err := spectrum.ProgramPath(file)
+		if err != nil {
+			return err
+		}
+		program, err = formats.ReadProgramWith(path, choose)
+		if err != nil {
+			return err
+		}
+		name = path
+	} else {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			return fmt.Errorf("missing parameter \"path\" or \"format\"")
+		}
+		var err error
+		program, err = formats.ReadProgramFromWith(r.Body, format, choose)
+		if err != nil {
+			return err
+		}
+		name = "http." + format
+	}
+
+	if formats.IsTape(program) {
+		romLoaded := make(chan (<-chan bool))
+		api.speccy.CommandChannel <- spectrum.Cmd_Reset{romLoaded, spectrum.RESET_HARD}
+		<-(<-romLoaded)
+	}
+
+	errChan := make(chan error)
+	api.speccy.CommandChannel <- spectrum.Cmd_Load{name, program, errChan}
+	if err := <-errChan; err != nil {
+		return err
+	}
+
+	if formats.IsTape(program) {
+		go func() {
+			if err := api.speccy.AutoLoadTape(); err != nil {
+				api.app.PrintfMsg("%s", err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (api *httpAPI) key(w http.ResponseWriter, r *http.Request) error {
+	code, err := uintParam(r, "code", 32, -1)
+	if err != nil {
+		return err
+	}
+
+	keyboard := api.speccy.Keyboard
+	switch action := r.URL.Query().Get("action"); action {
+	case "", "press":
+		<-keyboard.KeyPress(uint(code))
+	case "down":
+		keyboard.KeyDown(uint(code))
+	case "up":
+		keyboard.KeyUp(uint(code))
+	default:
+		return fmt.Errorf("invalid action \"%s\", expected press, down or up", action)
+	}
+	return nil
+}
+
+func (api *httpAPI) peek(w http.ResponseWriter, r *http.Request) error {
+	address, err := uintParam(r, "address", 16, -1)
+	if err != nil {
+		return err
+	}
+	count, err := uintParam(r, "count", 32, 1)
+	if err != nil {
+		return err
+	}
+	if address+count > 0x10000 {
+		return fmt.Errorf("the memory range exceeds the address space")
+	}
+
+	data := make([]byte, count)
+	done := make(chan bool)
+	api.speccy.CommandChannel <- spectrum.Cmd_ReadMemory{uint16(address), data, done}
+	<-done
+
+	// A []byte would be encoded as a base64 string
+	values := make([]uint, count)
+	for i, b := range data {
+		values[i] = uint(b)
+	}
+
+	return writeJSON(w, struct {
+		Address uint   `json:"address"`
+		Values  []uint `json:"values"`
+	}{uint(address), values})
+}
+
+func (api *httpAPI) poke(w http.ResponseWriter, r *http.Request) error {
+	address, err := uintParam(r, "address", 16, -1)
+	if err != nil {
+		return err
+	}
+	value, err := uintParam(r, "value", 8, -1)
+	if err != nil {
+		return err
+	}
+
+	api.speccy.Poke(uint16(address), byte(value))
+	return nil
+}
+
+func (api *httpAPI) registers(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, api.speccy.Registers())
+}
+
+func (api *httpAPI) screenshot(w http.ResponseWriter, r *http.Request) error {
+	ch := make(chan []byte)
+	api.speccy.CommandChannel <- spectrum.Cmd_MakeVideoMemoryDump{ch}
+	img := spectrum.ScreenToImage(<-ch)
+
+	w.Header().Set("Content-Type", "image/png")
+	return png.Encode(w, img)
+}
+
+func (api *httpAPI) reset(w http.ResponseWriter, r *http.Request) error {
+	var mode spectrum.ResetMode
+	switch r.URL.Query().Get("mode") {
+	case "", "soft":
+		mode = spectrum.RESET_SOFT
+	case "hard":
+		mode = spectrum.RESET_HARD
+	default:
+		return fmt.Errorf("invalid reset mode \"%s\", expected soft or hard", r.URL.Query().Get("mode"))
+	}
+
+	api.speccy.CommandChannel <- spectrum.Cmd_Reset{nil, mode}
+	return nil
+}
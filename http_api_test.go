@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestKnownHost(t *testing.T) {
+	tests := []struct {
+		listen string
+		host   string
+		known  bool
+	}{
+		{"127.0.0.1", "127.0.0.1:8080", true},
+		{"127.0.0.1", "localhost:8080", true},
+		{"127.0.0.1", "LOCALHOST", true},
+		{"127.0.0.1", "[::1]:8080", true},
+		{"127.0.0.1", "[::1]", true},
+
+		// A domain name rebound to 127.0.0.1
+		{"127.0.0.1", "attacker.example:8080", false},
+		{"127.0.0.1", "192.168.1.2:8080", false},
+
+		// The host of the listen address
+		{"speccy.lan", "speccy.lan:8080", true},
+		{"192.168.1.2", "192.168.1.2:8080", true},
+		{"192.168.1.2", "attacker.example:8080", false},
+
+		// Listening on all interfaces
+		{"0.0.0.0", "192.168.1.2:8080", true},
+		{"::", "[fe80::1]:8080", true},
+		{"0.0.0.0", "attacker.example:8080", false},
+	}
+
+	for _, test := range tests {
+		api := &httpAPI{host: test.listen}
+		if known := api.knownHost(&http.Request{Host: test.host}); known != test.known {
+			t.Errorf("listening on %q, host %q: expected %v, got %v", test.listen, test.host, test.known, known)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"image"
+	"image/png"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Live screen streaming over a WebSocket (GET /stream).
+//
+// The stream is a display receiver, so it gets the changes of the screen
+// at most once per emulated frame. The changes are sent as binary messages,
+// the first byte of a message is its type:
+//
+//	'C'  The palette: 16 colors, 3 bytes (R, G, B) each
+//	'P'  A PNG image of the whole screen (256x192, without the border)
+//	'R'  Changed rectangles: for each rectangle, its position and size
+//	     in 8x8 cells (x, y, width, height: 1 byte each), followed by the palette indices
+//	     of its pixels, row by row, encoded as (count, index) pairs
+//	'B'  The border color (1 byte)
+//
+// Only the cells whose pixels actually changed are sent.
+// After connecting, and whenever the screen is repainted, the client receives 'C' and 'P'.
+//
+// The client can send text messages "down CODE" and "up CODE" to press and release
+// the key with the specified logical code (KEY_*). The keys still held down
+// when the client disconnects are released.
+//
+// Like the rest of the HTTP API, the stream is available only to local clients
+// by default, and only to pages served from the same origin as the API.
+
+type screenStream struct {
+	ws   *websocketConn
+	data chan *spectrum.DisplayData
+
+	done      chan bool
+	closeOnce sync.Once
+
+	// The palette indices of the pixels known to the client
+	pixels      [spectrum.ScreenWidth * spectrum.ScreenHeight]byte
+	initialized bool
+
+	// The border color known to the client, or -1
+	border int
+}
+
+func (s *screenStream) GetDisplayDataChannel() chan<- *spectrum.DisplayData {
+	return s.data
+}
+
+func (s *screenStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.ws.Close()
+	})
+}
+
+func (api *httpAPI) stream(w http.ResponseWriter, r *http.Request) error {
+	ws, err := websocketUpgrade(w, r)
+	if err != nil {
+		return err
+	}
+
+	s := &screenStream{
+		ws:     ws,
+		data:   make(chan *spectrum.DisplayData),
+		done:   make(chan bool),
+		border: -1,
+	}
+	api.speccy.CommandChannel <- spectrum.Cmd_AddDisplay{s}
+
+	go s.readInput(api.speccy.Keyboard)
+
+	for {
+		select {
+		case <-s.done:
+			finished := make(chan byte)
+			api.speccy.CommandChannel <- spectrum.Cmd_RemoveDisplay{s, finished}
+			<-finished
+			return nil
+
+		case data := <-s.data:
+			if data.CompletionTime_orNil != nil {
+				data.CompletionTime_orNil <- time.Now()
+			}
+			if err := s.send(data); err != nil {
+				s.Close()
+			}
+		}
+	}
+}
+
+// Handles the key events sent by the client, until the connection is closed
+func (s *screenStream) readInput(keyboard *spectrum.Keyboard) {
+	held := make(map[uint]bool)
+	defer func() {
+		for code := range held {
+			keyboard.KeyUp(code)
+		}
+		s.Close()
+	}()
+
+	for {
+		opcode, msg, err := s.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if opcode != ws_OPCODE_TEXT {
+			continue
+		}
+
+		var action string
+		var code uint
+		if _, err := fmt.Sscanf(string(msg), "%s %d", &action, &code); err != nil {
+			continue
+		}
+		switch action {
+		case "down":
+			keyboard.KeyDown(code)
+			held[code] = true
+		case "up":
+			keyboard.KeyUp(code)
+			delete(held, code)
+		}
+	}
+}
+
+// Updates the pixels of the 8x8 cell [attr_x,attr_y] from the display data.
+// Returns whether any pixel changed.
+func (s *screenStream) updateCell(data *spectrum.DisplayData, attr_x, attr_y uint) bool {
+	changed := false
+	for y := attr_y * 8; y < attr_y*8+8; y++ {
+		ofs := y*spectrum.BytesPerLine + attr_x
+		bits := data.Bitmap[ofs]
+		ink, paper := byte(data.Attr[ofs]>>4), byte(data.Attr[ofs]&0x0f)
+
+		pixels := s.pixels[y*spectrum.ScreenWidth+attr_x*8:]
+		for x := uint(0); x < 8; x++ {
+			color := paper
+			if (bits & (0x80 >> x)) != 0 {
+				color = ink
+			}
+			if pixels[x] != color {
+				pixels[x] = color
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// Appends the rectangle of 8x8 cells to the 'R' message
+func (s *screenStream) appendRect(msg []byte, attr_x, attr_y, width, height uint) []byte {
+	msg = append(msg, byte(attr_x), byte(attr_y), byte(width), byte(height))
+
+	var count, color byte
+	for y := attr_y * 8; y < (attr_y+height)*8; y++ {
+		row := s.pixels[y*spectrum.ScreenWidth+attr_x*8 : y*spectrum.ScreenWidth+(attr_x+width)*8]
+		for _, c := range row {
+			if (count > 0) && ((c != color) || (count == 255)) {
+				msg = append(msg, count, color)
+				count = 0
+			}
+			color = c
+			count++
+		}
+	}
+	return append(msg, count, color)
+}
+
+func (s *screenStream) send(data *spectrum.DisplayData) error {
+	var changed [spectrum.ScreenWidth_Attr * spectrum.ScreenHeight_Attr]bool
+	for attr_y := uint(0); attr_y < spectrum.ScreenHeight_Attr; attr_y++ {
+		for attr_x := uint(0); attr_x < spectrum.ScreenWidth_Attr; attr_x++ {
+			i := attr_y*spectrum.ScreenWidth_Attr + attr_x
+			if data.Dirty[i] {
+				changed[i] = s.updateCell(data, attr_x, attr_y)
+			}
+		}
+	}
+
+	if !s.initialized || data.Repaint {
+		if err := s.sendScreen(); err != nil {
+			return err
+		}
+		s.initialized = true
+	} else {
+		// Each run of changed cells in a row of cells is sent as one rectangle
+		msg := []byte{'R'}
+		for attr_y := uint(0); attr_y < spectrum.ScreenHeight_Attr; attr_y++ {
+			row := changed[attr_y*spectrum.ScreenWidth_Attr : (attr_y+1)*spectrum.ScreenWidth_Attr]
+			for attr_x := uint(0); attr_x < spectrum.ScreenWidth_Attr; {
+				if !row[attr_x] {
+					attr_x++
+					continue
+				}
+				width := uint(1)
+				for (attr_x+width < spectrum.ScreenWidth_Attr) && row[attr_x+width] {
+					width++
+				}
+				msg = s.appendRect(msg, attr_x, attr_y, width, 1)
+				attr_x += width
+			}
+		}
+		if len(msg) > 1 {
+			if err := s.ws.WriteBinary(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n := len(data.BorderEvents); n > 0 {
+		if border := int(data.BorderEvents[n-1].Color); border != s.border {
+			s.border = border
+			if err := s.ws.WriteBinary([]byte{'B', byte(border)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sends the palette and the whole screen
+func (s *screenStream) sendScreen() error {
+	palette := spectrum.CurrentPalette()
+
+	msg := []byte{'C'}
+	for _, c := range palette {
+		msg = append(msg, byte(c>>16), byte(c>>8), byte(c))
+	}
+	if err := s.ws.WriteBinary(msg); err != nil {
+		return err
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, spectrum.ScreenWidth, spectrum.ScreenHeight), palette.ImagePalette())
+	copy(img.Pix, s.pixels[:])
+
+	var buf bytes.Buffer
+	buf.WriteByte('P')
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	if err := s.ws.WriteBinary(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if s.border >= 0 {
+		return s.ws.WriteBinary([]byte{'B', byte(s.border)})
+	}
+	return nil
+}
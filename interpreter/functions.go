@@ -2,11 +2,20 @@ package interpreter
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/guntars-lemps/gospeccy/formats"
 	"github.com/guntars-lemps/gospeccy/spectrum"
 	"github.com/sbinet/go-eval"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -115,14 +124,27 @@ func wrapper_definedFunction(t *eval.Thread, in []eval.Value, out []eval.Value)
 	out[0].(eval.BoolValue).Set(t, defined)
 }
 
+// Resets the machine and waits until the system ROM is loaded
+func reset(mode spectrum.ResetMode) {
+	romLoaded := make(chan (<-chan bool))
+	speccy.CommandChannel <- spectrum.Cmd_Reset{romLoaded, mode}
+	<-(<-romLoaded)
+}
+
 // Signature: func reset()
 func wrapper_reset(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	if app.TerminationInProgress() || app.Terminated() {
 		return
 	}
-	romLoaded := make(chan (<-chan bool))
-	speccy.CommandChannel <- spectrum.Cmd_Reset{romLoaded}
-	<-(<-romLoaded)
+	reset(spectrum.RESET_SOFT)
+}
+
+// Signature: func hardReset()
+func wrapper_hardReset(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+	reset(spectrum.RESET_HARD)
 }
 
 // Signature: func addSearchPath(path string)
@@ -137,18 +159,16 @@ func wrapper_setDownloadPath(t *eval.Thread, in []eval.Value, out []eval.Value)
 	spectrum.SetDownloadPath(path)
 }
 
-func load(path string) {
+func load(path string, zipEntry string) {
 	var program interface{}
-	program, err := formats.ReadProgram(path)
+	program, err := formats.ReadProgramWith(path, formats.ZipEntryNamed(zipEntry))
 	if err != nil {
 		fmt.Fprintf(stdout, "%s\n", err)
 		return
 	}
 
-	if _, isTAP := program.(*formats.TAP); isTAP {
-		romLoaded := make(chan (<-chan bool))
-		speccy.CommandChannel <- spectrum.Cmd_Reset{romLoaded}
-		<-(<-romLoaded)
+	if formats.IsTape(program) {
+		reset(spectrum.RESET_HARD)
 	}
 
 	errChan := make(chan error)
@@ -159,6 +179,16 @@ func load(path string) {
 		fmt.Fprintf(stdout, "%s\n", err)
 		return
 	}
+
+	spectrum.SetLoadedProgramPath(path)
+
+	if formats.IsTape(program) {
+		go func() {
+			if err := speccy.AutoLoadTape(); err != nil {
+				fmt.Fprintf(stdout, "%s\n", err)
+			}
+		}()
+	}
 }
 
 // Signature: func load(path string)
@@ -176,7 +206,26 @@ func wrapper_load(t *eval.Thread, in []eval.Value, out []eval.Value) {
 		return
 	}
 
-	load(path)
+	load(path, "")
+}
+
+// Signature: func loadZipEntry(path string, entry string)
+func wrapper_loadZipEntry(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+	entry := in[1].(eval.StringValue).Get(t)
+
+	var err error
+	path, err = spectrum.ProgramPath(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	load(path, entry)
 }
 
 // Signature: func cmdLineArg() string
@@ -197,7 +246,16 @@ func wrapper_save(t *eval.Thread, in []eval.Value, out []eval.Value) {
 
 	fullSnapshot := <-ch
 
-	data, err := fullSnapshot.EncodeSNA()
+	// The format is selected by the file name extension
+	var data []byte
+	var err error
+	formatName := "SNA"
+	if strings.ToLower(filepath.Ext(path)) == ".z80" {
+		formatName = "Z80"
+		data, err = fullSnapshot.EncodeZ80()
+	} else {
+		data, err = fullSnapshot.EncodeSNA()
+	}
 	if err != nil {
 		fmt.Fprintf(stdout, "%s\n", err)
 		return
@@ -209,7 +267,31 @@ func wrapper_save(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	}
 
 	if app.Verbose {
-		fmt.Fprintf(stdout, "wrote SNA snapshot \"%s\"", path)
+		fmt.Fprintf(stdout, "wrote %s snapshot \"%s\"", formatName, path)
+	}
+}
+
+// Signature: func saveState(slot uint)
+func wrapper_saveState(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	slot := int(in[0].(eval.UintValue).Get(t))
+	if err := speccy.SaveState(slot); err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	}
+}
+
+// Signature: func loadState(slot uint)
+func wrapper_loadState(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	slot := int(in[0].(eval.UintValue).Get(t))
+	if err := speccy.LoadState(slot); err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
 	}
 }
 
@@ -223,81 +305,1164 @@ func wrapper_fps(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	speccy.CommandChannel <- spectrum.Cmd_SetFPS{float32(fps), nil}
 }
 
+// Signature: func warp(enable bool)
+func wrapper_warp(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	enable := in[0].(eval.BoolValue).Get(t)
+	speccy.CommandChannel <- spectrum.Cmd_SetWarp{enable}
+}
+
+// Signature: func pause()
+func wrapper_pause(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	speccy.Pause()
+}
+
+// Signature: func resume()
+func wrapper_resume(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	speccy.Resume()
+}
+
 // Signature: func ula_accuracy(accurateEmulation bool)
 func wrapper_ulaAccuracy(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	if app.TerminationInProgress() || app.Terminated() {
 		return
 	}
 
-	accurateEmulation := in[0].(eval.BoolValue).Get(t)
-	speccy.CommandChannel <- spectrum.Cmd_SetUlaEmulationAccuracy{accurateEmulation}
+	accurateEmulation := in[0].(eval.BoolValue).Get(t)
+	speccy.CommandChannel <- spectrum.Cmd_SetUlaEmulationAccuracy{accurateEmulation}
+}
+
+// Signature: func wait(milliseconds uint)
+func wrapper_wait(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	milliseconds := in[0].(eval.UintValue).Get(t)
+	time.Sleep(time.Millisecond * time.Duration(milliseconds))
+}
+
+// Signature: func waitStable(frames uint)
+func wrapper_waitStable(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	frames := in[0].(eval.UintValue).Get(t)
+
+	done := make(chan bool, 1)
+	speccy.CommandChannel <- spectrum.Cmd_WaitStable{uint(frames), done}
+
+	select {
+	case ok := <-done:
+		if !ok {
+			fmt.Fprintf(stdout, "the emulation is paused\n")
+		}
+	case <-app.HasTerminated:
+	}
+}
+
+// Signature: func waitTitle(changedCells uint, stableFrames uint)
+func wrapper_waitTitle(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	changedCells := uint(in[0].(eval.UintValue).Get(t))
+	stableFrames := uint(in[1].(eval.UintValue).Get(t))
+
+	done := make(chan bool, 1)
+	speccy.CommandChannel <- spectrum.Cmd_WaitTitle{changedCells, stableFrames, done}
+
+	select {
+	case ok := <-done:
+		if !ok {
+			fmt.Fprintf(stdout, "the emulation is paused\n")
+		}
+	case <-app.HasTerminated:
+	}
+}
+
+// Signature: func sync()
+func wrapper_sync(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	done := make(chan bool, 1)
+	speccy.CommandChannel <- spectrum.Cmd_Sync{done}
+
+	select {
+	case ok := <-done:
+		if !ok {
+			fmt.Fprintf(stdout, "the emulation is paused\n")
+		}
+	case <-app.HasTerminated:
+	}
+}
+
+// Signature: func script(scriptName string)
+func wrapper_script(t *eval.Thread, in []eval.Value, out []eval.Value) {
+
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+
+	var err error
+	path, err = spectrum.ScriptPath(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	err = runScript(w, path, false /*optional*/)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+}
+
+// Signature: func scripts()
+func wrapper_scripts(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	names := spectrum.ScriptNames()
+	if len(names) == 0 {
+		fmt.Fprintf(stdout, "no scripts found\n")
+		return
+	}
+
+	for _, name := range names {
+		if err := checkScript(name); err != nil {
+			fmt.Fprintf(stdout, "%s (failed to compile: %s)\n", name, err)
+		} else {
+			fmt.Fprintf(stdout, "%s\n", name)
+		}
+	}
+}
+
+// Signature: func optionalScript(scriptName string)
+func wrapper_optionalScript(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	scriptName := in[0].(eval.StringValue).Get(t)
+
+	err := runScript(w, scriptName, true /*optional*/)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+}
+
+// Writes a PNG screenshot of the display, including the border.
+// It is set by the user interface, and it is nil if there is no display.
+var pngScreenshot_orNil func(path string) error
+
+// Installs the function used by screenshot() to write PNG files
+func SetScreenshotFunc(f func(path string) error) {
+	mutex.Lock()
+	pngScreenshot_orNil = f
+	mutex.Unlock()
+}
+
+// Signature: func screenshot(screenshotName string)
+func wrapper_screenshot(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+	if path == "" {
+		path = spectrum.DefaultScreenshotPath()
+	}
+
+	ch := make(chan []byte)
+	speccy.CommandChannel <- spectrum.Cmd_MakeVideoMemoryDump{ch}
+
+	data := <-ch
+
+	var err error
+	if strings.ToLower(filepath.Ext(path)) == ".png" {
+		mutex.Lock()
+		pngScreenshot := pngScreenshot_orNil
+		mutex.Unlock()
+
+		if pngScreenshot != nil {
+			err = pngScreenshot(path)
+		} else {
+			err = writePNG(path, spectrum.ScreenToImage(data))
+		}
+	} else {
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	}
+
+	if app.Verbose {
+		fmt.Fprintf(stdout, "wrote screenshot \"%s\"", path)
+	}
+}
+
+// Signature: func burstScreenshots(dir string, every uint, count uint)
+func wrapper_burstScreenshots(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	dir := in[0].(eval.StringValue).Get(t)
+	every := uint(in[1].(eval.UintValue).Get(t))
+	count := uint(in[2].(eval.UintValue).Get(t))
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	ch := make(chan []byte, count)
+	speccy.CommandChannel <- spectrum.Cmd_CaptureScreens{every, count, ch}
+
+	for i := 0; ; i++ {
+		select {
+		case vram, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			path := filepath.Join(dir, fmt.Sprintf("frame-%05d.png", i))
+			err := writePNG(path, spectrum.ScreenToImage(vram))
+			if err != nil {
+				fmt.Fprintf(stdout, "%s\n", err)
+				return
+			}
+
+		case <-app.HasTerminated:
+			return
+		}
+	}
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(file, img)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Signature: func sysvar(name string) uint
+func wrapper_sysvar(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	name := in[0].(eval.StringValue).Get(t)
+
+	value, err := speccy.SystemVariable(name)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	out[0].(eval.UintValue).Set(t, uint64(value))
+}
+
+// Signature: func peek(address uint) uint
+func wrapper_peek(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	address := in[0].(eval.UintValue).Get(t)
+	if address > 0xffff {
+		fmt.Fprintf(stdout, "invalid address %d\n", address)
+		return
+	}
+
+	out[0].(eval.UintValue).Set(t, uint64(speccy.Peek(uint16(address))))
+}
+
+// Signature: func poke(address uint, value uint)
+func wrapper_poke(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	address := in[0].(eval.UintValue).Get(t)
+	value := in[1].(eval.UintValue).Get(t)
+	if address > 0xffff {
+		fmt.Fprintf(stdout, "invalid address %d\n", address)
+		return
+	}
+	if value > 0xff {
+		fmt.Fprintf(stdout, "invalid value %d\n", value)
+		return
+	}
+
+	speccy.Poke(uint16(address), byte(value))
+}
+
+// Signature: func atPrompt() bool
+func wrapper_atPrompt(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	ch := make(chan bool)
+	speccy.CommandChannel <- spectrum.Cmd_AtBasicPrompt{ch}
+
+	out[0].(eval.BoolValue).Set(t, <-ch)
+}
+
+// Signature: func setSysvar(name string, value uint)
+func wrapper_setSysvar(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	name := in[0].(eval.StringValue).Get(t)
+	value := in[1].(eval.UintValue).Get(t)
+
+	err := speccy.SetSystemVariable(name, uint(value))
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	}
+}
+
+// Signature: func traceDiff(path string, ignoreUndocumentedFlags bool)
+func wrapper_traceDiff(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+	ignoreUndocumentedFlags := in[1].(eval.BoolValue).Get(t)
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+	reference, err := spectrum.ReadTrace(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	var flagsMask byte = 0xff
+	if ignoreUndocumentedFlags {
+		flagsMask = 0xd7
+	}
+
+	done := make(chan error, 1)
+	speccy.CommandChannel <- spectrum.Cmd_TraceDiff{reference, flagsMask, done}
+	err = <-done
+
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	} else {
+		fmt.Fprintf(stdout, "all %d steps match the trace\n", len(reference))
+	}
+}
+
+// Signature: func runZ80Test(path string, address uint)
+func wrapper_runZ80Test(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+	address := in[1].(eval.UintValue).Get(t)
+	if address > 0xffff {
+		fmt.Fprintf(stdout, "invalid address %d\n", address)
+		return
+	}
+
+	// A CP/M program prints its output by calling the BDOS
+	var output io.Writer
+	if address == spectrum.CPM_PROGRAM_ADDR {
+		output = stdout
+	}
+
+	program, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	// Run the test as fast as possible
+	oldSpeed := make(chan float32, 1)
+	speccy.CommandChannel <- spectrum.Cmd_SetSpeed{0, oldSpeed}
+
+	done := make(chan error, 1)
+	speccy.CommandChannel <- spectrum.Cmd_RunZ80Test{program, uint16(address), output, done}
+	err = <-done
+
+	speccy.CommandChannel <- spectrum.Cmd_SetSpeed{<-oldSpeed, nil}
+	speccy.CommandChannel <- spectrum.Cmd_Reset{}
+
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	}
+}
+
+// Signature: func gameDir() string
+func wrapper_gameDir(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	dir, err := spectrum.ProgramSettingsDir()
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	out[0].(eval.StringValue).Set(t, dir)
+}
+
+// Signature: func machine() string
+func wrapper_machine(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	ch := make(chan spectrum.MachineModel)
+	speccy.CommandChannel <- spectrum.Cmd_GetMachineModel{ch}
+
+	out[0].(eval.StringValue).Set(t, (<-ch).String())
+}
+
+// Signature: func setMachine(model string)
+func wrapper_setMachine(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	model, err := spectrum.ParseMachineModel(in[0].(eval.StringValue).Get(t))
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	errChan := make(chan error)
+	speccy.CommandChannel <- spectrum.Cmd_SetMachineModel{model, errChan}
+
+	err = <-errChan
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	}
+}
+
+// Signature: func memmap()
+func wrapper_memmap(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	ch := make(chan spectrum.PagingState)
+	speccy.CommandChannel <- spectrum.Cmd_GetPagingState{ch}
+	paging := <-ch
+
+	for i, page := range paging.Slots {
+		fmt.Fprintf(stdout, "0x%04x-0x%04x: %s\n", i*0x4000, i*0x4000+0x3fff, page)
+	}
+	if paging.PagingAvailable {
+		fmt.Fprintf(stdout, "shadow screen: %v, paging locked: %v\n", paging.ShadowScreen, paging.Locked)
+	} else {
+		fmt.Fprintf(stdout, "paging is not available on this machine\n")
+	}
+}
+
+// Signature: func playInput(path string)
+func wrapper_playInput(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+	defer file.Close()
+
+	events, err := spectrum.ReadInputScript(file)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	speccy.CommandChannel <- spectrum.Cmd_PlayInput{events}
+}
+
+// Signature: func recordInput(path string)
+func wrapper_recordInput(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+	if err := speccy.RecordInput(path); err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	}
+}
+
+// Signature: func stopRecordingInput()
+func wrapper_stopRecordingInput(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	if err := speccy.StopRecordingInput(); err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	}
+}
+
+// Signature: func typeString(s string)
+func wrapper_typeString(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	s := in[0].(eval.StringValue).Get(t)
+	<-speccy.Keyboard.TypeString(s)
+}
+
+// Signature: func registers()
+func wrapper_registers(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	fmt.Fprint(stdout, spectrum.FormatRegisters(speccy.Registers()))
+}
+
+// Go code run when a breakpoint is hit, set by 'onBreakpoint'. Protected by 'mutex'.
+var breakpointCallback string
+
+// Called by the emulator when a breakpoint is hit
+func breakpointHit(cpu formats.CpuState) {
+	out := intp.Stdout()
+	fmt.Fprintf(out, "breakpoint at 0x%04x\n", cpu.PC)
+	fmt.Fprint(out, spectrum.FormatRegisters(cpu))
+
+	runBreakpointCallback()
+}
+
+// Called by the emulator when a watchpoint is hit
+func watchHit(hit spectrum.WatchHit, cpu formats.CpuState) {
+	out := intp.Stdout()
+	fmt.Fprintf(out, "%s\n", hit)
+	fmt.Fprint(out, spectrum.FormatRegisters(cpu))
+
+	runBreakpointCallback()
+}
+
+func runBreakpointCallback() {
+	mutex.Lock()
+	code := breakpointCallback
+	mutex.Unlock()
+
+	if code != "" {
+		if err := intp.RunFrom("breakpoint", code); err != nil {
+			fmt.Fprintf(intp.Stdout(), "%s\n", err)
+		}
+	}
+}
+
+// Signature: func breakpoint(address uint)
+func wrapper_breakpoint(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	address := in[0].(eval.UintValue).Get(t)
+	if address > 0xffff {
+		fmt.Fprintf(stdout, "invalid address: %d\n", address)
+		return
+	}
+
+	speccy.SetBreakpoint(uint16(address))
+}
+
+// Signature: func clearBreakpoint(address uint)
+func wrapper_clearBreakpoint(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	address := in[0].(eval.UintValue).Get(t)
+	if address > 0xffff {
+		fmt.Fprintf(stdout, "invalid address: %d\n", address)
+		return
+	}
+
+	speccy.ClearBreakpoint(uint16(address))
+}
+
+// Signature: func clearBreakpoints()
+func wrapper_clearBreakpoints(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	speccy.ClearBreakpoints()
+}
+
+// Signature: func breakpoints()
+func wrapper_breakpoints(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	addresses := speccy.Breakpoints()
+	if len(addresses) == 0 {
+		fmt.Fprintf(stdout, "no breakpoints\n")
+		return
+	}
+	for _, address := range addresses {
+		fmt.Fprintf(stdout, "0x%04x\n", address)
+	}
+}
+
+// Signature: func watch(address uint)
+func wrapper_watch(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	address := in[0].(eval.UintValue).Get(t)
+	if address > 0xffff {
+		fmt.Fprintf(stdout, "invalid address: %d\n", address)
+		return
+	}
+
+	speccy.Watch(uint16(address), uint16(address), spectrum.WATCH_WRITE)
+}
+
+func watchRange(t *eval.Thread, in []eval.Value, mode spectrum.WatchMode) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	from := in[0].(eval.UintValue).Get(t)
+	to := in[1].(eval.UintValue).Get(t)
+	if (from > to) || (to > 0xffff) {
+		fmt.Fprintf(stdout, "invalid address range: %d-%d\n", from, to)
+		return
+	}
+
+	speccy.Watch(uint16(from), uint16(to), mode)
+}
+
+// Signature: func watchRange(from uint, to uint)
+func wrapper_watchRange(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	watchRange(t, in, spectrum.WATCH_WRITE)
+}
+
+// Signature: func watchReads(from uint, to uint)
+func wrapper_watchReads(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	watchRange(t, in, spectrum.WATCH_READ|spectrum.WATCH_WRITE)
+}
+
+// Signature: func unwatch(address uint)
+func wrapper_unwatch(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	address := in[0].(eval.UintValue).Get(t)
+	if address > 0xffff {
+		fmt.Fprintf(stdout, "invalid address: %d\n", address)
+		return
+	}
+
+	speccy.Watch(uint16(address), uint16(address), 0)
+}
+
+// Signature: func unwatchAll()
+func wrapper_unwatchAll(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	speccy.ClearWatches()
+}
+
+// Signature: func watches()
+func wrapper_watches(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	ranges := speccy.Watches()
+	if len(ranges) == 0 {
+		fmt.Fprintf(stdout, "no watchpoints\n")
+		return
+	}
+	for _, r := range ranges {
+		if r.From == r.To {
+			fmt.Fprintf(stdout, "0x%04x       %s\n", r.From, r.Mode)
+		} else {
+			fmt.Fprintf(stdout, "0x%04x-%04x  %s\n", r.From, r.To, r.Mode)
+		}
+	}
+}
+
+// Signature: func onBreakpoint(code string)
+func wrapper_onBreakpoint(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	mutex.Lock()
+	breakpointCallback = in[0].(eval.StringValue).Get(t)
+	mutex.Unlock()
+}
+
+// Signature: func disasm(address uint, count uint)
+func wrapper_disasm(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	address := in[0].(eval.UintValue).Get(t)
+	count := in[1].(eval.UintValue).Get(t)
+	if address > 0xffff {
+		fmt.Fprintf(stdout, "invalid address: %d\n", address)
+		return
+	}
+
+	memory := make([]byte, 0x10000)
+	done := make(chan bool)
+	speccy.CommandChannel <- spectrum.Cmd_ReadMemory{0, memory, done}
+	<-done
+
+	fmt.Fprint(stdout, spectrum.DisassembleListing(memory, uint16(address), uint(count)))
+}
+
+// Signature: func interruptCount() uint
+func wrapper_interruptCount(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	ch := make(chan uint64)
+	speccy.CommandChannel <- spectrum.Cmd_GetInterruptCount{ch}
+
+	out[0].(eval.UintValue).Set(t, <-ch)
+}
+
+// Signature: func tapeRewind()
+func wrapper_tapeRewind(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	speccy.CommandChannel <- spectrum.Cmd_RewindTape{}
+}
+
+// Signature: func tapePlay()
+func wrapper_tapePlay(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	speccy.CommandChannel <- spectrum.Cmd_PlayTape{}
+}
+
+// Signature: func tapeBlocks()
+func wrapper_tapeBlocks(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	tape := speccy.TapeDrive().Tape()
+	if tape == nil {
+		fmt.Fprintf(stdout, "no tape inserted\n")
+		return
+	}
+
+	ch := make(chan spectrum.TapeProgress)
+	speccy.CommandChannel <- spectrum.Cmd_GetTapeProgress{ch}
+	currentBlock := (<-ch).Block
+
+	for i, block := range tape.Blocks() {
+		marker := " "
+		if i == currentBlock {
+			marker = ">"
+		}
+
+		if block.FileType != "" {
+			fmt.Fprintf(stdout, "%s%3d  %-15s \"%s\"\n", marker, i+1, block.FileType+":", block.Filename)
+		} else {
+			fmt.Fprintf(stdout, "%s%3d  %d bytes\n", marker, i+1, block.Length)
+		}
+	}
+}
+
+// Signature: func tapeSeek(n uint)
+func wrapper_tapeSeek(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	n := in[0].(eval.UintValue).Get(t)
+	if n == 0 {
+		fmt.Fprintf(stdout, "invalid tape block number, the blocks are numbered from 1\n")
+		return
+	}
+
+	errChan := make(chan error)
+	speccy.CommandChannel <- spectrum.Cmd_SeekTape{int(n - 1), errChan}
+	if err := <-errChan; err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+	}
+}
+
+// Signature: func tapeProgress() float32
+func wrapper_tapeProgress(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	ch := make(chan spectrum.TapeProgress)
+	speccy.CommandChannel <- spectrum.Cmd_GetTapeProgress{ch}
+
+	out[0].(eval.FloatValue).Set(t, float64((<-ch).Percent))
+}
+
+// Signature: func tapeStatus()
+func wrapper_tapeStatus(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	ch := make(chan spectrum.TapeProgress)
+	speccy.CommandChannel <- spectrum.Cmd_GetTapeProgress{ch}
+
+	fmt.Fprintf(stdout, "%s\n", <-ch)
+}
+
+// Signature: func stack(n uint)
+func wrapper_stack(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	n := uint(in[0].(eval.UintValue).Get(t))
+
+	ch := make(chan *formats.FullSnapshot)
+	speccy.CommandChannel <- spectrum.Cmd_MakeSnapshot{ch}
+	sp := (<-ch).Cpu.SP
+
+	data := make([]byte, 2*n)
+	done := make(chan bool)
+	speccy.CommandChannel <- spectrum.Cmd_ReadMemory{sp, data, done}
+	<-done
+
+	for i := uint(0); i < n; i++ {
+		addr := sp + uint16(2*i)
+		word := uint16(data[2*i]) | (uint16(data[2*i+1]) << 8)
+		fmt.Fprintf(stdout, "0x%04x: 0x%04x\n", addr, word)
+	}
+}
+
+// Signature: func memhash(address uint, length uint) uint
+//
+// Memory is read through the active paging,
+// so on a 128k machine the hash covers the banks currently mapped into the address range.
+func wrapper_memhash(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	address := uint(in[0].(eval.UintValue).Get(t))
+	length := uint(in[1].(eval.UintValue).Get(t))
+
+	if (address > 0xffff) || (address+length > 0x10000) {
+		fmt.Fprintf(stdout, "the memory range exceeds 64k\n")
+		return
+	}
+
+	data := make([]byte, length)
+	done := make(chan bool)
+	speccy.CommandChannel <- spectrum.Cmd_ReadMemory{uint16(address), data, done}
+	<-done
+
+	out[0].(eval.UintValue).Set(t, uint64(crc32.ChecksumIEEE(data)))
+}
+
+// Signature: func applyIPS(path string, target string)
+func wrapper_applyIPS(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+	target := in[1].(eval.StringValue).Get(t)
+
+	var rom bool
+	switch strings.ToLower(target) {
+	case "rom":
+		rom = true
+	case "ram":
+		rom = false
+	default:
+		fmt.Fprintf(stdout, "invalid target \"%s\", expected \"rom\" or \"ram\"\n", target)
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	patch, err := formats.NewIPS(data)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: %s\n", path, err)
+		return
+	}
+
+	errChan := make(chan error)
+	speccy.CommandChannel <- spectrum.Cmd_ApplyIPS{patch, rom, errChan}
+	err = <-errChan
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: %s\n", path, err)
+		return
+	}
+
+	if app.Verbose {
+		app.PrintfMsg("applied %d IPS records from \"%s\"", len(patch.Records), path)
+	}
+}
+
+// Signature: func controls(name string)
+func wrapper_controls(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	name := in[0].(eval.StringValue).Get(t)
+
+	preset, err := spectrum.FindControlPreset(name)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	speccy.Joystick.SetControls(preset)
+}
+
+// Signature: func controlPresets()
+func wrapper_controlPresets(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	current := "kempston"
+	if controls := speccy.Joystick.Controls(); controls != nil {
+		current = controls.Name
+	}
+
+	for _, name := range spectrum.ControlPresetNames() {
+		keys := "Kempston joystick"
+		if preset, err := spectrum.FindControlPreset(name); err != nil {
+			keys = err.Error()
+		} else if preset != nil {
+			keys = preset.KeysString()
+		}
+
+		marker := " "
+		if name == current {
+			marker = "*"
+		}
+		fmt.Fprintf(stdout, "%s %-12s %s\n", marker, name, keys)
+	}
+}
+
+// Signature: func defineControls(name string, keys string, perGame bool)
+func wrapper_defineControls(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	name := in[0].(eval.StringValue).Get(t)
+	keys := in[1].(eval.StringValue).Get(t)
+	perGame := in[2].(eval.BoolValue).Get(t)
+
+	preset, err := spectrum.ParseControlPreset(name, keys)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+
+	err = spectrum.SaveControlPreset(preset, perGame)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+}
+
+// Signature: func mappedKeys()
+func wrapper_mappedKeys(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	var hostKeys []string
+	for hostKey := range spectrum.SDL_KeyMap {
+		hostKeys = append(hostKeys, hostKey)
+	}
+	sort.Strings(hostKeys)
+
+	for _, hostKey := range hostKeys {
+		var names []string
+		for _, logicalKeyCode := range spectrum.SDL_KeyMap[hostKey] {
+			names = append(names, spectrum.KeyName(logicalKeyCode))
+		}
+		fmt.Fprintf(stdout, "%-12s %s\n", hostKey, strings.Join(names, "+"))
+	}
+}
+
+// Signature: func formats()
+func wrapper_formats(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	for _, format := range formats.SupportedFormats() {
+		var access []string
+		if format.CanRead {
+			access = append(access, "load")
+		}
+		if format.CanWrite {
+			access = append(access, "save")
+		}
+
+		fmt.Fprintf(stdout, "%-4s %-12s %s\n", format.Name, strings.Join(format.Extensions, " "), strings.Join(access, ", "))
+	}
+	fmt.Fprintf(stdout, "Programs can also be loaded from ZIP archives\n")
 }
 
-// Signature: func wait(milliseconds uint)
-func wrapper_wait(t *eval.Thread, in []eval.Value, out []eval.Value) {
+// Signature: func repaint()
+func wrapper_repaint(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	if app.TerminationInProgress() || app.Terminated() {
 		return
 	}
 
-	milliseconds := in[0].(eval.UintValue).Get(t)
-	time.Sleep(time.Millisecond * time.Duration(milliseconds))
+	speccy.CommandChannel <- spectrum.Cmd_Repaint{}
 }
 
-// Signature: func script(scriptName string)
-func wrapper_script(t *eval.Thread, in []eval.Value, out []eval.Value) {
-
+// Signature: func repaintMode(mode string)
+func wrapper_repaintMode(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	if app.TerminationInProgress() || app.Terminated() {
 		return
 	}
 
-	path := in[0].(eval.StringValue).Get(t)
-
-	var err error
-	path, err = spectrum.ScriptPath(path)
+	mode, err := spectrum.ParseRepaintMode(in[0].(eval.StringValue).Get(t))
 	if err != nil {
 		fmt.Fprintf(stdout, "%s\n", err)
 		return
 	}
 
-	err = runScript(w, path, false /*optional*/)
+	speccy.CommandChannel <- spectrum.Cmd_SetRepaintMode{mode}
+}
+
+// Signature: func palette(name string)
+func wrapper_palette(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	palette, err := spectrum.FindPalette(in[0].(eval.StringValue).Get(t))
 	if err != nil {
-		fmt.Fprintf(stdout, "%s\n", err)
+		fmt.Fprintf(stdout, "%s (available: %s)\n", err, strings.Join(spectrum.PaletteNames(), ", "))
 		return
 	}
+
+	speccy.CommandChannel <- spectrum.Cmd_SetPalette{palette}
 }
 
-// Signature: func optionalScript(scriptName string)
-func wrapper_optionalScript(t *eval.Thread, in []eval.Value, out []eval.Value) {
-	scriptName := in[0].(eval.StringValue).Get(t)
+// Signature: func loadPalette(path string)
+func wrapper_loadPalette(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
 
-	err := runScript(w, scriptName, true /*optional*/)
+	palette, err := spectrum.LoadCustomPalette(in[0].(eval.StringValue).Get(t))
 	if err != nil {
 		fmt.Fprintf(stdout, "%s\n", err)
 		return
 	}
+
+	speccy.CommandChannel <- spectrum.Cmd_SetPalette{palette}
 }
 
-// Signature: func screenshot(screenshotName string)
-func wrapper_screenshot(t *eval.Thread, in []eval.Value, out []eval.Value) {
+// Signature: func screenAscii(width uint) string
+func wrapper_screenAscii(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	if app.TerminationInProgress() || app.Terminated() {
 		return
 	}
 
-	path := in[0].(eval.StringValue).Get(t)
+	width := in[0].(eval.UintValue).Get(t)
 
-	ch := make(chan []byte)
-	speccy.CommandChannel <- spectrum.Cmd_MakeVideoMemoryDump{ch}
+	vram := make([]byte, 6912)
+	done := make(chan bool)
+	speccy.CommandChannel <- spectrum.Cmd_ReadMemory{spectrum.SCREEN_BASE_ADDR, vram, done}
+	<-done
 
-	data := <-ch
+	out[0].(eval.StringValue).Set(t, spectrum.ScreenToASCII(vram, uint(width)))
+}
 
-	err := ioutil.WriteFile(path, data, 0600)
+// Signature: func out(port uint, value uint)
+func wrapper_out(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
 
-	if err != nil {
-		fmt.Fprintf(stdout, "%s\n", err)
+	port := in[0].(eval.UintValue).Get(t)
+	value := in[1].(eval.UintValue).Get(t)
+	if (port > 0xffff) || (value > 0xff) {
+		fmt.Fprintf(stdout, "port or value out of range\n")
+		return
 	}
 
-	if app.Verbose {
-		fmt.Fprintf(stdout, "wrote screenshot \"%s\"", path)
+	done := make(chan bool, 1)
+	speccy.CommandChannel <- spectrum.Cmd_Out{uint16(port), byte(value), done}
+
+	select {
+	case <-done:
+	case <-app.HasTerminated:
+	}
+}
+
+// Signature: func in(port uint) uint
+func wrapper_in(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	port := in[0].(eval.UintValue).Get(t)
+	if port > 0xffff {
+		fmt.Fprintf(stdout, "port out of range\n")
+		return
+	}
+
+	ch := make(chan byte, 1)
+	speccy.CommandChannel <- spectrum.Cmd_In{uint16(port), ch}
+
+	select {
+	case value := <-ch:
+		out[0].(eval.UintValue).Set(t, uint64(value))
+	case <-app.HasTerminated:
 	}
 }
 
@@ -317,6 +1482,55 @@ func wrapper_acceleratedLoad(t *eval.Thread, in []eval.Value, out []eval.Value)
 	speccy.CommandChannel <- spectrum.Cmd_SetAcceleratedLoad{enable}
 }
 
+// Signature: func extractBlock(n uint, path string)
+func wrapper_extractBlock(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if app.TerminationInProgress() || app.Terminated() {
+		return
+	}
+
+	n := in[0].(eval.UintValue).Get(t)
+	path := in[1].(eval.StringValue).Get(t)
+
+	tape := speccy.TapeDrive().Tape()
+	if tape == nil {
+		fmt.Fprintf(stdout, "no tape inserted\n")
+		return
+	}
+
+	length, checksumOK, err := extractBlock(tape, uint(n), path)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s\n", err)
+		return
+	}
+	if !checksumOK {
+		fmt.Fprintf(stdout, "warning: tape block %d has an invalid checksum\n", n)
+	}
+
+	if app.Verbose {
+		fmt.Fprintf(stdout, "wrote %d bytes to \"%s\"\n", length, path)
+	}
+}
+
+// Writes the data of the tape block 'n' to a file. The blocks are numbered from 1,
+// as in the listing of 'tapeBlocks'. Returns the number of bytes written.
+func extractBlock(tape *spectrum.Tape, n uint, path string) (length int, checksumOK bool, err error) {
+	if n == 0 {
+		return 0, false, errors.New("invalid tape block number, the blocks are numbered from 1")
+	}
+
+	payload, checksumOK, err := tape.BlockPayload(int(n - 1))
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = ioutil.WriteFile(path, payload, 0600)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return len(payload), checksumOK, nil
+}
+
 func url_printer(URL eval.Value) string {
 	s := URL.(eval.StringValue).Get(nil)
 
@@ -372,7 +1586,14 @@ func defineFunctions(w *eval.World) {
 		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_reset, functionSignature)
 		defineFunction("reset", funcType, funcValue)
 		help_keys = append(help_keys, "reset()")
-		help_vals = append(help_vals, "Reset the emulated machine")
+		help_vals = append(help_vals, "Reset the emulated machine, like the reset button (the RAM is preserved)")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_hardReset, functionSignature)
+		defineFunction("hardReset", funcType, funcValue)
+		help_keys = append(help_keys, "hardReset()")
+		help_vals = append(help_vals, "Reset the emulated machine and clear the RAM")
 	}
 	{
 		var functionSignature func(string) bool
@@ -409,12 +1630,33 @@ func defineFunctions(w *eval.World) {
 		help_keys = append(help_keys, "load(path string)")
 		help_vals = append(help_vals, "Load state from file (.SNA, .Z80, .Z80.ZIP, etc)")
 	}
+	{
+		var functionSignature func(string, string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_loadZipEntry, functionSignature)
+		defineFunction("loadZipEntry", funcType, funcValue)
+		help_keys = append(help_keys, "loadZipEntry(path string, entry string)")
+		help_vals = append(help_vals, "Load the specified file from a ZIP archive containing several programs")
+	}
 	{
 		var functionSignature func(string)
 		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_save, functionSignature)
 		defineFunction("save", funcType, funcValue)
 		help_keys = append(help_keys, "save(path string)")
-		help_vals = append(help_vals, "Save state to file (SNA format)")
+		help_vals = append(help_vals, "Save state to file (Z80 format if the name ends with .z80, SNA format otherwise)")
+	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_saveState, functionSignature)
+		defineFunction("saveState", funcType, funcValue)
+		help_keys = append(help_keys, "saveState(slot uint)")
+		help_vals = append(help_vals, "Save state into a quick-save slot (0-9), also Alt+Shift+number")
+	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_loadState, functionSignature)
+		defineFunction("loadState", funcType, funcValue)
+		help_keys = append(help_keys, "loadState(slot uint)")
+		help_vals = append(help_vals, "Restore state from a quick-save slot (0-9), also Alt+number")
 	}
 	{
 		var functionSignature func(float32)
@@ -423,6 +1665,27 @@ func defineFunctions(w *eval.World) {
 		help_keys = append(help_keys, "fps(n float32)")
 		help_vals = append(help_vals, "Change the display refresh frequency (0=default FPS)")
 	}
+	{
+		var functionSignature func(bool)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_warp, functionSignature)
+		defineFunction("warp", funcType, funcValue)
+		help_keys = append(help_keys, "warp(enable bool)")
+		help_vals = append(help_vals, "Run the emulation as fast as possible, with muted audio (false: restore the previous speed)")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_pause, functionSignature)
+		defineFunction("pause", funcType, funcValue)
+		help_keys = append(help_keys, "pause()")
+		help_vals = append(help_vals, "Pause the emulation")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_resume, functionSignature)
+		defineFunction("resume", funcType, funcValue)
+		help_keys = append(help_keys, "resume()")
+		help_vals = append(help_vals, "Resume the paused emulation")
+	}
 	{
 		var functionSignature func(bool)
 		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_ulaAccuracy, functionSignature)
@@ -437,6 +1700,27 @@ func defineFunctions(w *eval.World) {
 		help_keys = append(help_keys, "wait(milliseconds uint)")
 		help_vals = append(help_vals, "Wait before executing the next command")
 	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_waitStable, functionSignature)
+		defineFunction("waitStable", funcType, funcValue)
+		help_keys = append(help_keys, "waitStable(frames uint)")
+		help_vals = append(help_vals, "Wait until the screen does not change for the specified number of frames")
+	}
+	{
+		var functionSignature func(uint, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_waitTitle, functionSignature)
+		defineFunction("waitTitle", funcType, funcValue)
+		help_keys = append(help_keys, "waitTitle(changedCells uint, stableFrames uint)")
+		help_vals = append(help_vals, "Wait for the title screen: the first stable screen after a post-load repaint of changedCells 8x8 cells (0=default)")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_sync, functionSignature)
+		defineFunction("sync", funcType, funcValue)
+		help_keys = append(help_keys, "sync()")
+		help_vals = append(help_vals, "Wait until the next frame has been emulated and rendered")
+	}
 	{
 		var functionSignature func(string)
 		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_script, functionSignature)
@@ -444,6 +1728,13 @@ func defineFunctions(w *eval.World) {
 		help_keys = append(help_keys, "script(scriptName string)")
 		help_vals = append(help_vals, "Load and evaluate the specified Go script")
 	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_scripts, functionSignature)
+		defineFunction("scripts", funcType, funcValue)
+		help_keys = append(help_keys, "scripts()")
+		help_vals = append(help_vals, "List the available scripts, which can be run via script(scriptName)")
+	}
 	{
 		var functionSignature func(string)
 		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_optionalScript, functionSignature)
@@ -456,7 +1747,371 @@ func defineFunctions(w *eval.World) {
 		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_screenshot, functionSignature)
 		defineFunction("screenshot", funcType, funcValue)
 		help_keys = append(help_keys, "screenshot(screenshotName string)")
-		help_vals = append(help_vals, "Take a screenshot of the current display")
+		help_vals = append(help_vals, "Take a screenshot of the current display (.png: an image with the border, otherwise the raw video memory; \"\": a timestamped PNG)")
+	}
+	{
+		var functionSignature func(string, uint, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_burstScreenshots, functionSignature)
+		defineFunction("burstScreenshots", funcType, funcValue)
+		help_keys = append(help_keys, "burstScreenshots(dir string, every uint, count uint)")
+		help_vals = append(help_vals, "Save count PNG screenshots into dir, one every the specified number of frames")
+	}
+	{
+		var functionSignature func(string) uint
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_sysvar, functionSignature)
+		defineFunction("sysvar", funcType, funcValue)
+		help_keys = append(help_keys, "sysvar(name string) uint")
+		help_vals = append(help_vals, `Get the value of a system variable (e.g: "LAST K")`)
+	}
+	{
+		var functionSignature func(uint) uint
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_peek, functionSignature)
+		defineFunction("peek", funcType, funcValue)
+		help_keys = append(help_keys, "peek(address uint) uint")
+		help_vals = append(help_vals, "Read a byte from memory")
+	}
+	{
+		var functionSignature func(uint, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_poke, functionSignature)
+		defineFunction("poke", funcType, funcValue)
+		help_keys = append(help_keys, "poke(address uint, value uint)")
+		help_vals = append(help_vals, "Write a byte to memory (e.g: poke(23693, 71)), writes to ROM are ignored")
+	}
+	{
+		var functionSignature func() bool
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_atPrompt, functionSignature)
+		defineFunction("atPrompt", funcType, funcValue)
+		help_keys = append(help_keys, "atPrompt() bool")
+		help_vals = append(help_vals, "Whether the BASIC editor is waiting for a command")
+	}
+	{
+		var functionSignature func(string, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_setSysvar, functionSignature)
+		defineFunction("setSysvar", funcType, funcValue)
+		help_keys = append(help_keys, "setSysvar(name string, value uint)")
+		help_vals = append(help_vals, "Set the value of a system variable")
+	}
+	{
+		var functionSignature func(string, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_runZ80Test, functionSignature)
+		defineFunction("runZ80Test", funcType, funcValue)
+		help_keys = append(help_keys, "runZ80Test(path string, address uint)")
+		help_vals = append(help_vals, "Run a raw Z80 program loaded at the address without the ROM, until it jumps to 0. At 0x100, it is a CP/M program (e.g: zexall) which prints via the BDOS")
+	}
+	{
+		var functionSignature func(string, bool)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_traceDiff, functionSignature)
+		defineFunction("traceDiff", funcType, funcValue)
+		help_keys = append(help_keys, "traceDiff(path string, ignoreUndocumentedFlags bool)")
+		help_vals = append(help_vals, "Run in lockstep with a reference instruction trace and report the first divergence")
+	}
+	{
+		var functionSignature func() string
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_gameDir, functionSignature)
+		defineFunction("gameDir", funcType, funcValue)
+		help_keys = append(help_keys, "gameDir() string")
+		help_vals = append(help_vals, "The directory for files specific to the loaded program (quick-saves, etc)")
+	}
+	{
+		var functionSignature func() string
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_machine, functionSignature)
+		defineFunction("machine", funcType, funcValue)
+		help_keys = append(help_keys, "machine() string")
+		help_vals = append(help_vals, "The emulated machine model")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_setMachine, functionSignature)
+		defineFunction("setMachine", funcType, funcValue)
+		help_keys = append(help_keys, "setMachine(model string)")
+		help_vals = append(help_vals, `Switch to a different machine model ("48k" or "128k", which requires the 128k ROM) and reset it`)
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_memmap, functionSignature)
+		defineFunction("memmap", funcType, funcValue)
+		help_keys = append(help_keys, "memmap()")
+		help_vals = append(help_vals, "Print the memory pages mapped into the address space")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_playInput, functionSignature)
+		defineFunction("playInput", funcType, funcValue)
+		help_keys = append(help_keys, "playInput(path string)")
+		help_vals = append(help_vals, "Play back key presses from an input script (lines: FRAME down|up KEY)")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_recordInput, functionSignature)
+		defineFunction("recordInput", funcType, funcValue)
+		help_keys = append(help_keys, "recordInput(path string)")
+		help_vals = append(help_vals, "Record the input of the running program into an RZX file, for replaying it with load(path)")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_stopRecordingInput, functionSignature)
+		defineFunction("stopRecordingInput", funcType, funcValue)
+		help_keys = append(help_keys, "stopRecordingInput()")
+		help_vals = append(help_vals, "Stop recording the input and write the RZX file")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_typeString, functionSignature)
+		defineFunction("typeString", funcType, funcValue)
+		help_keys = append(help_keys, "typeString(s string)")
+		help_vals = append(help_vals, "Type the string on the Spectrum keyboard (\\n is Enter), and wait until it has been typed")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_registers, functionSignature)
+		defineFunction("registers", funcType, funcValue)
+		help_keys = append(help_keys, "registers()")
+		help_vals = append(help_vals, "Print the CPU registers")
+	}
+	{
+		var functionSignature func(uint, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_disasm, functionSignature)
+		defineFunction("disasm", funcType, funcValue)
+		help_keys = append(help_keys, "disasm(address uint, count uint)")
+		help_vals = append(help_vals, "Disassemble the specified number of Z80 instructions")
+	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_breakpoint, functionSignature)
+		defineFunction("breakpoint", funcType, funcValue)
+		help_keys = append(help_keys, "breakpoint(address uint)")
+		help_vals = append(help_vals, "Pause the emulation when the CPU reaches the address, continue with resume()")
+	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_clearBreakpoint, functionSignature)
+		defineFunction("clearBreakpoint", funcType, funcValue)
+		help_keys = append(help_keys, "clearBreakpoint(address uint)")
+		help_vals = append(help_vals, "Remove the breakpoint at the address")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_clearBreakpoints, functionSignature)
+		defineFunction("clearBreakpoints", funcType, funcValue)
+		help_keys = append(help_keys, "clearBreakpoints()")
+		help_vals = append(help_vals, "Remove all breakpoints")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_breakpoints, functionSignature)
+		defineFunction("breakpoints", funcType, funcValue)
+		help_keys = append(help_keys, "breakpoints()")
+		help_vals = append(help_vals, "Print the addresses of the breakpoints")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_onBreakpoint, functionSignature)
+		defineFunction("onBreakpoint", funcType, funcValue)
+		help_keys = append(help_keys, "onBreakpoint(code string)")
+		help_vals = append(help_vals, "Run the Go code whenever a breakpoint or a watchpoint is hit (empty string: nothing)")
+	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_watch, functionSignature)
+		defineFunction("watch", funcType, funcValue)
+		help_keys = append(help_keys, "watch(address uint)")
+		help_vals = append(help_vals, "Pause the emulation when the CPU writes to the address")
+	}
+	{
+		var functionSignature func(uint, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_watchRange, functionSignature)
+		defineFunction("watchRange", funcType, funcValue)
+		help_keys = append(help_keys, "watchRange(from uint, to uint)")
+		help_vals = append(help_vals, "Pause the emulation when the CPU writes to the address range (inclusive)")
+	}
+	{
+		var functionSignature func(uint, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_watchReads, functionSignature)
+		defineFunction("watchReads", funcType, funcValue)
+		help_keys = append(help_keys, "watchReads(from uint, to uint)")
+		help_vals = append(help_vals, "Pause the emulation when the CPU reads or writes the address range, including instruction fetches")
+	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_unwatch, functionSignature)
+		defineFunction("unwatch", funcType, funcValue)
+		help_keys = append(help_keys, "unwatch(address uint)")
+		help_vals = append(help_vals, "Remove the watchpoint at the address")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_unwatchAll, functionSignature)
+		defineFunction("unwatchAll", funcType, funcValue)
+		help_keys = append(help_keys, "unwatchAll()")
+		help_vals = append(help_vals, "Remove all watchpoints")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_watches, functionSignature)
+		defineFunction("watches", funcType, funcValue)
+		help_keys = append(help_keys, "watches()")
+		help_vals = append(help_vals, "Print the watched address ranges")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_resume, functionSignature)
+		defineFunction("cont", funcType, funcValue)
+		help_keys = append(help_keys, "cont()")
+		help_vals = append(help_vals, "Continue the emulation after a breakpoint, same as resume()")
+	}
+	{
+		var functionSignature func() uint
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_interruptCount, functionSignature)
+		defineFunction("interruptCount", funcType, funcValue)
+		help_keys = append(help_keys, "interruptCount() uint")
+		help_vals = append(help_vals, "Number of interrupts accepted by the CPU since the last reset")
+	}
+	{
+		var functionSignature func(uint, uint) uint
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_memhash, functionSignature)
+		defineFunction("memhash", funcType, funcValue)
+		help_keys = append(help_keys, "memhash(address uint, length uint) uint")
+		help_vals = append(help_vals, "CRC-32 of the memory range, as seen through the active paging")
+	}
+	{
+		var functionSignature func(string, string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_applyIPS, functionSignature)
+		defineFunction("applyIPS", funcType, funcValue)
+		help_keys = append(help_keys, "applyIPS(path string, target string)")
+		help_vals = append(help_vals, "Apply an IPS patch to the 48k BASIC \"rom\" or to the \"ram\" (offset 0 is address 0x4000)")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_controls, functionSignature)
+		defineFunction("controls", funcType, funcValue)
+		help_keys = append(help_keys, "controls(name string)")
+		help_vals = append(help_vals, "Map the joystick to keys using a preset, or \"up,down,left,right,fire\" keys (\"kempston\": no mapping)")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_controlPresets, functionSignature)
+		defineFunction("controlPresets", funcType, funcValue)
+		help_keys = append(help_keys, "controlPresets()")
+		help_vals = append(help_vals, "List the joystick-to-keys presets")
+	}
+	{
+		var functionSignature func(string, string, bool)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_defineControls, functionSignature)
+		defineFunction("defineControls", funcType, funcValue)
+		help_keys = append(help_keys, "defineControls(name string, keys string, perGame bool)")
+		help_vals = append(help_vals, "Save a joystick-to-keys preset, for example defineControls(\"zx\", \"q,a,z,x,space\", true)")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_mappedKeys, functionSignature)
+		defineFunction("mappedKeys", funcType, funcValue)
+		help_keys = append(help_keys, "mappedKeys()")
+		help_vals = append(help_vals, "List the mapping of host keys to Spectrum keys")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_formats, functionSignature)
+		defineFunction("formats", funcType, funcValue)
+		help_keys = append(help_keys, "formats()")
+		help_vals = append(help_vals, "List the supported file formats")
+	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_stack, functionSignature)
+		defineFunction("stack", funcType, funcValue)
+		help_keys = append(help_keys, "stack(n uint)")
+		help_vals = append(help_vals, "Print the top n 16-bit words of the stack")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_tapeRewind, functionSignature)
+		defineFunction("tapeRewind", funcType, funcValue)
+		help_keys = append(help_keys, "tapeRewind()")
+		help_vals = append(help_vals, "Rewind the tape to the first block")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_tapePlay, functionSignature)
+		defineFunction("tapePlay", funcType, funcValue)
+		help_keys = append(help_keys, "tapePlay()")
+		help_vals = append(help_vals, "Start the tape from the beginning of the current block")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_tapeBlocks, functionSignature)
+		defineFunction("tapeBlocks", funcType, funcValue)
+		help_keys = append(help_keys, "tapeBlocks()")
+		help_vals = append(help_vals, "List the blocks of the tape, with the names from the header blocks")
+	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_tapeSeek, functionSignature)
+		defineFunction("tapeSeek", funcType, funcValue)
+		help_keys = append(help_keys, "tapeSeek(n uint)")
+		help_vals = append(help_vals, "Move the tape to the n-th block (counting from 1, as listed by tapeBlocks)")
+	}
+	{
+		var functionSignature func() float32
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_tapeProgress, functionSignature)
+		defineFunction("tapeProgress", funcType, funcValue)
+		help_keys = append(help_keys, "tapeProgress() float32")
+		help_vals = append(help_vals, "Tape loading progress in percent")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_tapeStatus, functionSignature)
+		defineFunction("tapeStatus", funcType, funcValue)
+		help_keys = append(help_keys, "tapeStatus()")
+		help_vals = append(help_vals, "Print the current tape block (counting from 1), its name, and the loading progress of the block and of the tape")
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_repaint, functionSignature)
+		defineFunction("repaint", funcType, funcValue)
+		help_keys = append(help_keys, "repaint()")
+		help_vals = append(help_vals, "Repaint the whole screen, including the border")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_repaintMode, functionSignature)
+		defineFunction("repaintMode", funcType, funcValue)
+		help_keys = append(help_keys, "repaintMode(mode string)")
+		help_vals = append(help_vals, "Repaint only the changed regions (\"changes\"), every frame (\"full\"), or during color-cycling effects (\"auto\")")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_palette, functionSignature)
+		defineFunction("palette", funcType, funcValue)
+		help_keys = append(help_keys, "palette(name string)")
+		help_vals = append(help_vals, "Change the display palette: \"standard\", \"grayscale\", \"green\" or \"custom\"")
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_loadPalette, functionSignature)
+		defineFunction("loadPalette", funcType, funcValue)
+		help_keys = append(help_keys, "loadPalette(path string)")
+		help_vals = append(help_vals, "Load the \"custom\" palette from a file of 16 R,G,B lines, and use it")
+	}
+	{
+		var functionSignature func(uint) string
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_screenAscii, functionSignature)
+		defineFunction("screenAscii", funcType, funcValue)
+		help_keys = append(help_keys, "screenAscii(width uint) string")
+		help_vals = append(help_vals, "The screen as ASCII art, 'width' characters wide (0=default width)")
+	}
+	{
+		var functionSignature func(uint, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_out, functionSignature)
+		defineFunction("out", funcType, funcValue)
+		help_keys = append(help_keys, "out(port uint, value uint)")
+		help_vals = append(help_vals, "Write to an I/O port (e.g: out(254, 2) sets the border to red)")
+	}
+	{
+		var functionSignature func(uint) uint
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_in, functionSignature)
+		defineFunction("in", funcType, funcValue)
+		help_keys = append(help_keys, "in(port uint) uint")
+		help_vals = append(help_vals, "Read from an I/O port")
 	}
 	{
 		var functionSignature func(string)
@@ -472,6 +2127,13 @@ func defineFunctions(w *eval.World) {
 		help_keys = append(help_keys, "acceleratedLoad(on bool)")
 		help_vals = append(help_vals, "Set accelerated tape load on/off")
 	}
+	{
+		var functionSignature func(uint, string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_extractBlock, functionSignature)
+		defineFunction("extractBlock", funcType, funcValue)
+		help_keys = append(help_keys, "extractBlock(n uint, path string)")
+		help_vals = append(help_vals, "Write the data of the n-th tape block (counting from 1) to a file")
+	}
 
 	for _, f := range functionsToAdd {
 		defineFunction(f.Name, f.Type, f.Value)
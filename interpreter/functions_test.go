@@ -0,0 +1,52 @@
+package interpreter
+
+import (
+	"bytes"
+	"github.com/guntars-lemps/gospeccy/formats"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractBlock(t *testing.T) {
+	// A header block followed by a data block
+	header := []byte{formats.TAP_BLOCK_HEADER, formats.TAP_FILE_CODE}
+	header = append(header, "screen    "...)
+	header = append(header, 0x00, 0x1b, 0x00, 0x40, 0x00, 0x80)
+	data := []byte{formats.TAP_BLOCK_DATA, 1, 2, 3}
+	var tapData []byte
+	for _, block := range [][]byte{header, data} {
+		checksum := byte(0)
+		for _, b := range block {
+			checksum ^= b
+		}
+		block = append(block, checksum)
+		tapData = append(tapData, byte(len(block)), byte(len(block)>>8))
+		tapData = append(tapData, block...)
+	}
+	tap, err := formats.NewTAP(tapData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tape := spectrum.NewTape(tap)
+
+	// The data block is listed by 'tapeBlocks' as the block 2
+	path := filepath.Join(t.TempDir(), "block.bin")
+	length, checksumOK, err := extractBlock(tape, 2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (length != 3) || !checksumOK {
+		t.Errorf("expected 3 bytes with a valid checksum, got %d bytes, checksum valid: %v", length, checksumOK)
+	}
+	if payload, err := os.ReadFile(path); (err != nil) || !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("unexpected contents of the file: %v, %v", payload, err)
+	}
+
+	for _, n := range []uint{0, 3} {
+		if _, _, err := extractBlock(tape, n, path); err == nil {
+			t.Errorf("block %d: expected an error", n)
+		}
+	}
+}
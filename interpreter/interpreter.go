@@ -32,6 +32,10 @@ var (
 
 var mutex sync.Mutex
 
+// Serializes the execution of commands arriving from multiple sources,
+// such as the console and a command file
+var runMutex sync.Mutex
+
 const (
 	SCRIPT_DIRECTORY = "scripts"
 	STARTUP_SCRIPT   = "startup"
@@ -49,6 +53,14 @@ func newInterpreter() *Interpreter {
 	}
 }
 
+// Returns the writer which receives the output of interpreter functions
+func (i *Interpreter) Stdout() io.Writer {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return stdout
+}
+
 // Returns the previous stdout
 func (i *Interpreter) SetStdout(newStdout io.Writer) io.Writer {
 	mutex.Lock()
@@ -65,11 +77,28 @@ func (i *Interpreter) Run(sourceCode string) error {
 		sourceCode = "help()"
 	}
 
+	runMutex.Lock()
+	defer runMutex.Unlock()
+
 	err := i.run(w, "", sourceCode)
 
 	return err
 }
 
+// Runs a command received from a source other than the console.
+// The command is echoed to stdout, prefixed with the name of the source,
+// so that it can be told apart from the commands typed by the user.
+func (i *Interpreter) RunFrom(sourceName string, sourceCode string) error {
+	sourceCode = strings.TrimSpace(sourceCode)
+	if sourceCode == "" {
+		return nil
+	}
+
+	fmt.Fprintf(i.Stdout(), "%s> %s\n", sourceName, sourceCode)
+
+	return i.Run(sourceCode)
+}
+
 type ast_state_t int
 
 const (
@@ -269,6 +298,33 @@ func runScript(w *eval.World, scriptName string, optional bool) error {
 	return err
 }
 
+// Parses the specified script without evaluating it.
+// Returns the syntax error, if any.
+func checkScript(scriptName string) error {
+	fileName := scriptName + ".go"
+
+	path, err := spectrum.ScriptPath(fileName)
+	if err != nil {
+		return err
+	}
+
+	scriptData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	fileSet := token.NewFileSet()
+	_, err = parseStmtList(fileSet, string(scriptData))
+	if err != nil {
+		_, err2 := parseDeclList(fileSet, string(scriptData))
+		if err2 == nil {
+			err = nil
+		}
+	}
+
+	return err
+}
+
 func Init(_app *spectrum.Application, _cmdLineArg string, _speccy *spectrum.Spectrum48k) {
 	app = _app
 	cmdLineArg = _cmdLineArg
@@ -277,6 +333,8 @@ func Init(_app *spectrum.Application, _cmdLineArg string, _speccy *spectrum.Spec
 	if w == nil {
 		w = eval.NewWorld()
 		defineFunctions(w)
+		speccy.AddBreakpointListener(breakpointHit)
+		speccy.AddWatchListener(watchHit)
 	}
 }
 
@@ -12,12 +12,14 @@ import (
 	"github.com/guntars-lemps/gospeccy/spectrum"
 	"github.com/scottferg/Go-SDL/sdl"
 	"github.com/scottferg/Go-SDL/ttf"
+	"image/png"
+	"os"
 	"reflect"
+	"strconv"
 	"sync"
+	"time"
 )
 
-const DEFAULT_JOYSTICK_ID = 0
-
 var (
 	// Synchronizes the shutdown of SDL event loops.
 	// When all SDL event loops terminate, we can call 'sdl.Quit()'.
@@ -26,7 +28,8 @@ var (
 	// The application renderer
 	r *SDLRenderer
 
-	joystick *sdl.Joystick
+	// The opened host joysticks, the first two are mapped to the joysticks of players 1 and 2
+	joysticks []*sdl.Joystick
 
 	composer *SDLSurfaceComposer
 )
@@ -49,16 +52,31 @@ const (
 type SDLRenderer struct {
 	app                           *spectrum.Application
 	speccy                        *spectrum.Spectrum48k
-	scale2x, fullscreen           bool
+	scale                         uint
+	fullscreen                    bool
 	consoleY                      int16
 	width, height                 int
 	appSurface, speccySurface     SDLSurfaceAccessor
 	toggling                      bool
 	appSurfaceCh, speccySurfaceCh chan cmd_newSurface
 
-	audio     bool
-	audioFreq uint
-	hqAudio   bool
+	// The position of the Spectrum display within the output surface.
+	// Non-zero if the display is centered in order to keep its aspect ratio.
+	x, y int
+
+	audio       bool
+	audioFreq   uint
+	hqAudio     bool
+	audioBuffer uint
+	volume      float64
+	ayStereo    AYStereoMode
+
+	recordings
+
+	console *SDLConsole
+
+	// Nil unless -tape-status is enabled
+	tapeStatus_orNil *tapeStatusOverlay
 }
 
 type wrapSurface struct {
@@ -73,56 +91,103 @@ func (s *wrapSurface) UpdatedRectsCh() <-chan []sdl.Rect {
 	return nil
 }
 
-func width(scale2x, fullscreen bool) int {
-	if fullscreen {
-		scale2x = true
+const (
+	MIN_SCALE = 1
+	MAX_SCALE = 4
+)
+
+// Returns the scale actually used for the display.
+// Fullscreen mode uses at least the 2x scale.
+func effectiveScale(scale uint, fullscreen bool) uint {
+	if fullscreen && (scale < 2) {
+		return 2
 	}
-	if scale2x {
-		return spectrum.TotalScreenWidth * 2
+	return scale
+}
+
+func width(scale uint, fullscreen bool) int {
+	return spectrum.TotalScreenWidth * int(effectiveScale(scale, fullscreen))
+}
+
+func height(scale uint, fullscreen bool) int {
+	return spectrum.TotalScreenHeight * int(effectiveScale(scale, fullscreen))
+}
+
+// The resolution of the desktop, determined before the first video mode is set
+var desktopWidth, desktopHeight int
+
+// Returns the dimensions of the output surface.
+// In fullscreen mode with -keep-aspect, the output surface has the resolution of the desktop
+// and the Spectrum display is centered in it, so that the monitor does not stretch the display.
+// The display is scaled by an integer factor, so it keeps its own aspect ratio
+// (5:4 including the border), not the 4:3 ratio of a TV picture.
+func outputSize(scale uint, fullscreen bool) (int, int) {
+	w, h := width(scale, fullscreen), height(scale, fullscreen)
+	if fullscreen && *KeepAspect && (desktopWidth >= w) && (desktopHeight >= h) {
+		return desktopWidth, desktopHeight
 	}
-	return spectrum.TotalScreenWidth
+	return w, h
 }
 
-func height(scale2x, fullscreen bool) int {
-	if fullscreen {
-		scale2x = true
+// Returns the position of the Spectrum display centered within the output surface
+func displayPosition(output SDLSurfaceAccessor, scale uint, fullscreen bool) (int, int) {
+	surface := output.GetSurface()
+	x := (int(surface.W) - width(scale, fullscreen)) / 2
+	y := (int(surface.H) - height(scale, fullscreen)) / 2
+	if x < 0 {
+		x = 0
 	}
-	if scale2x {
-		return spectrum.TotalScreenHeight * 2
+	if y < 0 {
+		y = 0
 	}
-	return spectrum.TotalScreenHeight
+	return x, y
 }
 
-func newAppSurface(app *spectrum.Application, scale2x, fullscreen bool) SDLSurfaceAccessor {
+func newAppSurface(app *spectrum.Application, scale uint, fullscreen bool) SDLSurfaceAccessor {
 	var sdlMode int64
 	if fullscreen {
-		scale2x = true
 		sdlMode |= sdl.FULLSCREEN
 		sdl.ShowCursor(sdl.DISABLE)
 	} else {
-		sdl.ShowCursor(sdl.ENABLE)
-		sdlMode |= sdl.SWSURFACE
+		if !*kempstonMouse {
+			sdl.ShowCursor(sdl.ENABLE)
+		}
+		if !*VSync {
+			sdlMode |= sdl.SWSURFACE
+		}
+	}
+	if *VSync {
+		// Flipping a double-buffered hardware surface waits for the vertical retrace
+		sdlMode |= sdl.DOUBLEBUF | sdl.HWSURFACE
 	}
 
 	<-composer.ReplaceOutputSurface(nil)
 
-	surface := sdl.SetVideoMode(int(width(scale2x, fullscreen)), int(height(scale2x, fullscreen)), 32, uint32(sdlMode))
+	w, h := outputSize(scale, fullscreen)
+	surface := sdl.SetVideoMode(w, h, 32, uint32(sdlMode))
 	if app.Verbose {
 		app.PrintfMsg("video surface resolution: %dx%d", surface.W, surface.H)
 	}
+	if *VSync && ((surface.Flags & sdl.DOUBLEBUF) == 0) {
+		// The composer falls back to updating the changed rectangles
+		app.PrintfMsg("vsync: a double-buffered video surface is not available")
+	}
+
+	// The margins around a centered display are black
+	if (int(surface.W) > width(scale, fullscreen)) || (int(surface.H) > height(scale, fullscreen)) {
+		surface.FillRect(nil, 0)
+		surface.UpdateRect(0, 0, 0, 0)
+	}
 
 	<-composer.ReplaceOutputSurface(surface)
 
 	return &wrapSurface{surface}
 }
 
-func newSpeccySurface(app *spectrum.Application, speccy *spectrum.Spectrum48k, scale2x, fullscreen bool) SDLSurfaceAccessor {
+func newSpeccySurface(app *spectrum.Application, speccy *spectrum.Spectrum48k, scale uint, fullscreen bool) SDLSurfaceAccessor {
 	var speccySurface SDLSurfaceAccessor
-	if fullscreen {
-		scale2x = true
-	}
-	if scale2x {
-		sdlScreen := NewSDLScreen2x(app)
+	if scale = effectiveScale(scale, fullscreen); scale > 1 {
+		sdlScreen := NewSDLScreenScaled(app, scale)
 		speccy.CommandChannel <- spectrum.Cmd_AddDisplay{sdlScreen}
 		speccySurface = sdlScreen
 	} else {
@@ -133,50 +198,59 @@ func newSpeccySurface(app *spectrum.Application, speccy *spectrum.Spectrum48k, s
 	return speccySurface
 }
 
-func newFont(scale2x, fullscreen bool) *ttf.Font {
-	if fullscreen {
-		scale2x = true
-	}
+func newFont(scale uint, fullscreen bool) (*ttf.Font, error) {
+	scale = effectiveScale(scale, fullscreen)
 
 	var font *ttf.Font
 	{
 		path, err := spectrum.FontPath("VeraMono.ttf")
 		if err != nil {
-			panic(err.Error())
+			return nil, err
 		}
-		if scale2x {
-			font = ttf.OpenFont(path, 12)
+		if scale > 1 {
+			font = ttf.OpenFont(path, 6*int(scale))
 		} else {
 			font = ttf.OpenFont(path, 10)
 		}
 		if font == nil {
-			panic(sdl.GetError())
+			return nil, errors.New(sdl.GetError())
 		}
 	}
 
-	return font
+	return font, nil
 }
 
-func NewSDLRenderer(app *spectrum.Application, speccy *spectrum.Spectrum48k, scale2x, fullscreen bool, audio, hqAudio bool, audioFreq uint) *SDLRenderer {
-	width := width(scale2x, fullscreen)
-	height := height(scale2x, fullscreen)
+func NewSDLRenderer(app *spectrum.Application, speccy *spectrum.Spectrum48k, scale uint, fullscreen bool, audio, hqAudio bool, audioFreq, audioBuffer uint, volume float64, ayStereo AYStereoMode) *SDLRenderer {
+	width := width(scale, fullscreen)
+	height := height(scale, fullscreen)
 	r := &SDLRenderer{
 		app:             app,
 		speccy:          speccy,
-		scale2x:         scale2x,
+		scale:           scale,
 		fullscreen:      fullscreen,
 		appSurfaceCh:    make(chan cmd_newSurface),
 		speccySurfaceCh: make(chan cmd_newSurface),
-		appSurface:      newAppSurface(app, scale2x, fullscreen),
-		speccySurface:   newSpeccySurface(app, speccy, scale2x, fullscreen),
+		appSurface:      newAppSurface(app, scale, fullscreen),
+		speccySurface:   newSpeccySurface(app, speccy, scale, fullscreen),
 		width:           width,
 		height:          height,
 		audio:           audio,
 		audioFreq:       audioFreq,
 		hqAudio:         hqAudio,
+		audioBuffer:     audioBuffer,
+		volume:          clampVolume(volume),
+		ayStereo:        ayStereo,
+		recordings:      recordings{app: app, speccy: speccy},
+		console:         NewSDLConsole(app),
 	}
+	r.x, r.y = displayPosition(r.appSurface, scale, fullscreen)
+
+	composer.AddInputSurface(r.speccySurface.GetSurface(), r.x, r.y, r.speccySurface.UpdatedRectsCh())
 
-	composer.AddInputSurface(r.speccySurface.GetSurface(), 0, 0, r.speccySurface.UpdatedRectsCh())
+	if *TapeStatus {
+		r.tapeStatus_orNil = newTapeStatusOverlay(speccy, scale, fullscreen, r.x, r.y, width)
+		go tapeStatusLoop(app.NewEventLoop(), r.tapeStatus_orNil)
+	}
 
 	go r.loop()
 	return r
@@ -186,56 +260,92 @@ func (r *SDLRenderer) Terminated() bool {
 	return r.app.TerminationInProgress() || r.app.Terminated()
 }
 
-func (r *SDLRenderer) ResizeVideo(scale2x, fullscreen bool) {
-	finished := make(chan byte)
-	r.speccy.CommandChannel <- spectrum.Cmd_CloseAllDisplays{finished}
-	<-finished
+func (r *SDLRenderer) ResizeVideo(scale uint, fullscreen bool) {
+	// The console and the tape status would be removed from the composer together with the Spectrum screen
+	r.console.Hide()
+	if r.tapeStatus_orNil != nil {
+		r.tapeStatus_orNil.suspend()
+	}
 
-	if r.scale2x != scale2x {
-		if scale2x {
-			// 1x --> 2x
-			y := int16(r.height) - r.consoleY
-			r.consoleY = int16(2*r.height) - 2*y
-		} else {
-			// 2x --> 1x
-			y := int16(r.height) - r.consoleY
-			r.consoleY = int16(r.height/2) - y/2
-		}
+	// Other displays, such as a video recorder, are kept
+	if display, ok := r.speccySurface.(spectrum.DisplayReceiver); ok {
+		finished := make(chan byte)
+		r.speccy.CommandChannel <- spectrum.Cmd_RemoveDisplay{display, finished}
+		<-finished
+	}
+
+	oldScale := effectiveScale(r.scale, r.fullscreen)
+	newScale := effectiveScale(scale, fullscreen)
+	if oldScale != newScale {
+		// Keep the console at the same relative distance from the bottom of the window
+		y := int(r.height) - int(r.consoleY)
+		r.consoleY = int16(int(r.height)*int(newScale)/int(oldScale) - y*int(newScale)/int(oldScale))
 	}
 
-	r.width = width(scale2x, fullscreen)
-	r.height = height(scale2x, fullscreen)
-	r.scale2x = scale2x
+	r.width = width(scale, fullscreen)
+	r.height = height(scale, fullscreen)
+	r.scale = scale
 	r.fullscreen = fullscreen
 
 	done := make(chan bool)
-	r.appSurfaceCh <- cmd_newSurface{newAppSurface(r.app, scale2x, fullscreen), done}
+	appSurface := newAppSurface(r.app, scale, fullscreen)
+	r.x, r.y = displayPosition(appSurface, scale, fullscreen)
+	r.appSurfaceCh <- cmd_newSurface{appSurface, done}
 	<-done
 
-	r.speccySurfaceCh <- cmd_newSurface{newSpeccySurface(r.app, r.speccy, scale2x, fullscreen), done}
+	r.speccySurfaceCh <- cmd_newSurface{newSpeccySurface(r.app, r.speccy, scale, fullscreen), done}
 	<-done
+
+	if r.tapeStatus_orNil != nil {
+		r.tapeStatus_orNil.resume(scale, fullscreen, r.x, r.y, r.width)
+	}
+}
+
+// Shows the console if it is hidden, and hides it if it is visible
+func (r *SDLRenderer) ToggleConsole() error {
+	if r.console.Visible() {
+		r.console.Hide()
+		return nil
+	}
+	return r.console.Show(r.scale, r.fullscreen, r.x, r.y, r.width, r.height)
+}
+
+// Switches to the next display scale, wrapping from MAX_SCALE back to MIN_SCALE
+func (r *SDLRenderer) CycleScale() {
+	scale := r.scale + 1
+	if scale > MAX_SCALE {
+		scale = MIN_SCALE
+	}
+	r.ResizeVideo(scale, r.fullscreen)
 }
 
 func (r *SDLRenderer) ShowPaintedRegions(enable bool) {
 	composer.ShowPaintedRegions(enable)
 }
 
-func (r *SDLRenderer) setAudioParameters(enable, hqAudio bool, freq uint) {
+func (r *SDLRenderer) EnableDisplay(enable bool) {
+	composer.EnableOutput(enable)
+}
+
+func (r *SDLRenderer) setAudioParameters(enable, hqAudio bool, freq, bufferSize uint) {
 	r.audio = enable
 	r.hqAudio = hqAudio
 	r.audioFreq = freq
-
-	finished := make(chan byte)
-	r.speccy.CommandChannel <- spectrum.Cmd_CloseAllAudioReceivers{finished}
-	<-finished
+	r.audioBuffer = bufferSize
+
+	// Other audio receivers, such as a WAV recorder, are kept
+	sdlAudio_mutex.Lock()
+	oldAudio := sdlAudio_instance
+	sdlAudio_mutex.Unlock()
+	if oldAudio != nil {
+		finished := make(chan byte)
+		r.speccy.CommandChannel <- spectrum.Cmd_RemoveAudioReceiver{oldAudio, finished}
+		<-finished
+	}
 
 	if enable {
-		audio, err := NewSDLAudio(r.app, freq, hqAudio)
+		audio, err := NewSDLAudio(r.app, freq, hqAudio, bufferSize, r.volume, r.ayStereo)
 		if err == nil {
-			finished := make(chan byte)
-			r.speccy.CommandChannel <- spectrum.Cmd_CloseAllAudioReceivers{finished}
-			<-finished
-
 			r.speccy.CommandChannel <- spectrum.Cmd_AddAudioReceiver{audio}
 		} else {
 			r.app.PrintfMsg("%s", err)
@@ -245,19 +355,160 @@ func (r *SDLRenderer) setAudioParameters(enable, hqAudio bool, freq uint) {
 }
 
 func (r *SDLRenderer) EnableAudio(enable bool) {
-	r.setAudioParameters(enable, r.hqAudio, r.audioFreq)
+	r.setAudioParameters(enable, r.hqAudio, r.audioFreq, r.audioBuffer)
 }
 
 func (r *SDLRenderer) SetAudioFreq(freq uint) {
 	if r.audioFreq != freq {
-		r.setAudioParameters(r.audio, r.hqAudio, freq)
+		r.setAudioParameters(r.audio, r.hqAudio, freq, r.audioBuffer)
 	}
 }
 
 func (r *SDLRenderer) SetAudioQuality(hqAudio bool) {
 	if r.hqAudio != hqAudio {
-		r.setAudioParameters(r.audio, hqAudio, r.audioFreq)
+		r.setAudioParameters(r.audio, hqAudio, r.audioFreq, r.audioBuffer)
+	}
+}
+
+func (r *SDLRenderer) SetAudioBuffer(samples uint) error {
+	if err := checkAudioBufferSize(samples); err != nil {
+		return err
+	}
+	if r.audioBuffer != samples {
+		r.setAudioParameters(r.audio, r.hqAudio, r.audioFreq, samples)
 	}
+	return nil
+}
+
+// Sets the master volume of the audio output (0.0 ... 1.0).
+// Out-of-range values are clamped. The volume of a WAV recording is not affected.
+func (r *SDLRenderer) SetVolume(volume float64) {
+	r.volume = clampVolume(volume)
+
+	sdlAudio_mutex.Lock()
+	audio := sdlAudio_instance
+	sdlAudio_mutex.Unlock()
+	if audio != nil {
+		audio.SetVolume(r.volume)
+	}
+}
+
+func (r *SDLRenderer) Volume() float64 {
+	return r.volume
+}
+
+// Starts writing the audio output to a WAV file, at the current audio frequency.
+// A recording which is already in progress is stopped.
+func (r *SDLRenderer) RecordAudio(path string) error {
+	return r.recordAudio(path, r.audioFreq, r.hqAudio)
+}
+
+// The audio and video recordings of a user interface
+type recordings struct {
+	app    *spectrum.Application
+	speccy *spectrum.Spectrum48k
+
+	// The active audio recording, or nil
+	wavRecorder *WAVRecorder
+
+	// The active video recording, or nil
+	gifRecorder *GIFRecorder
+}
+
+// Starts writing the audio output to a WAV file.
+// A recording which is already in progress is stopped.
+func (r *recordings) recordAudio(path string, freq uint, hqAudio bool) error {
+	r.StopRecordingAudio()
+
+	rec, err := NewWAVRecorder(r.app, path, freq, hqAudio)
+	if err != nil {
+		return err
+	}
+
+	r.speccy.CommandChannel <- spectrum.Cmd_AddAudioReceiver{rec}
+	r.wavRecorder = rec
+
+	return nil
+}
+
+// Stops the audio recording and finalizes the WAV file
+func (r *recordings) StopRecordingAudio() error {
+	if r.wavRecorder == nil {
+		return errors.New("no audio recording is in progress")
+	}
+
+	finished := make(chan byte)
+	r.speccy.CommandChannel <- spectrum.Cmd_RemoveAudioReceiver{r.wavRecorder, finished}
+	<-finished
+
+	if r.app.Verbose {
+		r.app.PrintfMsg("stopped recording audio to \"%s\"", r.wavRecorder.Path())
+	}
+	r.wavRecorder = nil
+
+	return nil
+}
+
+// Starts recording the display to an animated GIF file.
+// After each recorded frame, 'frameSkip' frames are skipped.
+// A recording which is already in progress is stopped.
+func (r *recordings) RecordVideo(path string, frameSkip uint) error {
+	r.StopRecordingVideo()
+
+	rec, err := NewGIFRecorder(r.app, r.speccy, path, frameSkip)
+	if err != nil {
+		return err
+	}
+
+	r.speccy.CommandChannel <- spectrum.Cmd_AddDisplay{rec}
+	r.gifRecorder = rec
+
+	return nil
+}
+
+// Stops the video recording and writes the GIF file
+func (r *recordings) StopRecordingVideo() error {
+	if r.gifRecorder == nil {
+		return errors.New("no video recording is in progress")
+	}
+
+	finished := make(chan byte)
+	r.speccy.CommandChannel <- spectrum.Cmd_RemoveDisplay{r.gifRecorder, finished}
+	<-finished
+
+	if r.app.Verbose {
+		r.app.PrintfMsg("stopped recording video to \"%s\"", r.gifRecorder.Path())
+	}
+	r.gifRecorder = nil
+
+	return nil
+}
+
+// Writes the Spectrum screen, including the border, to a PNG file.
+// The image is always unscaled. If 'path' is empty, a timestamped name is used.
+func (r *SDLRenderer) Screenshot(path string) error {
+	if path == "" {
+		path = spectrum.DefaultScreenshotPath()
+	}
+
+	// The composer owns the surfaces, so this is safe even while the video is being resized
+	img := <-composer.CaptureScreen()
+	if img == nil {
+		return errors.New("screenshot: no display")
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(file, img)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
 }
 
 func (r *SDLRenderer) loop() {
@@ -286,7 +537,7 @@ func (r *SDLRenderer) loop() {
 			r.speccySurface.GetSurface().Free()
 			r.speccySurface = cmd.surface
 
-			composer.AddInputSurface(r.speccySurface.GetSurface(), 0, 0, r.speccySurface.UpdatedRectsCh())
+			composer.AddInputSurface(r.speccySurface.GetSurface(), r.x, r.y, r.speccySurface.UpdatedRectsCh())
 
 			cmd.done <- true
 
@@ -313,10 +564,75 @@ func (i *interpreterAccess_t) Run(sourceCode string) error {
 	return err
 }
 
+// Maps the value of a joystick axis to joystick directions, which drive the selected joystick interface.
+// The value is multiplied by the sensitivity, then values within the deadzone
+// (-deadzone ... +deadzone) are treated as the center position.
+// A move from one extreme to the other releases the opposite direction,
+// even if no centered value has been reported in between.
+func joystickAxis(joystick *spectrum.Joystick, value int16, deadzone uint, sensitivity float64, negative, positive uint) {
+	scaled := float64(value) * sensitivity
+	switch {
+	case scaled > float64(deadzone):
+		joystick.KempstonUp(negative)
+		joystick.KempstonDown(positive)
+	case scaled < -float64(deadzone):
+		joystick.KempstonUp(positive)
+		joystick.KempstonDown(negative)
+	default:
+		joystick.KempstonUp(negative)
+		joystick.KempstonUp(positive)
+	}
+}
+
+// Returns the emulated joystick driven by the host joystick with the specified index,
+// or nil if the host joystick is not mapped to a player
+func playerJoystick(speccy *spectrum.Spectrum48k, which uint8) *spectrum.Joystick {
+	switch which {
+	case 0:
+		return speccy.Joystick
+	case 1:
+		return speccy.Joystick2
+	}
+	return nil
+}
+
+var mouseButtons = map[uint8]uint{
+	sdl.BUTTON_LEFT:   spectrum.MOUSE_LEFT,
+	sdl.BUTTON_RIGHT:  spectrum.MOUSE_RIGHT,
+	sdl.BUTTON_MIDDLE: spectrum.MOUSE_MIDDLE,
+}
+
+// While the rewind key is held, the emulation is rewound at this rate
+const rewindRepeatInterval = 40 * time.Millisecond
+
+func rewindWhileHeld(speccy *spectrum.Spectrum48k, stop <-chan bool) {
+	ticker := time.NewTicker(rewindRepeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			speccy.CommandChannel <- spectrum.Cmd_Rewind{Frames: 2 * spectrum.REWIND_INTERVAL}
+		}
+	}
+}
+
 // A Go routine for processing SDL events.
-func sdlEventLoop(app *spectrum.Application, speccy *spectrum.Spectrum48k, verboseInput bool) {
+//
+// Files dragged onto the window are not loaded: SDL 1.2 does not deliver drag-and-drop
+// events (SDL_DROPFILE appeared in SDL 2.0). At runtime, a program can be loaded
+// with the console function load("PATH"), or with the HTTP API (-http, POST /load?path=PATH).
+func sdlEventLoop(app *spectrum.Application, speccy *spectrum.Spectrum48k, verboseInput bool, turboKey, rewindKey string, joystickDeadzone uint, joystickSensitivity float64) {
 	evtLoop := app.NewEventLoop()
 
+	// Whether the turbo key is being held
+	turbo := false
+
+	// Non-nil while the rewind key is being held
+	var stopRewind chan bool
+
 	shutdown.Add(1)
 	for {
 		select {
@@ -342,37 +658,46 @@ func sdlEventLoop(app *spectrum.Application, speccy *spectrum.Spectrum48k, verbo
 
 			case sdl.JoyAxisEvent:
 				if verboseInput {
-					app.PrintfMsg("[Joystick] Axis: %d, Value: %d", e.Axis, e.Value)
+					app.PrintfMsg("[Joystick %d] Axis: %d, Value: %d", e.Which, e.Axis, e.Value)
+				}
+				joystick := playerJoystick(speccy, e.Which)
+				if joystick == nil {
+					break
 				}
 				if e.Axis == 0 {
-					if e.Value > 0 {
-						speccy.Joystick.KempstonDown(spectrum.KEMPSTON_RIGHT)
-					} else if e.Value < 0 {
-						speccy.Joystick.KempstonDown(spectrum.KEMPSTON_LEFT)
-					} else {
-						speccy.Joystick.KempstonUp(spectrum.KEMPSTON_RIGHT)
-						speccy.Joystick.KempstonUp(spectrum.KEMPSTON_LEFT)
-					}
+					joystickAxis(joystick, e.Value, joystickDeadzone, joystickSensitivity, spectrum.KEMPSTON_LEFT, spectrum.KEMPSTON_RIGHT)
 				} else if e.Axis == 1 {
-					if e.Value > 0 {
-						speccy.Joystick.KempstonDown(spectrum.KEMPSTON_UP)
-					} else if e.Value < 0 {
-						speccy.Joystick.KempstonDown(spectrum.KEMPSTON_DOWN)
-					} else {
-						speccy.Joystick.KempstonUp(spectrum.KEMPSTON_UP)
-						speccy.Joystick.KempstonUp(spectrum.KEMPSTON_DOWN)
-					}
+					joystickAxis(joystick, e.Value, joystickDeadzone, joystickSensitivity, spectrum.KEMPSTON_DOWN, spectrum.KEMPSTON_UP)
 				}
 
 			case sdl.JoyButtonEvent:
 				if verboseInput {
-					app.PrintfMsg("[Joystick] Button: %d, State: %d", e.Button, e.State)
+					app.PrintfMsg("[Joystick %d] Button: %d, State: %d", e.Which, e.Button, e.State)
 				}
-				if e.Button == 0 {
+				joystick := playerJoystick(speccy, e.Which)
+				if (joystick != nil) && (e.Button == 0) {
 					if e.State > 0 {
-						speccy.Joystick.KempstonDown(spectrum.KEMPSTON_FIRE)
+						joystick.KempstonDown(spectrum.KEMPSTON_FIRE)
+					} else {
+						joystick.KempstonUp(spectrum.KEMPSTON_FIRE)
+					}
+				}
+
+			case sdl.MouseMotionEvent:
+				if verboseInput {
+					app.PrintfMsg("[Mouse] Xrel: %d, Yrel: %d", e.Xrel, e.Yrel)
+				}
+				speccy.Mouse.Move(int(e.Xrel), int(e.Yrel))
+
+			case sdl.MouseButtonEvent:
+				if verboseInput {
+					app.PrintfMsg("[Mouse] Button: %d, Type: %d", e.Button, e.Type)
+				}
+				if button, ok := mouseButtons[e.Button]; ok {
+					if e.Type == sdl.MOUSEBUTTONDOWN {
+						speccy.Mouse.ButtonDown(button)
 					} else {
-						speccy.Joystick.KempstonUp(spectrum.KEMPSTON_FIRE)
+						speccy.Mouse.ButtonUp(button)
 					}
 				}
 
@@ -386,16 +711,139 @@ func sdlEventLoop(app *spectrum.Application, speccy *spectrum.Spectrum48k, verbo
 					app.PrintfMsg("Scancode: %02x Sym: %08x Mod: %04x Unicode: %04x\n", e.Keysym.Scancode, e.Keysym.Sym, e.Keysym.Mod, e.Keysym.Unicode)
 				}
 
-				if (keyName == "escape") && (e.Type == sdl.KEYDOWN) {
+				if (keyName == "f10") && (e.Type == sdl.KEYDOWN) {
+					go func() {
+						mutex.Lock()
+						err := r.ToggleConsole()
+						mutex.Unlock()
+						if err != nil {
+							app.PrintfMsg("console: %s", err)
+						}
+					}()
+
+				} else if r.console.Visible() && (e.Type == sdl.KEYDOWN) {
+					// Keys typed into the console are not passed to the Spectrum.
+					// Key releases are passed through, so that no key remains pressed.
+					if keyName == "escape" {
+						go func() {
+							mutex.Lock()
+							r.console.Hide()
+							mutex.Unlock()
+						}()
+					} else {
+						r.console.KeyDown(keyName, e.Keysym.Unicode)
+					}
+
+				} else if (keyName == "escape") && (e.Type == sdl.KEYDOWN) {
 					if app.Verbose {
 						app.PrintfMsg("escape key -> request[exit the application]")
 					}
 					app.RequestExit()
 
+				} else if (keyName == "f12") && (e.Type == sdl.KEYDOWN) {
+					go func() {
+						path := spectrum.DefaultScreenshotPath()
+						if err := r.Screenshot(path); err != nil {
+							app.PrintfMsg("%s", err)
+						} else {
+							app.PrintfMsg("wrote screenshot \"%s\"", path)
+						}
+					}()
+
+				} else if (keyName == "f6") && (e.Type == sdl.KEYDOWN) {
+					go func() {
+						enabled := make(chan bool)
+						speccy.CommandChannel <- spectrum.Cmd_ToggleAcceleratedLoad{enabled}
+						if <-enabled {
+							app.PrintfMsg("accelerated tape loading: on")
+						} else {
+							app.PrintfMsg("accelerated tape loading: off")
+						}
+					}()
+
+				} else if (keyName == "f7") && (e.Type == sdl.KEYDOWN) {
+					go func() {
+						mutex.Lock()
+						r.CycleScale()
+						scale := r.scale
+						mutex.Unlock()
+						app.PrintfMsg("display scale: %dx", scale)
+					}()
+
+				} else if (keyName == "f5") && (e.Type == sdl.KEYDOWN) {
+					if speccy.IsPaused() {
+						speccy.Resume()
+					} else {
+						speccy.Pause()
+					}
+
+				} else if ((keyName == "page up") || (keyName == "page down")) && (e.Type == sdl.KEYDOWN) {
+					step := VOLUME_STEP
+					if keyName == "page down" {
+						step = -VOLUME_STEP
+					}
+					go func() {
+						mutex.Lock()
+						r.SetVolume(r.Volume() + step)
+						volume := r.Volume()
+						mutex.Unlock()
+						app.PrintfMsg("volume: %.0f%%", 100*volume)
+					}()
+
+				} else if (e.Type == sdl.KEYDOWN) && ((e.Keysym.Mod & sdl.KMOD_ALT) != 0) && (len(keyName) == 1) && (keyName[0] >= '0') && (keyName[0] <= '9') {
+					// Alt+Shift+number saves the state into a quick-save slot, Alt+number restores it.
+					// Shift+number alone is left to the Spectrum (EDIT, cursor keys, DELETE).
+					slot := int(keyName[0] - '0')
+					save := (e.Keysym.Mod & sdl.KMOD_SHIFT) != 0
+					go func() {
+						if save {
+							if err := speccy.SaveState(slot); err != nil {
+								app.PrintfMsg("%s", err)
+							} else {
+								app.PrintfMsg("saved state into slot %d", slot)
+							}
+						} else {
+							if err := speccy.LoadState(slot); err != nil {
+								app.PrintfMsg("%s", err)
+							} else {
+								app.PrintfMsg("loaded state from slot %d", slot)
+							}
+						}
+					}()
+
+				} else if (turboKey != "") && (keyName == turboKey) {
+					switch e.Type {
+					case sdl.KEYDOWN:
+						if !turbo {
+							turbo = true
+							speccy.CommandChannel <- spectrum.Cmd_SetWarp{true}
+						}
+					case sdl.KEYUP:
+						if turbo {
+							turbo = false
+							speccy.CommandChannel <- spectrum.Cmd_SetWarp{false}
+						}
+					}
+
+				} else if (rewindKey != "") && (keyName == rewindKey) {
+					switch e.Type {
+					case sdl.KEYDOWN:
+						if stopRewind == nil {
+							stopRewind = make(chan bool)
+							go rewindWhileHeld(speccy, stopRewind)
+						}
+					case sdl.KEYUP:
+						if stopRewind != nil {
+							close(stopRewind)
+							stopRewind = nil
+						}
+					}
+
 				} else {
 					sequence, haveMapping := spectrum.SDL_KeyMap[keyName]
 
-					if haveMapping {
+					// While paused, key releases are still delivered so that no key remains pressed
+					if haveMapping && !(speccy.IsPaused() && (e.Type == sdl.KEYDOWN)) {
 						switch e.Type {
 						case sdl.KEYDOWN:
 							// Normal order
@@ -415,6 +863,14 @@ func sdlEventLoop(app *spectrum.Application, speccy *spectrum.Spectrum48k, verbo
 	}
 }
 
+// Updates the display to reflect whether the emulation is paused.
+// Called by the emulator whenever the emulation is paused or resumed, see Spectrum48k.AddPauseListener.
+func showPaused(paused bool) {
+	if *PauseDim {
+		composer.Dim(paused)
+	}
+}
+
 func initSDLSubSystems(app *spectrum.Application) error {
 	if sdl.Init(sdl.INIT_VIDEO|sdl.INIT_AUDIO|sdl.INIT_JOYSTICK) != 0 {
 		return errors.New(sdl.GetError())
@@ -422,21 +878,28 @@ func initSDLSubSystems(app *spectrum.Application) error {
 	if ttf.Init() != 0 {
 		return errors.New(sdl.GetError())
 	}
-	if sdl.NumJoysticks() > 0 {
-		// Open joystick
-		joystick = sdl.JoystickOpen(DEFAULT_JOYSTICK_ID)
-		if joystick != nil {
-			if app.Verbose {
-				app.PrintfMsg("Opened Joystick %d", DEFAULT_JOYSTICK_ID)
-				app.PrintfMsg("Name: %s", sdl.JoystickName(DEFAULT_JOYSTICK_ID))
-				app.PrintfMsg("Number of Axes: %d", joystick.NumAxes())
-				app.PrintfMsg("Number of Buttons: %d", joystick.NumButtons())
-				app.PrintfMsg("Number of Balls: %d", joystick.NumBalls())
+	// Open all joysticks connected at startup. SDL 1.2 does not report joysticks connected later.
+	for id := 0; id < sdl.NumJoysticks(); id++ {
+		joystick := sdl.JoystickOpen(id)
+		if joystick == nil {
+			return fmt.Errorf("Couldn't open Joystick %d!", id)
+		}
+		joysticks = append(joysticks, joystick)
+
+		if app.Verbose {
+			app.PrintfMsg("Opened Joystick %d", id)
+			app.PrintfMsg("Name: %s", sdl.JoystickName(id))
+			app.PrintfMsg("Number of Axes: %d", joystick.NumAxes())
+			app.PrintfMsg("Number of Buttons: %d", joystick.NumButtons())
+			app.PrintfMsg("Number of Balls: %d", joystick.NumBalls())
+			if id >= 2 {
+				app.PrintfMsg("Joystick %d is not mapped to a player", id)
 			}
-		} else {
-			return errors.New("Couldn't open Joystick!")
 		}
 	}
+	if info := sdl.GetVideoInfo(); info != nil {
+		desktopWidth, desktopHeight = int(info.Current_w), int(info.Current_h)
+	}
 	sdl.WM_SetCaption("GoSpeccy - ZX Spectrum Emulator", "")
 	sdl.EnableUNICODE(1)
 	return nil
@@ -444,23 +907,72 @@ func initSDLSubSystems(app *spectrum.Application) error {
 
 var (
 	enableSDL          = flag.Bool("enable-sdl", true, "Enable SDL user interface")
-	Scale2x            = flag.Bool("2x", false, "2x display scaler")
-	Fullscreen         = flag.Bool("fullscreen", false, "Fullscreen (enable 2x scaler by default)")
+	Headless           = flag.Bool("headless", false, "Run without a window and without audio output. The frames and the audio are produced, so -record-audio and -record-video work")
+	Scale              = flag.Uint("scale", 1, "Display scale (1-4), can be changed with F7")
+	Fullscreen         = flag.Bool("fullscreen", false, "Fullscreen (at least 2x scale)")
+	VSync              = flag.Bool("vsync", false, "Present frames by flipping a double-buffered hardware surface, if available (disables -show-paint)")
+	KeepAspect         = flag.Bool("keep-aspect", false, "In fullscreen, center the display at an integer scale on the desktop resolution, so that the monitor does not stretch it")
 	Audio              = flag.Bool("audio", true, "Enable or disable audio")
 	AudioFreq          = flag.Uint("audio-freq", PLAYBACK_FREQUENCY, "Audio playback frequency (units: Hz)")
+	Volume             = flag.Float64("volume", 1.0, "Master volume (0.0-1.0), can be changed with PageUp/PageDown")
+	AYStereo           = flag.String("ay-stereo", "mono", "Placement of the AY channels: mono, abc or acb (stereo)")
+	AudioBuffer        = flag.Uint("audio-buffer", 0, "SDL audio buffer size in samples, a power of two (0: default). Smaller is lower latency, larger prevents crackling on slow machines")
 	HQAudio            = flag.Bool("audio-hq", true, "Enable or disable higher-quality audio")
 	ShowPaintedRegions = flag.Bool("show-paint", false, "Show painted display regions")
+	Display            = flag.Bool("display", true, "Update the window with the emulated display (the emulation runs even if disabled)")
+	TapeStatus         = flag.Bool("tape-status", false, "Show the progress of the tape at the top of the display while the tape is playing")
 	verboseInput       = flag.Bool("verbose-input", false, "Enable debugging messages (input device events)")
+	PauseDim           = flag.Bool("pause-dim", false, "Dim the display while the emulation is paused")
+	JoystickDeadzone   = flag.Uint("joystick-deadzone", 8000, "Joystick axis values from -N to N are treated as the center position (max: 32767)")
+	AxisSensitivity    = flag.Float64("joystick-sensitivity", 1.0, "Joystick axis values are multiplied by this factor before applying the deadzone, values above 1 react to smaller movements")
+	kempstonMouse      = flag.Bool("kempston-mouse", false, "Emulate the Kempston mouse (the window grabs the mouse)")
+	turboKey           = flag.String("turbo-key", "tab", "While this key is held, run the emulation at maximum speed (empty string: disabled)")
+	rewindKey          = flag.String("rewind-key", "f9", "While this key is held, rewind the emulation (empty string: disabled)")
+	RecordAudio        = flag.String("record-audio", "", "Write the audio output to the specified WAV file")
+	RecordVideo        = flag.String("record-video", "", "Record the display to the specified animated GIF file")
+	RecordVideoSkip    = flag.Uint("record-video-skip", 1, "The number of frames skipped after each frame recorded to the GIF file")
 )
 
+// The -2x flag is a shorthand for -scale=2
+type scale2xFlag struct{}
+
+func (f scale2xFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f scale2xFlag) String() string {
+	return "false"
+}
+
+func (f scale2xFlag) Set(value string) error {
+	enable, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if enable {
+		*Scale = 2
+	} else if *Scale == 2 {
+		*Scale = 1
+	}
+	return nil
+}
+
 func init() {
+	flag.Var(scale2xFlag{}, "2x", "2x display scaler (same as -scale=2)")
+
 	uiSettings = &InitialSettings{
-		scale2x:            Scale2x,
+		scale:              Scale,
 		fullscreen:         Fullscreen,
 		showPaintedRegions: ShowPaintedRegions,
+		display:            Display,
 		audio:              Audio,
 		audioFreq:          AudioFreq,
+		audioBuffer:        AudioBuffer,
+		volume:             Volume,
 		hqAudio:            HQAudio,
+		recordAudio:        RecordAudio,
+		recordVideo:        RecordVideo,
+		recordVideoSkip:    RecordVideoSkip,
 	}
 }
 
@@ -478,18 +990,55 @@ func Main() {
 	if !*enableSDL {
 		return
 	}
+	if *Headless {
+		mainHeadless(app, speccy, init_waitGroup)
+		return
+	}
+
+	// 'app.Wait()' returns after 'sdl.Quit()'
+	shutdownDone := app.AddShutdownTask()
+	defer shutdownDone()
+
+	if (*Scale < MIN_SCALE) || (*Scale > MAX_SCALE) {
+		app.PrintfMsg("invalid display scale: %d (expected %d-%d)", *Scale, MIN_SCALE, MAX_SCALE)
+		app.RequestExit()
+		return
+	}
+	if *AxisSensitivity <= 0 {
+		app.PrintfMsg("invalid joystick sensitivity: %g (expected a positive number)", *AxisSensitivity)
+		app.RequestExit()
+		return
+	}
+	if err := checkAudioBufferSize(*AudioBuffer); err != nil {
+		app.PrintfMsg("%s", err)
+		app.RequestExit()
+		return
+	}
+	ayStereo, err := ParseAYStereoMode(*AYStereo)
+	if err != nil {
+		app.PrintfMsg("%s", err)
+		app.RequestExit()
+		return
+	}
 
 	uiSettings = &InitialSettings{
-		scale2x:            Scale2x,
+		scale:              Scale,
 		fullscreen:         Fullscreen,
 		showPaintedRegions: ShowPaintedRegions,
+		display:            Display,
 		audio:              Audio,
 		audioFreq:          AudioFreq,
+		audioBuffer:        AudioBuffer,
+		volume:             Volume,
 		hqAudio:            HQAudio,
+		recordAudio:        RecordAudio,
+		recordVideo:        RecordVideo,
+		recordVideoSkip:    RecordVideoSkip,
 	}
 
 	composer = NewSDLSurfaceComposer(app)
 	composer.ShowPaintedRegions(*ShowPaintedRegions)
+	composer.EnableOutput(*Display)
 
 	// SDL subsystems init
 	if err := initSDLSubSystems(app); err != nil {
@@ -499,26 +1048,57 @@ func Main() {
 	}
 
 	// Setup the display
-	r = NewSDLRenderer(app, speccy, *Scale2x, *Fullscreen, *Audio, *HQAudio, *AudioFreq)
+	r = NewSDLRenderer(app, speccy, *Scale, *Fullscreen, *Audio, *HQAudio, *AudioFreq, *AudioBuffer, *Volume, ayStereo)
 	setUI(r)
+	interpreter.SetScreenshotFunc(r.Screenshot)
+	speccy.AddPauseListener(showPaused)
+
+	// The emulation may have been paused before the listener was added, for example at a breakpoint
+	showPaused(speccy.IsPaused())
 
 	// Setup the audio
 	if *Audio {
-		audio, err := NewSDLAudio(app, *AudioFreq, *HQAudio)
+		audio, err := NewSDLAudio(app, *AudioFreq, *HQAudio, *AudioBuffer, *Volume, ayStereo)
 		if err == nil {
 			speccy.CommandChannel <- spectrum.Cmd_AddAudioReceiver{audio}
 		} else {
 			app.PrintfMsg("%s", err)
 		}
 	}
+	if *RecordAudio != "" {
+		mutex.Lock()
+		err := r.RecordAudio(*RecordAudio)
+		mutex.Unlock()
+		if err != nil {
+			app.PrintfMsg("%s", err)
+		}
+	}
+	if *RecordVideo != "" {
+		mutex.Lock()
+		err := r.RecordVideo(*RecordVideo, *RecordVideoSkip)
+		mutex.Unlock()
+		if err != nil {
+			app.PrintfMsg("%s", err)
+		}
+	}
+
+	if *kempstonMouse {
+		// Grab the mouse, so that the relative motion is not limited by the window
+		speccy.Mouse.SetEnabled(true)
+		sdl.ShowCursor(sdl.DISABLE)
+		sdl.WM_GrabInput(sdl.GRAB_ON)
+	}
 
 	// Start the SDL event loop
-	go sdlEventLoop(app, speccy, *verboseInput)
+	go sdlEventLoop(app, speccy, *verboseInput, *turboKey, *rewindKey, *JoystickDeadzone, *AxisSensitivity)
 
 	init_waitGroup.Done()
 
 	hint := "Hint: Press F10 to invoke the built-in console.\n"
 	hint += "      Input an empty line in the console to display available commands.\n"
+	hint += "      Use Up/Down in the console to recall previous commands.\n"
+	hint += "      Alt+Shift+0..9 saves the state into a slot, Alt+0..9 restores it.\n"
+	hint += "      PageUp/PageDown changes the volume.\n"
 	fmt.Print(hint)
 
 	// Wait for all event loops to terminate, and then call 'sdl.Quit()'
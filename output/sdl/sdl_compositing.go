@@ -12,6 +12,8 @@ package sdl_output
 import (
 	"github.com/scottferg/Go-SDL/sdl"
 	"github.com/guntars-lemps/gospeccy/spectrum"
+	"image"
+	"image/color"
 	"math/rand"
 	"unsafe"
 )
@@ -31,6 +33,12 @@ type SDLSurfaceComposer struct {
 	commandChannel chan interface{}
 
 	showPaintedRegions bool
+
+	// Whether the output is dimmed, for example while the emulation is paused
+	dimmed bool
+
+	// If true, the output surface is not updated
+	outputDisabled bool
 }
 
 type input_surface_t struct {
@@ -101,6 +109,28 @@ func (composer *SDLSurfaceComposer) ShowPaintedRegions(enable bool) {
 	composer.commandChannel <- cmd_showPaintedRegions{enable}
 }
 
+// Enqueues a command that will dim or undim the output surface.
+// Dimming is an overlay, the input surfaces are left unchanged.
+func (composer *SDLSurfaceComposer) Dim(enable bool) {
+	composer.commandChannel <- cmd_dim{enable}
+}
+
+// Enqueues a command that will enable or disable updates of the output surface.
+// While disabled, changes of the input surfaces are ignored.
+// Re-enabling the output repaints the whole output surface.
+func (composer *SDLSurfaceComposer) EnableOutput(enable bool) {
+	composer.commandChannel <- cmd_enableOutput{enable}
+}
+
+// Enqueues a command that will copy the first input surface (the Spectrum screen)
+// into an unscaled image of size TotalScreenWidth x TotalScreenHeight.
+// The returned channel receives nil if there are no input surfaces.
+func (composer *SDLSurfaceComposer) CaptureScreen() <-chan *image.RGBA {
+	img := make(chan *image.RGBA, 1)
+	composer.commandChannel <- cmd_captureScreen{img}
+	return img
+}
+
 type cmd_add struct {
 	surface        *sdl.Surface
 	x, y           int
@@ -130,6 +160,18 @@ type cmd_showPaintedRegions struct {
 	enable bool
 }
 
+type cmd_dim struct {
+	enable bool
+}
+
+type cmd_enableOutput struct {
+	enable bool
+}
+
+type cmd_captureScreen struct {
+	img chan<- *image.RGBA
+}
+
 type cmd_update struct {
 	surface *input_surface_t
 	rects   []sdl.Rect
@@ -177,8 +219,23 @@ func (composer *SDLSurfaceComposer) commandLoop(app *spectrum.Application) {
 				composer.showPaintedRegions = cmd.enable
 				composer.repaintTheWholeOutputSurface()
 
+			case cmd_dim:
+				if composer.dimmed != cmd.enable {
+					composer.dimmed = cmd.enable
+					composer.repaintTheWholeOutputSurface()
+				}
+
+			case cmd_enableOutput:
+				if composer.outputDisabled == cmd.enable {
+					composer.outputDisabled = !cmd.enable
+					composer.repaintTheWholeOutputSurface()
+				}
+
 			case cmd_update:
 				composer.performCompositing(cmd.surface.x, cmd.surface.y, cmd.rects)
+
+			case cmd_captureScreen:
+				cmd.img <- composer.captureScreen()
 			}
 		}
 	}
@@ -346,6 +403,35 @@ func (composer *SDLSurfaceComposer) repaintTheWholeOutputSurface() {
 	}
 }
 
+func (composer *SDLSurfaceComposer) captureScreen() *image.RGBA {
+	if len(composer.inputs) == 0 {
+		return nil
+	}
+
+	surface := &SDLSurface{composer.inputs[0].surface}
+
+	// A scaled surface is downscaled by taking one pixel out of each scale x scale square
+	scale := surface.Width() / spectrum.TotalScreenWidth
+	if scale == 0 {
+		scale = 1
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, spectrum.TotalScreenWidth, spectrum.TotalScreenHeight))
+
+	pitch, bpp := surface.Pitch(), surface.Bpp()
+
+	surface.surface.Lock()
+	for y := uint(0); y < spectrum.TotalScreenHeight; y++ {
+		for x := uint(0); x < spectrum.TotalScreenWidth; x++ {
+			c := *(*uint32)(unsafe.Pointer(uintptr(surface.surface.Pixels) + uintptr(y*scale*pitch+x*scale*bpp)))
+			img.SetRGBA(int(x), int(y), color.RGBA{uint8(c >> 16), uint8(c >> 8), uint8(c), 0xff})
+		}
+	}
+	surface.surface.Unlock()
+
+	return img
+}
+
 // Used to generate colors when 'showPaintedRegions' is true
 var rnd *rand.Rand = rand.New(rand.NewSource(0))
 
@@ -356,10 +442,21 @@ var rnd *rand.Rand = rand.New(rand.NewSource(0))
 // ofsX, ofsY: The translation to be applied to each element of 'rects'.
 //             After the translation, the position of each rectangle is relative
 //             to the coordinate system of the output surface.
+//
+// A double-buffered output surface (-vsync) is presented by flipping the buffers.
+// The back buffer does not contain the previous frame, so the whole output surface
+// is composed each time and the painted regions are not shown.
 func (composer *SDLSurfaceComposer) performCompositing(ofsX, ofsY int, rects []sdl.Rect) {
-	if composer.output_orNil != nil {
+	if (composer.output_orNil != nil) && !composer.outputDisabled {
 		output := composer.output_orNil
 
+		doubleBuffered := (output.Flags & sdl.DOUBLEBUF) != 0
+		if doubleBuffered {
+			ofsX, ofsY = 0, 0
+			rects = []sdl.Rect{{X: 0, Y: 0, W: uint16(output.W), H: uint16(output.H)}}
+			output.FillRect(nil, 0)
+		}
+
 		updateRects := make([]sdl.Rect, 0)
 
 		for inputIndex, input := range composer.inputs {
@@ -380,7 +477,16 @@ func (composer *SDLSurfaceComposer) performCompositing(ofsX, ofsY int, rects []s
 			}
 		}
 
-		if composer.showPaintedRegions {
+		if composer.dimmed {
+			const alpha = 0x80
+			output.Lock()
+			for _, updateRect := range updateRects {
+				fillRect(&SDLSurface{output}, updateRect, 0x000000, alpha)
+			}
+			output.Unlock()
+		}
+
+		if composer.showPaintedRegions && !doubleBuffered {
 			R := rnd.Float32()
 			G := rnd.Float32() * (1.0 - R)
 			B := rnd.Float32() * (1.0 - R - G)
@@ -392,7 +498,11 @@ func (composer *SDLSurfaceComposer) performCompositing(ofsX, ofsY int, rects []s
 			}
 		}
 
-		output.UpdateRects(updateRects)
+		if doubleBuffered {
+			output.Flip()
+		} else {
+			output.UpdateRects(updateRects)
+		}
 	}
 }
 
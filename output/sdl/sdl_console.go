@@ -0,0 +1,322 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"bufio"
+	"errors"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"github.com/scottferg/Go-SDL/sdl"
+	"github.com/scottferg/Go-SDL/ttf"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// The maximum number of lines kept in the console history
+const CONSOLE_HISTORY_SIZE = 500
+
+const (
+	console_bgColor = 0x202020
+	console_padding = 2
+)
+
+var console_fgColor = sdl.Color{R: 255, G: 255, B: 255}
+
+func consoleHistoryPath() string {
+	return path.Join(spectrum.DefaultUserDir, "console_history")
+}
+
+// A single-line text editor with a history of entered lines
+type lineEditor struct {
+	line   []rune
+	cursor int
+
+	history []string
+
+	// Index into 'history' of the recalled line, or len(history) if editing a new line
+	historyPos int
+
+	// The new line being edited before the history was browsed
+	savedLine string
+}
+
+func newLineEditor(history []string) *lineEditor {
+	return &lineEditor{history: history, historyPos: len(history)}
+}
+
+func (e *lineEditor) text() string {
+	return string(e.line)
+}
+
+func (e *lineEditor) setText(s string) {
+	e.line = []rune(s)
+	e.cursor = len(e.line)
+}
+
+// Processes a pressed key.
+// When 'enter' is true, the returned line has been entered and added to the history.
+func (e *lineEditor) key(keyName string, unicode uint16) (line string, enter bool) {
+	switch keyName {
+	case "return", "enter":
+		line = e.text()
+		e.addHistory(line)
+		e.setText("")
+		e.savedLine = ""
+		return line, true
+
+	case "backspace":
+		if e.cursor > 0 {
+			e.line = append(e.line[:e.cursor-1], e.line[e.cursor:]...)
+			e.cursor--
+		}
+
+	case "delete":
+		if e.cursor < len(e.line) {
+			e.line = append(e.line[:e.cursor], e.line[e.cursor+1:]...)
+		}
+
+	case "left":
+		if e.cursor > 0 {
+			e.cursor--
+		}
+
+	case "right":
+		if e.cursor < len(e.line) {
+			e.cursor++
+		}
+
+	case "home":
+		e.cursor = 0
+
+	case "end":
+		e.cursor = len(e.line)
+
+	case "up":
+		if e.historyPos > 0 {
+			if e.historyPos == len(e.history) {
+				e.savedLine = e.text()
+			}
+			e.historyPos--
+			e.setText(e.history[e.historyPos])
+		}
+
+	case "down":
+		if e.historyPos < len(e.history) {
+			e.historyPos++
+			if e.historyPos == len(e.history) {
+				e.setText(e.savedLine)
+			} else {
+				e.setText(e.history[e.historyPos])
+			}
+		}
+
+	default:
+		if unicode >= 32 && unicode != 127 {
+			e.line = append(e.line, 0)
+			copy(e.line[e.cursor+1:], e.line[e.cursor:])
+			e.line[e.cursor] = rune(unicode)
+			e.cursor++
+		}
+	}
+
+	return "", false
+}
+
+// Appends the line to the history, unless it is empty or equal to the previous entry.
+// The oldest entries are dropped if the history exceeds CONSOLE_HISTORY_SIZE.
+func (e *lineEditor) addHistory(line string) {
+	if (strings.TrimSpace(line) != "") && !((len(e.history) > 0) && (e.history[len(e.history)-1] == line)) {
+		e.history = append(e.history, line)
+		if len(e.history) > CONSOLE_HISTORY_SIZE {
+			e.history = e.history[len(e.history)-CONSOLE_HISTORY_SIZE:]
+		}
+	}
+	e.historyPos = len(e.history)
+}
+
+// Reads the console history. A missing file is not an error.
+func readConsoleHistory(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var history []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			history = append(history, line)
+		}
+	}
+	if len(history) > CONSOLE_HISTORY_SIZE {
+		history = history[len(history)-CONSOLE_HISTORY_SIZE:]
+	}
+
+	return history, scanner.Err()
+}
+
+func writeConsoleHistory(path_ string, history []string) error {
+	if err := os.MkdirAll(path.Dir(path_), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path_)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, line := range history {
+		w.WriteString(line)
+		w.WriteString("\n")
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// The F10 console: a line of text at the bottom of the window.
+// While the console is visible, it receives all pressed keys.
+type SDLConsole struct {
+	mutex sync.Mutex
+
+	editor *lineEditor
+
+	// Nil while the console is hidden
+	surface        *sdl.Surface
+	font           *ttf.Font
+	updatedRectsCh chan []sdl.Rect
+
+	app *spectrum.Application
+}
+
+func NewSDLConsole(app *spectrum.Application) *SDLConsole {
+	history, err := readConsoleHistory(consoleHistoryPath())
+	if err != nil {
+		app.PrintfMsg("console history: %s", err)
+	}
+
+	return &SDLConsole{
+		editor: newLineEditor(history),
+		app:    app,
+	}
+}
+
+func (c *SDLConsole) Visible() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.surface != nil
+}
+
+// Shows the console at the bottom of the Spectrum display,
+// which is located at x,y in the window and has the specified dimensions
+func (c *SDLConsole) Show(scale uint, fullscreen bool, x, y, width, height int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.surface != nil {
+		return nil
+	}
+
+	font, err := newFont(scale, fullscreen)
+	if err != nil {
+		return err
+	}
+
+	// Measure the height of a line of text
+	sample := ttf.RenderUTF8_Blended(font, "> ", console_fgColor)
+	if sample == nil {
+		font.Close()
+		return errors.New(sdl.GetError())
+	}
+	h := int(sample.H) + 2*console_padding
+	sample.Free()
+
+	surface := sdl.CreateRGBSurface(sdl.SWSURFACE, width, h, 32, 0, 0, 0, 0)
+	if surface == nil {
+		font.Close()
+		return errors.New(sdl.GetError())
+	}
+
+	c.font = font
+	c.surface = surface
+	c.updatedRectsCh = make(chan []sdl.Rect, 1)
+	c.render()
+
+	composer.AddInputSurface(surface, x, y+height-h, c.updatedRectsCh)
+	return nil
+}
+
+func (c *SDLConsole) Hide() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.surface == nil {
+		return
+	}
+
+	<-composer.RemoveInputSurface(c.surface)
+
+	c.surface.Free()
+	c.surface = nil
+	c.font.Close()
+	c.font = nil
+	c.updatedRectsCh = nil
+}
+
+// Passes a pressed key to the console.
+// If a line has been entered, it is echoed, run in the interpreter,
+// and the updated history is saved.
+func (c *SDLConsole) KeyDown(keyName string, unicode uint16) {
+	c.mutex.Lock()
+	line, enter := c.editor.key(keyName, unicode)
+	history := c.editor.history
+	if c.surface != nil {
+		c.render()
+	}
+	c.mutex.Unlock()
+
+	if !enter {
+		return
+	}
+
+	c.app.PrintfMsg("> %s", line)
+	if err := writeConsoleHistory(consoleHistoryPath(), history); err != nil {
+		c.app.PrintfMsg("console history: %s", err)
+	}
+
+	go func() {
+		if err := (&interpreterAccess_t{}).Run(line); err != nil {
+			c.app.PrintfMsg("%s", err)
+		}
+	}()
+}
+
+// Draws the edited line, with a '|' at the cursor position.
+// The caller must hold 'c.mutex'.
+func (c *SDLConsole) render() {
+	e := c.editor
+	text := "> " + string(e.line[:e.cursor]) + "|" + string(e.line[e.cursor:])
+
+	c.surface.FillRect(nil, console_bgColor)
+	if textSurface := ttf.RenderUTF8_Blended(c.font, text, console_fgColor); textSurface != nil {
+		c.surface.Blit(&sdl.Rect{X: console_padding, Y: console_padding}, textSurface, nil)
+		textSurface.Free()
+	}
+
+	rect := sdl.Rect{X: 0, Y: 0, W: uint16(c.surface.W), H: uint16(c.surface.H)}
+	select {
+	case c.updatedRectsCh <- []sdl.Rect{rect}:
+	default:
+		// A repaint of the whole surface is already pending
+	}
+}
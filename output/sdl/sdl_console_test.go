@@ -0,0 +1,72 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"testing"
+)
+
+func typeLine(e *lineEditor, s string) (string, bool) {
+	for _, c := range s {
+		e.key("", uint16(c))
+	}
+	return e.key("return", 0)
+}
+
+func TestLineEditorHistory(t *testing.T) {
+	e := newLineEditor(nil)
+
+	typeLine(e, "a")
+	typeLine(e, "b")
+	typeLine(e, "b")
+	typeLine(e, "")
+
+	if len(e.history) != 2 {
+		t.Fatalf("expected 2 history entries, got %v", e.history)
+	}
+
+	e.key("", 'x')
+	e.key("up", 0)
+	if e.text() != "b" {
+		t.Errorf("up: expected \"b\", got %q", e.text())
+	}
+	e.key("up", 0)
+	e.key("up", 0)
+	if e.text() != "a" {
+		t.Errorf("up: expected \"a\", got %q", e.text())
+	}
+	e.key("down", 0)
+	e.key("down", 0)
+	if e.text() != "x" {
+		t.Errorf("down: expected the edited line \"x\", got %q", e.text())
+	}
+}
+
+func TestLineEditorEditing(t *testing.T) {
+	e := newLineEditor(nil)
+
+	for _, c := range "ac" {
+		e.key("", uint16(c))
+	}
+	e.key("left", 0)
+	e.key("", 'b')
+	e.key("home", 0)
+	e.key("delete", 0)
+	e.key("end", 0)
+	e.key("backspace", 0)
+
+	line, enter := e.key("return", 0)
+	if !enter || (line != "b") {
+		t.Errorf("expected \"b\", got %q", line)
+	}
+}
+
+func TestLineEditorHistorySize(t *testing.T) {
+	e := newLineEditor(nil)
+	for i := 0; i < CONSOLE_HISTORY_SIZE+10; i++ {
+		typeLine(e, string(rune('a'+i%2)))
+	}
+	if len(e.history) != CONSOLE_HISTORY_SIZE {
+		t.Errorf("expected %d history entries, got %d", CONSOLE_HISTORY_SIZE, len(e.history))
+	}
+}
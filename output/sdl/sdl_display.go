@@ -99,9 +99,9 @@ func newSDLSurface(app *spectrum.Application, w, h int) *SDLSurface {
 	return &SDLSurface{surface}
 }
 
-// Create an SDL surface suitable for a 2x scaled screen
-func NewSDLSurface2x(app *spectrum.Application) *SDLSurface {
-	return newSDLSurface(app, 2*spectrum.TotalScreenWidth, 2*spectrum.TotalScreenHeight)
+// Create an SDL surface suitable for a screen scaled by an integer factor
+func NewSDLSurfaceScaled(app *spectrum.Application, scale uint) *SDLSurface {
+	return newSDLSurface(app, int(scale)*spectrum.TotalScreenWidth, int(scale)*spectrum.TotalScreenHeight)
 }
 
 // Create an SDL surface suitable for an unscaled screen
@@ -209,6 +209,7 @@ func (display *SDLScreen) render(screen *spectrum.DisplayData) {
 	surface := display.screenSurface
 	bpp := surface.Bpp()
 	pixels := &unscaledDisplay.pixels
+	palette := spectrum.CurrentPalette()
 
 	surface.surface.Lock()
 	for _, r := range *unscaledDisplay.changedRegions {
@@ -219,7 +220,7 @@ func (display *SDLScreen) render(screen *spectrum.DisplayData) {
 			wy := spectrum.TotalScreenWidth * y
 			addr := surface.addrXY(uint(r.X), y)
 			for x := uint(r.X); x < end_x; x++ {
-				*(*uint32)(unsafe.Pointer(addr)) = spectrum.Palette[pixels[wy+x]]
+				*(*uint32)(unsafe.Pointer(addr)) = palette[pixels[wy+x]]
 				addr += uintptr(bpp)
 			}
 		}
@@ -235,11 +236,11 @@ func (display *SDLScreen) render(screen *spectrum.DisplayData) {
 
 }
 
-// ===========
-// SDLScreen2x
-// ===========
+// ===============
+// SDLScreenScaled
+// ===============
 
-type SDLScreen2x struct {
+type SDLScreenScaled struct {
 	// Channel for receiving display changes
 	screenChannel chan *spectrum.DisplayData
 
@@ -251,13 +252,17 @@ type SDLScreen2x struct {
 
 	updatedRectsCh chan []sdl.Rect
 
+	// Each Spectrum pixel is rendered as a scale x scale square
+	scale uint
+
 	app *spectrum.Application
 }
 
-func NewSDLScreen2x(app *spectrum.Application) *SDLScreen2x {
-	SDL_screen := &SDLScreen2x{
+func NewSDLScreenScaled(app *spectrum.Application, scale uint) *SDLScreenScaled {
+	SDL_screen := &SDLScreenScaled{
 		screenChannel:   make(chan *spectrum.DisplayData),
-		screenSurface:   NewSDLSurface2x(app),
+		screenSurface:   NewSDLSurfaceScaled(app, scale),
+		scale:           scale,
 		unscaledDisplay: newUnscaledDisplay(),
 		updatedRectsCh:  make(chan []sdl.Rect),
 		app:             app,
@@ -268,34 +273,36 @@ func NewSDLScreen2x(app *spectrum.Application) *SDLScreen2x {
 	return SDL_screen
 }
 
-func (display *SDLScreen2x) UpdatedRectsCh() <-chan []sdl.Rect {
+func (display *SDLScreenScaled) UpdatedRectsCh() <-chan []sdl.Rect {
 	return display.updatedRectsCh
 }
 
-func (display *SDLScreen2x) GetSurface() *sdl.Surface {
+func (display *SDLScreenScaled) GetSurface() *sdl.Surface {
 	return display.screenSurface.surface
 }
 
 // Implement DisplayReceiver
-func (display *SDLScreen2x) GetDisplayDataChannel() chan<- *spectrum.DisplayData {
+func (display *SDLScreenScaled) GetDisplayDataChannel() chan<- *spectrum.DisplayData {
 	return display.screenChannel
 }
 
-func (display *SDLScreen2x) Close() {
+func (display *SDLScreenScaled) Close() {
 	display.screenChannel <- nil
 }
 
 // Implement screen_renderer_t
-func (display *SDLScreen2x) render(screen *spectrum.DisplayData) {
+func (display *SDLScreenScaled) render(screen *spectrum.DisplayData) {
 	unscaledDisplay := display.unscaledDisplay
 	unscaledDisplay.newFrame()
 	unscaledDisplay.render(screen)
 
 	surface := display.screenSurface
+	scale := display.scale
 	bpp := uintptr(surface.Bpp())
-	bpp2 := 2 * bpp
+	bppN := uintptr(scale) * bpp
 	pitch := uintptr(surface.Pitch())
 	pixels := &unscaledDisplay.pixels
+	palette := spectrum.CurrentPalette()
 
 	surface.surface.Lock()
 	for _, r := range *unscaledDisplay.changedRegions {
@@ -303,19 +310,22 @@ func (display *SDLScreen2x) render(screen *spectrum.DisplayData) {
 		end_y := uint(r.Y) + uint(r.H)
 
 		for y := uint(r.Y); y < end_y; y++ {
-			addr := surface.addrXY(2*uint(r.X), 2*y)
+			addr := surface.addrXY(scale*uint(r.X), scale*y)
 			wy := spectrum.TotalScreenWidth * y
 
 			for x := uint(r.X); x < end_x; x++ {
-				color := spectrum.Palette[pixels[wy+x]]
+				color := palette[pixels[wy+x]]
 
-				// Fill a 2x2 rectangle
-				*(*uint32)(unsafe.Pointer(addr)) = color
-				*(*uint32)(unsafe.Pointer(addr + bpp)) = color
-				*(*uint32)(unsafe.Pointer(addr + pitch)) = color
-				*(*uint32)(unsafe.Pointer(addr + pitch + bpp)) = color
+				// Fill a scale x scale rectangle
+				row := addr
+				for dy := uint(0); dy < scale; dy++ {
+					for dx := uintptr(0); dx < bppN; dx += bpp {
+						*(*uint32)(unsafe.Pointer(row + dx)) = color
+					}
+					row += pitch
+				}
 
-				addr += bpp2
+				addr += bppN
 			}
 		}
 	}
@@ -325,7 +335,7 @@ func (display *SDLScreen2x) render(screen *spectrum.DisplayData) {
 		screen.CompletionTime_orNil <- time.Now()
 	}
 
-	SDL_updateRects(surface.surface, unscaledDisplay.changedRegions, 2 /*scale*/, display.updatedRectsCh)
+	SDL_updateRects(surface.surface, unscaledDisplay.changedRegions, scale, display.updatedRectsCh)
 	unscaledDisplay.releaseMemory()
 }
 
@@ -487,11 +497,11 @@ func (disp *UnscaledDisplay) scanlineFill(minx, maxx, y int, color byte) {
 }
 
 // Render border in the interval [start,end)
-func (disp *UnscaledDisplay) renderBorderBetweenTwoEvents(start spectrum.BorderEvent, end spectrum.BorderEvent) {
+func (disp *UnscaledDisplay) renderBorderBetweenTwoEvents(start spectrum.BorderEvent, end spectrum.BorderEvent, timings *spectrum.ULATimings) {
 	spectrum.Assert(start.TState < end.TState)
 
-	const DISPLAY_START = spectrum.DISPLAY_START
-	const TSTATES_PER_LINE = spectrum.TSTATES_PER_LINE
+	DISPLAY_START := timings.DisplayStart()
+	TSTATES_PER_LINE := timings.TStatesPerLine
 
 	if start.TState < DISPLAY_START {
 		start.TState = DISPLAY_START
@@ -540,19 +550,19 @@ func (disp *UnscaledDisplay) renderBorderBetweenTwoEvents(start spectrum.BorderE
 	}
 }
 
-func (disp *UnscaledDisplay) renderBorder(events []spectrum.BorderEvent) {
+func (disp *UnscaledDisplay) renderBorder(events []spectrum.BorderEvent, timings *spectrum.ULATimings) {
 	if !spectrum.SameBorderEvents(disp.border, events) {
 		if len(events) > 0 {
 			firstEvent := &events[0]
 			spectrum.Assert(firstEvent.TState == 0)
 
 			lastEvent := &events[len(events)-1]
-			spectrum.Assert(lastEvent.TState == spectrum.TStatesPerFrame)
+			spectrum.Assert(lastEvent.TState == timings.TStatesPerFrame)
 
 			numEvents := len(events)
 
 			for i := 0; i < numEvents-1; i++ {
-				disp.renderBorderBetweenTwoEvents(events[i], events[i+1])
+				disp.renderBorderBetweenTwoEvents(events[i], events[i+1], timings)
 			}
 
 			disp.changedRegions.addBorder( /*scale*/ 1)
@@ -589,6 +599,11 @@ func (disp *UnscaledDisplay) render(screen *spectrum.DisplayData) {
 
 	pixels := &disp.pixels
 
+	if screen.Repaint {
+		// Force the border to be rendered
+		disp.border = nil
+	}
+
 	var attr_x, attr_y uint
 	for attr_y = 0; attr_y < spectrum.ScreenHeight_Attr; attr_y++ {
 		dst_Y0 := Y0 + 8*attr_y
@@ -624,5 +639,11 @@ func (disp *UnscaledDisplay) render(screen *spectrum.DisplayData) {
 		}
 	}
 
-	disp.renderBorder(screen.BorderEvents)
+	disp.renderBorder(screen.BorderEvents, &screen.Timings)
+
+	if screen.Repaint {
+		// Report the whole screen as a single changed region
+		disp.changedRegions = newListOfRects()
+		disp.changedRegions.add(0, 0, spectrum.TotalScreenWidth, spectrum.TotalScreenHeight)
+	}
 }
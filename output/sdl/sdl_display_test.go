@@ -179,6 +179,37 @@ func newSurface() *sdl.Surface {
 
 // }
 
+// A "rainbow border", as drawn by many tape loaders:
+// the border color changes at the start of each scanline.
+func TestRainbowBorder(t *testing.T) {
+	events := []spectrum.BorderEvent{{0, 0}}
+	for y := 1; y < spectrum.TotalScreenHeight; y++ {
+		tstate := spectrum.DISPLAY_START + y*spectrum.TSTATES_PER_LINE
+		events = append(events, spectrum.BorderEvent{tstate, byte(y % 8)})
+	}
+	events = append(events, spectrum.BorderEvent{spectrum.TStatesPerFrame, 0})
+
+	disp := newUnscaledDisplay()
+	disp.renderBorder(events, &spectrum.Timings48k)
+
+	for y := 0; y < spectrum.TotalScreenHeight; y++ {
+		xs := []int{0, spectrum.ScreenBorderX - 1, spectrum.TotalScreenWidth - 1}
+		if (y < spectrum.ScreenBorderY) || (y >= spectrum.TotalScreenHeight-spectrum.ScreenBorderY) {
+			xs = append(xs, spectrum.TotalScreenWidth/2)
+		}
+		for _, x := range xs {
+			if color := disp.pixels[y*spectrum.TotalScreenWidth+x]; color != byte(y%8) {
+				t.Fatalf("pixel [%d,%d]: expected color %d, got %d", x, y, y%8, color)
+			}
+		}
+	}
+
+	// The paper area is not part of the border
+	if color := disp.pixels[(spectrum.TotalScreenHeight/2)*spectrum.TotalScreenWidth+spectrum.TotalScreenWidth/2]; color != 0 {
+		t.Errorf("the border was drawn over the paper area")
+	}
+}
+
 func BenchmarkRender(b *testing.B) {
 	b.StopTimer()
 
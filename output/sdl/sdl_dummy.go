@@ -2,23 +2,33 @@
 
 package sdl_output
 
+import "errors"
+
 type InitialSettings struct {
-	scale2x            *bool
+	scale              *uint
 	fullscreen         *bool
 	showPaintedRegions *bool
+	display            *bool
+
+	audio       *bool
+	audioFreq   *uint
+	hqAudio     *bool
+	audioBuffer *uint
+	volume      *float64
+
+	recordAudio *string
 
-	audio     *bool
-	audioFreq *uint
-	hqAudio   *bool
+	recordVideo     *string
+	recordVideoSkip *uint
 }
 
 func (s *InitialSettings) Terminated() bool {
 	return false
 }
 
-func (s *InitialSettings) ResizeVideo(scale2x, fullscreen bool) {
+func (s *InitialSettings) ResizeVideo(scale uint, fullscreen bool) {
 	// Overwrite the command-line settings
-	*s.scale2x = scale2x
+	*s.scale = scale
 	*s.fullscreen = fullscreen
 }
 
@@ -26,6 +36,11 @@ func (s *InitialSettings) ShowPaintedRegions(enable bool) {
 	*s.showPaintedRegions = enable
 }
 
+func (s *InitialSettings) EnableDisplay(enable bool) {
+	// Overwrite the command-line settings
+	*s.display = enable
+}
+
 func (s *InitialSettings) EnableAudio(enable bool) {
 	// Overwrite the command-line settings
 	*s.audio = enable
@@ -40,3 +55,46 @@ func (s *InitialSettings) SetAudioQuality(hqAudio bool) {
 	// Overwrite the command-line settings
 	*s.hqAudio = hqAudio
 }
+
+func (s *InitialSettings) SetAudioBuffer(samples uint) error {
+	if err := checkAudioBufferSize(samples); err != nil {
+		return err
+	}
+	// Overwrite the command-line settings
+	*s.audioBuffer = samples
+	return nil
+}
+
+func (s *InitialSettings) SetVolume(volume float64) {
+	// Overwrite the command-line settings
+	*s.volume = clampVolume(volume)
+}
+
+func (s *InitialSettings) RecordAudio(path string) error {
+	// Overwrite the command-line settings
+	*s.recordAudio = path
+	return nil
+}
+
+func (s *InitialSettings) StopRecordingAudio() error {
+	if *s.recordAudio == "" {
+		return errors.New("no audio recording is in progress")
+	}
+	*s.recordAudio = ""
+	return nil
+}
+
+func (s *InitialSettings) RecordVideo(path string, frameSkip uint) error {
+	// Overwrite the command-line settings
+	*s.recordVideo = path
+	*s.recordVideoSkip = frameSkip
+	return nil
+}
+
+func (s *InitialSettings) StopRecordingVideo() error {
+	if *s.recordVideo == "" {
+		return errors.New("no video recording is in progress")
+	}
+	*s.recordVideo = ""
+	return nil
+}
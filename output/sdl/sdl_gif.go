@@ -0,0 +1,337 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"bufio"
+	"compress/lzw"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"image"
+	"image/color"
+	"os"
+	"time"
+)
+
+// A display receiver which records the emulated display, including the border,
+// to an animated GIF file. It does not depend on the SDL window,
+// so the recording continues even if the window is minimized.
+//
+// The frames are written to the file as they arrive. Only the most recent frame
+// is kept in memory, because its delay is known when the next frame arrives.
+// A frame which is identical to the previous one only extends the delay of the previous frame.
+type GIFRecorder struct {
+	// Channel for receiving display changes
+	screenChannel chan *spectrum.DisplayData
+
+	// Receives a value after the file has been written by 'Close'
+	closed chan byte
+
+	path string
+
+	unscaledDisplay *UnscaledDisplay
+
+	// The number of frames skipped after each recorded frame
+	frameSkip uint
+	countdown uint
+
+	file *gifFile
+
+	// The first error which occurred while writing the file
+	err error
+
+	// The last recorded frame, not yet written to the file
+	lastFrame *image.Paletted
+
+	// The pixels of the last recorded frame
+	lastPixels *[spectrum.TotalScreenWidth * spectrum.TotalScreenHeight]byte
+
+	numFrames int
+
+	// The time since the last recorded frame started, in units of 1/100 s
+	elapsed float32
+
+	finished bool
+
+	speccy *spectrum.Spectrum48k
+	app    *spectrum.Application
+}
+
+// =============================
+// GIF recorder loop (goroutine)
+// =============================
+
+func gifRecorderLoop(evtLoop *spectrum.EventLoop, rec *GIFRecorder) {
+	screenChannel := rec.screenChannel
+
+	shutdown.Add(1)
+	for {
+		select {
+		case <-evtLoop.Pause:
+			// The application is terminating
+			rec.finish()
+			evtLoop.Pause <- 0
+
+		case <-evtLoop.Terminate:
+			// Terminate this Go routine
+			if evtLoop.App().Verbose {
+				evtLoop.App().PrintfMsg("GIF recorder loop: exit")
+			}
+			evtLoop.Terminate <- 0
+			shutdown.Done()
+			return
+
+		case screen := <-screenChannel:
+			if screen != nil {
+				rec.render(screen)
+			} else {
+				// Ignore the "<-screenChannel" case from now on
+				screenChannel = nil
+
+				rec.finish()
+				rec.closed <- 0
+
+				done := evtLoop.Delete()
+				go func() { <-done }()
+			}
+		}
+	}
+}
+
+// Starts recording the display to a GIF file.
+// After each recorded frame, 'frameSkip' frames are skipped.
+func NewGIFRecorder(app *spectrum.Application, speccy *spectrum.Spectrum48k, path string, frameSkip uint) (*GIFRecorder, error) {
+	file, err := createGIFFile(path, spectrum.TotalScreenWidth, spectrum.TotalScreenHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &GIFRecorder{
+		file:            file,
+		screenChannel:   make(chan *spectrum.DisplayData),
+		closed:          make(chan byte),
+		path:            path,
+		unscaledDisplay: newUnscaledDisplay(),
+		frameSkip:       frameSkip,
+		speccy:          speccy,
+		app:             app,
+	}
+
+	go gifRecorderLoop(app.NewEventLoop(), rec)
+
+	return rec, nil
+}
+
+// Implement DisplayReceiver
+func (rec *GIFRecorder) GetDisplayDataChannel() chan<- *spectrum.DisplayData {
+	return rec.screenChannel
+}
+
+// Writes the GIF file
+func (rec *GIFRecorder) Close() {
+	rec.screenChannel <- nil
+	<-rec.closed
+}
+
+func (rec *GIFRecorder) Path() string {
+	return rec.path
+}
+
+func (rec *GIFRecorder) render(screen *spectrum.DisplayData) {
+	unscaledDisplay := rec.unscaledDisplay
+	unscaledDisplay.newFrame()
+	unscaledDisplay.render(screen)
+	unscaledDisplay.releaseMemory()
+
+	if screen.CompletionTime_orNil != nil {
+		screen.CompletionTime_orNil <- time.Now()
+	}
+
+	if rec.finished {
+		return
+	}
+
+	if rec.countdown > 0 {
+		rec.countdown--
+	} else {
+		rec.countdown = rec.frameSkip
+		if (rec.lastPixels == nil) || (*rec.lastPixels != unscaledDisplay.pixels) {
+			rec.addFrame(&unscaledDisplay.pixels)
+		}
+	}
+
+	if fps := rec.speccy.GetCurrentFPS(); fps > 0 {
+		rec.elapsed += 100 / fps
+	}
+}
+
+// Writes the last recorded frame to the file, with the delay elapsed since it started
+func (rec *GIFRecorder) flushFrame() {
+	if rec.lastFrame == nil {
+		return
+	}
+
+	// Carry the rounding error over to the next frame
+	delay := int(rec.elapsed + 0.5)
+	if delay < 1 {
+		delay = 1
+	}
+	rec.elapsed -= float32(delay)
+
+	if rec.err == nil {
+		rec.err = rec.file.writeFrame(rec.lastFrame, delay)
+	}
+	rec.lastFrame = nil
+}
+
+func (rec *GIFRecorder) addFrame(pixels *[spectrum.TotalScreenWidth * spectrum.TotalScreenHeight]byte) {
+	rec.flushFrame()
+
+	palette := make(color.Palette, len(spectrum.CurrentPalette()))
+	for i, c := range spectrum.CurrentPalette() {
+		palette[i] = color.RGBA{uint8(c >> 16), uint8(c >> 8), uint8(c), 0xff}
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, spectrum.TotalScreenWidth, spectrum.TotalScreenHeight), palette)
+	copy(img.Pix, pixels[:])
+
+	rec.lastFrame = img
+	rec.numFrames++
+
+	rec.lastPixels = new([spectrum.TotalScreenWidth * spectrum.TotalScreenHeight]byte)
+	*rec.lastPixels = *pixels
+}
+
+// Writes the last frame and closes the file.
+// Calling this method more than once has no effect.
+func (rec *GIFRecorder) finish() {
+	if rec.finished {
+		return
+	}
+	rec.finished = true
+
+	rec.flushFrame()
+	if err := rec.file.close(); rec.err == nil {
+		rec.err = err
+	}
+
+	switch {
+	case rec.err != nil:
+		rec.app.PrintfMsg("recording video to \"%s\": %s", rec.path, rec.err)
+	case rec.numFrames == 0:
+		rec.app.PrintfMsg("recording video to \"%s\": no frames have been recorded", rec.path)
+	case rec.app.Verbose:
+		rec.app.PrintfMsg("wrote %d frames to \"%s\"", rec.numFrames, rec.path)
+	}
+
+	rec.lastPixels = nil
+}
+
+// =================
+// GIF file encoding
+// =================
+
+// An animated GIF file which is written frame by frame.
+// The standard library's encoder requires all frames to be present in memory.
+type gifFile struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+// Creates the file and writes the header of an animation which loops forever
+func createGIFFile(path string, width, height int) (*gifFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &gifFile{file: file, w: bufio.NewWriter(file)}
+
+	// Header, and the logical screen descriptor without a global color table
+	f.w.WriteString("GIF89a")
+	f.w.Write([]byte{byte(width), byte(width >> 8), byte(height), byte(height >> 8), 0, 0, 0})
+
+	// Application extension: loop forever
+	f.w.Write([]byte{0x21, 0xff, 11})
+	f.w.WriteString("NETSCAPE2.0")
+	f.w.Write([]byte{3, 1, 0, 0, 0})
+
+	return f, nil
+}
+
+// Writes a frame which is displayed for 'delay' hundredths of a second.
+// The frame has a local color table.
+func (f *gifFile) writeFrame(img *image.Paletted, delay int) error {
+	// The size of the color table is 2^(bits)
+	bits := 2
+	for (1 << uint(bits)) < len(img.Palette) {
+		bits++
+	}
+
+	// Graphic control extension
+	f.w.Write([]byte{0x21, 0xf9, 4, 0, byte(delay), byte(delay >> 8), 0, 0})
+
+	// Image descriptor with a local color table
+	b := img.Bounds()
+	f.w.Write([]byte{0x2c, 0, 0, 0, 0,
+		byte(b.Dx()), byte(b.Dx() >> 8), byte(b.Dy()), byte(b.Dy() >> 8),
+		0x80 | byte(bits-1)})
+	for i := 0; i < (1 << uint(bits)); i++ {
+		var r, g, b uint32
+		if i < len(img.Palette) {
+			r, g, b, _ = img.Palette[i].RGBA()
+		}
+		f.w.Write([]byte{byte(r >> 8), byte(g >> 8), byte(b >> 8)})
+	}
+
+	// Image data, LZW-compressed and split into sub-blocks
+	f.w.WriteByte(byte(bits))
+	blocks := &gifBlockWriter{w: f.w}
+	lzwWriter := lzw.NewWriter(blocks, lzw.LSB, bits)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		if _, err := lzwWriter.Write(img.Pix[i : i+b.Dx()]); err != nil {
+			return err
+		}
+	}
+	if err := lzwWriter.Close(); err != nil {
+		return err
+	}
+	blocks.flush()
+	_, err := f.w.Write([]byte{0})
+	return err
+}
+
+// Writes the trailer and closes the file
+func (f *gifFile) close() error {
+	f.w.WriteByte(0x3b)
+	err := f.w.Flush()
+	if err2 := f.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Splits the written data into sub-blocks of at most 255 bytes, each preceded by its size
+type gifBlockWriter struct {
+	w   *bufio.Writer
+	buf [255]byte
+	n   int
+}
+
+func (bw *gifBlockWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		bw.buf[bw.n] = b
+		bw.n++
+		if bw.n == len(bw.buf) {
+			bw.flush()
+		}
+	}
+	return len(p), nil
+}
+
+func (bw *gifBlockWriter) flush() {
+	if bw.n > 0 {
+		bw.w.WriteByte(byte(bw.n))
+		bw.w.Write(bw.buf[:bw.n])
+		bw.n = 0
+	}
+}
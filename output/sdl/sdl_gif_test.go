@@ -0,0 +1,71 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGIFFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.gif")
+
+	palette := color.Palette{}
+	for i := 0; i < 16; i++ {
+		palette = append(palette, color.RGBA{uint8(i * 16), 0, uint8(255 - i*16), 0xff})
+	}
+
+	const width, height = 300, 200
+	file, err := createGIFFile(path, width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []*image.Paletted
+	for frame := 0; frame < 3; frame++ {
+		img := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		for i := range img.Pix {
+			img.Pix[i] = byte((i/7 + frame) % len(palette))
+		}
+		frames = append(frames, img)
+		if err := file.writeFrame(img, frame+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	anim, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != len(frames) {
+		t.Fatalf("expected %d frames, got %d", len(frames), len(anim.Image))
+	}
+	if anim.LoopCount != 0 {
+		t.Errorf("expected an infinite loop, got loop count %d", anim.LoopCount)
+	}
+	for i, img := range anim.Image {
+		if anim.Delay[i] != i+1 {
+			t.Errorf("frame %d: expected delay %d, got %d", i, i+1, anim.Delay[i])
+		}
+		if img.Bounds() != frames[i].Bounds() {
+			t.Fatalf("frame %d: expected bounds %v, got %v", i, frames[i].Bounds(), img.Bounds())
+		}
+		if string(img.Pix) != string(frames[i].Pix) {
+			t.Errorf("frame %d: the pixels differ", i)
+		}
+		if len(img.Palette) != len(palette) || img.Palette[5] != palette[5] {
+			t.Errorf("frame %d: the palette differs", i)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"sync"
+	"time"
+)
+
+// A display which discards the frames. In the headless mode it takes the place of the window,
+// so that the emulator produces the frames as if they were displayed.
+type nullDisplay struct {
+	data   chan *spectrum.DisplayData
+	closed chan byte
+}
+
+func newNullDisplay() *nullDisplay {
+	d := &nullDisplay{make(chan *spectrum.DisplayData), make(chan byte)}
+	go func() {
+		for screen := range d.data {
+			if screen == nil {
+				d.closed <- 0
+				return
+			}
+			if screen.CompletionTime_orNil != nil {
+				screen.CompletionTime_orNil <- time.Now()
+			}
+		}
+	}()
+	return d
+}
+
+// Implement DisplayReceiver
+func (d *nullDisplay) GetDisplayDataChannel() chan<- *spectrum.DisplayData {
+	return d.data
+}
+
+func (d *nullDisplay) Close() {
+	d.data <- nil
+	<-d.closed
+}
+
+// An audio device which discards the audio data. In the headless mode it takes the place
+// of the SDL audio, so that the emulator produces the audio as if it was played.
+type nullAudio struct {
+	data   chan *spectrum.AudioData
+	closed chan byte
+}
+
+func newNullAudio() *nullAudio {
+	a := &nullAudio{make(chan *spectrum.AudioData), make(chan byte)}
+	go func() {
+		for audioData := range a.data {
+			if audioData == nil {
+				a.closed <- 0
+				return
+			}
+		}
+	}()
+	return a
+}
+
+// Implement AudioReceiver
+func (a *nullAudio) GetAudioDataChannel() chan<- *spectrum.AudioData {
+	return a.data
+}
+
+func (a *nullAudio) Close() {
+	a.data <- nil
+	<-a.closed
+}
+
+// The user interface of the headless mode. The settings of the window and of the audio
+// output are ignored, the audio and video recordings work as usual.
+type headlessUI struct {
+	recordings
+
+	audioFreq uint
+	hqAudio   bool
+}
+
+func (ui *headlessUI) Terminated() bool {
+	return ui.app.TerminationInProgress() || ui.app.Terminated()
+}
+
+func (ui *headlessUI) ResizeVideo(scale uint, fullscreen bool) {}
+func (ui *headlessUI) ShowPaintedRegions(enable bool)          {}
+func (ui *headlessUI) EnableDisplay(enable bool)               {}
+func (ui *headlessUI) EnableAudio(enable bool)                 {}
+func (ui *headlessUI) SetVolume(volume float64)                {}
+
+func (ui *headlessUI) SetAudioFreq(freq uint) {
+	ui.audioFreq = freq
+}
+
+func (ui *headlessUI) SetAudioQuality(hqAudio bool) {
+	ui.hqAudio = hqAudio
+}
+
+func (ui *headlessUI) SetAudioBuffer(samples uint) error {
+	return checkAudioBufferSize(samples)
+}
+
+func (ui *headlessUI) RecordAudio(path string) error {
+	return ui.recordAudio(path, ui.audioFreq, ui.hqAudio)
+}
+
+// Runs the emulator without a window and without audio output
+func mainHeadless(app *spectrum.Application, speccy *spectrum.Spectrum48k, init_waitGroup *sync.WaitGroup) {
+	ui := &headlessUI{
+		recordings: recordings{app: app, speccy: speccy},
+		audioFreq:  *AudioFreq,
+		hqAudio:    *HQAudio,
+	}
+	setUI(ui)
+
+	speccy.CommandChannel <- spectrum.Cmd_AddDisplay{newNullDisplay()}
+	speccy.CommandChannel <- spectrum.Cmd_AddAudioReceiver{newNullAudio()}
+
+	if *RecordAudio != "" {
+		mutex.Lock()
+		err := ui.RecordAudio(*RecordAudio)
+		mutex.Unlock()
+		if err != nil {
+			app.PrintfMsg("%s", err)
+		}
+	}
+	if *RecordVideo != "" {
+		mutex.Lock()
+		err := ui.RecordVideo(*RecordVideo, *RecordVideoSkip)
+		mutex.Unlock()
+		if err != nil {
+			app.PrintfMsg("%s", err)
+		}
+	}
+
+	init_waitGroup.Done()
+
+	if app.Verbose {
+		app.PrintfMsg("running headless")
+	}
+}
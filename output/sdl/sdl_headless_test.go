@@ -0,0 +1,25 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"testing"
+	"time"
+)
+
+func TestNullReceivers(t *testing.T) {
+	display := newNullDisplay()
+	completionTime := make(chan time.Time, 1)
+	display.GetDisplayDataChannel() <- &spectrum.DisplayData{CompletionTime_orNil: completionTime}
+	select {
+	case <-completionTime:
+	case <-time.After(time.Second):
+		t.Errorf("the null display did not complete the frame")
+	}
+	display.Close()
+
+	audio := newNullAudio()
+	audio.GetAudioDataChannel() <- &spectrum.AudioData{}
+	audio.Close()
+}
@@ -0,0 +1,45 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"testing"
+)
+
+func TestJoystickAxis(t *testing.T) {
+	const deadzone = 8000
+
+	tests := []struct {
+		value       int16
+		sensitivity float64
+		left, right bool
+	}{
+		{0, 1, false, false},
+		{7000, 1, false, false},
+		{-7000, 1, false, false},
+		{9000, 1, false, true},
+		{-9000, 1, true, false},
+
+		// A higher sensitivity reacts to smaller movements
+		{7000, 2, false, true},
+		{-7000, 2, true, false},
+
+		// A lower sensitivity requires larger movements
+		{9000, 0.5, false, false},
+		{20000, 0.5, false, true},
+	}
+
+	for _, test := range tests {
+		joystick := spectrum.NewJoystick()
+		joystickAxis(joystick, test.value, deadzone, test.sensitivity, spectrum.KEMPSTON_LEFT, spectrum.KEMPSTON_RIGHT)
+
+		state := joystick.GetState()
+		left := (state & (1 << 1)) != 0
+		right := (state & (1 << 0)) != 0
+		if (left != test.left) || (right != test.right) {
+			t.Errorf("value %d, sensitivity %g: expected left=%v right=%v, got left=%v right=%v",
+				test.value, test.sensitivity, test.left, test.right, left, right)
+		}
+	}
+}
@@ -3,6 +3,7 @@
 package sdl_output
 
 import (
+	"fmt"
 	intp "github.com/guntars-lemps/gospeccy/interpreter"
 	"github.com/sbinet/go-eval"
 	"sync"
@@ -11,11 +12,18 @@ import (
 type userInterfaceSettings_t interface {
 	Terminated() bool
 
-	ResizeVideo(scale2x, fullscreen bool)
+	ResizeVideo(scale uint, fullscreen bool)
 	ShowPaintedRegions(enable bool)
+	EnableDisplay(enable bool)
 	EnableAudio(enable bool)
 	SetAudioFreq(freq uint) // 0 means "default frequency"
 	SetAudioQuality(hqAudio bool)
+	SetAudioBuffer(samples uint) error // 0 means "default size"
+	SetVolume(volume float64)          // 0.0 ... 1.0
+	RecordAudio(path string) error
+	StopRecordingAudio() error
+	RecordVideo(path string, frameSkip uint) error
+	StopRecordingVideo() error
 }
 
 var uiSettings userInterfaceSettings_t
@@ -33,17 +41,15 @@ func wrapper_scale(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	if uiSettings.Terminated() {
 		return
 	}
-	n := in[0].(eval.UintValue).Get(t)
-	switch n {
-	case 1:
-		mutex.Lock()
-		uiSettings.ResizeVideo(false, false)
-		mutex.Unlock()
-	case 2:
-		mutex.Lock()
-		uiSettings.ResizeVideo(true, false)
-		mutex.Unlock()
+	n := uint(in[0].(eval.UintValue).Get(t))
+	if (n < MIN_SCALE) || (n > MAX_SCALE) {
+		fmt.Fprintf(intp.GetInterpreter().Stdout(), "invalid display scale: %d (expected %d-%d)\n", n, MIN_SCALE, MAX_SCALE)
+		return
 	}
+
+	mutex.Lock()
+	uiSettings.ResizeVideo(n, false)
+	mutex.Unlock()
 }
 
 // Signature: func fullscreen(enable bool)
@@ -54,11 +60,11 @@ func wrapper_fullscreen(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	enable := in[0].(eval.BoolValue).Get(t)
 	if enable {
 		mutex.Lock()
-		uiSettings.ResizeVideo(true, true)
+		uiSettings.ResizeVideo(2, true)
 		mutex.Unlock()
 	} else {
 		mutex.Lock()
-		uiSettings.ResizeVideo(true, false)
+		uiSettings.ResizeVideo(2, false)
 		mutex.Unlock()
 	}
 }
@@ -76,6 +82,19 @@ func wrapper_showPaint(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	mutex.Unlock()
 }
 
+// Signature: func display(enable bool)
+func wrapper_display(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	enable := in[0].(eval.BoolValue).Get(t)
+
+	mutex.Lock()
+	uiSettings.EnableDisplay(enable)
+	mutex.Unlock()
+}
+
 // Signature: func audio(enable bool)
 func wrapper_audio(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	if uiSettings.Terminated() {
@@ -115,6 +134,135 @@ func wrapper_audioHQ(t *eval.Thread, in []eval.Value, out []eval.Value) {
 	mutex.Unlock()
 }
 
+// Signature: func audioBuffer(samples uint)
+func wrapper_audioBuffer(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	samples := uint(in[0].(eval.UintValue).Get(t))
+
+	mutex.Lock()
+	err := uiSettings.SetAudioBuffer(samples)
+	mutex.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(intp.GetInterpreter().Stdout(), "%s\n", err)
+	}
+}
+
+// Signature: func volume(level float32)
+func wrapper_volume(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	level := in[0].(eval.FloatValue).Get(t)
+
+	mutex.Lock()
+	uiSettings.SetVolume(level)
+	mutex.Unlock()
+}
+
+// Signature: func recordAudio(path string)
+func wrapper_recordAudio(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+
+	mutex.Lock()
+	err := uiSettings.RecordAudio(path)
+	mutex.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(intp.GetInterpreter().Stdout(), "%s\n", err)
+	}
+}
+
+// Signature: func stopRecordingAudio()
+func wrapper_stopRecordingAudio(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	mutex.Lock()
+	err := uiSettings.StopRecordingAudio()
+	mutex.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(intp.GetInterpreter().Stdout(), "%s\n", err)
+	}
+}
+
+// Signature: func recordVideo(path string)
+func wrapper_recordVideo(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+
+	mutex.Lock()
+	err := uiSettings.RecordVideo(path, *RecordVideoSkip)
+	mutex.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(intp.GetInterpreter().Stdout(), "%s\n", err)
+	}
+}
+
+// Signature: func recordVideoSkip(path string, frameSkip uint)
+func wrapper_recordVideoSkip(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	path := in[0].(eval.StringValue).Get(t)
+	frameSkip := uint(in[1].(eval.UintValue).Get(t))
+
+	mutex.Lock()
+	err := uiSettings.RecordVideo(path, frameSkip)
+	mutex.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(intp.GetInterpreter().Stdout(), "%s\n", err)
+	}
+}
+
+// Signature: func stopRecordingVideo()
+func wrapper_stopRecordingVideo(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	mutex.Lock()
+	err := uiSettings.StopRecordingVideo()
+	mutex.Unlock()
+
+	if err != nil {
+		fmt.Fprintf(intp.GetInterpreter().Stdout(), "%s\n", err)
+	}
+}
+
+// Signature: func audioStats()
+func wrapper_audioStats(t *eval.Thread, in []eval.Value, out []eval.Value) {
+	if uiSettings.Terminated() {
+		return
+	}
+
+	stdout := intp.GetInterpreter().Stdout()
+
+	stats, enabled := currentAudioStats()
+	if !enabled {
+		fmt.Fprintf(stdout, "audio is disabled\n")
+		return
+	}
+
+	fmt.Fprintf(stdout, "underruns: %d, samples: %d, buffered frames: %d\n", stats.Underruns, stats.Samples, stats.BufferedFrames)
+}
+
 func defineFunctions() {
 	{
 		var functionSignature func(uint)
@@ -124,7 +272,7 @@ func defineFunctions() {
 			Type:       funcType,
 			Value:      funcValue,
 			Help_key:   "scale(n uint)",
-			Help_value: "Change the display scale (1 or 2)",
+			Help_value: "Change the display scale (1-4)",
 		})
 	}
 	{
@@ -149,6 +297,17 @@ func defineFunctions() {
 			Help_value: "Show painted regions",
 		})
 	}
+	{
+		var functionSignature func(bool)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_display, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "display",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "display(enable bool)",
+			Help_value: "Enable or disable updating the window (the emulation keeps running)",
+		})
+	}
 	{
 		var functionSignature func(bool)
 		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_audio, functionSignature)
@@ -182,6 +341,94 @@ func defineFunctions() {
 			Help_value: "Enable or disable high-quality audio",
 		})
 	}
+	{
+		var functionSignature func(uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_audioBuffer, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "audioBuffer",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "audioBuffer(samples uint)",
+			Help_value: "Set the SDL audio buffer size, a power of two (0=default size, smaller=lower latency)",
+		})
+	}
+	{
+		var functionSignature func(float32)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_volume, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "volume",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "volume(level float32)",
+			Help_value: "Set the master volume (0.0-1.0), also PageUp/PageDown",
+		})
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_recordAudio, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "recordAudio",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "recordAudio(path string)",
+			Help_value: "Write the audio output to a WAV file, at the current audio frequency",
+		})
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_stopRecordingAudio, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "stopRecordingAudio",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "stopRecordingAudio()",
+			Help_value: "Stop the audio recording and finalize the WAV file",
+		})
+	}
+	{
+		var functionSignature func(string)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_recordVideo, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "recordVideo",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "recordVideo(path string)",
+			Help_value: "Record the display to an animated GIF file (see the -record-video-skip option)",
+		})
+	}
+	{
+		var functionSignature func(string, uint)
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_recordVideoSkip, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "recordVideoSkip",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "recordVideoSkip(path string, frameSkip uint)",
+			Help_value: "Record the display to an animated GIF file, skipping 'frameSkip' frames after each recorded frame",
+		})
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_stopRecordingVideo, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "stopRecordingVideo",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "stopRecordingVideo()",
+			Help_value: "Stop the video recording and write the GIF file",
+		})
+	}
+	{
+		var functionSignature func()
+		funcType, funcValue := eval.FuncFromNativeTyped(wrapper_audioStats, functionSignature)
+		intp.DefineFunction(intp.Function{
+			Name:       "audioStats",
+			Type:       funcType,
+			Value:      funcValue,
+			Help_key:   "audioStats()",
+			Help_value: "Print the number of audio buffer underruns, samples played and buffered frames",
+		})
+	}
 }
 
 func init() {
@@ -17,6 +17,7 @@ import (
 	"github.com/guntars-lemps/gospeccy/spectrum"
 	"math"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -92,6 +93,9 @@ func forwarderLoop(evtLoop *spectrum.EventLoop, audio *SDLAudio) {
 
 		case audioData := <-audioDataChannel:
 			if audioData != nil {
+				if audioData.Flush {
+					audio.flush()
+				}
 				if !playback_closed {
 					audio.bufferAdd()
 					audio.playback <- audioData
@@ -142,6 +146,12 @@ const FREQUENCY_CHANGE_RATE = 1.0002
 // In other words: ((FREQUENCY_CHANGE_RATE-1) * MIN_PLAYBACK_FREQUENCY) has to be greater than 1.
 const MIN_PLAYBACK_FREQUENCY = 10000
 
+// The range of SDL audio buffer sizes (units: samples) accepted by NewSDLAudio
+const (
+	MIN_AUDIO_BUFFER = 256
+	MAX_AUDIO_BUFFER = 32768
+)
+
 // The ZX Spectrum beeper has only two levels: 0 and 1.
 // However, the beeper can produce multi-channel sound if it changes so quickly that
 // the speaker (speaker = the physical object that the TV uses to produce the sound)
@@ -154,6 +164,78 @@ const MIN_PLAYBACK_FREQUENCY = 10000
 // It is used only when 'hqAudio' is enabled.
 const RESPONSE_FREQUENCY = 12000
 
+// The level of one AY channel at full volume, relative to the beeper's Audio16_Table
+const AY_CHANNEL_LEVEL = 0x7fff / 2
+
+// How the AY channels A, B and C are placed in the output
+type AYStereoMode int
+
+const (
+	AY_STEREO_MONO AYStereoMode = iota // All channels in both speakers, one output channel
+	AY_STEREO_ABC                      // A on the left, B in the center, C on the right
+	AY_STEREO_ACB                      // A on the left, C in the center, B on the right
+)
+
+func ParseAYStereoMode(s string) (AYStereoMode, error) {
+	switch strings.ToLower(s) {
+	case "mono":
+		return AY_STEREO_MONO, nil
+	case "abc":
+		return AY_STEREO_ABC, nil
+	case "acb":
+		return AY_STEREO_ACB, nil
+	}
+	return AY_STEREO_MONO, errors.New(fmt.Sprintf("invalid AY stereo mode: %s (expected mono, abc or acb)", s))
+}
+
+// The number of output channels
+func (mode AYStereoMode) numOutputs() int {
+	if mode == AY_STEREO_MONO {
+		return 1
+	}
+	return 2
+}
+
+// Returns the gains of the AY channels A, B and C in the output channel 'out' (0: left, 1: right).
+// A channel at the side is partially heard in the other speaker.
+// The gains of a channel sum to 2, so that the loudest sound has the same level as in mono.
+func (mode AYStereoMode) gains(out int) [3]float64 {
+	const NEAR, CENTER, FAR = 1.5, 1.0, 0.5
+
+	var left [3]float64
+	switch mode {
+	case AY_STEREO_ABC:
+		left = [3]float64{NEAR, CENTER, FAR}
+	case AY_STEREO_ACB:
+		left = [3]float64{NEAR, FAR, CENTER}
+	default:
+		return [3]float64{1, 1, 1}
+	}
+
+	if out == 0 {
+		return left
+	}
+	var right [3]float64
+	for ch := range left {
+		right[ch] = 2 - left[ch]
+	}
+	return right
+}
+
+// The step of the volume hotkeys
+const VOLUME_STEP = 0.1
+
+// Limits the master volume to the range 0.0 ... 1.0
+func clampVolume(volume float64) float64 {
+	if volume < 0 {
+		return 0
+	}
+	if volume > 1 {
+		return 1
+	}
+	return volume
+}
+
 type SDLAudio struct {
 	// Synchronous Go channel for receiving 'AudioData' objects
 	data chan *spectrum.AudioData
@@ -182,34 +264,107 @@ type SDLAudio struct {
 	// hovers around 'BUFSIZE_IDEAL'.
 	virtualFreq uint
 
+	resampler audioResampler
+
+	// The master volume, from 0.0 to 1.0
+	volume float64
+
+	// The number of frames seen by this 'SDLAudio' object
+	frame uint
+
+	// Statistics, see 'AudioStats'
+	numUnderruns uint
+	numSamples   uint64
+
+	mutex sync.Mutex
+}
+
+// Converts 'AudioData' objects into 16-bit samples
+type audioResampler struct {
+	// The sample rate of the output
+	freq uint
+
 	// Sum of fractions which were lost because of integer truncation
 	numSamples_cummulativeFraction float32
 
-	// Array for storing samples. It is declared here in order
-	// to avoid repetitive allocation of this array in method 'render'.
+	// Arrays for storing samples. They are declared here in order
+	// to avoid repetitive allocation of these arrays in method 'render'.
+	beeper  []float64
 	samples []float64
 
 	// Array for storing samples. It is declared here in order
 	// to avoid repetitive allocation of this array in method 'render'.
 	samples_int16 []int16
 
-	// Overflow from previous frame. It is used if 'hqAudio' is enabled.
-	overflow []float64
+	// Overflow from previous frame, for each output channel. It is used if 'hqAudio' is enabled.
+	overflow [][]float64
 
 	// Enables higher-quality audio resampling
 	hqAudio bool
 
-	// The number of frames seen by this 'SDLAudio' object
-	frame uint
+	// The placement of the AY channels. In stereo modes, two output channels are produced.
+	ayStereo AYStereoMode
 
-	mutex sync.Mutex
+	// The master volume (0.0 ... 1.0) applied to the mixed beeper and AY output,
+	// and the gain applied to the last sample of the previous frame.
+	// When the volume changes, the gain moves towards it gradually over one frame
+	// so that the change does not produce a click.
+	volume, gain float64
 }
 
+type AudioStats struct {
+	// The number of times the playback buffer ran empty while the audio was playing.
+	// Each occurrence is likely to be heard as a click.
+	Underruns uint
+
+	// The total number of samples sent to the SDL audio device
+	Samples uint64
+
+	// The number of 'AudioData' objects currently waiting for playback
+	BufferedFrames uint
+}
+
+// The currently open SDL audio, or nil
 var sdlAudio_instance *SDLAudio = nil
+var sdlAudio_mutex sync.Mutex
+
+// Returns the statistics of the currently open SDL audio.
+// The 2nd return value is false if audio is disabled.
+func currentAudioStats() (AudioStats, bool) {
+	sdlAudio_mutex.Lock()
+	audio := sdlAudio_instance
+	sdlAudio_mutex.Unlock()
+
+	if audio == nil {
+		return AudioStats{}, false
+	}
+	return audio.Stats(), true
+}
+
+// Returns an error if 'samples' is not a valid size of the SDL audio buffer.
+// SDL requires the size to be a power of two. The value 0 selects the default size.
+func checkAudioBufferSize(samples uint) error {
+	if samples == 0 {
+		return nil
+	}
+	if (samples < MIN_AUDIO_BUFFER) || (samples > MAX_AUDIO_BUFFER) || ((samples & (samples - 1)) != 0) {
+		return errors.New(fmt.Sprintf("invalid audio buffer size: %d (expected a power of two from %d to %d)", samples, MIN_AUDIO_BUFFER, MAX_AUDIO_BUFFER))
+	}
+	return nil
+}
 
 // Opens SDL audio.
 // If 'playbackFrequency' is 0, the frequency will be equivalent to PLAYBACK_FREQUENCY.
-func NewSDLAudio(app *spectrum.Application, playbackFrequency uint, hqAudio bool) (*SDLAudio, error) {
+//
+// 'bufferSize' is the size of the SDL audio buffer, in samples.
+// A small buffer reduces the delay between the emulation and the sound,
+// but the buffer may run empty on a slow machine, which is heard as crackling.
+// If 'bufferSize' is 0, the buffer holds about 43 milliseconds of sound
+// (2048 samples at PLAYBACK_FREQUENCY).
+//
+// 'volume' is the master volume, from 0.0 to 1.0.
+// In the stereo modes of 'ayStereo', a two-channel audio device is opened.
+func NewSDLAudio(app *spectrum.Application, playbackFrequency uint, hqAudio bool, bufferSize uint, volume float64, ayStereo AYStereoMode) (*SDLAudio, error) {
 	if playbackFrequency == 0 {
 		playbackFrequency = PLAYBACK_FREQUENCY
 	}
@@ -218,13 +373,20 @@ func NewSDLAudio(app *spectrum.Application, playbackFrequency uint, hqAudio bool
 		return nil, errors.New(fmt.Sprintf("playback frequency of %d Hz is too low", playbackFrequency))
 	}
 
+	if err := checkAudioBufferSize(bufferSize); err != nil {
+		return nil, err
+	}
+	if bufferSize == 0 {
+		bufferSize = uint(2048 * float32(playbackFrequency) / PLAYBACK_FREQUENCY)
+	}
+
 	// Open SDL audio
 	var spec sdl_audio.AudioSpec
 	{
 		spec.Freq = int(playbackFrequency)
 		spec.Format = sdl_audio.AUDIO_S16SYS
-		spec.Channels = 1
-		spec.Samples = uint16(2048 * float32(playbackFrequency) / PLAYBACK_FREQUENCY)
+		spec.Channels = uint8(ayStereo.numOutputs())
+		spec.Samples = uint16(bufferSize)
 		if sdl_audio.OpenAudio(&spec, &spec) != 0 {
 			return nil, errors.New(sdl.GetError())
 		}
@@ -242,12 +404,17 @@ func NewSDLAudio(app *spectrum.Application, playbackFrequency uint, hqAudio bool
 		bufSize:               0,
 		freq:                  uint(spec.Freq),
 		virtualFreq:           uint(spec.Freq),
-		hqAudio:               hqAudio,
+		resampler:             audioResampler{freq: uint(spec.Freq), hqAudio: hqAudio, ayStereo: ayStereo, volume: clampVolume(volume), gain: clampVolume(volume)},
+		volume:                clampVolume(volume),
 	}
 
 	go forwarderLoop(app.NewEventLoop(), audio)
 	go playbackLoop(app, audio)
 
+	sdlAudio_mutex.Lock()
+	sdlAudio_instance = audio
+	sdlAudio_mutex.Unlock()
+
 	return audio, nil
 }
 
@@ -268,6 +435,31 @@ func (audio *SDLAudio) Close() {
 	audio.mutex.Lock()
 	audio.forwarderLoopFinished = nil
 	audio.mutex.Unlock()
+
+	sdlAudio_mutex.Lock()
+	if sdlAudio_instance == audio {
+		sdlAudio_instance = nil
+	}
+	sdlAudio_mutex.Unlock()
+}
+
+// Sets the master volume. The value is clamped to the range 0.0 ... 1.0.
+func (audio *SDLAudio) SetVolume(volume float64) {
+	audio.mutex.Lock()
+	audio.volume = clampVolume(volume)
+	audio.mutex.Unlock()
+}
+
+func (audio *SDLAudio) Stats() AudioStats {
+	audio.mutex.Lock()
+	stats := AudioStats{
+		Underruns:      audio.numUnderruns,
+		Samples:        audio.numSamples,
+		BufferedFrames: audio.bufSize,
+	}
+	audio.mutex.Unlock()
+
+	return stats
 }
 
 // Called when the number of buffered 'AudioData' objects increases by 1
@@ -285,12 +477,32 @@ func (audio *SDLAudio) bufferAdd() {
 	audio.mutex.Unlock()
 }
 
+// Discards the 'AudioData' objects waiting for playback
+func (audio *SDLAudio) flush() {
+	for {
+		select {
+		case <-audio.playback:
+			audio.mutex.Lock()
+			audio.bufSize--
+			audio.mutex.Unlock()
+		default:
+			return
+		}
+	}
+}
+
 // Called when the number of buffered 'AudioData' objects decreases by 1
 func (audio *SDLAudio) bufferRemove() {
 	audio.mutex.Lock()
 	{
 		audio.bufSize--
 
+		if (audio.bufSize == 0) && audio.sdlAudioUnpaused {
+			// The SDL audio device will run out of samples
+			// unless the next 'AudioData' object arrives in time
+			audio.numUnderruns++
+		}
+
 		changedFreq := false
 		if audio.bufSize < BUFSIZE_IDEAL-2 {
 			// Prevent future buffer underruns
@@ -465,7 +677,10 @@ func add_hq(samples []float64, x, w, h, spread, spread1 float64) {
 	}
 }
 
-func (audio *SDLAudio) render(audioData *spectrum.AudioData) {
+// Converts the audio data of one frame into samples.
+// In stereo mode, the samples of the left and right channels are interleaved.
+// The returned slice is valid until the next call.
+func (r *audioResampler) render(audioData *spectrum.AudioData, virtualFreq uint) []int16 {
 	var events []spectrum.BeeperEvent
 
 	if len(audioData.BeeperEvents) > 0 {
@@ -473,13 +688,13 @@ func (audio *SDLAudio) render(audioData *spectrum.AudioData) {
 		spectrum.Assert(firstEvent.TState == 0)
 
 		var lastEvent *spectrum.BeeperEvent = &audioData.BeeperEvents[len(audioData.BeeperEvents)-1]
-		spectrum.Assert(lastEvent.TState == spectrum.TStatesPerFrame)
+		spectrum.Assert(lastEvent.TState == audioData.TStatesPerFrame)
 
 		events = audioData.BeeperEvents
 	} else {
 		events = make([]spectrum.BeeperEvent, 2)
 		events[0] = spectrum.BeeperEvent{TState: 0, Level: 0}
-		events[1] = spectrum.BeeperEvent{TState: spectrum.TStatesPerFrame, Level: 0}
+		events[1] = spectrum.BeeperEvent{TState: audioData.TStatesPerFrame, Level: 0}
 	}
 
 	/*
@@ -493,57 +708,73 @@ func (audio *SDLAudio) render(audioData *spectrum.AudioData) {
 	*/
 
 	numEvents := len(events)
+	numOutputs := r.ayStereo.numOutputs()
 
-	spread := float64(audio.freq) / RESPONSE_FREQUENCY
+	spread := float64(r.freq) / RESPONSE_FREQUENCY
 	spread1 := 1 / spread
 
 	var numSamples int
+	var beeper []float64
 	var samples []float64
 	var samples_int16 []int16
-	var overflow []float64
+	var overflow [][]float64
 	{
-		audio.mutex.Lock()
-
-		numSamples_float := float32(audio.virtualFreq) / audioData.FPS
+		numSamples_float := float32(virtualFreq) / audioData.FPS
 		numSamples = int(numSamples_float)
 
 		len_overflow := int(math.Ceil(spread)) + 2
 
-		audio.numSamples_cummulativeFraction += numSamples_float - float32(numSamples)
-		if audio.numSamples_cummulativeFraction >= 1.0 {
+		r.numSamples_cummulativeFraction += numSamples_float - float32(numSamples)
+		if r.numSamples_cummulativeFraction >= 1.0 {
 			numSamples += 1
-			audio.numSamples_cummulativeFraction -= 1.0
+			r.numSamples_cummulativeFraction -= 1.0
+		}
+
+		if len(r.beeper) < numSamples+len_overflow {
+			r.beeper = make([]float64, numSamples+len_overflow)
 		}
+		beeper = r.beeper
 
-		if len(audio.samples) < numSamples+len_overflow {
-			audio.samples = make([]float64, numSamples+len_overflow)
+		if len(r.samples) < numSamples+len_overflow {
+			r.samples = make([]float64, numSamples+len_overflow)
 		}
-		samples = audio.samples
+		samples = r.samples
 
-		if len(audio.samples_int16) < numSamples {
-			audio.samples_int16 = make([]int16, numSamples)
+		if len(r.samples_int16) < numSamples*numOutputs {
+			r.samples_int16 = make([]int16, numSamples*numOutputs)
 		}
-		samples_int16 = audio.samples_int16
+		samples_int16 = r.samples_int16
 
-		if len(audio.overflow) < len_overflow {
-			new_overflow := make([]float64, len_overflow)
-			copy(new_overflow, overflow)
-			audio.overflow = new_overflow
+		for len(r.overflow) < numOutputs {
+			r.overflow = append(r.overflow, nil)
 		}
-		overflow = audio.overflow
+		for out := 0; out < numOutputs; out++ {
+			if len(r.overflow[out]) < len_overflow {
+				new_overflow := make([]float64, len_overflow)
+				copy(new_overflow, r.overflow[out])
+				r.overflow[out] = new_overflow
+			}
+		}
+		overflow = r.overflow
+	}
 
-		audio.mutex.Unlock()
+	if audioData.Flush {
+		// Do not carry the sound of the previous frame over to the reset machine
+		for out := range overflow {
+			for i := range overflow[out] {
+				overflow[out][i] = 0
+			}
+		}
 	}
 
-	var k float64 = float64(numSamples) / spectrum.TStatesPerFrame
+	var k float64 = float64(numSamples) / float64(audioData.TStatesPerFrame)
 
+	// The beeper is the same in all output channels
 	{
-		for i := 0; i < len(samples); i++ {
-			samples[i] = 0
+		for i := 0; i < len(beeper); i++ {
+			beeper[i] = 0
 		}
 
-		copy(samples[:], overflow[:])
-
 		for i := 0; i < numEvents-1; i++ {
 			start := events[i]
 			end := events[i+1]
@@ -553,21 +784,90 @@ func (audio *SDLAudio) render(audioData *spectrum.AudioData) {
 			var position0 float64 = float64(start.TState) * k
 			var position1 float64 = float64(end.TState) * k
 
-			if audio.hqAudio {
-				add_hq(samples, position0+1, position1-position0, level, spread, spread1)
+			if r.hqAudio {
+				add_hq(beeper, position0+1, position1-position0, level, spread, spread1)
 			} else {
-				add_lq(samples, position0+1, position1-position0, level)
+				add_lq(beeper, position0+1, position1-position0, level)
 			}
 		}
+	}
 
-		copy(overflow[:], samples[numSamples:])
+	gainStep := 0.0
+	if numSamples > 0 {
+		gainStep = (r.volume - r.gain) / float64(numSamples)
 	}
 
-	for i := 0; i < numSamples; i++ {
-		const VOLUME_ADJUSTMENT = 0.5
-		samples_int16[i] = int16(VOLUME_ADJUSTMENT * samples[i])
+	for out := 0; out < numOutputs; out++ {
+		copy(samples, beeper)
+		for i := range overflow[out] {
+			samples[i] += overflow[out][i]
+		}
+
+		// Mix in the AY chip
+		if numOutputs == 1 {
+			if n := len(audioData.AYSamples); n > 0 {
+				w := float64(numSamples) / float64(n)
+				for i, ay := range audioData.AYSamples {
+					level := float64(ay) * AY_CHANNEL_LEVEL
+					if r.hqAudio {
+						add_hq(samples, float64(i)*w+1, w, level, spread, spread1)
+					} else {
+						add_lq(samples, float64(i)*w+1, w, level)
+					}
+				}
+			}
+		} else {
+			gains := r.ayStereo.gains(out)
+			if n := len(audioData.AYChannels[0]); n > 0 {
+				w := float64(numSamples) / float64(n)
+				for i := 0; i < n; i++ {
+					var ay float64 = 0
+					for ch := 0; ch < 3; ch++ {
+						ay += gains[ch] * float64(audioData.AYChannels[ch][i])
+					}
+					level := ay * AY_CHANNEL_LEVEL
+					if r.hqAudio {
+						add_hq(samples, float64(i)*w+1, w, level, spread, spread1)
+					} else {
+						add_lq(samples, float64(i)*w+1, w, level)
+					}
+				}
+			}
+		}
+
+		copy(overflow[out][:], samples[numSamples:])
+
+		for i := 0; i < numSamples; i++ {
+			const VOLUME_ADJUSTMENT = 0.5
+			gain := r.gain + gainStep*float64(i+1)
+			sample := VOLUME_ADJUSTMENT * gain * samples[i]
+			if sample > 0x7fff {
+				sample = 0x7fff
+			} else if sample < -0x8000 {
+				sample = -0x8000
+			}
+			samples_int16[i*numOutputs+out] = int16(sample)
+		}
+	}
+	if numSamples > 0 {
+		r.gain = r.volume
 	}
 
+	return samples_int16[0 : numSamples*numOutputs]
+}
+
+func (audio *SDLAudio) render(audioData *spectrum.AudioData) {
+	audio.mutex.Lock()
+	virtualFreq := audio.virtualFreq
+	audio.resampler.volume = audio.volume
+	audio.mutex.Unlock()
+
+	samples := audio.resampler.render(audioData, virtualFreq)
+
 	audio.frame++
-	sdl_audio.SendAudio_int16(samples_int16[0:numSamples])
+	sdl_audio.SendAudio_int16(samples)
+
+	audio.mutex.Lock()
+	audio.numSamples += uint64(len(samples) / audio.resampler.ayStereo.numOutputs())
+	audio.mutex.Unlock()
 }
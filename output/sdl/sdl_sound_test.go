@@ -0,0 +1,76 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"testing"
+)
+
+// Audio data of one frame with a silent beeper and AY channel A at full volume
+func makeAYChannelA() *spectrum.AudioData {
+	var channels [3][]float32
+	mixed := make([]float32, spectrum.AY_SAMPLES_PER_FRAME)
+	for ch := range channels {
+		channels[ch] = make([]float32, spectrum.AY_SAMPLES_PER_FRAME)
+	}
+	for i := range mixed {
+		channels[0][i] = 1
+		mixed[i] = 1
+	}
+
+	return &spectrum.AudioData{
+		FPS:             50,
+		TStatesPerFrame: spectrum.TStatesPerFrame,
+		BeeperEvents:    nil,
+		AYSamples:       mixed,
+		AYChannels:      channels,
+	}
+}
+
+func TestAudioResampler_AYStereo(t *testing.T) {
+	const freq = 48000
+
+	mono := audioResampler{freq: freq, ayStereo: AY_STEREO_MONO, volume: 1, gain: 1}
+	samples := mono.render(makeAYChannelA(), freq)
+	if len(samples) != freq/50 {
+		t.Fatalf("mono: expected %d samples, got %d", freq/50, len(samples))
+	}
+	monoLevel := samples[len(samples)/2]
+
+	abc := audioResampler{freq: freq, ayStereo: AY_STEREO_ABC, volume: 1, gain: 1}
+	samples = abc.render(makeAYChannelA(), freq)
+	if len(samples) != 2*freq/50 {
+		t.Fatalf("stereo: expected %d samples, got %d", 2*freq/50, len(samples))
+	}
+	left, right := samples[len(samples)/2], samples[len(samples)/2+1]
+	if (left <= monoLevel) || (right >= monoLevel) || (right <= 0) {
+		t.Errorf("ABC: channel A should be louder on the left, mono %d, left %d, right %d", monoLevel, left, right)
+	}
+
+	if mode, err := ParseAYStereoMode("ACB"); (err != nil) || (mode != AY_STEREO_ACB) {
+		t.Errorf("expected AY_STEREO_ACB, got %v (%v)", mode, err)
+	}
+	if _, err := ParseAYStereoMode("surround"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestAudioResampler_Volume(t *testing.T) {
+	const freq = 48000
+
+	r := audioResampler{freq: freq, volume: 1, gain: 1}
+	full := r.render(makeAYChannelA(), freq)[freq/100]
+
+	// The volume changes gradually during the next frame
+	r.volume = 0.5
+	samples := r.render(makeAYChannelA(), freq)
+	if (samples[1] <= samples[len(samples)-2]) || (samples[1] > full) {
+		t.Errorf("expected a gradual decrease from %d, got %d ... %d", full, samples[1], samples[len(samples)-2])
+	}
+
+	samples = r.render(makeAYChannelA(), freq)
+	if half := samples[freq/100]; (half < full/2-1) || (half > full/2+1) {
+		t.Errorf("expected the level %d, got %d", full/2, half)
+	}
+}
@@ -0,0 +1,192 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"errors"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"github.com/scottferg/Go-SDL/sdl"
+	"github.com/scottferg/Go-SDL/ttf"
+	"sync"
+	"time"
+)
+
+// How often the tape status overlay is updated
+const tapeStatus_updatePeriod = 250 * time.Millisecond
+
+// An overlay at the top of the Spectrum display, which shows the progress of the tape while it is playing
+type tapeStatusOverlay struct {
+	speccy *spectrum.Spectrum48k
+
+	mutex sync.Mutex
+
+	font           *ttf.Font
+	surface        *sdl.Surface
+	updatedRectsCh chan []sdl.Rect
+
+	// The text currently shown
+	text string
+
+	// The scale, and the position and width of the Spectrum display in the window
+	scale      uint
+	fullscreen bool
+	x, y       int
+	width      int
+
+	// While suspended, the overlay is not shown. See 'SDLRenderer.ResizeVideo'.
+	suspended bool
+}
+
+func newTapeStatusOverlay(speccy *spectrum.Spectrum48k, scale uint, fullscreen bool, x, y, width int) *tapeStatusOverlay {
+	return &tapeStatusOverlay{
+		speccy:     speccy,
+		scale:      scale,
+		fullscreen: fullscreen,
+		x:          x,
+		y:          y,
+		width:      width,
+	}
+}
+
+// =============================
+// Tape status loop (goroutine)
+// =============================
+
+func tapeStatusLoop(evtLoop *spectrum.EventLoop, overlay *tapeStatusOverlay) {
+	ticker := time.NewTicker(tapeStatus_updatePeriod)
+	defer ticker.Stop()
+
+	// The emulator cannot be queried after the application starts terminating
+	terminating := false
+
+	shutdown.Add(1)
+	for {
+		select {
+		case <-evtLoop.Pause:
+			terminating = true
+			evtLoop.Pause <- 0
+
+		case <-evtLoop.Terminate:
+			// Terminate this Go routine
+			if evtLoop.App().Verbose {
+				evtLoop.App().PrintfMsg("tape status loop: exit")
+			}
+			evtLoop.Terminate <- 0
+			shutdown.Done()
+			return
+
+		case <-ticker.C:
+			if !terminating {
+				ch := make(chan spectrum.TapeProgress)
+				overlay.speccy.CommandChannel <- spectrum.Cmd_GetTapeProgress{ch}
+				progress := <-ch
+
+				if err := overlay.update(progress); err != nil {
+					evtLoop.App().PrintfMsg("tape status: %s", err)
+				}
+			}
+		}
+	}
+}
+
+// Shows the progress if the tape is playing, otherwise hides the overlay
+func (overlay *tapeStatusOverlay) update(progress spectrum.TapeProgress) error {
+	overlay.mutex.Lock()
+	defer overlay.mutex.Unlock()
+
+	if !progress.Playing || overlay.suspended {
+		overlay.hide()
+		return nil
+	}
+
+	text := progress.String()
+	if overlay.surface == nil {
+		if err := overlay.show(); err != nil {
+			return err
+		}
+	} else if text == overlay.text {
+		return nil
+	}
+
+	overlay.text = text
+	overlay.render()
+	return nil
+}
+
+// Hides the overlay until 'resume' is called
+func (overlay *tapeStatusOverlay) suspend() {
+	overlay.mutex.Lock()
+	defer overlay.mutex.Unlock()
+
+	overlay.suspended = true
+	overlay.hide()
+}
+
+// Allows the overlay to be shown at the new position of the Spectrum display
+func (overlay *tapeStatusOverlay) resume(scale uint, fullscreen bool, x, y, width int) {
+	overlay.mutex.Lock()
+	defer overlay.mutex.Unlock()
+
+	overlay.scale, overlay.fullscreen = scale, fullscreen
+	overlay.x, overlay.y, overlay.width = x, y, width
+	overlay.suspended = false
+}
+
+func (overlay *tapeStatusOverlay) show() error {
+	font, err := newFont(overlay.scale, overlay.fullscreen)
+	if err != nil {
+		return err
+	}
+
+	// Measure the height of a line of text
+	sample := ttf.RenderUTF8_Blended(font, "0", console_fgColor)
+	if sample == nil {
+		font.Close()
+		return errors.New(sdl.GetError())
+	}
+	h := int(sample.H) + 2*console_padding
+	sample.Free()
+
+	surface := sdl.CreateRGBSurface(sdl.SWSURFACE, overlay.width, h, 32, 0, 0, 0, 0)
+	if surface == nil {
+		font.Close()
+		return errors.New(sdl.GetError())
+	}
+
+	overlay.font = font
+	overlay.surface = surface
+	overlay.updatedRectsCh = make(chan []sdl.Rect, 1)
+
+	composer.AddInputSurface(surface, overlay.x, overlay.y, overlay.updatedRectsCh)
+	return nil
+}
+
+func (overlay *tapeStatusOverlay) hide() {
+	if overlay.surface == nil {
+		return
+	}
+
+	<-composer.RemoveInputSurface(overlay.surface)
+
+	overlay.surface.Free()
+	overlay.surface = nil
+	overlay.font.Close()
+	overlay.font = nil
+	overlay.updatedRectsCh = nil
+	overlay.text = ""
+}
+
+func (overlay *tapeStatusOverlay) render() {
+	overlay.surface.FillRect(nil, console_bgColor)
+	if textSurface := ttf.RenderUTF8_Blended(overlay.font, overlay.text, console_fgColor); textSurface != nil {
+		overlay.surface.Blit(&sdl.Rect{X: console_padding, Y: console_padding}, textSurface, nil)
+		textSurface.Free()
+	}
+
+	rect := sdl.Rect{X: 0, Y: 0, W: uint16(overlay.surface.W), H: uint16(overlay.surface.H)}
+	select {
+	case overlay.updatedRectsCh <- []sdl.Rect{rect}:
+	default:
+		// A repaint of the whole surface is already pending
+	}
+}
@@ -0,0 +1,208 @@
+// +build linux freebsd
+
+package sdl_output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"io"
+	"os"
+)
+
+// The size of the RIFF/WAVE header preceding the samples
+const WAV_HEADER_SIZE = 44
+
+// An audio receiver which writes the emulated audio output
+// to a WAV file (16-bit mono PCM)
+type WAVRecorder struct {
+	// Synchronous Go channel for receiving 'AudioData' objects
+	data chan *spectrum.AudioData
+
+	// Receives a value after the file has been finalized by 'Close'
+	closed chan byte
+
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+
+	resampler audioResampler
+
+	// The number of samples written so far
+	numSamples uint32
+
+	// The first error which occurred while writing the file
+	err error
+
+	app *spectrum.Application
+}
+
+// =============================
+// WAV recorder loop (goroutine)
+// =============================
+
+func wavRecorderLoop(evtLoop *spectrum.EventLoop, rec *WAVRecorder) {
+	audioDataChannel := rec.data
+
+	shutdown.Add(1)
+	for {
+		select {
+		case <-evtLoop.Pause:
+			// The application is terminating
+			rec.finish()
+			evtLoop.Pause <- 0
+
+		case <-evtLoop.Terminate:
+			// Terminate this Go routine
+			if evtLoop.App().Verbose {
+				evtLoop.App().PrintfMsg("WAV recorder loop: exit")
+			}
+			evtLoop.Terminate <- 0
+			shutdown.Done()
+			return
+
+		case audioData := <-audioDataChannel:
+			if audioData != nil {
+				rec.write(audioData)
+			} else {
+				// Ignore the "<-audioDataChannel" case from now on
+				audioDataChannel = nil
+
+				rec.finish()
+				rec.closed <- 0
+
+				done := evtLoop.Delete()
+				go func() { <-done }()
+			}
+		}
+	}
+}
+
+// Creates the WAV file and starts the recording.
+// If 'freq' is 0, the sample rate will be PLAYBACK_FREQUENCY.
+func NewWAVRecorder(app *spectrum.Application, path string, freq uint, hqAudio bool) (*WAVRecorder, error) {
+	if freq == 0 {
+		freq = PLAYBACK_FREQUENCY
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &WAVRecorder{
+		data:      make(chan *spectrum.AudioData),
+		closed:    make(chan byte),
+		path:      path,
+		file:      file,
+		writer:    bufio.NewWriter(file),
+		resampler: audioResampler{freq: freq, hqAudio: hqAudio, volume: 1, gain: 1},
+		app:       app,
+	}
+
+	// The header is rewritten with the correct lengths when the recording finishes
+	rec.writeHeader(rec.writer)
+	if rec.err != nil {
+		file.Close()
+		return nil, rec.err
+	}
+
+	go wavRecorderLoop(app.NewEventLoop(), rec)
+
+	return rec, nil
+}
+
+// Implement AudioReceiver
+func (rec *WAVRecorder) GetAudioDataChannel() chan<- *spectrum.AudioData {
+	return rec.data
+}
+
+// Finalizes the WAV file
+func (rec *WAVRecorder) Close() {
+	rec.data <- nil
+	<-rec.closed
+}
+
+func (rec *WAVRecorder) Path() string {
+	return rec.path
+}
+
+func (rec *WAVRecorder) writeHeader(w io.Writer) {
+	const (
+		channels       = 1
+		bytesPerSample = 2
+	)
+	freq := uint32(rec.resampler.freq)
+	dataSize := rec.numSamples * bytesPerSample
+
+	var h [WAV_HEADER_SIZE]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], WAV_HEADER_SIZE-8+dataSize)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16) // The size of the format chunk
+	binary.LittleEndian.PutUint16(h[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(h[22:], channels)
+	binary.LittleEndian.PutUint32(h[24:], freq)
+	binary.LittleEndian.PutUint32(h[28:], freq*channels*bytesPerSample)
+	binary.LittleEndian.PutUint16(h[32:], channels*bytesPerSample)
+	binary.LittleEndian.PutUint16(h[34:], 8*bytesPerSample)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataSize)
+
+	if _, err := w.Write(h[:]); (err != nil) && (rec.err == nil) {
+		rec.err = err
+	}
+}
+
+func (rec *WAVRecorder) write(audioData *spectrum.AudioData) {
+	if (rec.file == nil) || (rec.err != nil) {
+		return
+	}
+
+	// The sample rate is fixed, there is no playback buffer to keep filled
+	samples := rec.resampler.render(audioData, rec.resampler.freq)
+
+	var buf [2]byte
+	for _, sample := range samples {
+		binary.LittleEndian.PutUint16(buf[:], uint16(sample))
+		if _, err := rec.writer.Write(buf[:]); err != nil {
+			rec.err = err
+			break
+		}
+	}
+	rec.numSamples += uint32(len(samples))
+
+	if rec.err != nil {
+		rec.app.PrintfMsg("recording audio to \"%s\": %s", rec.path, rec.err)
+	}
+}
+
+// Flushes the samples, updates the header and closes the file.
+// Calling this method more than once has no effect.
+func (rec *WAVRecorder) finish() {
+	if rec.file == nil {
+		return
+	}
+
+	// An error reported by 'write' is not reported again
+	reported := (rec.err != nil)
+
+	if err := rec.writer.Flush(); (err != nil) && (rec.err == nil) {
+		rec.err = err
+	}
+	if _, err := rec.file.Seek(0, io.SeekStart); (err != nil) && (rec.err == nil) {
+		rec.err = err
+	}
+	rec.writeHeader(rec.file)
+	if err := rec.file.Close(); (err != nil) && (rec.err == nil) {
+		rec.err = err
+	}
+	rec.file = nil
+
+	if (rec.err != nil) && !reported {
+		rec.app.PrintfMsg("recording audio to \"%s\": %s", rec.path, rec.err)
+	} else if (rec.err == nil) && rec.app.Verbose {
+		rec.app.PrintfMsg("wrote %d audio samples to \"%s\"", rec.numSamples, rec.path)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/guntars-lemps/gospeccy/spectrum"
+	"time"
+)
+
+// Waits until a BASIC editor is ready for a command, and then types the line into it.
+// This function should run in a separate goroutine.
+func typeAtPrompt(app *spectrum.Application, speccy *spectrum.Spectrum48k, line string) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.HasTerminated:
+			return
+
+		case <-ticker.C:
+			if app.TerminationInProgress() {
+				return
+			}
+
+			ch := make(chan spectrum.BasicEditor)
+			speccy.CommandChannel <- spectrum.Cmd_GetBasicEditor{ch}
+			if editor := <-ch; editor != spectrum.BASIC_EDITOR_NONE {
+				events, err := spectrum.BasicLineInput(line, editor)
+				if err != nil {
+					app.PrintfMsg("%s", err)
+					return
+				}
+				speccy.CommandChannel <- spectrum.Cmd_PlayInput{events}
+				return
+			}
+		}
+	}
+}
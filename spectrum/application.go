@@ -19,6 +19,10 @@ type Application struct {
 
 	eventLoops []*EventLoop
 
+	// Tasks which have to finish after all event loops have terminated,
+	// such as releasing the resources of an output backend
+	shutdownTasks sync.WaitGroup
+
 	terminationInProgress bool
 	terminated            bool
 
@@ -157,6 +161,35 @@ func (app *Application) RequestExit() {
 	close(app.exitApp)
 }
 
+// Registers a task which has to finish before 'Wait' returns.
+// The returned function has to be called exactly once, when the task finishes.
+// The task should finish after 'HasTerminated' is closed,
+// or earlier if it turns out there is nothing to clean up.
+func (app *Application) AddShutdownTask() (done func()) {
+	app.shutdownTasks.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(app.shutdownTasks.Done)
+	}
+}
+
+// Blocks until the application has terminated and all shutdown tasks have finished.
+// This function does not request the application to exit.
+func (app *Application) Wait() {
+	<-app.HasTerminated
+	app.shutdownTasks.Wait()
+}
+
+// Requests the application to exit and blocks until it has fully stopped:
+// all event loops (the emulation, the keyboard, the display and audio receivers)
+// have terminated and all shutdown tasks have finished.
+// This is the call to use when embedding the emulator into another program.
+func (app *Application) StopAndWait() {
+	app.RequestExit()
+	app.Wait()
+}
+
 func (app *Application) TerminationInProgress() bool {
 	app.mutex.Lock()
 	a := app.terminationInProgress
@@ -0,0 +1,64 @@
+package spectrum
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// How long AutoLoadTape waits for the machine to become ready
+const autoLoadTimeout = 10 * time.Second
+
+// Waits until the machine is ready for a command, types the command which loads
+// a program from tape (LOAD "" in 48K BASIC, or selects "Tape Loader" in the 128K menu),
+// and starts the tape.
+//
+// If the machine does not become ready within a few seconds, for example because
+// a BASIC program is running, no keys are pressed and an error is returned.
+// If another program is loaded meanwhile, no keys are pressed either and nil is returned,
+// so that a program loaded later does not receive the LOAD command.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) AutoLoadTape() error {
+	app := speccy.app
+	deadline := time.Now().Add(autoLoadTimeout)
+	loadCount := atomic.LoadUint32(&speccy.loadCount)
+
+	modelCh := make(chan MachineModel)
+	speccy.CommandChannel <- Cmd_GetMachineModel{modelCh}
+	romType := ROM48
+	if <-modelCh != MODEL_48K {
+		romType = ROM128
+	}
+
+	for {
+		if app.TerminationInProgress() || app.Terminated() {
+			return nil
+		}
+		if atomic.LoadUint32(&speccy.loadCount) != loadCount {
+			// Superseded by another program
+			return nil
+		}
+
+		ch := make(chan bool)
+		if romType == ROM48 {
+			speccy.CommandChannel <- Cmd_AtBasicPrompt{ch}
+		} else {
+			speccy.CommandChannel <- Cmd_AtMenu128{ch}
+		}
+		if <-ch {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("auto-load: the machine is not ready for the LOAD command, type LOAD \"\" and call tapePlay()")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	done := make(chan bool)
+	speccy.Keyboard.CommandChannel <- Cmd_SendLoad{romType, done}
+	<-done
+
+	speccy.CommandChannel <- Cmd_PlayTape{}
+	return nil
+}
@@ -0,0 +1,315 @@
+package spectrum
+
+// Emulation of the AY-3-8912 programmable sound generator of the 128k Spectrum.
+//
+// The chip is accessed via port 0xFFFD (register select, register read) and
+// port 0xBFFD (register write). Register writes are recorded with their T-states
+// and the chip's output is generated at the end of each frame.
+
+// The number of CPU T-states per one step of the AY emulation.
+// The AY clock is half of the CPU clock, and the tone generators count at 1/8 of the AY clock.
+const ay_stepTStates = 16
+
+// The number of emulation steps averaged into one output sample
+const ay_stepsPerSample = 4
+
+// The number of samples produced by the AY emulation per frame of the 48k machine
+const AY_SAMPLES_PER_FRAME = TStatesPerFrame / (ay_stepTStates * ay_stepsPerSample)
+
+// Returns the number of samples produced by the AY emulation per frame of the specified length
+func ay_samplesPerFrame(tstatesPerFrame int) int {
+	return tstatesPerFrame / (ay_stepTStates * ay_stepsPerSample)
+}
+
+// Bits of register 13 (envelope shape)
+const (
+	ay_ENV_HOLD      = 0x01
+	ay_ENV_ALTERNATE = 0x02
+	ay_ENV_ATTACK    = 0x04
+	ay_ENV_CONTINUE  = 0x08
+)
+
+// Valid bits of the 16 registers
+var ay_registerMasks = [16]byte{
+	0xff, 0x0f, 0xff, 0x0f, 0xff, 0x0f, // Tone periods of channels A, B, C
+	0x1f,             // Noise period
+	0xff,             // Mixer
+	0x1f, 0x1f, 0x1f, // Volumes of channels A, B, C
+	0xff, 0xff, // Envelope period
+	0x0f,       // Envelope shape
+	0xff, 0xff, // I/O ports A and B
+}
+
+// The output level of a channel for each of the 16 volume levels, normalized to 0 .. 1.
+// The levels are logarithmic, as measured on a real chip.
+var AY_VolumeTable = [16]float32{
+	0x0000 / 65535.0, 0x0385 / 65535.0, 0x053D / 65535.0, 0x0770 / 65535.0,
+	0x0AD7 / 65535.0, 0x0FD5 / 65535.0, 0x15B0 / 65535.0, 0x230C / 65535.0,
+	0x2B4C / 65535.0, 0x43C1 / 65535.0, 0x5A4B / 65535.0, 0x732F / 65535.0,
+	0x9204 / 65535.0, 0xAFF1 / 65535.0, 0xD921 / 65535.0, 0xFFFF / 65535.0,
+}
+
+type ayRegisterWrite struct {
+	// The number of T-states since the beginning of the frame
+	TState int
+
+	Register byte
+	Value    byte
+}
+
+type AY struct {
+	registers        [16]byte
+	selectedRegister byte
+
+	// Register writes which have not been emulated yet
+	writes []ayRegisterWrite
+
+	// Tone generators
+	toneCounter [3]uint
+	toneOutput  [3]bool
+
+	// Noise generator
+	noiseCounter   uint
+	noiseShift     uint32 // 17-bit shift register
+	noisePrescaler bool   // The noise generator steps at half the rate of the tone generators
+
+	// Envelope generator
+	envCounter   uint
+	envStep      uint // 0 .. 15
+	envAttack    bool // Whether the envelope is currently rising
+	envHolding   bool
+	envVolume    uint
+	envPrescaler bool
+}
+
+func NewAY() *AY {
+	ay := &AY{}
+	ay.reset()
+	return ay
+}
+
+// Resets the chip and discards the pending register writes
+func (ay *AY) reset() {
+	*ay = AY{writes: ay.writes[0:0]}
+	ay.noiseShift = 1
+	ay.registers[7] = 0xff
+	ay.restartEnvelope()
+}
+
+// Handles a write to port 0xFFFD
+func (ay *AY) selectRegister(value byte) {
+	ay.selectedRegister = value & 0x0f
+}
+
+// Handles a read from port 0xFFFD.
+// The writes already recorded during the current frame are taken into account.
+func (ay *AY) readRegister() byte {
+	for i := len(ay.writes) - 1; i >= 0; i-- {
+		if ay.writes[i].Register == ay.selectedRegister {
+			return ay.writes[i].Value
+		}
+	}
+	return ay.registers[ay.selectedRegister]
+}
+
+// Handles a write to port 0xBFFD at the specified T-state
+func (ay *AY) writeRegister(tstate int, value byte) {
+	register := ay.selectedRegister
+	ay.writes = append(ay.writes, ayRegisterWrite{tstate, register, value & ay_registerMasks[register]})
+}
+
+// Writes the register immediately, for example when loading a snapshot
+func (ay *AY) setRegister(register, value byte) {
+	register &= 0x0f
+	ay.registers[register] = value & ay_registerMasks[register]
+	if register == 13 {
+		ay.restartEnvelope()
+	}
+}
+
+func (ay *AY) applyWrite(w ayRegisterWrite) {
+	ay.registers[w.Register] = w.Value
+
+	// Writing the envelope shape restarts the envelope, even if the value is the same
+	if w.Register == 13 {
+		ay.restartEnvelope()
+	}
+}
+
+func (ay *AY) restartEnvelope() {
+	ay.envCounter = 0
+	ay.envStep = 0
+	ay.envAttack = (ay.registers[13] & ay_ENV_ATTACK) != 0
+	ay.envHolding = false
+	ay.updateEnvelopeVolume()
+}
+
+func (ay *AY) updateEnvelopeVolume() {
+	if ay.envAttack {
+		ay.envVolume = ay.envStep
+	} else {
+		ay.envVolume = 15 - ay.envStep
+	}
+}
+
+// Advances the envelope by one step.
+//
+// The 8 distinct shapes:
+//
+//	0x00-0x03, 0x09  \___    0x0A  \/\/
+//	0x04-0x07, 0x0F  /___    0x0B  \‾‾‾
+//	0x08             \\\\    0x0C  ////
+//	0x0D             /‾‾‾    0x0E  /\/\
+func (ay *AY) envelopeStep() {
+	if ay.envHolding {
+		return
+	}
+
+	ay.envStep++
+	if ay.envStep <= 15 {
+		ay.updateEnvelopeVolume()
+		return
+	}
+
+	shape := ay.registers[13]
+	switch {
+	case (shape & ay_ENV_CONTINUE) == 0:
+		ay.envHolding = true
+		ay.envVolume = 0
+
+	case (shape & ay_ENV_HOLD) != 0:
+		if (shape & ay_ENV_ALTERNATE) != 0 {
+			ay.envAttack = !ay.envAttack
+		}
+		ay.envHolding = true
+		if ay.envAttack {
+			ay.envVolume = 15
+		} else {
+			ay.envVolume = 0
+		}
+
+	default:
+		if (shape & ay_ENV_ALTERNATE) != 0 {
+			ay.envAttack = !ay.envAttack
+		}
+		ay.envStep = 0
+		ay.updateEnvelopeVolume()
+	}
+}
+
+// Period registers equal to 0 behave like 1
+func ay_period(period uint) uint {
+	if period == 0 {
+		return 1
+	}
+	return period
+}
+
+// Emulates one step, and returns the outputs of the channels A, B and C (0 .. 1)
+func (ay *AY) step() [3]float32 {
+	r := &ay.registers
+
+	for ch := 0; ch < 3; ch++ {
+		ay.toneCounter[ch]++
+		if ay.toneCounter[ch] >= ay_period(uint(r[2*ch])|(uint(r[2*ch+1])<<8)) {
+			ay.toneCounter[ch] = 0
+			ay.toneOutput[ch] = !ay.toneOutput[ch]
+		}
+	}
+
+	ay.noisePrescaler = !ay.noisePrescaler
+	if ay.noisePrescaler {
+		ay.noiseCounter++
+		if ay.noiseCounter >= ay_period(uint(r[6])) {
+			ay.noiseCounter = 0
+			bit := (ay.noiseShift ^ (ay.noiseShift >> 3)) & 1
+			ay.noiseShift = (ay.noiseShift >> 1) | (bit << 16)
+		}
+	}
+
+	ay.envPrescaler = !ay.envPrescaler
+	if ay.envPrescaler {
+		ay.envCounter++
+		if ay.envCounter >= ay_period(uint(r[11])|(uint(r[12])<<8)) {
+			ay.envCounter = 0
+			ay.envelopeStep()
+		}
+	}
+
+	noiseOutput := (ay.noiseShift & 1) != 0
+
+	var out [3]float32
+	for ch := uint(0); ch < 3; ch++ {
+		toneDisabled := (r[7] & (1 << ch)) != 0
+		noiseDisabled := (r[7] & (8 << ch)) != 0
+		if (ay.toneOutput[ch] || toneDisabled) && (noiseOutput || noiseDisabled) {
+			volume := r[8+ch]
+			if (volume & 0x10) != 0 {
+				out[ch] = AY_VolumeTable[ay.envVolume]
+			} else {
+				out[ch] = AY_VolumeTable[volume&0x0f]
+			}
+		}
+	}
+
+	return out
+}
+
+// Emulates the chip for the duration of one frame, applying the register writes
+// at their T-states. Returns ay_samplesPerFrame(tstatesPerFrame) samples of the sum of the three
+// channels (0 .. 3), and the same number of samples of each channel A, B, C (0 .. 1).
+// The audio receiver is responsible for clamping the final mix.
+//
+// Writes beyond the end of the frame are moved to the next frame.
+func (ay *AY) frame_end(tstatesPerFrame int) (samples []float32, channels [3][]float32) {
+	numSamples := ay_samplesPerFrame(tstatesPerFrame)
+	samples = make([]float32, numSamples)
+	for ch := range channels {
+		channels[ch] = make([]float32, numSamples)
+	}
+
+	w := 0
+	for i := range samples {
+		var sum [3]float32
+		for j := 0; j < ay_stepsPerSample; j++ {
+			tstate := (i*ay_stepsPerSample + j) * ay_stepTStates
+			for (w < len(ay.writes)) && (ay.writes[w].TState <= tstate) {
+				ay.applyWrite(ay.writes[w])
+				w++
+			}
+			out := ay.step()
+			for ch := range sum {
+				sum[ch] += out[ch]
+			}
+		}
+
+		for ch := range channels {
+			channels[ch][i] = sum[ch] / ay_stepsPerSample
+			samples[i] += channels[ch][i]
+		}
+	}
+
+	// Replay the overflowing writes
+	n := 0
+	for _, write := range ay.writes[w:] {
+		if write.TState < tstatesPerFrame {
+			ay.applyWrite(write)
+		} else {
+			write.TState -= tstatesPerFrame
+			ay.writes[n] = write
+			n++
+		}
+	}
+	ay.writes = ay.writes[0:n]
+
+	return samples, channels
+}
+
+// Returns the contents of the registers and the selected register
+func (ay *AY) state() (registers [16]byte, selectedRegister byte) {
+	registers = ay.registers
+	for _, w := range ay.writes {
+		registers[w.Register] = w.Value
+	}
+	return registers, ay.selectedRegister
+}
@@ -0,0 +1,260 @@
+package spectrum
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Typing BASIC lines into the line editor of the 48k ROM.
+// The editor of the 128k ROM accepts keywords letter by letter.
+//
+// The 48k editor does not accept keywords letter by letter. Depending on the cursor mode,
+// a key produces either a keyword or a letter, so each keyword has to be entered
+// with the key sequence that produces its token:
+//
+//	K mode (start of a statement): a letter key enters a command, such as P for PRINT
+//	L mode: a letter key enters the letter
+//	E mode (CAPS SHIFT + SYMBOL SHIFT): a key enters a function, such as I for CODE
+//	SYMBOL SHIFT: a key enters an operator or a keyword, such as F for TO
+
+// Keys pressed at the same time
+type keyChord []uint
+
+type basicKeyword struct {
+	text  string
+	keys  []keyChord
+	kMode bool // Whether the keyword can be entered only in K mode
+}
+
+var basicKeywords []basicKeyword
+
+// The number of frames a key is held down, and the number of frames between keys
+const (
+	basicTyping_holdFrames    = 2
+	basicTyping_releaseFrames = 6
+)
+
+func init() {
+	letterKeys := map[byte]uint{
+		'A': KEY_A, 'B': KEY_B, 'C': KEY_C, 'D': KEY_D, 'E': KEY_E, 'F': KEY_F, 'G': KEY_G,
+		'H': KEY_H, 'I': KEY_I, 'J': KEY_J, 'K': KEY_K, 'L': KEY_L, 'M': KEY_M, 'N': KEY_N,
+		'O': KEY_O, 'P': KEY_P, 'Q': KEY_Q, 'R': KEY_R, 'S': KEY_S, 'T': KEY_T, 'U': KEY_U,
+		'V': KEY_V, 'W': KEY_W, 'X': KEY_X, 'Y': KEY_Y, 'Z': KEY_Z,
+		'1': KEY_1, '2': KEY_2, '3': KEY_3, '4': KEY_4, '5': KEY_5,
+		'6': KEY_6, '7': KEY_7, '8': KEY_8, '9': KEY_9, '0': KEY_0,
+	}
+
+	add := func(kMode bool, text string, keys ...keyChord) {
+		basicKeywords = append(basicKeywords, basicKeyword{text, keys, kMode})
+	}
+	eMode := keyChord{KEY_CapsShift, KEY_SymbolShift}
+
+	commands := map[byte]string{
+		'A': "NEW", 'B': "BORDER", 'C': "CONTINUE", 'D': "DIM", 'E': "REM", 'F': "FOR",
+		'G': "GO TO", 'H': "GO SUB", 'I': "INPUT", 'J': "LOAD", 'K': "LIST", 'L': "LET",
+		'M': "PAUSE", 'N': "NEXT", 'O': "POKE", 'P': "PRINT", 'Q': "PLOT", 'R': "RUN",
+		'S': "SAVE", 'T': "RANDOMIZE", 'U': "IF", 'V': "CLS", 'W': "DRAW", 'X': "CLEAR",
+		'Y': "RETURN", 'Z': "COPY",
+	}
+	for key, text := range commands {
+		add(true, text, keyChord{letterKeys[key]})
+	}
+	add(true, "GOTO", keyChord{KEY_G})
+	add(true, "GOSUB", keyChord{KEY_H})
+
+	functions := map[byte]string{
+		'A': "READ", 'B': "BIN", 'C': "LPRINT", 'D': "DATA", 'E': "TAN", 'F': "SGN",
+		'G': "ABS", 'H': "SQR", 'I': "CODE", 'J': "VAL", 'K': "LEN", 'L': "USR",
+		'M': "PI", 'N': "INKEY$", 'O': "PEEK", 'P': "TAB", 'Q': "SIN", 'R': "INT",
+		'S': "RESTORE", 'T': "RND", 'U': "CHR$", 'V': "LLIST", 'W': "COS", 'X': "EXP",
+		'Y': "STR$", 'Z': "LN",
+	}
+	for key, text := range functions {
+		add(false, text, eMode, keyChord{letterKeys[key]})
+	}
+
+	symbolShiftedFunctions := map[byte]string{
+		'B': "BRIGHT", 'C': "PAPER", 'E': "ATN", 'H': "CIRCLE", 'I': "IN", 'J': "VAL$",
+		'K': "SCREEN$", 'L': "ATTR", 'M': "INVERSE", 'N': "OVER", 'O': "OUT", 'Q': "ASN",
+		'R': "VERIFY", 'T': "MERGE", 'V': "FLASH", 'W': "ACS", 'X': "INK", 'Z': "BEEP",
+		'A': "~", 'D': "\\", 'F': "{", 'G': "}", 'S': "|", 'U': "]", 'Y': "[",
+		'1': "DEF FN", '2': "FN", '3': "LINE", '4': "OPEN #", '5': "CLOSE #",
+		'6': "MOVE", '7': "ERASE", '8': "POINT", '9': "CAT", '0': "FORMAT",
+	}
+	for key, text := range symbolShiftedFunctions {
+		add(false, text, eMode, keyChord{KEY_SymbolShift, letterKeys[key]})
+	}
+
+	// The characters typed with SYMBOL SHIFT are in 'symbolShiftRunes'
+	symbolShiftedKeywords := map[byte]string{
+		'A': "STOP", 'D': "STEP", 'E': ">=", 'F': "TO", 'G': "THEN", 'I': "AT",
+		'Q': "<=", 'S': "NOT", 'U': "OR", 'W': "<>", 'Y': "AND",
+	}
+	for key, text := range symbolShiftedKeywords {
+		add(false, text, keyChord{KEY_SymbolShift, letterKeys[key]})
+	}
+
+	// Prefer the longest match, for example INKEY$ over INK
+	sort.Sort(byKeywordLength(basicKeywords))
+}
+
+type byKeywordLength []basicKeyword
+
+func (a byKeywordLength) Len() int      { return len(a) }
+func (a byKeywordLength) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byKeywordLength) Less(i, j int) bool {
+	if len(a[i].text) != len(a[j].text) {
+		return len(a[i].text) > len(a[j].text)
+	}
+	return a[i].text < a[j].text
+}
+
+func isLetter(c byte) bool {
+	return ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z'))
+}
+
+// Returns the keyword at position 'i' of 'line', if any
+func matchBasicKeyword(line string, i int, kMode bool) (basicKeyword, bool) {
+	for _, keyword := range basicKeywords {
+		if keyword.kMode != kMode {
+			continue
+		}
+		n := len(keyword.text)
+		if (len(line)-i < n) || !strings.EqualFold(line[i:i+n], keyword.text) {
+			continue
+		}
+		// A keyword must not be a part of a longer name, such as AT in "bat"
+		if isLetter(keyword.text[0]) && (i > 0) && isLetter(line[i-1]) {
+			continue
+		}
+		if isLetter(keyword.text[n-1]) && (len(line) > i+n) && isLetter(line[i+n]) {
+			continue
+		}
+		return keyword, true
+	}
+	return basicKeyword{}, false
+}
+
+// Returns the key chords which enter the BASIC line into the editor of the 48k ROM,
+// assuming the editor is empty and in K mode. The ENTER key is not included.
+func basicLineKeys(line string) ([]keyChord, error) {
+	var keys []keyChord
+
+	kMode := true
+	inString := false
+	inComment := false
+	for i := 0; i < len(line); {
+		c, size := utf8.DecodeRuneInString(line[i:])
+
+		if inComment {
+			// The rest of the line after REM is entered as is
+		} else if inString {
+			if c == '"' {
+				inString = false
+			}
+		} else {
+			if c == ' ' {
+				// The editor inserts spaces around keywords automatically
+				i++
+				continue
+			}
+
+			var keyword basicKeyword
+			found := false
+			if kMode {
+				keyword, found = matchBasicKeyword(line, i, true)
+			}
+			if !found {
+				keyword, found = matchBasicKeyword(line, i, false)
+			}
+			if found {
+				keys = append(keys, keyword.keys...)
+				kMode = (keyword.text == "THEN")
+				inComment = (keyword.text == "REM")
+				i += len(keyword.text)
+				if inComment && (i < len(line)) && (line[i] == ' ') {
+					i++
+				}
+				continue
+			}
+
+			if c == '"' {
+				inString = true
+			}
+		}
+
+		chord, err := characterKeys(c)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, chord)
+
+		// A colon starts a new statement, a line number does not end the K mode
+		if (c == ':') && !inString && !inComment {
+			kMode = true
+		} else if !((c >= '0') && (c <= '9')) {
+			kMode = false
+		}
+		i += size
+	}
+
+	return keys, nil
+}
+
+// Returns the key chord which types the character as is, not as a keyword
+func characterKeys(c rune) (keyChord, error) {
+	sequence, ok := runeKeyMap[c]
+	if !ok || (c == '\n') {
+		return nil, errors.New("cannot type character '" + string(c) + "'")
+	}
+	return keyChord(sequence), nil
+}
+
+// Returns the key chords which enter the BASIC line into the editor of the 128k ROM.
+// The editor accepts keywords letter by letter, so the line is typed as is.
+func basicLineKeys128(line string) ([]keyChord, error) {
+	var keys []keyChord
+	for _, c := range line {
+		chord, err := characterKeys(c)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, chord)
+	}
+	return keys, nil
+}
+
+// Returns input events which type the BASIC line into the specified editor
+// and press ENTER. The editor is assumed to be waiting for a command with
+// an empty line (see Cmd_GetBasicEditor). In the 48k editor, the line
+// is in K mode, which is the case at the "0 OK" prompt.
+func BasicLineInput(line string, editor BasicEditor) ([]InputEvent, error) {
+	var keys []keyChord
+	var err error
+	if editor == BASIC_EDITOR_128K {
+		keys, err = basicLineKeys128(line)
+	} else {
+		keys, err = basicLineKeys(line)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, keyChord{KEY_Enter})
+
+	var events []InputEvent
+	frame := uint(0)
+	for _, chord := range keys {
+		for _, key := range chord {
+			events = append(events, InputEvent{Frame: frame, Down: true, Code: key})
+		}
+		frame += basicTyping_holdFrames
+		for _, key := range chord {
+			events = append(events, InputEvent{Frame: frame, Down: false, Code: key})
+		}
+		frame += basicTyping_releaseFrames
+	}
+
+	return events, nil
+}
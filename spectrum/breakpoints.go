@@ -0,0 +1,141 @@
+package spectrum
+
+import (
+	"github.com/guntars-lemps/gospeccy/formats"
+)
+
+type Cmd_SetBreakpoint struct {
+	// Sets or clears the breakpoint at the specified address
+	Address uint16
+	Enable  bool
+}
+type Cmd_ClearBreakpoints struct{}
+type Cmd_GetBreakpoints struct {
+	// Receives the addresses of the breakpoints, in ascending order
+	Chan chan<- []uint16
+}
+
+// The state of the execution breakpoints.
+// Except for the listeners, it is accessed only from the emulation goroutine.
+type breakpoints struct {
+	// One entry for each address. Nil if there are no breakpoints,
+	// so that the check performed before each instruction is cheap.
+	set   *[0x10000]bool
+	count int
+
+	// Whether the emulation has stopped in the middle of a frame
+	// at a breakpoint or at a watchpoint
+	stopped bool
+
+	// Whether the breakpoint at the current PC has already been reported,
+	// so that the instruction is executed when the emulation is resumed
+	skip bool
+
+	listeners []func(cpu formats.CpuState)
+}
+
+// Causes the emulation to pause when the CPU is about to execute the instruction
+// at the specified address. The machine stays frozen in the middle of the frame
+// until 'Resume' is called. This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) SetBreakpoint(address uint16) {
+	speccy.CommandChannel <- Cmd_SetBreakpoint{address, true}
+}
+
+// This function must not be called from the emulation goroutine
+func (speccy *Spectrum48k) ClearBreakpoint(address uint16) {
+	speccy.CommandChannel <- Cmd_SetBreakpoint{address, false}
+}
+
+// This function must not be called from the emulation goroutine
+func (speccy *Spectrum48k) ClearBreakpoints() {
+	speccy.CommandChannel <- Cmd_ClearBreakpoints{}
+}
+
+// Returns the addresses of the breakpoints, in ascending order.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) Breakpoints() []uint16 {
+	ch := make(chan []uint16)
+	speccy.CommandChannel <- Cmd_GetBreakpoints{ch}
+	return <-ch
+}
+
+// Registers a function to be called whenever a breakpoint is hit.
+// The function receives the CPU registers and runs in a separate goroutine.
+func (speccy *Spectrum48k) AddBreakpointListener(f func(cpu formats.CpuState)) {
+	speccy.paused_mutex.Lock()
+	speccy.breakpoints.listeners = append(speccy.breakpoints.listeners, f)
+	speccy.paused_mutex.Unlock()
+}
+
+func (b *breakpoints) setBreakpoint(address uint16, enable bool) {
+	if b.set == nil {
+		if !enable {
+			return
+		}
+		b.set = new([0x10000]bool)
+	}
+
+	if b.set[address] != enable {
+		b.set[address] = enable
+		if enable {
+			b.count++
+		} else {
+			b.count--
+		}
+	}
+
+	if b.count == 0 {
+		b.set = nil
+	}
+}
+
+func (b *breakpoints) clear() {
+	b.set = nil
+	b.count = 0
+}
+
+func (b *breakpoints) addresses() []uint16 {
+	addresses := []uint16{}
+	if b.set != nil {
+		for address, enabled := range b.set {
+			if enabled {
+				addresses = append(addresses, uint16(address))
+			}
+		}
+	}
+	return addresses
+}
+
+// Called before executing an instruction if there are any breakpoints.
+// Returns true if the emulation has to stop.
+func (speccy *Spectrum48k) breakpointTrap() bool {
+	b := &speccy.breakpoints
+
+	if b.skip {
+		b.skip = false
+		return false
+	}
+	if !b.set[speccy.Cpu.PC()] {
+		return false
+	}
+
+	b.stopped = true
+	b.skip = true
+	speccy.Pause()
+
+	// The listeners may run interpreter code, which cannot run while
+	// another command of the interpreter is waiting for a frame
+	speccy.releaseFrameWaiters()
+
+	cpu := speccy.cpuState()
+	cpu.Tstate = uint(speccy.ula.cpuTState())
+
+	speccy.paused_mutex.Lock()
+	listeners := b.listeners
+	speccy.paused_mutex.Unlock()
+	for _, f := range listeners {
+		go f(cpu)
+	}
+
+	return true
+}
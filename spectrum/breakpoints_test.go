@@ -0,0 +1,22 @@
+package spectrum
+
+import (
+	"testing"
+)
+
+func TestBreakpointReleasesFrameWaiters(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	done := make(chan bool, 1)
+	speccy.CommandChannel <- Cmd_Sync{done}
+	speccy.Breakpoints() // Wait until the command loop has handled Cmd_Sync
+
+	speccy.breakpoints.setBreakpoint(0x8000, true)
+	speccy.Cpu.SetPC(0x8000)
+	if !speccy.breakpointTrap() {
+		t.Fatalf("expected the emulation to stop at the breakpoint")
+	}
+	if receiveBool(t, done) {
+		t.Errorf("expected sync to fail at the breakpoint")
+	}
+}
@@ -0,0 +1,188 @@
+package spectrum
+
+// The first T-state of a frame during which the ULA of the 48k machine delays the CPU (with late timings).
+// In general, the contention starts one T-state before the ULA reads the first byte of the screen.
+const FIRST_CONTENDED_TSTATE = FIRST_SCREEN_BYTE - 1
+
+// The delay pattern repeats every 8 T-states while the ULA is reading the screen
+var contentionPattern = [8]int{6, 5, 4, 3, 2, 1, 0, 0}
+
+// Returns the number of T-states by which the ULA delays the CPU
+// when the CPU accesses contended memory or the ULA at the specified T-state
+func (ula *ULA) contentionDelay(tstate int) int {
+	t := tstate - (ula.timings.FirstScreenByte - 1)
+	if (t < 0) || (t >= ScreenHeight*ula.timings.TStatesPerLine) {
+		return 0
+	}
+
+	x := t % ula.timings.TStatesPerLine
+	if x >= LINE_SCREEN {
+		return 0
+	}
+
+	return contentionPattern[x%8]
+}
+
+// Returns the current T-state of the CPU within the frame, including the contention delays
+func (ula *ULA) cpuTState() int {
+	return ula.z80.GetTstates() + ula.contentionTStates
+}
+
+// Delays the CPU by the number of T-states, so that the frame ends earlier
+// in terms of the T-states counted by the CPU
+func (ula *ULA) delayCPU(tstates int) {
+	ula.contentionTStates += tstates
+	ula.z80.EventNextEvent -= tstates
+}
+
+// Returns the T-state at which the next memory or I/O cycle of the current instruction starts
+func (ula *ULA) cycleTState() int {
+	return ula.cpuTState() + ula.cycleTStates
+}
+
+// Called before the CPU executes an instruction
+func (ula *ULA) instructionStart() {
+	ula.cycleTStates = 0
+	ula.m1Cycle = true
+	ula.indexPrefix = false
+}
+
+// Accounts for a memory cycle of the current instruction. If 'contended' is true,
+// the contention delay at the start of the cycle is applied to the CPU.
+// 'value' is the byte read or written. Returns the T-state at which the memory is accessed.
+//
+// The CPU reports the T-states at instruction boundaries only, so the cycles are timed
+// by their lengths: 4 T-states for an opcode fetch (M1), and 3 T-states for the other
+// memory reads and writes. The T-states which some instructions spend on internal
+// operations between the memory cycles are not taken into account.
+func (ula *ULA) memoryCycle(contended bool, value byte) int {
+	if contended {
+		ula.delayCPU(ula.contentionDelay(ula.cycleTState()))
+	}
+	tstate := ula.cycleTState()
+
+	if ula.m1Cycle {
+		ula.cycleTStates += 4
+
+		// A prefix is followed by another opcode fetch, except for DD CB and FD CB:
+		// the displacement and the opcode which follow them are read by normal memory reads
+		switch value {
+		case 0xdd, 0xfd, 0xed:
+			ula.m1Cycle = true
+		case 0xcb:
+			ula.m1Cycle = !ula.indexPrefix
+		default:
+			ula.m1Cycle = false
+		}
+		ula.indexPrefix = (value == 0xdd) || (value == 0xfd)
+	} else {
+		ula.cycleTStates += 3
+	}
+
+	return tstate
+}
+
+// Accounts for the I/O cycle of an IN or OUT instruction. If 'contended' is true,
+// the contention delay is applied to the CPU. Returns the T-state at which the port
+// is accessed, which includes the contention delay if it is applied or if the ULA
+// emulation is accurate.
+func (ula *ULA) ioCycle(port uint16, contended bool) int {
+	tstate := ula.cycleTState()
+	delay := ula.ioCycleTStates(port, tstate) - 4
+	if contended {
+		ula.delayCPU(delay)
+	}
+
+	// The next cycle starts after the delay, if it has been applied
+	ula.cycleTStates += 4
+
+	if contended || ula.accurateEmulation {
+		return tstate + delay
+	}
+	return tstate
+}
+
+func isContendedAddress(address uint16) bool {
+	return (address >= 0x4000) && (address < 0x8000)
+}
+
+// Returns the number of T-states taken by the I/O cycle of an IN or OUT instruction
+// which starts at the specified T-state. Without contention, the cycle takes 4 T-states.
+//
+// The cycle is contended if the ULA is addressed (bit 0 of the port is reset),
+// or if the high byte of the port looks like an address in contended memory:
+//
+//	high byte   bit 0   pattern
+//	contended   0       C:1, C:3
+//	contended   1       C:1, C:1, C:1, C:1
+//	other       0       N:1, C:3
+//	other       1       N:4
+//
+// where C:n means "apply the contention delay, then wait n T-states"
+// and N:n means "wait n T-states".
+func (ula *ULA) ioCycleTStates(port uint16, tstate int) int {
+	t := tstate
+	contend := func(n int) {
+		t += ula.contentionDelay(t) + n
+	}
+
+	ulaPort := (port & 0x0001) == 0
+	switch {
+	case isContendedAddress(port) && ulaPort:
+		contend(1)
+		contend(3)
+	case isContendedAddress(port):
+		contend(1)
+		contend(1)
+		contend(1)
+		contend(1)
+	case ulaPort:
+		t += 1
+		contend(3)
+	default:
+		t += 4
+	}
+
+	return t - tstate
+}
+
+// The T-state at which a port read returns the first byte fetched by the ULA
+// of the 48k machine (the bitmap byte at 0x4000), with late timings.
+// In general, it is two T-states after the ULA starts reading the screen.
+const FIRST_FLOATING_BUS_TSTATE = FIRST_SCREEN_BYTE + 2
+
+// Returns the value of the floating bus at the specified T-state: the value read
+// from a port to which no device responds. While the ULA is reading the screen,
+// the bus holds the byte being fetched by the ULA, otherwise it holds 0xFF.
+//
+// Every 8 T-states of a screen line, the ULA fetches the bitmap and attribute bytes
+// of two adjacent 8x1 cells, and then leaves the bus idle for 4 T-states:
+//
+//	T-state   0       1          2         3            4 ... 7
+//	value     bitmap  attribute  bitmap+1  attribute+1  0xFF
+func (ula *ULA) floatingBus(tstate int) byte {
+	t := tstate - (ula.timings.FirstScreenByte + 2)
+	if (t < 0) || (t >= ScreenHeight*ula.timings.TStatesPerLine) {
+		return 0xff
+	}
+
+	x := t % ula.timings.TStatesPerLine
+	if x >= LINE_SCREEN {
+		return 0xff
+	}
+	y := uint(t / ula.timings.TStatesPerLine)
+
+	column := uint(x/8) * 2
+	switch x % 8 {
+	case 2, 3:
+		column++
+	case 4, 5, 6, 7:
+		return 0xff
+	}
+
+	screen := ula.memory.screenData()
+	if (x % 2) == 0 {
+		return screen[xy_to_screenAddr(uint8(column*8), uint8(y))-SCREEN_BASE_ADDR]
+	}
+	return screen[ATTR_BASE_ADDR-SCREEN_BASE_ADDR+(y/8)*ScreenWidth_Attr+column]
+}
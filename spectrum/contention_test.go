@@ -0,0 +1,124 @@
+package spectrum
+
+import "testing"
+
+// A memory or I/O cycle of an instruction, and the contention delay expected
+// at its start. The delays follow the contention tables of the FUSE emulator,
+// where the 48k ULA delays the CPU by 6, 5, 4, 3, 2, 1, 0, 0 T-states
+// starting at T-state 14335.
+type testCycle struct {
+	port    bool
+	address uint16
+	delay   int
+}
+
+func TestContentionPerCycle(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   []byte
+		cycles []testCycle
+
+		// The T-state at which the instruction ends, without internal operations
+		end int
+	}{
+		{
+			// pc:4, pc+1:3, pc+2:3, nn:3
+			name: "LD A,(0x4000) at 0x4000",
+			code: []byte{0x3a, 0x00, 0x40},
+			cycles: []testCycle{
+				{false, 0x4000, 6}, // 14335: 6
+				{false, 0x4001, 4}, // 14345: 4
+				{false, 0x4002, 5}, // 14352: 5
+				{false, 0x4000, 5}, // 14360: 5
+			},
+			end: 14335 + 13 + 20,
+		},
+		{
+			// pc:4, pc+1:4, IO (N:1, C:3)
+			name: "IN A,(C) at 0x4000 with BC=0x00FE",
+			code: []byte{0xed, 0x78},
+			cycles: []testCycle{
+				{false, 0x4000, 6}, // 14335: 6
+				{false, 0x4001, 4}, // 14345: 4
+				{true, 0x00fe, 3},  // 14353: N:1, then C:3 at 14354: 3
+			},
+			end: 14335 + 12 + 6 + 4 + 3,
+		},
+		{
+			// pc:4, pc+1:4, pc+2:3, pc+3:3, and the internal operations which are not timed
+			name: "SET 0,(IX+1) at 0x4000",
+			code: []byte{0xdd, 0xcb, 0x01, 0xc6},
+			cycles: []testCycle{
+				{false, 0x4000, 6}, // 14335: 6
+				{false, 0x4001, 4}, // 14345: 4
+				{false, 0x4002, 4}, // 14353: 4
+				{false, 0x4003, 5}, // 14360: 5
+			},
+			end: 14335 + 14 + 19,
+		},
+	}
+
+	for _, test := range tests {
+		speccy := newTestSpectrum()
+		ula := speccy.ula
+		memory := speccy.Memory
+		speccy.Cpu.EventNextEvent = TStatesPerFrame
+
+		for i, b := range test.code {
+			memory.Write(0x4000+uint16(i), b)
+		}
+
+		memory.cpuCycles, memory.contentionActive = true, true
+		ula.delayCPU(FIRST_CONTENDED_TSTATE)
+		ula.instructionStart()
+
+		for i, cycle := range test.cycles {
+			before := ula.cpuTState()
+			if cycle.port {
+				speccy.Ports.Read(cycle.address)
+			} else {
+				memory.Read(cycle.address)
+			}
+			if delay := ula.cpuTState() - before; delay != cycle.delay {
+				t.Errorf("%s: cycle %d: expected a delay of %d T-states, got %d", test.name, i, cycle.delay, delay)
+			}
+		}
+
+		if end := ula.cycleTState(); end != test.end {
+			t.Errorf("%s: expected the instruction to end at T-state %d, got %d", test.name, test.end, end)
+		}
+	}
+}
+
+func TestOutDelaysCPU(t *testing.T) {
+	speccy := newTestSpectrum()
+	ula := speccy.ula
+	memory := speccy.Memory
+	speccy.Cpu.EventNextEvent = TStatesPerFrame
+
+	// OUT (0xfe),A with A=0x02 at 0x8000: pc:4, pc+1:3, IO (N:1, C:3).
+	// The I/O cycle starts at T-state 14335, the ULA delays it by 5 T-states at 14336.
+	memory.Write(0x8000, 0xd3)
+	memory.Write(0x8001, 0xfe)
+
+	memory.cpuCycles, memory.contentionActive = true, true
+	ula.delayCPU(FIRST_CONTENDED_TSTATE - 7)
+	ula.instructionStart()
+
+	memory.Read(0x8000)
+	memory.Read(0x8001)
+	before := ula.cpuTState()
+	speccy.Ports.Write(0x02fe, 0x01)
+
+	if delay := ula.cpuTState() - before; delay != 5 {
+		t.Errorf("expected the OUT to delay the CPU by 5 T-states, got %d", delay)
+	}
+	if end := ula.cycleTState(); end != FIRST_CONTENDED_TSTATE+4+5 {
+		t.Errorf("expected the instruction to end at T-state %d, got %d", FIRST_CONTENDED_TSTATE+4+5, end)
+	}
+
+	events := speccy.Ports.borderEvents
+	if last := events[len(events)-1]; (last.Color != 1) || (last.TState != FIRST_CONTENDED_TSTATE+5) {
+		t.Errorf("expected the border to change to 1 at T-state %d, got %+v", FIRST_CONTENDED_TSTATE+5, last)
+	}
+}
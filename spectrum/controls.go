@@ -0,0 +1,242 @@
+package spectrum
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Maps the joystick directions and the fire button to Spectrum keys.
+// This is useful for games which do not support the Kempston joystick.
+type ControlPreset struct {
+	Name string
+
+	// Logical key codes, indexed by KEMPSTON_FIRE, KEMPSTON_UP, ...
+	// The value CONTROL_KEMPSTON leaves the control on the Kempston interface.
+	Keys [5]uint
+}
+
+// A control which is not mapped to a key, but drives the Kempston interface.
+// Its name in the textual form of a preset is "kempston".
+const CONTROL_KEMPSTON = ^uint(0)
+
+// The order of keys in the textual form of a preset
+var controlPresetOrder = []uint{KEMPSTON_UP, KEMPSTON_DOWN, KEMPSTON_LEFT, KEMPSTON_RIGHT, KEMPSTON_FIRE}
+
+// Names of keys which can appear in a preset
+var controlKeyNames = map[string]uint{
+	"space": KEY_Space,
+	"enter": KEY_Enter,
+	"caps":  KEY_CapsShift,
+	"sym":   KEY_SymbolShift,
+}
+
+// Built-in presets.
+// The name "kempston" is reserved for the Kempston joystick itself.
+var builtinControlPresets = map[string]string{
+	"qaop":      "q,a,o,p,m",
+	"cursor":    "7,6,5,8,0",
+	"opspace":   "q,a,o,p,space",
+	"sinclair1": "9,8,6,7,0",
+	"sinclair2": "4,3,1,2,5",
+}
+
+func init() {
+	for name, seq := range SDL_KeyMap {
+		if (len(seq) == 1) && (len(name) == 1) && strings.Contains("0123456789abcdefghijklmnopqrstuvwxyz", name) {
+			controlKeyNames[name] = seq[0]
+		}
+	}
+}
+
+// Parses a preset in the form "UP,DOWN,LEFT,RIGHT,FIRE", for example "q,a,o,p,space".
+// A key is a letter, a digit, "space", "enter", "caps", "sym" or "kempston".
+func ParseControlPreset(name, keys string) (*ControlPreset, error) {
+	fields := strings.Split(keys, ",")
+	if len(fields) != len(controlPresetOrder) {
+		return nil, errors.New("invalid controls \"" + keys + "\": expected 5 keys (up,down,left,right,fire)")
+	}
+
+	preset := &ControlPreset{Name: name}
+	for i, field := range fields {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "kempston" {
+			preset.Keys[controlPresetOrder[i]] = CONTROL_KEMPSTON
+			continue
+		}
+		keyCode, ok := controlKeyNames[field]
+		if !ok {
+			return nil, errors.New("invalid controls \"" + keys + "\": unknown key \"" + field + "\"")
+		}
+		preset.Keys[controlPresetOrder[i]] = keyCode
+	}
+
+	return preset, nil
+}
+
+// Returns the preset in the form accepted by ParseControlPreset
+func (preset *ControlPreset) KeysString() string {
+	var fields []string
+	for _, logicalCode := range controlPresetOrder {
+		if preset.Keys[logicalCode] == CONTROL_KEMPSTON {
+			fields = append(fields, "kempston")
+			continue
+		}
+		for name, keyCode := range controlKeyNames {
+			if keyCode == preset.Keys[logicalCode] {
+				fields = append(fields, name)
+				break
+			}
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// Files containing user-defined presets. The file in the settings directory
+// of the loaded program has precedence over the global file.
+func controlPresetFiles() []string {
+	files := []string{}
+	if dir, err := ProgramSettingsDir(); err == nil {
+		files = append(files, path.Join(dir, "controls"))
+	}
+	files = append(files, path.Join(DefaultUserDir, "controls"))
+	return files
+}
+
+// Reads user-defined presets from a file with lines in the form "NAME KEYS".
+// A missing file is not an error.
+func readControlPresets(filePath string) (map[string]string, error) {
+	presets := make(map[string]string)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return presets, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) == 0) || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: invalid line \"%s\"", filePath, scanner.Text())
+		}
+		presets[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return presets, nil
+}
+
+// Returns the preset with the specified name, or nil for "kempston".
+// User-defined presets have precedence over the built-in ones.
+// A string in the form "UP,DOWN,LEFT,RIGHT,FIRE" is accepted as well.
+func FindControlPreset(name string) (*ControlPreset, error) {
+	if name == "kempston" {
+		return nil, nil
+	}
+	if strings.Contains(name, ",") {
+		return ParseControlPreset(name, name)
+	}
+
+	for _, filePath := range controlPresetFiles() {
+		presets, err := readControlPresets(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if keys, ok := presets[name]; ok {
+			return ParseControlPreset(name, keys)
+		}
+	}
+
+	if keys, ok := builtinControlPresets[name]; ok {
+		return ParseControlPreset(name, keys)
+	}
+
+	return nil, errors.New("no such controls preset: \"" + name + "\"")
+}
+
+// Returns the names of all available presets, sorted
+func ControlPresetNames() []string {
+	unique := map[string]bool{"kempston": true}
+	for name := range builtinControlPresets {
+		unique[name] = true
+	}
+	for _, filePath := range controlPresetFiles() {
+		presets, err := readControlPresets(filePath)
+		if err != nil {
+			continue
+		}
+		for name := range presets {
+			unique[name] = true
+		}
+	}
+
+	var names []string
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Saves the preset as a user-defined one.
+// If 'perGame' is true, the preset is visible only while the current program is loaded.
+func SaveControlPreset(preset *ControlPreset, perGame bool) error {
+	if (preset.Name == "kempston") || strings.ContainsAny(preset.Name, ", \t") {
+		return errors.New("invalid preset name \"" + preset.Name + "\"")
+	}
+
+	var filePath string
+	if perGame {
+		dir, err := ProgramSettingsDir()
+		if err != nil {
+			return err
+		}
+		filePath = path.Join(dir, "controls")
+	} else {
+		err := os.MkdirAll(DefaultUserDir, 0755)
+		if err != nil {
+			return err
+		}
+		filePath = path.Join(DefaultUserDir, "controls")
+	}
+
+	presets, err := readControlPresets(filePath)
+	if err != nil {
+		return err
+	}
+	presets[preset.Name] = preset.KeysString()
+
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, name := range names {
+		_, err = fmt.Fprintf(file, "%s %s\n", name, presets[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
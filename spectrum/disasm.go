@@ -0,0 +1,392 @@
+package spectrum
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Z80 disassembler.
+//
+// The opcodes are decoded by splitting them into the bit fields x (bits 7-6),
+// y (bits 5-3) and z (bits 2-0), with y further split into p (bits 5-4) and q (bit 3).
+// Undocumented instructions are included: the IXH/IXL/IYH/IYL registers, SLL,
+// IN (C), OUT (C),0 and the DDCB/FDCB instructions which also copy the result to a register.
+// Mnemonics are upper-case, numbers are hexadecimal with a '$' prefix.
+// "NOP*" denotes an invalid instruction, or a prefix which is ignored by the CPU.
+
+var (
+	disasm_r    = [8]string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+	disasm_rp   = [4]string{"BC", "DE", "HL", "SP"}
+	disasm_rp2  = [4]string{"BC", "DE", "HL", "AF"}
+	disasm_cc   = [8]string{"NZ", "Z", "NC", "C", "PO", "PE", "P", "M"}
+	disasm_alu  = [8]string{"ADD A,", "ADC A,", "SUB ", "SBC A,", "AND ", "XOR ", "OR ", "CP "}
+	disasm_rot  = [8]string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL"}
+	disasm_im   = [8]string{"0", "0/1", "1", "2", "0", "0/1", "1", "2"}
+	disasm_x0z7 = [8]string{"RLCA", "RRCA", "RLA", "RRA", "DAA", "CPL", "SCF", "CCF"}
+	disasm_ed7  = [8]string{"LD I,A", "LD R,A", "LD A,I", "LD A,R", "RRD", "RLD", "NOP", "NOP"}
+	disasm_bli  = [4][4]string{
+		{"LDI", "CPI", "INI", "OUTI"},
+		{"LDD", "CPD", "IND", "OUTD"},
+		{"LDIR", "CPIR", "INIR", "OTIR"},
+		{"LDDR", "CPDR", "INDR", "OTDR"},
+	}
+)
+
+type disassembler struct {
+	read    func(address uint16) byte
+	address uint16
+
+	// The number of bytes decoded so far
+	length uint16
+
+	// "IX" or "IY" after a DD or FD prefix, otherwise an empty string
+	index string
+
+	// The displacement of (IX+d), read by the first call to 'indexed'
+	displacement    int8
+	displacementSet bool
+}
+
+func (d *disassembler) next() byte {
+	b := d.read(d.address + d.length)
+	d.length++
+	return b
+}
+
+func (d *disassembler) n() string {
+	return fmt.Sprintf("$%02X", d.next())
+}
+
+func (d *disassembler) nn() string {
+	lo := uint16(d.next())
+	hi := uint16(d.next())
+	return fmt.Sprintf("$%04X", (hi<<8)|lo)
+}
+
+// The target of a relative jump
+func (d *disassembler) rel() string {
+	e := int8(d.next())
+	return fmt.Sprintf("$%04X", d.address+d.length+uint16(e))
+}
+
+func (d *disassembler) hl() string {
+	if d.index != "" {
+		return d.index
+	}
+	return "HL"
+}
+
+// Returns "(HL)", or "(IX+d)" after reading the displacement
+func (d *disassembler) indexed() string {
+	if d.index == "" {
+		return "(HL)"
+	}
+	if !d.displacementSet {
+		d.displacement = int8(d.next())
+		d.displacementSet = true
+	}
+	if d.displacement < 0 {
+		return fmt.Sprintf("(%s-$%02X)", d.index, -int(d.displacement))
+	}
+	return fmt.Sprintf("(%s+$%02X)", d.index, d.displacement)
+}
+
+// Returns the name of the 8-bit register with the index 'i' (0-7).
+// After a DD or FD prefix, H and L are replaced by the halves of the index register,
+// unless the instruction also accesses the memory via (IX+d).
+func (d *disassembler) r(i byte, halves bool) string {
+	switch {
+	case i == 6:
+		return d.indexed()
+	case (i == 4) && halves && (d.index != ""):
+		return d.index + "H"
+	case (i == 5) && halves && (d.index != ""):
+		return d.index + "L"
+	}
+	return disasm_r[i]
+}
+
+func (d *disassembler) rp(p byte) string {
+	if p == 2 {
+		return d.hl()
+	}
+	return disasm_rp[p]
+}
+
+func (d *disassembler) rp2(p byte) string {
+	if p == 2 {
+		return d.hl()
+	}
+	return disasm_rp2[p]
+}
+
+// Decodes an unprefixed instruction, or an instruction following a DD or FD prefix
+func (d *disassembler) main() string {
+	op := d.next()
+
+	x, y, z := op>>6, (op>>3)&7, op&7
+	p, q := y>>1, y&1
+
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				return "NOP"
+			case 1:
+				return "EX AF,AF'"
+			case 2:
+				return "DJNZ " + d.rel()
+			case 3:
+				return "JR " + d.rel()
+			default:
+				return "JR " + disasm_cc[y-4] + "," + d.rel()
+			}
+		case 1:
+			if q == 0 {
+				return "LD " + d.rp(p) + "," + d.nn()
+			}
+			return "ADD " + d.hl() + "," + d.rp(p)
+		case 2:
+			switch y {
+			case 0:
+				return "LD (BC),A"
+			case 1:
+				return "LD A,(BC)"
+			case 2:
+				return "LD (DE),A"
+			case 3:
+				return "LD A,(DE)"
+			case 4:
+				return "LD (" + d.nn() + ")," + d.hl()
+			case 5:
+				return "LD " + d.hl() + ",(" + d.nn() + ")"
+			case 6:
+				return "LD (" + d.nn() + "),A"
+			default:
+				return "LD A,(" + d.nn() + ")"
+			}
+		case 3:
+			if q == 0 {
+				return "INC " + d.rp(p)
+			}
+			return "DEC " + d.rp(p)
+		case 4:
+			return "INC " + d.r(y, true)
+		case 5:
+			return "DEC " + d.r(y, true)
+		case 6:
+			dst := d.r(y, true)
+			return "LD " + dst + "," + d.n()
+		default:
+			return disasm_x0z7[y]
+		}
+
+	case 1:
+		if (y == 6) && (z == 6) {
+			return "HALT"
+		}
+		halves := (y != 6) && (z != 6)
+		dst := d.r(y, halves)
+		return "LD " + dst + "," + d.r(z, halves)
+
+	case 2:
+		return disasm_alu[y] + d.r(z, true)
+
+	default:
+		switch z {
+		case 0:
+			return "RET " + disasm_cc[y]
+		case 1:
+			if q == 0 {
+				return "POP " + d.rp2(p)
+			}
+			switch p {
+			case 0:
+				return "RET"
+			case 1:
+				return "EXX"
+			case 2:
+				return "JP (" + d.hl() + ")"
+			default:
+				return "LD SP," + d.hl()
+			}
+		case 2:
+			return "JP " + disasm_cc[y] + "," + d.nn()
+		case 3:
+			switch y {
+			case 0:
+				return "JP " + d.nn()
+			case 1:
+				return d.cb()
+			case 2:
+				return "OUT (" + d.n() + "),A"
+			case 3:
+				return "IN A,(" + d.n() + ")"
+			case 4:
+				return "EX (SP)," + d.hl()
+			case 5:
+				return "EX DE,HL"
+			case 6:
+				return "DI"
+			default:
+				return "EI"
+			}
+		case 4:
+			return "CALL " + disasm_cc[y] + "," + d.nn()
+		case 5:
+			if q == 0 {
+				return "PUSH " + d.rp2(p)
+			}
+			// CALL nn. The prefixes are handled by 'instruction'.
+			return "CALL " + d.nn()
+		case 6:
+			return disasm_alu[y] + d.n()
+		default:
+			return fmt.Sprintf("RST $%02X", y*8)
+		}
+	}
+}
+
+// Decodes the instruction following a CB prefix.
+// After DD or FD, the displacement precedes the opcode.
+func (d *disassembler) cb() string {
+	var operand string
+	if d.index != "" {
+		operand = d.indexed()
+	}
+
+	op := d.next()
+	x, y, z := op>>6, (op>>3)&7, op&7
+
+	if d.index == "" {
+		operand = disasm_r[z]
+	}
+
+	// Undocumented: the result is also copied to the register 'z'
+	copyTo := ""
+	if (d.index != "") && (z != 6) && (x != 1) {
+		copyTo = "," + disasm_r[z]
+	}
+
+	switch x {
+	case 0:
+		return disasm_rot[y] + " " + operand + copyTo
+	case 1:
+		return fmt.Sprintf("BIT %d,%s", y, operand)
+	case 2:
+		return fmt.Sprintf("RES %d,%s%s", y, operand, copyTo)
+	default:
+		return fmt.Sprintf("SET %d,%s%s", y, operand, copyTo)
+	}
+}
+
+// Decodes the instruction following an ED prefix
+func (d *disassembler) ed() string {
+	op := d.next()
+	x, y, z := op>>6, (op>>3)&7, op&7
+	p, q := y>>1, y&1
+
+	if x == 1 {
+		switch z {
+		case 0:
+			if y == 6 {
+				return "IN (C)"
+			}
+			return "IN " + disasm_r[y] + ",(C)"
+		case 1:
+			if y == 6 {
+				return "OUT (C),0"
+			}
+			return "OUT (C)," + disasm_r[y]
+		case 2:
+			if q == 0 {
+				return "SBC HL," + disasm_rp[p]
+			}
+			return "ADC HL," + disasm_rp[p]
+		case 3:
+			if q == 0 {
+				return "LD (" + d.nn() + ")," + disasm_rp[p]
+			}
+			return "LD " + disasm_rp[p] + ",(" + d.nn() + ")"
+		case 4:
+			return "NEG"
+		case 5:
+			if y == 1 {
+				return "RETI"
+			}
+			return "RETN"
+		case 6:
+			return "IM " + disasm_im[y]
+		default:
+			return disasm_ed7[y]
+		}
+	}
+
+	if (x == 2) && (z <= 3) && (y >= 4) {
+		return disasm_bli[y-4][z]
+	}
+
+	// Invalid instructions behave like two NOPs
+	return "NOP*"
+}
+
+func (d *disassembler) instruction() string {
+	switch d.read(d.address) {
+	case 0xcb:
+		d.length++
+		return d.cb()
+	case 0xed:
+		d.length++
+		return d.ed()
+	case 0xdd, 0xfd:
+		if d.read(d.address) == 0xdd {
+			d.index = "IX"
+		} else {
+			d.index = "IY"
+		}
+
+		// A prefix followed by another prefix only delays the interrupts
+		switch d.read(d.address + 1) {
+		case 0xdd, 0xed, 0xfd:
+			d.length = 1
+			return "NOP*"
+		}
+
+		d.length++
+		return d.main()
+	}
+	return d.main()
+}
+
+// Disassembles the instruction at the specified address.
+// The function 'read' returns the contents of the memory.
+// Returns the text of the instruction and its length in bytes.
+func Disassemble(read func(address uint16) byte, address uint16) (text string, length uint) {
+	d := &disassembler{read: read, address: address}
+	text = d.instruction()
+	return text, uint(d.length)
+}
+
+// Disassembles 'count' instructions starting at 'address', one line per instruction.
+// Each line contains the address, the bytes of the instruction and its text.
+func DisassembleListing(memory []byte, address uint16, count uint) string {
+	read := func(address uint16) byte {
+		return memory[address]
+	}
+
+	var listing strings.Builder
+	for i := uint(0); i < count; i++ {
+		text, length := Disassemble(read, address)
+
+		var hex string
+		for j := uint(0); j < length; j++ {
+			hex += fmt.Sprintf("%02X ", read(address+uint16(j)))
+		}
+		fmt.Fprintf(&listing, "%04X  %-12s %s\n", address, hex, text)
+
+		address += uint16(length)
+	}
+	return listing.String()
+}
@@ -79,6 +79,26 @@ const (
 	BORDER_TSTATE_ADJUSTMENT = 2
 )
 
+// The timings of the ULA, which depend on the machine model.
+// The constants above describe the 48k machine.
+type ULATimings struct {
+	TStatesPerFrame int
+	TStatesPerLine  int
+
+	// T-state when the first byte of the screen (16384) is displayed
+	FirstScreenByte int
+}
+
+var (
+	Timings48k  = ULATimings{TStatesPerFrame: TStatesPerFrame, TStatesPerLine: TSTATES_PER_LINE, FirstScreenByte: FIRST_SCREEN_BYTE}
+	Timings128k = ULATimings{TStatesPerFrame: 70908, TStatesPerLine: 228, FirstScreenByte: 14362}
+)
+
+// Returns the T-state which corresponds to pixel (0,0) on the host-machine display
+func (timings *ULATimings) DisplayStart() int {
+	return timings.FirstScreenByte - timings.TStatesPerLine*BORDER_TOP - ScreenBorderX/PIXELS_PER_TSTATE + BORDER_TSTATE_ADJUSTMENT
+}
+
 type RGBA struct {
 	R, G, B, A byte
 }
@@ -87,25 +107,6 @@ func (color RGBA) value32() uint32 {
 	return (uint32(color.A) << 24) | (uint32(color.R) << 16) | (uint32(color.G) << 8) | uint32(color.B)
 }
 
-var Palette [16]uint32 = [16]uint32{
-	RGBA{000, 000, 000, 255}.value32(),
-	RGBA{000, 000, 192, 255}.value32(),
-	RGBA{192, 000, 000, 255}.value32(),
-	RGBA{192, 000, 192, 255}.value32(),
-	RGBA{000, 192, 000, 255}.value32(),
-	RGBA{000, 192, 192, 255}.value32(),
-	RGBA{192, 192, 000, 255}.value32(),
-	RGBA{192, 192, 192, 255}.value32(),
-	RGBA{000, 000, 000, 255}.value32(),
-	RGBA{000, 000, 255, 255}.value32(),
-	RGBA{255, 000, 000, 255}.value32(),
-	RGBA{255, 000, 255, 255}.value32(),
-	RGBA{000, 255, 000, 255}.value32(),
-	RGBA{000, 255, 255, 255}.value32(),
-	RGBA{255, 255, 000, 255}.value32(),
-	RGBA{255, 255, 255, 255}.value32(),
-}
-
 func screenAddr_to_xy(screenAddr uint16) (x, y uint8) {
 	// address: [0 1 0 y7 y6 y2 y1 y0 / y5 y4 y3 x4 x3 x2 x1 x0]
 	x = uint8((screenAddr & 0x001f) << 3)
@@ -143,6 +144,12 @@ type DisplayData struct {
 
 	BorderEvents []BorderEvent
 
+	// The timings of the machine, needed to place the border events on the screen
+	Timings ULATimings
+
+	// The display receiver should repaint the whole screen, including the border
+	Repaint bool
+
 	// From structure Cmd_RenderFrame
 	CompletionTime_orNil chan<- time.Time
 }
@@ -155,18 +162,6 @@ type DisplayReceiver interface {
 	Close()
 }
 
-// Let 'addr' be in range 0x4000 ... 0x5800-1.
-// Then 'screenline_start_tstates[(addr-0x4000)/BytesPerLine]' is the T-state when the Spectrum
-// starts painting the screenline containing 'addr'.
-var screenline_start_tstates [ScreenHeight]int
-
-func init() {
-	for y := uint8(0); y < ScreenHeight; y++ {
-		addr := xy_to_screenAddr(0, y)
-		screenline_start_tstates[(addr-SCREEN_BASE_ADDR)/BytesPerLine] = FIRST_SCREEN_BYTE + int(y)*TSTATES_PER_LINE
-	}
-}
-
 func init() {
 	// Some sanity checks
 	Assert(ScreenBorderX <= LINE_RIGHT_BORDER*PIXELS_PER_TSTATE)
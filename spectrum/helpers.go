@@ -36,10 +36,13 @@ package spectrum
 
 import (
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -48,6 +51,7 @@ var DefaultUserDir = path.Join(os.Getenv("HOME"), ".config", "gospeccy")
 var srcDir string
 var customSearchPaths []string
 var downloadPath string
+var loadedProgramPath string
 var mutex sync.RWMutex
 
 func init() {
@@ -79,6 +83,62 @@ func SetDownloadPath(path string) {
 	mutex.Unlock()
 }
 
+// Records the path of the most recently loaded program.
+// This determines the directory returned by ProgramSettingsDir.
+func SetLoadedProgramPath(path string) {
+	mutex.Lock()
+	loadedProgramPath = path
+	mutex.Unlock()
+}
+
+// Returns the directory where files related to the specified program
+// (quick-saves, screenshots, pokes, configuration) are stored.
+// The directory is $HOME/.config/gospeccy/games/NAME-HASH, where NAME is derived
+// from the file name and HASH is the CRC-32 of the file's contents.
+func GameSettingsPath(programPath string) (string, error) {
+	data, err := ioutil.ReadFile(programPath)
+	if err != nil {
+		return "", err
+	}
+
+	name := path.Base(programPath)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	name = strings.Map(func(r rune) rune {
+		if (r == '/') || (r == ' ') || (r < 32) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	dirName := fmt.Sprintf("%s-%08x", name, crc32.ChecksumIEEE(data))
+	return path.Join(DefaultUserDir, "games", dirName), nil
+}
+
+// Returns the settings directory of the most recently loaded program.
+// The directory is created if it does not exist.
+// An error is returned if no program has been loaded.
+func ProgramSettingsDir() (string, error) {
+	mutex.RLock()
+	programPath := loadedProgramPath
+	mutex.RUnlock()
+
+	if programPath == "" {
+		return "", errors.New("no program has been loaded")
+	}
+
+	dir, err := GameSettingsPath(programPath)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
 func searchForValidPath(paths []string, fileName string) (string, error) {
 	for _, dir := range paths {
 		if _, err := os.Lstat(dir); err == nil {
@@ -176,6 +236,46 @@ func ScriptPath(fileName string) (string, error) {
 	return searchForValidPath(paths, fileName)
 }
 
+// Returns the names of the scripts (without the ".go" extension)
+// found in the directories searched by ScriptPath, sorted alphabetically.
+// A script present in several directories is listed only once.
+func ScriptNames() []string {
+	var (
+		currDir = "scripts"
+		userDir = path.Join(DefaultUserDir, "scripts")
+		srcDir  = path.Join(srcDir, "scripts")
+	)
+
+	var paths []string
+	paths = append(paths, currDir, userDir, srcDir)
+	appendCustomSearchPaths(&paths)
+
+	found := make(map[string]bool)
+	var names []string
+	for _, dir := range paths {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			// Ignore missing directories
+			continue
+		}
+
+		for _, file := range files {
+			if file.IsDir() || (path.Ext(file.Name()) != ".go") {
+				continue
+			}
+
+			name := strings.TrimSuffix(file.Name(), ".go")
+			if !found[name] {
+				found[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
 // Return a valid path for the specified font file,
 // or the original filename if the search did not find anything.
 //
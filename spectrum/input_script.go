@@ -0,0 +1,159 @@
+package spectrum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// An input event read from an input script
+type InputEvent struct {
+	// The frame (relative to the start of the playback) at which the event happens
+	Frame uint
+
+	Down bool
+
+	// Whether 'Code' is a Kempston joystick code (KEMPSTON_*) or a logical key code (KEY_*)
+	Joystick bool
+	Code     uint
+}
+
+// Names of keys and joystick directions, as used in input scripts
+var inputScriptKeyNames = map[string]uint{
+	"1": KEY_1, "2": KEY_2, "3": KEY_3, "4": KEY_4, "5": KEY_5,
+	"6": KEY_6, "7": KEY_7, "8": KEY_8, "9": KEY_9, "0": KEY_0,
+
+	"q": KEY_Q, "w": KEY_W, "e": KEY_E, "r": KEY_R, "t": KEY_T,
+	"y": KEY_Y, "u": KEY_U, "i": KEY_I, "o": KEY_O, "p": KEY_P,
+
+	"a": KEY_A, "s": KEY_S, "d": KEY_D, "f": KEY_F, "g": KEY_G,
+	"h": KEY_H, "j": KEY_J, "k": KEY_K, "l": KEY_L, "enter": KEY_Enter,
+
+	"caps": KEY_CapsShift, "z": KEY_Z, "x": KEY_X, "c": KEY_C, "v": KEY_V,
+	"b": KEY_B, "n": KEY_N, "m": KEY_M, "symbol": KEY_SymbolShift, "space": KEY_Space,
+}
+
+var inputScriptJoystickNames = map[string]uint{
+	"kempston-fire":  KEMPSTON_FIRE,
+	"kempston-up":    KEMPSTON_UP,
+	"kempston-down":  KEMPSTON_DOWN,
+	"kempston-left":  KEMPSTON_LEFT,
+	"kempston-right": KEMPSTON_RIGHT,
+}
+
+// Parses an input script.
+//
+// Each line of the script has the form "FRAME down|up KEY", for example:
+//
+//	# Press and release 'A'
+//	100 down a
+//	110 up a
+//	150 down kempston-fire
+//
+// FRAME is counted from the start of the playback and the events must be ordered by it.
+// KEY is a digit, a letter, "enter", "space", "caps", "symbol",
+// or one of "kempston-fire", "kempston-up", "kempston-down", "kempston-left", "kempston-right".
+// Empty lines and lines starting with '#' are ignored.
+func ReadInputScript(r io.Reader) ([]InputEvent, error) {
+	var events []InputEvent
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lineError := func(msg string) error {
+			return fmt.Errorf("input script, line %d: %s", lineNumber, msg)
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, lineError("expected \"FRAME down|up KEY\"")
+		}
+
+		frame, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, lineError("invalid frame number")
+		}
+		if (len(events) > 0) && (uint(frame) < events[len(events)-1].Frame) {
+			return nil, lineError("the events are not ordered by frame number")
+		}
+
+		event := InputEvent{Frame: uint(frame)}
+
+		switch fields[1] {
+		case "down":
+			event.Down = true
+		case "up":
+			event.Down = false
+		default:
+			return nil, lineError("expected \"down\" or \"up\"")
+		}
+
+		name := strings.ToLower(fields[2])
+		if code, isKey := inputScriptKeyNames[name]; isKey {
+			event.Code = code
+		} else if code, isJoystick := inputScriptJoystickNames[name]; isJoystick {
+			event.Joystick = true
+			event.Code = code
+		} else {
+			return nil, lineError("unknown key \"" + fields[2] + "\"")
+		}
+
+		events = append(events, event)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+type Cmd_PlayInput struct {
+	// The events, ordered by frame number.
+	// The playback starts with the next frame.
+	Events []InputEvent
+}
+
+// State of the playback of an input script
+type inputPlayback struct {
+	events []InputEvent
+	next   int  // Index of the next event to play
+	frame  uint // Number of frames since the start of the playback
+}
+
+// Injects the input events scheduled for the current frame.
+// Called at the beginning of each frame.
+func (speccy *Spectrum48k) playInput() {
+	playback := speccy.inputPlayback
+
+	for (playback.next < len(playback.events)) && (playback.events[playback.next].Frame <= playback.frame) {
+		event := playback.events[playback.next]
+
+		switch {
+		case event.Joystick && event.Down:
+			speccy.Joystick.KempstonDown(event.Code)
+		case event.Joystick && !event.Down:
+			speccy.Joystick.KempstonUp(event.Code)
+		case event.Down:
+			speccy.Keyboard.KeyDown(event.Code)
+		default:
+			speccy.Keyboard.KeyUp(event.Code)
+		}
+
+		playback.next++
+	}
+
+	playback.frame++
+
+	if playback.next == len(playback.events) {
+		speccy.inputPlayback = nil
+	}
+}
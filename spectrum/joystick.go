@@ -25,7 +25,11 @@ WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
 package spectrum
 
-import "sync"
+import (
+	"errors"
+	"strings"
+	"sync"
+)
 
 const (
 	KEMPSTON_FIRE = iota
@@ -35,6 +39,44 @@ const (
 	KEMPSTON_RIGHT
 )
 
+// The joystick interface emulated by the host joystick
+type JoystickMode int
+
+const (
+	JOYSTICK_KEMPSTON JoystickMode = iota
+
+	// Sinclair Interface 2, the port of player 1 (keys 6-0)
+	JOYSTICK_SINCLAIR1
+
+	// Sinclair Interface 2, the port of player 2 (keys 1-5)
+	JOYSTICK_SINCLAIR2
+
+	// Cursor (Protek, AGF) joystick (keys 5-8 and 0)
+	JOYSTICK_CURSOR
+
+	// Fuller Box joystick (port 0x7F, active-low)
+	JOYSTICK_FULLER
+)
+
+var joystickModeNames = []string{"kempston", "sinclair1", "sinclair2", "cursor", "fuller"}
+
+func (mode JoystickMode) String() string {
+	return joystickModeNames[mode]
+}
+
+func ParseJoystickMode(name string) (JoystickMode, error) {
+	// The Interface 2 ports are wired like the player 1 port of the ROM cartridge games
+	if name == "interface2" {
+		return JOYSTICK_SINCLAIR1, nil
+	}
+	for mode, modeName := range joystickModeNames {
+		if name == modeName {
+			return JoystickMode(mode), nil
+		}
+	}
+	return JOYSTICK_KEMPSTON, errors.New("invalid joystick type \"" + name + "\" (expected: " + strings.Join(joystickModeNames, ", ") + ")")
+}
+
 var kempstonMask = map[uint]byte{
 	KEMPSTON_FIRE:  0x0010,
 	KEMPSTON_UP:    0x0008,
@@ -43,10 +85,26 @@ var kempstonMask = map[uint]byte{
 	KEMPSTON_RIGHT: 0x0001,
 }
 
+// The bits of the Fuller Box port 0x7F, which are reset while the control is active
+var fullerMask = map[uint]byte{
+	KEMPSTON_FIRE:  0x80,
+	KEMPSTON_UP:    0x01,
+	KEMPSTON_DOWN:  0x02,
+	KEMPSTON_LEFT:  0x04,
+	KEMPSTON_RIGHT: 0x08,
+}
+
 type Joystick struct {
 	speccy *Spectrum48k
 	state  byte
 	mutex  sync.RWMutex
+
+	// If not nil, the joystick presses keys instead of driving the Kempston interface,
+	// except for the controls mapped to CONTROL_KEMPSTON
+	controls_orNil *ControlPreset
+
+	// Whether the joystick drives the Fuller Box instead of the Kempston interface
+	fuller bool
 }
 
 func NewJoystick() *Joystick {
@@ -76,14 +134,146 @@ func (joystick *Joystick) SetState(state byte) {
 	joystick.mutex.Unlock()
 }
 
+// Returns the key pressed by the control, or false if the control drives the Kempston interface.
+// The caller must hold the mutex.
+func (joystick *Joystick) controlKey(logicalCode uint) (uint, bool) {
+	if joystick.controls_orNil == nil {
+		return 0, false
+	}
+	key := joystick.controls_orNil.Keys[logicalCode]
+	return key, (key != CONTROL_KEMPSTON)
+}
+
 func (joystick *Joystick) KempstonDown(logicalCode uint) {
 	joystick.mutex.Lock()
+	if key, isKey := joystick.controlKey(logicalCode); isKey {
+		joystick.speccy.Keyboard.KeyDown(key)
+	}
 	joystick.state |= kempstonMask[logicalCode]
 	joystick.mutex.Unlock()
 }
 
 func (joystick *Joystick) KempstonUp(logicalCode uint) {
 	joystick.mutex.Lock()
+	if key, isKey := joystick.controlKey(logicalCode); isKey {
+		joystick.speccy.Keyboard.KeyUp(key)
+	}
 	joystick.state &= ^kempstonMask[logicalCode]
 	joystick.mutex.Unlock()
 }
+
+// Returns the state visible to the emulated machine through the Kempston interface
+func (joystick *Joystick) kempstonState() byte {
+	joystick.mutex.RLock()
+	state := joystick.state
+	for logicalCode, mask := range kempstonMask {
+		if _, isKey := joystick.controlKey(logicalCode); isKey {
+			state &^= mask
+		}
+	}
+	joystick.mutex.RUnlock()
+	return state
+}
+
+// Returns whether the joystick drives the Fuller Box (port 0x7F)
+func (joystick *Joystick) fullerConnected() bool {
+	joystick.mutex.RLock()
+	fuller := joystick.fuller
+	joystick.mutex.RUnlock()
+	return fuller
+}
+
+// Returns the value read from the Fuller Box port 0x7F
+func (joystick *Joystick) fullerState() byte {
+	state := joystick.kempstonState()
+
+	var result byte = 0xff
+	for logicalCode, mask := range kempstonMask {
+		if (state & mask) != 0 {
+			result &^= fullerMask[logicalCode]
+		}
+	}
+	return result
+}
+
+// Maps the joystick to keys, or restores the Kempston interface if 'controls_orNil' is nil.
+// Keys pressed via the previous mapping are released.
+func (joystick *Joystick) SetControls(controls_orNil *ControlPreset) {
+	joystick.mutex.Lock()
+	for logicalCode, mask := range kempstonMask {
+		if key, isKey := joystick.controlKey(logicalCode); isKey && ((joystick.state & mask) != 0) {
+			joystick.speccy.Keyboard.KeyUp(key)
+		}
+	}
+	joystick.state = 0
+	joystick.controls_orNil = controls_orNil
+	joystick.fuller = false
+	joystick.mutex.Unlock()
+}
+
+// Selects the joystick interface.
+// The Sinclair and Cursor joysticks are read through the keyboard matrix,
+// so they are implemented as the built-in control presets of the same name.
+// The Fuller Box replaces the Kempston interface.
+func (joystick *Joystick) SetMode(mode JoystickMode) {
+	switch mode {
+	case JOYSTICK_KEMPSTON:
+		joystick.SetControls(nil)
+		return
+	case JOYSTICK_FULLER:
+		joystick.SetControls(nil)
+		joystick.mutex.Lock()
+		joystick.fuller = true
+		joystick.mutex.Unlock()
+		return
+	}
+
+	preset, err := ParseControlPreset(mode.String(), builtinControlPresets[mode.String()])
+	if err != nil {
+		panic(err)
+	}
+	joystick.SetControls(preset)
+}
+
+// Returns the current key mapping, or nil if the Kempston interface is used
+func (joystick *Joystick) Controls() *ControlPreset {
+	joystick.mutex.RLock()
+	controls := joystick.controls_orNil
+	joystick.mutex.RUnlock()
+	return controls
+}
+
+// The Kempston interface and the Fuller Box can be driven by the joysticks of both players
+
+// The Kempston interface stays connected even if no joystick drives it,
+// because games which poll it would see all directions held down on an unassigned port.
+// It is disconnected only by Cmd_SetKempston.
+func (speccy *Spectrum48k) kempstonConnected() bool {
+	return speccy.kempston
+}
+
+// Returns the value read from the Kempston port: the directions of both players are combined
+func (speccy *Spectrum48k) kempstonState() byte {
+	var state byte = 0
+	for _, joystick := range []*Joystick{speccy.Joystick, speccy.Joystick2} {
+		if !joystick.fullerConnected() {
+			state |= joystick.kempstonState()
+		}
+	}
+	return state
+}
+
+func (speccy *Spectrum48k) fullerConnected() bool {
+	return speccy.Joystick.fullerConnected() || speccy.Joystick2.fullerConnected()
+}
+
+// Returns the value read from the Fuller Box port: the directions of both players are combined
+func (speccy *Spectrum48k) fullerState() byte {
+	var state byte = 0xff
+	for _, joystick := range []*Joystick{speccy.Joystick, speccy.Joystick2} {
+		if joystick.fullerConnected() {
+			state &= joystick.fullerState()
+		}
+	}
+	return state
+}
@@ -26,8 +26,10 @@ WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package spectrum
 
 import (
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
 type rowState struct {
@@ -39,8 +41,16 @@ type Cmd_KeyPress struct {
 	done           chan bool
 }
 
+// Presses each key sequence in turn
+type Cmd_TypeKeys struct {
+	sequences [][]uint
+	done      chan bool
+}
+
+// Types the command which loads a program from tape
 type Cmd_SendLoad struct {
 	romType RomType
+	done    chan bool
 }
 
 type Keyboard struct {
@@ -66,13 +76,38 @@ func (keyboard *Keyboard) init(speccy *Spectrum48k) {
 }
 
 func (keyboard *Keyboard) delayAfterKeyDown() {
-	// Sleep for 1 frame
-	time.Sleep(1e9 / time.Duration(keyboard.speccy.GetCurrentFPS()))
+	keyboard.delayFrames(1)
 }
 
 func (keyboard *Keyboard) delayAfterKeyUp() {
-	// Sleep for 10 frames
-	time.Sleep(10 * 1e9 / time.Duration(keyboard.speccy.GetCurrentFPS()))
+	keyboard.delayFrames(10)
+}
+
+// Waits for the duration of the specified number of emulated frames.
+//
+// At a limited speed, the frames are timed by the clock. While the speed
+// is unlimited (warp), the emulated frames are counted instead, so that keys
+// are not held down for hundreds of frames and auto-repeated.
+// The speed is checked after each frame, so warp can be toggled during the wait.
+func (keyboard *Keyboard) delayFrames(frames uint64) {
+	speccy := keyboard.speccy
+
+	lastCount := speccy.getFrameCount()
+	for frames > 0 {
+		fps, speed := speccy.GetCurrentFPS(), speccy.GetCurrentSpeed()
+		if speed != 0 {
+			time.Sleep(time.Duration(1e9 / (fps * speed)))
+			frames--
+		} else {
+			time.Sleep(1 * time.Millisecond)
+			if n := speccy.getFrameCount() - lastCount; n < frames {
+				frames -= n
+			} else {
+				frames = 0
+			}
+		}
+		lastCount = speccy.getFrameCount()
+	}
 }
 
 func (keyboard *Keyboard) commandLoop() {
@@ -100,6 +135,12 @@ func (keyboard *Keyboard) commandLoop() {
 				keyboard.delayAfterKeyUp()
 				cmd.done <- true
 
+			case Cmd_TypeKeys:
+				for _, sequence := range cmd.sequences {
+					keyboard.pressSequence(sequence)
+				}
+				cmd.done <- true
+
 			case Cmd_SendLoad:
 				if cmd.romType == ROM48 {
 					// LOAD
@@ -126,13 +167,29 @@ func (keyboard *Keyboard) commandLoop() {
 					keyboard.KeyDown(KEY_Enter)
 					keyboard.delayAfterKeyDown()
 					keyboard.KeyUp(KEY_Enter)
+				} else {
+					// "Tape Loader" is the initially selected option of the 128K menu
+					keyboard.pressSequence([]uint{KEY_Enter})
 				}
+				cmd.done <- true
 			}
 		}
 	}
 
 }
 
+// Presses the keys in the given order, then releases them in the reverse order
+func (keyboard *Keyboard) pressSequence(sequence []uint) {
+	for _, key := range sequence {
+		keyboard.KeyDown(key)
+	}
+	keyboard.delayAfterKeyDown()
+	for i := len(sequence) - 1; i >= 0; i-- {
+		keyboard.KeyUp(sequence[i])
+	}
+	keyboard.delayAfterKeyUp()
+}
+
 func (k *Keyboard) reset() {
 	// Initialize 'k.keyStates'
 	for row := uint(0); row < 8; row++ {
@@ -187,6 +244,33 @@ func (keyboard *Keyboard) KeyPressSequence(logicalKeyCodes ...uint) chan bool {
 	return done
 }
 
+// Types the string on the Spectrum keyboard, using CapsShift and SymbolShift where needed.
+// Characters which cannot be typed are skipped with a warning.
+// Note that the Spectrum interprets the keys according to its current mode,
+// so for example in the K mode of 48K BASIC the letter "j" enters the keyword LOAD.
+func (keyboard *Keyboard) TypeString(s string) chan bool {
+	sequences, unmapped := stringToKeys(s)
+	for _, c := range unmapped {
+		keyboard.speccy.app.PrintfMsg("type: skipping %q: no key mapping", c)
+	}
+
+	done := make(chan bool, 1)
+	keyboard.CommandChannel <- Cmd_TypeKeys{sequences, done}
+	return done
+}
+
+// Maps each character of the string to the keys which type it
+func stringToKeys(s string) (sequences [][]uint, unmapped []rune) {
+	for _, c := range s {
+		if sequence, ok := runeKeyMap[c]; ok {
+			sequences = append(sequences, sequence)
+		} else {
+			unmapped = append(unmapped, c)
+		}
+	}
+	return sequences, unmapped
+}
+
 // Logical key codes
 const (
 	KEY_1 = iota
@@ -284,6 +368,16 @@ var keyCodes = map[uint]keyCell{
 	KEY_Space:       {row: 7, mask: 0x01},
 }
 
+// Returns the name of a logical key code, as used in input scripts
+func KeyName(logicalKeyCode uint) string {
+	for name, code := range inputScriptKeyNames {
+		if code == logicalKeyCode {
+			return name
+		}
+	}
+	return "?"
+}
+
 var SDL_KeyMap = map[string][]uint{
 	"0": {KEY_0},
 	"1": {KEY_1},
@@ -372,6 +466,58 @@ var SDL_KeyMap = map[string][]uint{
 	"[/]": {KEY_SymbolShift, KEY_V},
 }
 
+// Characters typed with SymbolShift, as printed in red on the 48K keyboard.
+// Also used when typing BASIC lines, see characterKeys.
+var symbolShiftRunes = map[rune]uint{
+	'!':  KEY_1,
+	'@':  KEY_2,
+	'#':  KEY_3,
+	'$':  KEY_4,
+	'%':  KEY_5,
+	'&':  KEY_6,
+	'\'': KEY_7,
+	'(':  KEY_8,
+	')':  KEY_9,
+	'_':  KEY_0,
+	'<':  KEY_R,
+	'>':  KEY_T,
+	';':  KEY_O,
+	'"':  KEY_P,
+	'^':  KEY_H,
+	'-':  KEY_J,
+	'+':  KEY_K,
+	'=':  KEY_L,
+	':':  KEY_Z,
+	'£':  KEY_X,
+	'?':  KEY_C,
+	'/':  KEY_V,
+	'*':  KEY_B,
+	',':  KEY_N,
+	'.':  KEY_M,
+}
+
+// Maps characters to the keys used by Keyboard.TypeString.
+// Letters and digits are taken from SDL_KeyMap, capital letters are typed with CapsShift.
+var runeKeyMap = map[rune][]uint{
+	' ':  {KEY_Space},
+	'\n': {KEY_Enter},
+}
+
+func init() {
+	for name, sequence := range SDL_KeyMap {
+		if (len(name) == 1) && (len(sequence) == 1) && strings.Contains("0123456789abcdefghijklmnopqrstuvwxyz", name) {
+			c := rune(name[0])
+			runeKeyMap[c] = sequence
+			if unicode.IsLetter(c) {
+				runeKeyMap[unicode.ToUpper(c)] = []uint{KEY_CapsShift, sequence[0]}
+			}
+		}
+	}
+	for c, key := range symbolShiftRunes {
+		runeKeyMap[c] = []uint{KEY_SymbolShift, key}
+	}
+}
+
 func init() {
 	if len(keyCodes) != 40 {
 		panic("invalid keyboard specification")
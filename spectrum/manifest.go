@@ -0,0 +1,52 @@
+package spectrum
+
+import (
+	"fmt"
+	"github.com/guntars-lemps/gospeccy/formats"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+)
+
+type Cmd_SetManifest struct {
+	// After each successful load, a line describing the loaded program is written here.
+	// The value nil disables the manifest.
+	Manifest_orNil io.Writer
+}
+
+// Returns the name of the format of the program
+func programFormat(name string, program interface{}) string {
+	switch program.(type) {
+	case *formats.TAP:
+		return "TAP"
+	case *formats.TZX:
+		return "TZX"
+	case *formats.RZX:
+		return "RZX"
+	}
+
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	if ext == "" {
+		return "snapshot"
+	}
+	return strings.ToUpper(ext)
+}
+
+// Appends a line to the manifest, if any.
+// The line contains the name and the format of the loaded program,
+// the machine model, and the CRC-32 of the memory right after loading the program
+// (in case of a tape, right after inserting the tape).
+// The fields are separated by tabs.
+func (speccy *Spectrum48k) writeManifestEntry(name string, program interface{}) {
+	if speccy.manifest_orNil == nil {
+		return
+	}
+
+	hash := crc32.ChecksumIEEE(speccy.Memory.Data())
+
+	_, err := fmt.Fprintf(speccy.manifest_orNil, "%s\t%s\t%s\t%08x\n", name, programFormat(name, program), speccy.model, hash)
+	if err != nil {
+		speccy.app.PrintfMsg("manifest: %s", err)
+	}
+}
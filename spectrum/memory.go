@@ -1,41 +1,255 @@
 package spectrum
 
+import "fmt"
+
 type Memory struct {
-	data   [0x10000]byte
+	ram [8][0x4000]byte
+	rom [2][0x4000]byte
+
+	// The banks mapped into the four 16k slots of the address space
+	slots     [4]*[0x4000]byte
+	slotPages [4]MemoryPage
+
+	// The last value written to port 0x7FFD
+	paging byte
+
+	// Whether port 0x7FFD is connected, i.e. whether the machine is a 128k one
+	pagingAvailable bool
+
 	speccy *Spectrum48k
+
+	// If true, the first 16k are writable RAM instead of ROM
+	romWritable bool
+
+	// Whether the slots contain contended RAM (the odd banks, which include the 48k screen bank 5)
+	contendedSlots [4]bool
+
+	// Whether the accesses to contended RAM are delayed by the ULA.
+	// It is set only while instructions are executed, see Cmd_SetContention.
+	contentionActive bool
+
+	// Whether the accesses are the memory cycles of the instructions executed by the CPU,
+	// which are timed by ULA.memoryCycle. It is set only while instructions are executed.
+	cpuCycles bool
+
+	watches memoryWatches
+}
+
+// A 16k memory page
+type MemoryPage struct {
+	ROM  bool
+	Bank uint
+}
+
+func (page MemoryPage) String() string {
+	if page.ROM {
+		return fmt.Sprintf("ROM %d", page.Bank)
+	}
+	return fmt.Sprintf("RAM %d", page.Bank)
+}
+
+// The memory paging state, as controlled by port 0x7FFD on 128k machines
+type PagingState struct {
+	// The page mapped into each of the four 16k slots of the address space
+	Slots [4]MemoryPage
+
+	// Whether the ULA displays the shadow screen (RAM 7) instead of RAM 5
+	ShadowScreen bool
+
+	// Whether paging has been disabled until the next reset
+	Locked bool
+
+	// Whether the machine supports paging at all
+	PagingAvailable bool
 }
 
+// Bits of port 0x7FFD
+const (
+	PAGING_RAM_MASK      = 0x07
+	PAGING_SHADOW_SCREEN = 0x08
+	PAGING_ROM           = 0x10
+	PAGING_LOCK          = 0x20
+)
+
 func NewMemory() *Memory {
-	return &Memory{}
+	memory := &Memory{}
+	memory.mapPages()
+	return memory
 }
 
 func (memory *Memory) init(speccy *Spectrum48k) {
 	memory.speccy = speccy
 }
 
+// Clears the RAM and resets the paging.
+// The contents of the ROM banks are not modified.
 func (memory *Memory) reset() {
-	for i := 0; i < 0x10000; i++ {
-		memory.data[i] = 0
+	for bank := range memory.ram {
+		for i := range memory.ram[bank] {
+			memory.ram[bank][i] = 0
+		}
+	}
+
+	memory.paging = 0
+	memory.mapPages()
+}
+
+// Updates 'slots' according to the paging state.
+// The 48k memory layout corresponds to the 128k banks 5, 2 and 0.
+func (memory *Memory) mapPages() {
+	romBank := uint(memory.paging&PAGING_ROM) >> 4
+	ramBank := uint(memory.paging & PAGING_RAM_MASK)
+
+	memory.slotPages = [4]MemoryPage{
+		{ROM: true, Bank: romBank},
+		{ROM: false, Bank: 5},
+		{ROM: false, Bank: 2},
+		{ROM: false, Bank: ramBank},
+	}
+
+	for i, page := range memory.slotPages {
+		if page.ROM {
+			memory.slots[i] = &memory.rom[page.Bank]
+		} else {
+			memory.slots[i] = &memory.ram[page.Bank]
+		}
+		memory.contendedSlots[i] = !page.ROM && ((page.Bank & 1) != 0)
+	}
+}
+
+// Enables or disables port 0x7FFD, and resets the paging
+func (memory *Memory) setPagingAvailable(available bool) {
+	memory.pagingAvailable = available
+	memory.paging = 0
+	memory.mapPages()
+}
+
+// Handles a write to port 0x7FFD.
+// After the lock bit has been set, the writes are ignored until the next reset.
+func (memory *Memory) writePagingPort(value byte) {
+	if !memory.pagingAvailable || ((memory.paging & PAGING_LOCK) != 0) {
+		return
+	}
+
+	shadowScreenChanged := ((memory.paging ^ value) & PAGING_SHADOW_SCREEN) != 0
+	oldScreen := memory.screenData()
+
+	memory.paging = value
+	memory.mapPages()
+
+	if shadowScreenChanged && (memory.speccy != nil) {
+		memory.speccy.ula.screenBankChanged(oldScreen)
+	}
+}
+
+// Returns the RAM bank displayed by the ULA
+func (memory *Memory) screenBank() uint {
+	if memory.pagingAvailable && ((memory.paging & PAGING_SHADOW_SCREEN) != 0) {
+		return 7
+	}
+	return 5
+}
+
+// Returns the bitmap and the attributes of the displayed screen (6912 bytes).
+// Offset 0 corresponds to SCREEN_BASE_ADDR.
+func (memory *Memory) screenData() []byte {
+	return memory.ram[memory.screenBank()][0:0x1b00]
+}
+
+// Copies a 16k image (or two images, 32k) into the ROM banks
+func (memory *Memory) loadROM(rom []byte) {
+	copy(memory.rom[0][:], rom)
+	if len(rom) > 0x4000 {
+		copy(memory.rom[1][:], rom[0x4000:])
+	}
+}
+
+// Copies the contents of all RAM banks,
+// bypassing the tracking of screen changes
+func (memory *Memory) loadBanks(banks *[8][0x4000]byte) {
+	memory.ram = *banks
+}
+
+// Copies 'data' into the currently paged memory starting at 'address',
+// bypassing the ROM write-protection and the tracking of screen changes
+func (memory *Memory) load(address uint16, data []byte) {
+	for i, value := range data {
+		a := address + uint16(i)
+		memory.slots[a>>14][a&0x3fff] = value
 	}
 }
 
 func (memory *Memory) Read(address uint16) byte {
-	return memory.data[address]
+	slot := address >> 14
+	value := memory.slots[slot][address&0x3fff]
+	if memory.cpuCycles {
+		memory.speccy.ula.memoryCycle(memory.contentionActive && memory.contendedSlots[slot], value)
+	}
+
+	if memory.watches.active {
+		memory.watches.check(address, WATCH_READ, value, value)
+	}
+	return value
+}
+
+// Returns the byte at the specified address, without the side effects of 'Read':
+// no memory cycle is accounted for and the watchpoints are not checked
+func (memory *Memory) peek(address uint16) byte {
+	return memory.slots[address>>14][address&0x3fff]
 }
 
 func (memory *Memory) Write(address uint16, value byte) {
-	if (address >= SCREEN_BASE_ADDR) && (address < ATTR_BASE_ADDR) {
-		memory.speccy.ula.screenBitmapWrite(address, memory.data[address], value)
-	} else if (address >= ATTR_BASE_ADDR) && (address < 0x5b00) {
-		memory.speccy.ula.screenAttrWrite(address, memory.data[address], value)
+	slot := address >> 14
+
+	var tstate int
+	if memory.cpuCycles {
+		tstate = memory.speccy.ula.memoryCycle(memory.contentionActive && memory.contendedSlots[slot], value)
+	}
+
+	page := memory.slotPages[slot]
+	if page.ROM && !memory.romWritable {
+		return
+	}
+
+	offset := address & 0x3fff
+	if !page.ROM && (page.Bank == memory.screenBank()) && (offset < 0x1b00) {
+		if !memory.cpuCycles {
+			tstate = memory.speccy.ula.cpuTState()
+		}
+
+		screenAddress := SCREEN_BASE_ADDR + offset
+		oldValue := memory.slots[slot][offset]
+		if screenAddress < ATTR_BASE_ADDR {
+			memory.speccy.ula.screenBitmapWrite(screenAddress, oldValue, value, tstate)
+		} else {
+			memory.speccy.ula.screenAttrWrite(screenAddress, oldValue, value, tstate)
+		}
 	}
-	if address >= 0x4000 {
-		memory.data[address] = value
+
+	if memory.watches.active {
+		memory.watches.check(address, WATCH_WRITE, memory.slots[slot][offset], value)
 	}
+
+	memory.slots[slot][offset] = value
 }
 
+// Returns a copy of the currently paged 64k address space
 func (memory *Memory) Data() []byte {
-	return memory.data[:]
+	data := make([]byte, 0x10000)
+	for i, slot := range memory.slots {
+		copy(data[i*0x4000:], slot[:])
+	}
+	return data
+}
+
+// Returns the current paging state
+func (memory *Memory) PagingState() PagingState {
+	return PagingState{
+		Slots:           memory.slotPages,
+		ShadowScreen:    memory.screenBank() == 7,
+		Locked:          (memory.paging & PAGING_LOCK) != 0,
+		PagingAvailable: memory.pagingAvailable,
+	}
 }
 
 func init() {
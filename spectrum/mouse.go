@@ -0,0 +1,91 @@
+package spectrum
+
+import "sync"
+
+// Kempston mouse buttons
+const (
+	MOUSE_LEFT = iota
+	MOUSE_RIGHT
+	MOUSE_MIDDLE
+)
+
+// The bits of port 0xFADF, indexed by MOUSE_LEFT, MOUSE_RIGHT, MOUSE_MIDDLE.
+// A button which is pressed reads as 0.
+var mouseButtonMask = [3]byte{0x02, 0x01, 0x04}
+
+// The Kempston mouse interface.
+//
+// The position is read as two 8-bit counters, which the interface increments
+// or decrements as the mouse moves. The counters wrap around, so programs
+// compute the motion from the difference between two consecutive reads.
+type Mouse struct {
+	mutex   sync.Mutex
+	enabled bool
+
+	// The counters read at ports 0xFBDF (X) and 0xFFDF (Y).
+	// Y increases when the mouse moves up.
+	x, y byte
+
+	// Bits set according to mouseButtonMask, a set bit means the button is pressed
+	buttons byte
+}
+
+func NewMouse() *Mouse {
+	return &Mouse{}
+}
+
+// Connects or disconnects the interface.
+// A disconnected interface does not respond to port reads.
+func (mouse *Mouse) SetEnabled(enable bool) {
+	mouse.mutex.Lock()
+	mouse.enabled = enable
+	mouse.mutex.Unlock()
+}
+
+func (mouse *Mouse) Enabled() bool {
+	mouse.mutex.Lock()
+	enabled := mouse.enabled
+	mouse.mutex.Unlock()
+	return enabled
+}
+
+// Moves the mouse by the specified number of host pixels.
+// A positive 'dy' means a movement down, as in SDL.
+func (mouse *Mouse) Move(dx, dy int) {
+	mouse.mutex.Lock()
+	mouse.x += byte(dx)
+	mouse.y -= byte(dy)
+	mouse.mutex.Unlock()
+}
+
+func (mouse *Mouse) ButtonDown(button uint) {
+	mouse.mutex.Lock()
+	mouse.buttons |= mouseButtonMask[button]
+	mouse.mutex.Unlock()
+}
+
+func (mouse *Mouse) ButtonUp(button uint) {
+	mouse.mutex.Lock()
+	mouse.buttons &^= mouseButtonMask[button]
+	mouse.mutex.Unlock()
+}
+
+// Returns whether the interface responds to a read from the port
+func (mouse *Mouse) decodesPort(address uint16) bool {
+	return ((address & 0x0021) == 0x0001) && mouse.Enabled()
+}
+
+// Returns the value read from port 0xFADF (buttons), 0xFBDF (X) or 0xFFDF (Y).
+// The interface decodes only A0 and A5, and selects the value by A8 and A10.
+func (mouse *Mouse) readPort(address uint16) byte {
+	mouse.mutex.Lock()
+	defer mouse.mutex.Unlock()
+
+	switch address & 0x0521 {
+	case 0x0101:
+		return mouse.x
+	case 0x0501:
+		return mouse.y
+	}
+	return 0xff &^ mouse.buttons
+}
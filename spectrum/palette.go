@@ -0,0 +1,189 @@
+package spectrum
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A table of the 16 colors of the Spectrum, in the ARGB format.
+// Colors 0-7 are the normal colors, colors 8-15 are their bright variants.
+type Palette [16]uint32
+
+var palette_standard = Palette{
+	RGBA{000, 000, 000, 255}.value32(),
+	RGBA{000, 000, 192, 255}.value32(),
+	RGBA{192, 000, 000, 255}.value32(),
+	RGBA{192, 000, 192, 255}.value32(),
+	RGBA{000, 192, 000, 255}.value32(),
+	RGBA{000, 192, 192, 255}.value32(),
+	RGBA{192, 192, 000, 255}.value32(),
+	RGBA{192, 192, 192, 255}.value32(),
+	RGBA{000, 000, 000, 255}.value32(),
+	RGBA{000, 000, 255, 255}.value32(),
+	RGBA{255, 000, 000, 255}.value32(),
+	RGBA{255, 000, 255, 255}.value32(),
+	RGBA{000, 255, 000, 255}.value32(),
+	RGBA{000, 255, 255, 255}.value32(),
+	RGBA{255, 255, 000, 255}.value32(),
+	RGBA{255, 255, 255, 255}.value32(),
+}
+
+var palette_grayscale = monochromePalette(RGBA{255, 255, 255, 255})
+
+// The color of a green-phosphor monitor
+var palette_green = monochromePalette(RGBA{51, 255, 102, 255})
+
+// The built-in palettes, plus "custom" after LoadCustomPalette has been called
+var palettes = map[string]*Palette{
+	"standard":  &palette_standard,
+	"grayscale": &palette_grayscale,
+	"green":     &palette_green,
+}
+
+var (
+	currentPalette *Palette = &palette_standard
+	palette_mutex  sync.RWMutex
+)
+
+// Returns the brightness (0 ... 255) of a color in the ARGB format
+func brightness(c uint32) uint {
+	r := (c >> 16) & 0xff
+	g := (c >> 8) & 0xff
+	b := c & 0xff
+	return uint((299*r + 587*g + 114*b) / 1000)
+}
+
+// Returns a palette whose colors are shades of 'tint',
+// matching the brightness of the standard colors
+func monochromePalette(tint RGBA) Palette {
+	var p Palette
+	for i, c := range palette_standard {
+		l := brightness(c)
+		p[i] = RGBA{
+			byte(uint(tint.R) * l / 255),
+			byte(uint(tint.G) * l / 255),
+			byte(uint(tint.B) * l / 255),
+			255,
+		}.value32()
+	}
+	return p
+}
+
+// Returns the palette used for rendering the display.
+// The returned palette must not be modified.
+func CurrentPalette() *Palette {
+	palette_mutex.RLock()
+	defer palette_mutex.RUnlock()
+	return currentPalette
+}
+
+// Changes the palette used for rendering the display.
+// The screen is not repainted automatically.
+func SetPalette(p *Palette) {
+	palette_mutex.Lock()
+	currentPalette = p
+	palette_mutex.Unlock()
+}
+
+// Returns the names of the available palettes
+func PaletteNames() []string {
+	palette_mutex.RLock()
+	defer palette_mutex.RUnlock()
+
+	names := make([]string, 0, len(palettes))
+	for name := range palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func FindPalette(name string) (*Palette, error) {
+	palette_mutex.RLock()
+	defer palette_mutex.RUnlock()
+
+	p, found := palettes[name]
+	if !found {
+		if name == "custom" {
+			return nil, errors.New("no custom palette has been loaded")
+		}
+		return nil, fmt.Errorf("unknown palette: %s", name)
+	}
+	return p, nil
+}
+
+// Reads a palette from a text file which contains 16 colors.
+// Each color is specified as three numbers (red, green, blue) in the range 0-255,
+// separated by spaces or commas. Empty lines, and text following '#', are ignored.
+func ReadPalette(path string) (*Palette, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var p Palette
+	numColors := 0
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.FieldsFunc(line, func(c rune) bool {
+			return (c == ',') || (c == ' ') || (c == '\t')
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected 3 color components, found %d", path, lineNumber, len(fields))
+		}
+		if numColors == len(p) {
+			return nil, fmt.Errorf("%s:%d: too many colors", path, lineNumber)
+		}
+
+		var rgb [3]byte
+		for i, field := range fields {
+			value, err := strconv.ParseUint(field, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid color component: %s", path, lineNumber, field)
+			}
+			rgb[i] = byte(value)
+		}
+
+		p[numColors] = RGBA{rgb[0], rgb[1], rgb[2], 255}.value32()
+		numColors++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if numColors != len(p) {
+		return nil, fmt.Errorf("%s: expected %d colors, found %d", path, len(p), numColors)
+	}
+
+	return &p, nil
+}
+
+// Reads the palette from the specified file and makes it available as "custom"
+func LoadCustomPalette(path string) (*Palette, error) {
+	p, err := ReadPalette(path)
+	if err != nil {
+		return nil, err
+	}
+
+	palette_mutex.Lock()
+	palettes["custom"] = p
+	palette_mutex.Unlock()
+
+	return p, nil
+}
@@ -0,0 +1,62 @@
+package spectrum
+
+import "github.com/guntars-lemps/gospeccy/formats"
+
+type Cmd_ApplyIPS struct {
+	Patch *formats.IPS
+
+	// If true, the patch is applied to the 48k BASIC ROM and survives resets
+	// and changes of the machine model. In the 128k model, the 48k BASIC ROM is the second ROM.
+	// Otherwise the patch is applied to the 48k of RAM starting at address 0x4000,
+	// which matches the layout of the memory in a snapshot.
+	ROM bool
+
+	ErrChan chan<- error
+}
+
+// Returns the 48k BASIC ROM within the system ROM image
+func (speccy *Spectrum48k) basicROM() []byte {
+	if speccy.romType == ROM128 {
+		return speccy.rom[0x4000:0x8000]
+	}
+	return speccy.rom[0:0x4000]
+}
+
+// Applies the ROM patches to the system ROM image.
+// Called after the ROM image has been replaced.
+func (speccy *Spectrum48k) applyROMPatches() error {
+	for _, patch := range speccy.romPatches {
+		err := patch.Apply(speccy.basicROM())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (speccy *Spectrum48k) applyIPS(patch *formats.IPS, rom bool) error {
+	if rom {
+		err := patch.Apply(speccy.basicROM())
+		if err != nil {
+			return err
+		}
+		speccy.romPatches = append(speccy.romPatches, patch)
+
+		speccy.Memory.loadROM(speccy.rom[:])
+		return nil
+	}
+
+	ram := speccy.Memory.Data()[0x4000:]
+
+	err := patch.Apply(ram)
+	if err != nil {
+		return err
+	}
+
+	// Write through the memory so that the screen is updated
+	for i, value := range ram {
+		speccy.Memory.Write(0x4000+uint16(i), value)
+	}
+
+	return nil
+}
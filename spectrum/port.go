@@ -63,6 +63,12 @@ type Ports struct {
 	beeperLevel  byte
 	beeperEvents []BeeperEvent
 
+	// The last value written to port 0xFE
+	lastWrite byte
+
+	// Issue 2 machines read bit 6 of port 0xFE differently than Issue 3 machines
+	issue2 bool
+
 	// Number of supposed reads from tapedrive port.
 	// This counter is reset to 0 at the beginning of each frame.
 	tapeReadCount uint
@@ -89,6 +95,8 @@ func (p *Ports) reset() {
 	p.borderEvents = p.borderEvents[0:0]
 	p.borderEvents = append(p.borderEvents, BorderEvent{TState: 0, Color: p.speccy.ula.getBorderColor()})
 
+	p.lastWrite = 0
+
 	p.beeperLevel = 0
 	p.beeperEvents = p.beeperEvents[0:0]
 	p.beeperEvents = append(p.beeperEvents, BeeperEvent{TState: 0, Level: p.beeperLevel})
@@ -111,18 +119,32 @@ func SameBorderEvents(l1, l2 []BorderEvent) bool {
 	return true
 }
 
+// Returns whether the border color changed during the current frame
+func (p *Ports) borderChanged() bool {
+	tstatesPerFrame := p.speccy.ula.timings.TStatesPerFrame
+	n := 0
+	for _, e := range p.borderEvents {
+		if e.TState < tstatesPerFrame {
+			n++
+		}
+	}
+	return n > 1
+}
+
 func (p *Ports) frame_begin() {
 	p.tapeReadCount = 0
 }
 
 func (p *Ports) frame_end() FrameStatusOfPorts {
+	tstatesPerFrame := p.speccy.ula.timings.TStatesPerFrame
+
 	// Border events
 	{
 		// Determine the number of events overflowing the frame
 		var numOverflow int
 		{
 			i := len(p.borderEvents)
-			for (i > 0) && (p.borderEvents[i-1].TState >= TStatesPerFrame) {
+			for (i > 0) && (p.borderEvents[i-1].TState >= tstatesPerFrame) {
 				i--
 			}
 			numOverflow = len(p.borderEvents) - i
@@ -136,17 +158,17 @@ func (p *Ports) frame_end() FrameStatusOfPorts {
 		var colorAtTState0 byte
 		if numOverflow == 0 {
 			colorAtTState0 = p.speccy.ula.getBorderColor()
-		} else if overflow[0].TState == TStatesPerFrame {
+		} else if overflow[0].TState == tstatesPerFrame {
 			colorAtTState0 = overflow[0].Color
 		} else {
 			// Use the Color of the last event that did NOT overflow.
-			// Note: The fact that (numOverflow > 0) and (overflow[0].TState >= TStatesPerFrame) and
+			// Note: The fact that (numOverflow > 0) and (overflow[0].TState >= tstatesPerFrame) and
 			// (there always exists an event with T-state value equal to 0)
 			// implies that (numEvents > 0).
 			colorAtTState0 = p.borderEvents[numEvents-1].Color
 		}
 
-		if (numOverflow > 0) && (overflow[0].TState == TStatesPerFrame) {
+		if (numOverflow > 0) && (overflow[0].TState == tstatesPerFrame) {
 			p.borderEvents = p.borderEvents[0:0]
 		} else {
 			p.borderEvents = p.borderEvents[0:0]
@@ -155,7 +177,7 @@ func (p *Ports) frame_end() FrameStatusOfPorts {
 
 		// Replay the overflowing events
 		for i := 0; i < numOverflow; i++ {
-			p.borderEvents = append(p.borderEvents, BorderEvent{(overflow[i].TState - TStatesPerFrame), overflow[i].Color})
+			p.borderEvents = append(p.borderEvents, BorderEvent{(overflow[i].TState - tstatesPerFrame), overflow[i].Color})
 		}
 	}
 
@@ -165,7 +187,7 @@ func (p *Ports) frame_end() FrameStatusOfPorts {
 		var numOverflow int
 		{
 			i := len(p.beeperEvents)
-			for (i > 0) && (p.beeperEvents[i-1].TState >= TStatesPerFrame) {
+			for (i > 0) && (p.beeperEvents[i-1].TState >= tstatesPerFrame) {
 				i--
 			}
 			numOverflow = len(p.beeperEvents) - i
@@ -179,17 +201,17 @@ func (p *Ports) frame_end() FrameStatusOfPorts {
 		var levelAtTState0 byte
 		if numOverflow == 0 {
 			levelAtTState0 = p.beeperLevel
-		} else if overflow[0].TState == TStatesPerFrame {
+		} else if overflow[0].TState == tstatesPerFrame {
 			levelAtTState0 = overflow[0].Level
 		} else {
 			// Use the Level of the last event that did NOT overflow.
-			// Note: The fact that (numOverflow > 0) and (overflow[0].TState >= TStatesPerFrame) and
+			// Note: The fact that (numOverflow > 0) and (overflow[0].TState >= tstatesPerFrame) and
 			// (there always exists an event with T-state value equal to 0)
 			// implies that (numEvents > 0).
 			levelAtTState0 = p.beeperEvents[numEvents-1].Level
 		}
 
-		if (numOverflow > 0) && (overflow[0].TState == TStatesPerFrame) {
+		if (numOverflow > 0) && (overflow[0].TState == tstatesPerFrame) {
 			p.beeperEvents = p.beeperEvents[0:0]
 		} else {
 			p.beeperEvents = p.beeperEvents[0:0]
@@ -198,7 +220,7 @@ func (p *Ports) frame_end() FrameStatusOfPorts {
 
 		// Replay the overflowing events
 		for i := 0; i < numOverflow; i++ {
-			p.beeperEvents = append(p.beeperEvents, BeeperEvent{(overflow[i].TState - TStatesPerFrame), overflow[i].Level})
+			p.beeperEvents = append(p.beeperEvents, BeeperEvent{(overflow[i].TState - tstatesPerFrame), overflow[i].Level})
 		}
 	}
 
@@ -209,20 +231,21 @@ func (p *Ports) frame_end() FrameStatusOfPorts {
 
 // Returns a copy of the list of border events.
 // The difference between [the T-state of the 1st event] and [the T-state of the last event]
-// always equals to TStatesPerFrame (if the returned list is not empty).
+// always equals to the number of T-states per frame (if the returned list is not empty).
 //
 // If the returned list is non-empty, its length is at least 2.
 func (p *Ports) getBorderEvents() []BorderEvent {
+	tstatesPerFrame := p.speccy.ula.timings.TStatesPerFrame
 	n := len(p.borderEvents)
-	for (n > 0) && (p.borderEvents[n-1].TState > TStatesPerFrame) {
+	for (n > 0) && (p.borderEvents[n-1].TState > tstatesPerFrame) {
 		n--
 	}
 
 	ret := make([]BorderEvent, n, n+1)
 	copy(ret[0:n], p.borderEvents[0:n])
 
-	if (n > 0) && (ret[n-1].TState < TStatesPerFrame) {
-		ret = append(ret, BorderEvent{TStatesPerFrame, ret[n-1].Color})
+	if (n > 0) && (ret[n-1].TState < tstatesPerFrame) {
+		ret = append(ret, BorderEvent{tstatesPerFrame, ret[n-1].Color})
 	}
 
 	return ret
@@ -230,26 +253,33 @@ func (p *Ports) getBorderEvents() []BorderEvent {
 
 // Returns a copy of the list of beeper events.
 // The difference between [the T-state of the 1st event] and [the T-state of the last event]
-// always equals to TStatesPerFrame (if the returned list is not empty).
+// always equals to the number of T-states per frame (if the returned list is not empty).
 //
 // If the returned list is non-empty, its length is at least 2.
 func (p *Ports) getBeeperEvents() []BeeperEvent {
+	tstatesPerFrame := p.speccy.ula.timings.TStatesPerFrame
 	n := len(p.beeperEvents)
-	for (n > 0) && (p.beeperEvents[n-1].TState > TStatesPerFrame) {
+	for (n > 0) && (p.beeperEvents[n-1].TState > tstatesPerFrame) {
 		n--
 	}
 
 	ret := make([]BeeperEvent, n, n+1)
 	copy(ret[0:n], p.beeperEvents[0:n])
 
-	if (n > 0) && (ret[n-1].TState < TStatesPerFrame) {
-		ret = append(ret, BeeperEvent{TStatesPerFrame, ret[n-1].Level})
+	if (n > 0) && (ret[n-1].TState < tstatesPerFrame) {
+		ret = append(ret, BeeperEvent{tstatesPerFrame, ret[n-1].Level})
 	}
 
 	return ret
 }
 
 func (p *Ports) Read(address uint16) byte {
+	tstate := p.ioCycle(address)
+
+	// During RZX playback, the program reads the recorded values
+	if playback := p.speccy.rzxPlayback; (playback != nil) && playback.running {
+		return playback.nextIN()
+	}
 
 	var result byte = 0xff
 
@@ -267,23 +297,105 @@ func (p *Ports) Read(address uint16) byte {
 			p.tapeReadCount++
 			earBit := p.speccy.tapeDrive.getEarBit()
 			result &= earBit
+
+			// Make the edges audible even if the loader does not echo them to port 0xFE
+			p.setBeeperLevel(tstate, p.mixTapeSound(p.beeperLevel))
 		} else {
-			// clear ear bit
-			result = result &^ 0x40
+			result &= p.earBit()
 		}
-	} else if (address & 0x00e0) == 0x0000 {
-		result &= p.speccy.Joystick.GetState()
+	} else if ((address & 0xc002) == 0xc000) && (p.speccy.ay_orNil != nil) {
+		// AY register read (port 0xFFFD)
+		result = p.speccy.ay_orNil.readRegister()
+	} else if ((address & 0x00ff) == 0x007f) && p.speccy.fullerConnected() {
+		result = p.speccy.fullerState()
+	} else if ((address & 0x00e0) == 0x0000) && p.speccy.kempstonConnected() {
+		result &= p.speccy.kempstonState()
+	} else if p.speccy.Mouse.decodesPort(address) {
+		// The Kempston joystick has priority over the mouse, whose decoding overlaps with it
+		result = p.speccy.Mouse.readPort(address)
+	} else if p.speccy.contention {
+		// Unassigned port, the ULA may be driving the data bus
+		result = p.speccy.ula.floatingBus(tstate)
 	} else {
 		// Unassigned port
 		result = 0xff
 	}
 
+	if recording := p.speccy.rzxRecording; (recording != nil) && recording.running {
+		recording.in = append(recording.in, result)
+	}
+
 	return result
 }
 
+// Returns the value of the EAR bit (bit 6 of port 0xFE) when no tape is playing.
+//
+// With nothing connected to the EAR socket, the bit reflects the last value written to port 0xFE.
+// On an Issue 3 machine the bit is set if bit 4 (EAR) was set. On an Issue 2 machine
+// the bit is set if bit 4 or bit 3 (MIC) was set.
+func (p *Ports) earBit() byte {
+	var mask byte = 0x10
+	if p.issue2 {
+		mask = 0x18
+	}
+
+	if (p.lastWrite & mask) != 0 {
+		return 0xff
+	}
+	return 0xbf
+}
+
+// Returns the beeper level 'level' combined with the signal of the tape being loaded,
+// if the tape sound is enabled. The tape signal replaces the EAR output.
+func (p *Ports) mixTapeSound(level byte) byte {
+	if p.speccy.tapeSound && p.speccy.readFromTape && !p.speccy.tapeDrive.AcceleratedLoad {
+		if p.speccy.tapeDrive.earBit == 0xff {
+			level |= 2
+		} else {
+			level &^= 2
+		}
+	}
+	return level
+}
+
+// Adds a beeper event if the level changed
+func (p *Ports) setBeeperLevel(tstate int, level byte) {
+	if p.beeperLevel != level {
+		p.beeperLevel = level
+
+		last := len(p.beeperEvents) - 1
+		if p.beeperEvents[last].TState == tstate {
+			p.beeperEvents[last].Level = level
+		} else {
+			p.beeperEvents = append(p.beeperEvents, BeeperEvent{tstate, level})
+		}
+	}
+}
+
+// Accounts for the I/O cycle of the current port access, and returns the T-state of the access.
+// With accurate ULA emulation, this includes the delay caused by I/O contention.
+// If the contention is emulated, the delay is applied to the CPU.
+func (p *Ports) ioCycle(address uint16) int {
+	ula := p.speccy.ula
+	memory := p.speccy.Memory
+	if memory.cpuCycles {
+		return ula.ioCycle(address, memory.contentionActive)
+	}
+
+	// The access is not made by an instruction, for example it is made by Cmd_Out
+	tstate := ula.cpuTState()
+	if ula.accurateEmulation {
+		tstate += ula.ioCycleTStates(address, tstate) - 4
+	}
+	return tstate
+}
+
 func (p *Ports) Write(address uint16, b byte) {
+	tstate := p.ioCycle(address)
 
 	if (address & 0x0001) == 0 {
+		p.lastWrite = b
+
 		color := (b & 0x07)
 
 		// Modify the border only if it really changed
@@ -291,32 +403,29 @@ func (p *Ports) Write(address uint16, b byte) {
 			p.speccy.ula.setBorderColor(color)
 
 			last := len(p.borderEvents) - 1
-			if p.borderEvents[last].TState == p.speccy.Cpu.GetTstates() {
+			if p.borderEvents[last].TState == tstate {
 				p.borderEvents[last].Color = color
 			} else {
-				p.borderEvents = append(p.borderEvents, BorderEvent{p.speccy.Cpu.GetTstates(), color})
+				p.borderEvents = append(p.borderEvents, BorderEvent{tstate, color})
 			}
 		}
 
 		// EAR(bit 4) and MIC(bit 3) output
-		newBeeperLevel := (b & 0x18) >> 3
-		if p.speccy.readFromTape && !p.speccy.tapeDrive.AcceleratedLoad {
-			if p.speccy.tapeDrive.earBit == 0xff {
-				newBeeperLevel |= 2
-			} else {
-				newBeeperLevel &^= 2
-			}
-		}
-		if p.beeperLevel != newBeeperLevel {
-			p.beeperLevel = newBeeperLevel
+		p.setBeeperLevel(tstate, p.mixTapeSound((b&0x18)>>3))
+	}
 
-			last := len(p.beeperEvents) - 1
-			if p.beeperEvents[last].TState == p.speccy.Cpu.GetTstates() {
-				p.beeperEvents[last].Level = newBeeperLevel
-			} else {
-				p.beeperEvents = append(p.beeperEvents, BeeperEvent{p.speccy.Cpu.GetTstates(), newBeeperLevel})
-			}
+	// The AY chip is decoded by A15=1 and A1=0:
+	// port 0xFFFD (A14=1) selects a register, port 0xBFFD (A14=0) writes to it
+	if ay := p.speccy.ay_orNil; (ay != nil) && ((address & 0x8002) == 0x8000) {
+		if (address & 0x4000) != 0 {
+			ay.selectRegister(b)
+		} else {
+			ay.writeRegister(tstate, b)
 		}
 	}
 
+	// Memory paging (port 0x7FFD) is decoded by A15=0 and A1=0
+	if (address & 0x8002) == 0 {
+		p.speccy.Memory.writePagingPort(b)
+	}
 }
@@ -0,0 +1,53 @@
+package spectrum
+
+import (
+	"fmt"
+	"github.com/guntars-lemps/gospeccy/formats"
+)
+
+// Returns the CPU registers.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) Registers() formats.CpuState {
+	ch := make(chan formats.CpuState)
+	speccy.CommandChannel <- Cmd_GetRegisters{ch}
+	return <-ch
+}
+
+// Returns the flags in the F register as a string such as "SZ-H-PNC",
+// with '.' in place of the flags which are reset
+func flagsString(f byte) string {
+	const names = "SZ5H3PNC"
+
+	s := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		if (f & (0x80 >> uint(i))) != 0 {
+			s[i] = names[i]
+		} else {
+			s[i] = '.'
+		}
+	}
+	return string(s)
+}
+
+// Formats the registers for display, in several lines
+func FormatRegisters(cpu formats.CpuState) string {
+	word := func(hi, lo byte) uint16 {
+		return (uint16(hi) << 8) | uint16(lo)
+	}
+
+	return fmt.Sprintf(""+
+		"AF %04x  AF' %04x  F %s\n"+
+		"BC %04x  BC' %04x\n"+
+		"DE %04x  DE' %04x\n"+
+		"HL %04x  HL' %04x\n"+
+		"IX %04x  IY  %04x\n"+
+		"SP %04x  PC  %04x\n"+
+		"I  %02x    R   %02x    IFF1 %d  IFF2 %d  IM %d  T-state %d\n",
+		word(cpu.A, cpu.F), word(cpu.A_, cpu.F_), flagsString(cpu.F),
+		word(cpu.B, cpu.C), word(cpu.B_, cpu.C_),
+		word(cpu.D, cpu.E), word(cpu.D_, cpu.E_),
+		word(cpu.H, cpu.L), word(cpu.H_, cpu.L_),
+		cpu.IX, cpu.IY,
+		cpu.SP, cpu.PC,
+		cpu.I, cpu.R, cpu.IFF1, cpu.IFF2, cpu.IM, cpu.Tstate)
+}
@@ -0,0 +1,173 @@
+package spectrum
+
+import (
+	"bytes"
+	"errors"
+	"github.com/guntars-lemps/gospeccy/formats"
+)
+
+// Rewinding of the emulation.
+//
+// Every 'REWIND_INTERVAL' frames the state of the machine is recorded into a bounded
+// ring buffer, and Cmd_Rewind restores one of the recorded states. To save memory,
+// only the newest state holds a complete copy of the RAM. Each older state holds
+// the blocks of RAM in which it differs from the next newer state, therefore
+// the oldest state can be dropped without affecting the others.
+//
+// The tape position is not recorded.
+
+// The number of frames between two recorded states
+const REWIND_INTERVAL = 5
+
+// The granularity of the RAM differences between two recorded states
+const rewind_blockSize = 256
+
+type rewindBlock struct {
+	// The offset of the block in the RAM banks, as if they were a single array
+	offset uint
+	data   [rewind_blockSize]byte
+}
+
+type rewindState struct {
+	cpu    formats.CpuState
+	halted bool
+	border byte
+	paging byte
+
+	ay        formats.AYState
+	ayPresent bool
+
+	// The RAM blocks of this state which differ from the next newer state.
+	// This is nil for the newest state.
+	delta []rewindBlock
+}
+
+type rewindBuffer struct {
+	// A ring buffer of states, ordered from the oldest to the newest
+	states []rewindState
+	first  int
+	count  int
+
+	// The contents of the RAM banks at the time the newest state was recorded
+	ram [8][0x4000]byte
+
+	// The number of frames since the newest state was recorded
+	framesSinceLastState uint
+}
+
+// Returns nil if 'seconds' is too small to hold a single state
+func newRewindBuffer(seconds float32) *rewindBuffer {
+	capacity := int(seconds*DefaultFPS/REWIND_INTERVAL + 0.5)
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &rewindBuffer{states: make([]rewindState, capacity)}
+}
+
+func (b *rewindBuffer) index(i int) int {
+	return (b.first + i) % len(b.states)
+}
+
+func (b *rewindBuffer) newest() *rewindState {
+	return &b.states[b.index(b.count-1)]
+}
+
+// Appends a new state, dropping the oldest state if the buffer is full
+func (b *rewindBuffer) record(state rewindState, ram *[8][0x4000]byte) {
+	if b.count > 0 {
+		newest := b.newest()
+		newest.delta = nil
+		for bank := range ram {
+			for ofs := 0; ofs < 0x4000; ofs += rewind_blockSize {
+				oldBlock := b.ram[bank][ofs : ofs+rewind_blockSize]
+				if !bytes.Equal(oldBlock, ram[bank][ofs:ofs+rewind_blockSize]) {
+					block := rewindBlock{offset: uint(bank*0x4000 + ofs)}
+					copy(block.data[:], oldBlock)
+					newest.delta = append(newest.delta, block)
+				}
+			}
+		}
+	}
+
+	if b.count == len(b.states) {
+		b.states[b.first] = rewindState{}
+		b.first = b.index(1)
+		b.count--
+	}
+
+	b.ram = *ram
+	b.count++
+	*b.newest() = state
+	b.framesSinceLastState = 0
+}
+
+// Drops the recorded states which are newer than 'frames' frames ago,
+// reconstructs the RAM of the newest remaining state and returns the state.
+// If there are not enough recorded states, the oldest state is returned.
+// Returns nil if the buffer is empty.
+func (b *rewindBuffer) rewind(frames uint) *rewindState {
+	if b.count == 0 {
+		return nil
+	}
+
+	for (b.count > 1) && (b.framesSinceLastState < frames) {
+		b.count--
+		for _, block := range b.newest().delta {
+			bank, ofs := block.offset/0x4000, block.offset%0x4000
+			copy(b.ram[bank][ofs:], block.data[:])
+		}
+		b.newest().delta = nil
+		b.framesSinceLastState += REWIND_INTERVAL
+	}
+	b.framesSinceLastState = 0
+
+	return b.newest()
+}
+
+func (speccy *Spectrum48k) recordRewindState() {
+	b := speccy.rewind_orNil
+
+	b.framesSinceLastState++
+	if (b.count > 0) && (b.framesSinceLastState < REWIND_INTERVAL) {
+		return
+	}
+
+	s := speccy.MakeSnapshot()
+	b.record(rewindState{
+		cpu:       s.Cpu,
+		halted:    speccy.Cpu.Halted,
+		border:    s.Ula.Border,
+		paging:    speccy.Memory.paging,
+		ay:        s.AY,
+		ayPresent: s.AYPresent,
+	}, &speccy.Memory.ram)
+}
+
+// Restores the state of the machine recorded at least 'frames' frames ago
+func (speccy *Spectrum48k) rewind(frames uint) error {
+	if speccy.rewind_orNil == nil {
+		return errors.New("rewinding is disabled")
+	}
+
+	state := speccy.rewind_orNil.rewind(frames)
+	if state == nil {
+		return errors.New("no state has been recorded yet")
+	}
+
+	speccy.setCpuState(state.cpu)
+	speccy.Cpu.Halted = state.halted
+	speccy.Ports.Write(0xfe, state.border&0x07)
+
+	speccy.Memory.paging = state.paging
+	speccy.Memory.mapPages()
+	speccy.Memory.ram = speccy.rewind_orNil.ram
+
+	if state.ayPresent && (speccy.ay_orNil != nil) {
+		speccy.setAYState(state.ay)
+	}
+
+	speccy.repaint()
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package spectrum
+
+import (
+	"errors"
+	"github.com/guntars-lemps/gospeccy/formats"
+	"io/ioutil"
+)
+
+// RZX playback and recording.
+//
+// While an RZX recording is being played back, the IN instructions do not sample
+// the keyboard, the joystick or the tape. They return the recorded values instead.
+// Each frame of the recording ends with an interrupt after the recorded number
+// of opcode fetches, which keeps the emulation in lockstep with the recording.
+// The opcode fetches are counted by observing the increments of the R register.
+//
+// A recording starts with a snapshot of the machine. The first recorded frame lasts
+// until the next interrupt, it is empty unless the machine is stopped at a breakpoint.
+// Each following frame starts with the interrupt and contains the values read
+// by the IN instructions executed until the next interrupt.
+
+// If a frame of the recording takes longer than this number of T-states to execute,
+// the playback is considered to be out of sync and the frame is cut short
+const rzx_MAX_FRAME_TSTATES = 4 * TStatesPerFrame
+
+// State of the playback of an RZX recording
+type rzxPlayback struct {
+	frames []formats.RZXFrame
+	frame  int // Index of the current frame
+	in     int // Index of the next IN value in the current frame
+
+	// Whether instructions of the recording are being executed.
+	// Port reads which are not caused by the program, such as 'Cmd_In', are not fed from the recording.
+	running bool
+
+	// Whether the emulation no longer matches the recording
+	outOfSync, outOfSyncReported bool
+}
+
+func newRZXPlayback(rzx *formats.RZX) *rzxPlayback {
+	return &rzxPlayback{frames: rzx.Frames}
+}
+
+// Returns the next IN value recorded in the current frame
+func (playback *rzxPlayback) nextIN() byte {
+	values := playback.frames[playback.frame].InValues
+	if playback.in >= len(values) {
+		playback.outOfSync = true
+		return 0xff
+	}
+
+	value := values[playback.in]
+	playback.in++
+	return value
+}
+
+// Loads the snapshot of the recording and starts the playback
+func (speccy *Spectrum48k) loadRZX(rzx *formats.RZX) error {
+	err := speccy.loadSnapshot(rzx.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	speccy.rzxPlayback = newRZXPlayback(rzx)
+	return nil
+}
+
+// Returns the number of opcode fetches since the R register had the value 'r'.
+// Called after each instruction.
+func (speccy *Spectrum48k) fetchesSince(r uint16) uint {
+	return uint((speccy.Cpu.R - r) & 0x7f)
+}
+
+// Executes the instructions of the current frame of the RZX recording.
+// The frame ends after the recorded number of opcode fetches.
+func (speccy *Spectrum48k) doOpcodesRZX() {
+	playback := speccy.rzxPlayback
+	fetchCount := uint(playback.frames[playback.frame].FetchCount)
+
+	playback.running = true
+
+	var fetches uint = 0
+	for fetches < fetchCount {
+		if speccy.Cpu.GetTstates() >= rzx_MAX_FRAME_TSTATES {
+			playback.outOfSync = true
+			break
+		}
+
+		r := speccy.Cpu.R
+		if speccy.Cpu.Halted {
+			speccy.Cpu.DoHalt()
+		} else {
+			speccy.lastInstructionAddr = speccy.Cpu.PC()
+			speccy.Cpu.DoOpcode()
+		}
+		fetches += speccy.fetchesSince(r)
+	}
+
+	playback.running = false
+}
+
+// Advances the RZX playback to the next frame.
+// Called at the end of each frame.
+func (speccy *Spectrum48k) rzxFrameEnd() {
+	playback := speccy.rzxPlayback
+
+	if playback.in != len(playback.frames[playback.frame].InValues) {
+		playback.outOfSync = true
+	}
+	if playback.outOfSync && !playback.outOfSyncReported {
+		speccy.app.PrintfMsg("RZX: the playback is out of sync with the recording at frame %d", playback.frame)
+		playback.outOfSyncReported = true
+	}
+
+	playback.frame++
+	playback.in = 0
+
+	if playback.frame == len(playback.frames) {
+		speccy.rzxPlayback = nil
+		speccy.app.PrintfMsg("RZX: end of the recording, the control is returned to the user")
+	}
+}
+
+type Cmd_RecordInput struct {
+	// The file to which the recording is written when it is stopped
+	FilePath string
+
+	Err chan<- error
+}
+
+type Cmd_StopRecordingInput struct {
+	// Receives the result of writing the recording
+	Err chan<- error
+}
+
+// State of an RZX recording
+type rzxRecording struct {
+	filePath string
+	rzx      *formats.RZX
+
+	// The IN values and the number of opcode fetches in the current frame
+	in      []byte
+	fetches uint
+
+	// Whether instructions are being executed, see 'rzxPlayback.running'
+	running bool
+}
+
+// Adds the current frame to the recording
+func (recording *rzxRecording) endFrame() {
+	frame := formats.RZXFrame{FetchCount: uint16(recording.fetches), InValues: recording.in}
+	recording.rzx.Frames = append(recording.rzx.Frames, frame)
+
+	recording.in = nil
+	recording.fetches = 0
+}
+
+func (speccy *Spectrum48k) startRZXRecording(filePath string) error {
+	if speccy.rzxPlayback != nil {
+		return errors.New("cannot record the input during RZX playback")
+	}
+	if speccy.rzxRecording != nil {
+		return errors.New("the input is already being recorded to \"" + speccy.rzxRecording.filePath + "\"")
+	}
+
+	recording := &rzxRecording{
+		filePath: filePath,
+		rzx: &formats.RZX{
+			Creator:  "GoSpeccy",
+			Snapshot: speccy.MakeSnapshot(),
+			TStates:  uint32(speccy.ula.cpuTState()),
+		},
+	}
+
+	// Fail now rather than when the recording is stopped
+	_, err := recording.rzx.Encode()
+	if err != nil {
+		return err
+	}
+
+	speccy.rzxRecording = recording
+	return nil
+}
+
+// Stops the recording and writes it to the file
+func (speccy *Spectrum48k) stopRZXRecording() error {
+	recording := speccy.rzxRecording
+	if recording == nil {
+		return errors.New("the input is not being recorded")
+	}
+	speccy.rzxRecording = nil
+
+	recording.endFrame()
+
+	data, err := recording.rzx.Encode()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(recording.filePath, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	if speccy.app.Verbose {
+		speccy.app.PrintfMsg("RZX: wrote %d frames to \"%s\"", len(recording.rzx.Frames), recording.filePath)
+	}
+	return nil
+}
+
+// Starts recording the input of the running program into an RZX file.
+// The file is written when the recording is stopped by 'StopRecordingInput',
+// by a reset, by loading a program, or when the emulator exits.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) RecordInput(filePath string) error {
+	errChan := make(chan error)
+	speccy.CommandChannel <- Cmd_RecordInput{filePath, errChan}
+	return <-errChan
+}
+
+// Stops recording the input and writes the recording to the file.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) StopRecordingInput() error {
+	errChan := make(chan error)
+	speccy.CommandChannel <- Cmd_StopRecordingInput{errChan}
+	return <-errChan
+}
@@ -0,0 +1,63 @@
+package spectrum
+
+import "bytes"
+
+// Characters ordered from the darkest to the brightest
+const asciiRamp = " .:-=+*#%@"
+
+// Returns the brightness (0 ... 255) of a color from the standard palette
+func paletteBrightness(color byte) uint {
+	return brightness(palette_standard[color])
+}
+
+// Converts the video memory (6912 bytes: bitmap followed by attributes)
+// to ASCII art which is 'width' characters wide. The number of lines is
+// chosen so that the aspect ratio is approximately preserved,
+// assuming that characters are twice as tall as they are wide.
+// The flash attribute is ignored.
+func ScreenToASCII(vram []byte, width uint) string {
+	if width == 0 {
+		width = 64
+	}
+	if width > ScreenWidth {
+		width = ScreenWidth
+	}
+
+	cellW := float64(ScreenWidth) / float64(width)
+	cellH := 2 * cellW
+	height := uint(float64(ScreenHeight) / cellH)
+	if height == 0 {
+		height = 1
+	}
+
+	var buf bytes.Buffer
+	for row := uint(0); row < height; row++ {
+		y0 := uint(float64(row) * cellH)
+		y1 := uint(float64(row+1) * cellH)
+		if y1 > ScreenHeight {
+			y1 = ScreenHeight
+		}
+
+		for col := uint(0); col < width; col++ {
+			x0 := uint(float64(col) * cellW)
+			x1 := uint(float64(col+1) * cellW)
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sum, n uint
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sum += paletteBrightness(vramPixelColor(vram, x, y))
+					n++
+				}
+			}
+
+			level := (sum / n) * uint(len(asciiRamp)) / 256
+			buf.WriteByte(asciiRamp[level])
+		}
+		buf.WriteByte('\n')
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,50 @@
+package spectrum
+
+import (
+	"image"
+	"image/color"
+	"time"
+)
+
+// Returns a file name for a screenshot, based on the current time
+func DefaultScreenshotPath() string {
+	return time.Now().Format("screenshot-20060102-150405.png")
+}
+
+// Returns the color (an index into the palette) of the pixel at [x,y] of the specified video memory.
+// The flash attribute is ignored.
+func vramPixelColor(vram []byte, x, y uint) byte {
+	addr := xy_to_screenAddr(uint8(x), uint8(y)) - SCREEN_BASE_ADDR
+	attr := vram[ATTR_BASE_ADDR-SCREEN_BASE_ADDR+(y>>3)*ScreenWidth_Attr+(x>>3)]
+
+	bright := (attr & 0x40) >> 3
+	if (vram[addr] & (0x80 >> (x & 7))) != 0 {
+		return bright | (attr & 0x07)
+	}
+	return bright | ((attr >> 3) & 0x07)
+}
+
+// Converts the palette to a palette usable in paletted images
+func (p *Palette) ImagePalette() color.Palette {
+	palette := make(color.Palette, len(p))
+	for i, c := range p {
+		palette[i] = color.RGBA{uint8(c >> 16), uint8(c >> 8), uint8(c), 0xff}
+	}
+	return palette
+}
+
+// Converts the video memory (6912 bytes: bitmap followed by attributes)
+// to a 256x192 image without the border.
+// The flash attribute is ignored.
+func ScreenToImage(vram []byte) *image.Paletted {
+	palette := CurrentPalette().ImagePalette()
+
+	img := image.NewPaletted(image.Rect(0, 0, ScreenWidth, ScreenHeight), palette)
+	for y := uint(0); y < ScreenHeight; y++ {
+		for x := uint(0); x < ScreenWidth; x++ {
+			img.SetColorIndex(int(x), int(y), vramPixelColor(vram, x, y))
+		}
+	}
+
+	return img
+}
@@ -13,7 +13,24 @@ type AudioData struct {
 	// The FPS (frames per second) value that applies to this AudioData object
 	FPS float32
 
+	// The length of the frame, which depends on the machine model.
+	// The last beeper event is at this T-state.
+	TStatesPerFrame int
+
 	BeeperEvents []BeeperEvent
+
+	// The output of the AY chip, ay_samplesPerFrame(TStatesPerFrame) samples evenly spread over the frame.
+	// Each sample is the sum of the three channels (0 .. 3), see AY_VolumeTable.
+	// The slice is nil if the AY chip is disabled.
+	AYSamples []float32
+
+	// The output of each of the AY channels A, B and C (0 .. 1), sampled in the same way
+	// as AYSamples. Used by receivers which place the channels in the stereo field.
+	AYChannels [3][]float32
+
+	// If true, the receiver should discard the audio which it has buffered
+	// but not played yet, because the emulated machine has been reset
+	Flush bool
 }
 
 const MAX_AUDIO_LEVEL = 3
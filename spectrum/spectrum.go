@@ -31,7 +31,9 @@ import (
 	"errors"
 	"github.com/guntars-lemps/gospeccy/formats"
 	"github.com/guntars-lemps/z80"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -46,6 +48,39 @@ const (
 	ROM128
 )
 
+type MachineModel int
+
+const (
+	MODEL_48K MachineModel = iota
+	MODEL_128K
+	MODEL_PLUS2
+	MODEL_PLUS3
+)
+
+var machineModelNames = []string{"48k", "128k", "+2", "+3"}
+
+func (model MachineModel) String() string {
+	return machineModelNames[model]
+}
+
+// Returns the ULA timings of the machine model
+func (model MachineModel) Timings() ULATimings {
+	if model == MODEL_48K {
+		return Timings48k
+	}
+	return Timings128k
+}
+
+func ParseMachineModel(name string) (MachineModel, error) {
+	for i, s := range machineModelNames {
+		// "48" and "128" are accepted as well
+		if (s == name) || (s == name+"k") {
+			return MachineModel(i), nil
+		}
+	}
+	return MODEL_48K, errors.New("unknown machine model \"" + name + "\"")
+}
+
 type DisplayInfo struct {
 	displayReceiver DisplayReceiver
 
@@ -60,29 +95,86 @@ type DisplayInfo struct {
 	numMissedFrames uint
 
 	missedChanges *DisplayData
+
+	// Whether the next frame sent to the 'displayReceiver' should be fully repainted
+	repaint bool
 }
 
 type Spectrum48k struct {
+	// The number of frames emulated since the start. Accessed atomically.
+	// It is the first field, so that it is 64-bit aligned on 32-bit platforms.
+	frameCount uint64
+
 	Cpu       *z80.Z80
 	Memory    *Memory
 	ula       *ULA
 	Keyboard  *Keyboard
 	Joystick  *Joystick
+	Joystick2 *Joystick // The joystick of player 2
+	Mouse     *Mouse
 	tapeDrive *TapeDrive
 
 	Ports *Ports
 
+	// The AY sound chip, or nil if it is disabled
+	ay_orNil *AY
+
+	// Whether the AY chip is connected to the 48k machine, see Cmd_SetAY
+	ay48k bool
+
+	// The recorded states for Cmd_Rewind, or nil if rewinding is disabled
+	rewind_orNil *rewindBuffer
+
 	rom     [0x8000]byte
 	romType RomType
 
+	// The ROM images of the machine models, see Cmd_SetROM
+	roms map[MachineModel]*[0x8000]byte
+
+	// The patches applied to the 48k BASIC ROM, see Cmd_ApplyIPS
+	romPatches []*formats.IPS
+
+	// The emulated machine model
+	model MachineModel
+
+	// Whether the memory contention and the floating bus are emulated, see Cmd_SetContention
+	contention bool
+
+	// Whether the signal of the tape being loaded is heard, see Cmd_SetTapeSound
+	tapeSound bool
+
+	// Whether the Kempston joystick interface is connected, see Cmd_SetKempston
+	kempston bool
+
+	// The number of Cmd_Load commands executed so far. Accessed atomically.
+	loadCount uint32
+
 	// The current display refresh frequency.
 	// The initial value is 'DefaultFPS'.
 	// It is always greater than 0.
 	currentFPS       float32
 	currentFPS_mutex sync.Mutex // To respect the Go memory model
 
-	// A value received from this channel sets the display refresh frequency
-	fpsCh chan float32
+	// Emulation speed relative to 'currentFPS'. The value 0 means "as fast as possible".
+	// Protected by 'currentFPS_mutex'.
+	speed float32
+
+	// Whether warp is enabled (see Cmd_SetWarp), and the speed to restore when it is disabled.
+	// Protected by 'currentFPS_mutex'.
+	warp            bool
+	speedBeforeWarp float32
+
+	// Receiving from this channel tells the emulator loop that the frame rate may have changed
+	frameRateChanged chan bool
+
+	// Whether the emulation is paused, and the functions to call when it changes.
+	// Protected by 'paused_mutex'.
+	paused         bool
+	pauseListeners []func(paused bool)
+	paused_mutex   sync.Mutex
+
+	// Receiving from this channel tells the emulator loop that 'paused' may have changed
+	pausedChanged chan bool
 
 	// This buffered channel (if not nil) will receive at most one value.
 	// The value 'true' sent through this channel indicates that the system ROM has been loaded.
@@ -110,17 +202,83 @@ type Spectrum48k struct {
 	// executed instructions which appeared to be reading from the tape
 	shouldPlayTheTape int
 
+	// Address of the most recently executed instruction
+	lastInstructionAddr uint16
+
+	// Number of maskable interrupts accepted by the CPU since the last reset
+	interruptCount uint64
+
+	// Whether the ULA has yet to start the interrupt of the current frame
+	interruptPending bool
+
+	// Determines whether frames are sent to the displays as fully repainted
+	repaintMode RepaintMode
+
+	// Number of consecutive frames during which the screen and the border did not change
+	stableFrames uint
+
+	// Pending 'Cmd_WaitTitle' commands
+	titleWaiters []*titleWaiter
+
+	// Pending 'Cmd_Sync' commands
+	syncWaiters []chan<- bool
+
+	// The running 'Cmd_CaptureScreens' command, or nil
+	screenCapture *screenCapture
+
+	// Pending 'Cmd_WaitStable' commands
+	stableScreenWaiters []Cmd_WaitStable
+
+	// Whether the next 'AudioData' sent to the audio receivers should have the 'Flush' flag set
+	flushAudio bool
+
+	// Pending 'Cmd_In' and 'Cmd_Out' commands, executed at the beginning of the next frame
+	pendingPortAccesses []interface{}
+
+	// The raw Z80 program being run without the ROM, or nil
+	z80test *z80test
+
+	// Receives a line for each loaded program, see 'Cmd_SetManifest'
+	manifest_orNil io.Writer
+
+	// The comparison against a reference instruction trace, or nil
+	traceDiff *traceDiff
+
+	// The input script being played back, or nil
+	inputPlayback *inputPlayback
+
+	// The RZX recording being played back, or nil
+	rzxPlayback *rzxPlayback
+
+	// The RZX recording of the input, or nil
+	rzxRecording *rzxRecording
+
+	breakpoints breakpoints
+
 	z80_instructionCounter     uint64 // Number of Z80 instructions executed
 	z80_instructionsMeasured   uint64 // Number of Z80 instrs that can be related to 'hostCpu_instructionCounter'
 	hostCpu_instructionCounter uint64
 }
 
+type ResetMode int
+
+const (
+	// Clears the RAM and resets all of the hardware. This is the default.
+	RESET_HARD ResetMode = iota
+
+	// Resets the hardware like the reset button of the real machine.
+	// The contents of the RAM are preserved.
+	RESET_SOFT
+)
+
 type Cmd_Reset struct {
 	// This channel will receive [a channel X which will receive 'true'
 	// when it is detected that the system ROM is loaded].
 	// The channel X will receive 'false' if the emulated machine is reset before
 	// the detection process ends.
 	SystemROMLoaded_orNil chan<- <-chan bool
+
+	Mode ResetMode
 }
 type Cmd_RenderFrame struct {
 	// This channel (if not nil) will receive the real time when the rendering finished.
@@ -144,13 +302,62 @@ type Cmd_AddDisplay struct {
 type Cmd_CloseAllDisplays struct {
 	Finished chan<- byte
 }
+
+// Removes the display from the list of displays and closes it.
+// Does nothing if the display is not in the list.
+type Cmd_RemoveDisplay struct {
+	Display  DisplayReceiver
+	Finished chan<- byte
+}
+type Cmd_Repaint struct{}
+
+// Changes the palette and repaints the screen
+type Cmd_SetPalette struct {
+	Palette *Palette
+}
 type Cmd_SetFPS struct {
 	NewFPS       float32
 	OldFPS_orNil chan<- float32
 }
+type Cmd_SetSpeed struct {
+	// Speed multiplier, 1.0 is the normal speed.
+	// The value 0 disables the frame limiter and mutes the audio.
+	NewSpeed       float32
+	OldSpeed_orNil chan<- float32
+}
+type Cmd_SetWarp struct {
+	// While warp is enabled, the emulation runs as fast as possible and the audio is muted.
+	// Disabling warp restores the previous speed.
+	Enable bool
+}
 type Cmd_SetUlaEmulationAccuracy struct {
 	AccurateEmulation bool
 }
+type Cmd_SetUlaTiming struct {
+	Timing UlaTiming
+}
+type Cmd_SetContention struct {
+	// Whether the ULA delays the CPU when it accesses contended memory
+	// or contended I/O ports while the ULA is reading the screen,
+	// and whether the reads from unassigned ports return the floating bus value
+	Enable bool
+}
+type Cmd_SetKempston struct {
+	// Whether the Kempston joystick interface (port 0x1F) is connected
+	Enable bool
+}
+type Cmd_SetIssue2 struct {
+	// Whether the machine is an Issue 2 Spectrum, which reads the EAR bit of port 0xFE
+	// differently. Loading a snapshot in the Z80 format changes this setting.
+	Enable bool
+}
+type Cmd_SetTapeSound struct {
+	// Whether the signal of the tape being loaded is mixed into the beeper output
+	Enable bool
+}
+type Cmd_SetRepaintMode struct {
+	Mode RepaintMode
+}
 type Cmd_GetNumAudioReceivers struct {
 	N chan<- uint
 }
@@ -160,6 +367,13 @@ type Cmd_AddAudioReceiver struct {
 type Cmd_CloseAllAudioReceivers struct {
 	Finished chan<- byte
 }
+
+// Removes the receiver from the list of audio receivers and closes it.
+// Does nothing if the receiver is not in the list.
+type Cmd_RemoveAudioReceiver struct {
+	Receiver AudioReceiver
+	Finished chan<- byte
+}
 type Cmd_LoadSnapshot struct {
 	InformalFilename string // This is only used for logging purposes
 	Snapshot         formats.Snapshot
@@ -176,10 +390,125 @@ type Cmd_MakeSnapshot struct {
 type Cmd_MakeVideoMemoryDump struct {
 	Chan chan<- []byte
 }
+type Cmd_CaptureScreens struct {
+	// A copy of the video memory is sent to 'Chan' at the end of every 'Every'-th frame,
+	// 'Count' times in total. 'Chan' is closed after the last copy.
+	// The channel should be able to buffer 'Count' values,
+	// otherwise a slow receiver delays the emulation.
+	Every, Count uint
+	Chan         chan<- []byte
+}
+type Cmd_ReadMemory struct {
+	// Fills 'Data' with the memory contents starting at 'Address'
+	Address uint16
+	Data    []byte
+	Done    chan<- bool
+}
+type Cmd_WriteMemory struct {
+	// Writes 'Data' to memory starting at 'Address'.
+	// Writes to ROM are ignored.
+	Address uint16
+	Data    []byte
+	Done    chan<- bool
+}
+type Cmd_GetMachineModel struct {
+	Chan chan<- MachineModel
+}
+type Cmd_SetMachineModel struct {
+	// Switches the emulated machine to the specified model and resets it
+	Model   MachineModel
+	ErrChan chan<- error
+}
+type Cmd_SetROM struct {
+	// Sets the ROM image of the specified machine model, used when the machine
+	// is switched to the model. The 128k ROM consists of the 128k editor (ROM 0)
+	// followed by 48k BASIC (ROM 1).
+	Model MachineModel
+	ROM   *[0x8000]byte
+}
+type Cmd_Out struct {
+	// Writes a value to an I/O port, as if executed by the CPU
+	// at the beginning of the next frame, or immediately if the emulation is paused
+	Port  uint16
+	Value byte
+	Done  chan<- bool
+}
+type Cmd_In struct {
+	// Reads a value from an I/O port, as if executed by the CPU
+	// at the beginning of the next frame, or immediately if the emulation is paused
+	Port uint16
+	Chan chan<- byte
+}
+type Cmd_WaitStable struct {
+	// 'Done' receives true after the screen and the border
+	// have not changed for 'Frames' consecutive frames,
+	// or false if the emulation is paused
+	Frames uint
+	Done   chan<- bool
+}
+type Cmd_WaitTitle struct {
+	// 'Done' receives true when the title screen of a game has been detected
+	// (see title.go), or false if the emulation is paused.
+	//
+	// A frame in which at least 'ChangedCells' 8x8 cells changed counts
+	// as a full-screen repaint. The value 0 selects a default threshold.
+	// The screen has to remain unchanged for 'StableFrames' frames after the repaint.
+	ChangedCells uint
+	StableFrames uint
+	Done         chan<- bool
+}
+type Cmd_GetInterruptCount struct {
+	Chan chan<- uint64
+}
+type Cmd_GetRegisters struct {
+	// Receives the CPU registers. Commands are handled between instructions,
+	// so all registers are from the same instruction boundary.
+	Chan chan<- formats.CpuState
+}
+type Cmd_RewindTape struct{}
+type Cmd_PlayTape struct{}
+type Cmd_SeekTape struct {
+	// Moves the tape to the beginning of the block with the specified index
+	Block   int
+	ErrChan chan<- error
+}
+type Cmd_GetTapeProgress struct {
+	Chan chan<- TapeProgress
+}
+type Cmd_GetPagingState struct {
+	Chan chan<- PagingState
+}
 type Cmd_SetAcceleratedLoad struct {
-	// Set accelerated tape load on/off
+	// Set accelerated tape load on/off.
+	// The setting can be changed safely while a tape block is being loaded:
+	// the acceleration only raises the frame rate, the tape signal is the same.
 	Enable bool
 }
+type Cmd_ToggleAcceleratedLoad struct {
+	// Receives the new setting. May be nil.
+	Chan chan<- bool
+}
+type Cmd_SetAY struct {
+	// Connect/disconnect the AY sound chip to the 48k machine.
+	// The 128k machine always has the AY chip.
+	Enable bool
+}
+type Cmd_FlushAudio struct{}
+
+// Executes the pending 'Cmd_In' and 'Cmd_Out' commands, and fails the pending
+// 'Cmd_Sync', 'Cmd_WaitStable' and 'Cmd_WaitTitle' commands if the emulation is paused
+type Cmd_ReleaseFrameWaiters struct{}
+type Cmd_SetRewindBuffer struct {
+	// The length of the history kept for Cmd_Rewind.
+	// The value 0 disables rewinding and discards the recorded states.
+	Seconds float32
+}
+type Cmd_Rewind struct {
+	// Restores the state of the machine recorded at least 'Frames' frames ago.
+	// The tape is not rewound.
+	Frames  uint
+	ErrChan chan<- error // May be nil
+}
 
 // Creates a new speccy object and starts its command-loop goroutine.
 //
@@ -193,6 +522,8 @@ func NewSpectrum48k(app *Application, rom [0x8000]byte) *Spectrum48k {
 	memory := NewMemory()
 	keyboard := NewKeyboard()
 	joystick := NewJoystick()
+	joystick2 := NewJoystick()
+	mouse := NewMouse()
 	ports := NewPorts()
 	z80 := z80.NewZ80(memory, ports)
 	ula := NewULA()
@@ -205,27 +536,35 @@ func NewSpectrum48k(app *Application, rom [0x8000]byte) *Spectrum48k {
 		ula:            ula,
 		Keyboard:       keyboard,
 		Joystick:       joystick,
+		Joystick2:      joystick2,
+		Mouse:          mouse,
 		Ports:          ports,
 		rom:            rom,
 		romType:        ROM48,
+		roms:           map[MachineModel]*[0x8000]byte{MODEL_48K: &rom},
 		displays:       make([]*DisplayInfo, 0),
 		audioReceivers: make([]AudioReceiver, 0),
 		app:            app,
 		tapeDrive:      tapeDrive,
+		tapeSound:      true,
+		kempston:       true,
 	}
 
 	memory.init(speccy)
 	keyboard.init(speccy)
 	joystick.init(speccy)
+	joystick2.init(speccy)
+	joystick2.SetMode(JOYSTICK_SINCLAIR2)
 	ula.init(z80, memory, ports)
 	ports.init(speccy)
 	tapeDrive.init(speccy)
 
-	speccy.reset(nil)
+	speccy.reset(RESET_HARD, nil)
 
 	speccy.currentFPS = DefaultFPS
-	speccy.fpsCh = make(chan float32, 1)
-	speccy.fpsCh <- DefaultFPS
+	speccy.speed = 1
+	speccy.frameRateChanged = make(chan bool, 1)
+	speccy.pausedChanged = make(chan bool, 1)
 
 	commandChannel := make(chan interface{})
 	speccy.CommandChannel = commandChannel
@@ -239,6 +578,12 @@ func NewSpectrum48k(app *Application, rom [0x8000]byte) *Spectrum48k {
 func (speccy *Spectrum48k) Close() {
 	speccy.close()
 
+	if speccy.rzxRecording != nil {
+		if err := speccy.stopRZXRecording(); err != nil {
+			speccy.app.PrintfMsg("RZX: %s", err)
+		}
+	}
+
 	if speccy.app.Verbose {
 		eff := speccy.GetEmulationEfficiency()
 		if eff != 0 {
@@ -263,6 +608,119 @@ func (speccy *Spectrum48k) GetCurrentFPS() float32 {
 	return fps
 }
 
+// Get current emulation speed multiplier
+func (speccy *Spectrum48k) GetCurrentSpeed() float32 {
+	speccy.currentFPS_mutex.Lock()
+	speed := speccy.speed
+	speccy.currentFPS_mutex.Unlock()
+	return speed
+}
+
+// Returns the number of frames to render per second,
+// taking into account the speed multiplier. Zero means "unlimited".
+//
+// The caller must hold 'currentFPS_mutex'.
+func (speccy *Spectrum48k) frameRate() float32 {
+	return speccy.currentFPS * speccy.speed
+}
+
+// Changes the speed multiplier.
+// The caller must hold 'currentFPS_mutex'.
+func (speccy *Spectrum48k) setSpeed(newSpeed float32) {
+	if newSpeed != speccy.speed {
+		speccy.speed = newSpeed
+
+		speccy.notifyFrameRateChanged()
+	}
+}
+
+// Tells the emulator loop to read the new frame rate.
+// The emulator loop reads the frame rate after receiving the notification,
+// so a single pending notification is enough and the latest change always wins.
+func (speccy *Spectrum48k) notifyFrameRateChanged() {
+	select {
+	case speccy.frameRateChanged <- true:
+	default:
+	}
+}
+
+// Stops the emulation. The displays keep showing the last frame, and no audio is generated.
+func (speccy *Spectrum48k) Pause() {
+	speccy.setPaused(true)
+}
+
+// Continues the emulation stopped by Pause
+func (speccy *Spectrum48k) Resume() {
+	speccy.setPaused(false)
+}
+
+func (speccy *Spectrum48k) IsPaused() bool {
+	speccy.paused_mutex.Lock()
+	paused := speccy.paused
+	speccy.paused_mutex.Unlock()
+	return paused
+}
+
+// Registers a function to be called whenever the emulation is paused or resumed
+func (speccy *Spectrum48k) AddPauseListener(f func(paused bool)) {
+	speccy.paused_mutex.Lock()
+	speccy.pauseListeners = append(speccy.pauseListeners, f)
+	speccy.paused_mutex.Unlock()
+}
+
+func (speccy *Spectrum48k) setPaused(paused bool) {
+	speccy.paused_mutex.Lock()
+	changed := (paused != speccy.paused)
+	speccy.paused = paused
+	listeners := speccy.pauseListeners
+	speccy.paused_mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	// The emulator loop reads 'paused' after receiving the notification,
+	// so a single pending notification is enough
+	select {
+	case speccy.pausedChanged <- true:
+	default:
+	}
+
+	for _, f := range listeners {
+		f(paused)
+	}
+}
+
+// Returns the number of frames emulated since the start
+func (speccy *Spectrum48k) getFrameCount() uint64 {
+	return atomic.LoadUint64(&speccy.frameCount)
+}
+
+// A closed channel. Receiving from it never blocks.
+var alwaysReady = make(chan time.Time)
+
+func init() {
+	close(alwaysReady)
+}
+
+// Returns a ticker for the specified frame rate.
+// If the frame rate is unlimited (zero), the ticker is nil and
+// the returned channel never blocks.
+func newFrameTicker(frameRate float32) (*time.Ticker, <-chan time.Time) {
+	if frameRate == 0 {
+		return nil, alwaysReady
+	}
+	ticker := time.NewTicker(time.Duration(1e9 / frameRate))
+	return ticker, ticker.C
+}
+
+func stopFrameTicker(ticker_orNil *time.Ticker) {
+	if ticker_orNil != nil {
+		ticker_orNil.Stop()
+		Drain(ticker_orNil)
+	}
+}
+
 // Load a program (tape or snapshot)
 func (speccy *Spectrum48k) load(program interface{}) error {
 	var err error
@@ -272,7 +730,11 @@ func (speccy *Spectrum48k) load(program interface{}) error {
 	case formats.Snapshot:
 		speccy.loadSnapshot(program.(formats.Snapshot))
 	case *formats.TAP:
-		speccy.loadTape(program)
+		speccy.loadTape(NewTape(program))
+	case *formats.TZX:
+		speccy.loadTape(NewTapeFromTZX(program))
+	case *formats.RZX:
+		err = speccy.loadRZX(program)
 	default:
 		err = errors.New("Invalid program type.")
 		return err
@@ -281,21 +743,42 @@ func (speccy *Spectrum48k) load(program interface{}) error {
 	return err
 }
 
+// Returns the byte at the specified memory address.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) Peek(address uint16) byte {
+	data := make([]byte, 1)
+	done := make(chan bool)
+	speccy.CommandChannel <- Cmd_ReadMemory{address, data, done}
+	<-done
+	return data[0]
+}
+
+// Writes a byte to the specified memory address. Writes to ROM are ignored.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) Poke(address uint16, value byte) {
+	done := make(chan bool)
+	speccy.CommandChannel <- Cmd_WriteMemory{address, []byte{value}, done}
+	<-done
+}
+
 // Return the TapeDrive instance
 func (speccy *Spectrum48k) TapeDrive() *TapeDrive {
 	return speccy.tapeDrive
 }
 
 // Sends 'Cmd_RenderFrame' commands to the 'speccy' object in regular intervals.
-// The interval depends on the value of FPS (frames per second).
+// The interval depends on the value of FPS (frames per second)
+// and on the speed multiplier.
 //
 // This function should run in a separate goroutine.
 func (speccy *Spectrum48k) EmulatorLoop() {
 	evtLoop := speccy.app.NewEventLoop()
 	app := evtLoop.App()
 
-	fps := <-speccy.fpsCh
-	ticker := time.NewTicker(time.Duration(1e9 / fps))
+	speccy.currentFPS_mutex.Lock()
+	fps := speccy.frameRate()
+	speccy.currentFPS_mutex.Unlock()
+	ticker, tick := newFrameTicker(fps)
 
 	// Render the 1st frame (the 2nd frame will be rendered after 1/FPS seconds)
 	{
@@ -313,11 +796,15 @@ func (speccy *Spectrum48k) EmulatorLoop() {
 
 	var newFPS_orMinusOne float32 = -1
 
+	// Whether the event loop has been paused by the application (see 'EventLoop.Pause')
+	stopped := false
+
 	for {
 		select {
 		case <-evtLoop.Pause:
-			ticker.Stop()
-			Drain(ticker)
+			stopFrameTicker(ticker)
+			ticker, tick = nil, nil
+			stopped = true
 			evtLoop.Pause <- 0
 
 		case <-evtLoop.Terminate:
@@ -328,26 +815,60 @@ func (speccy *Spectrum48k) EmulatorLoop() {
 			evtLoop.Terminate <- 0
 			return
 
-		case <-ticker.C:
+		case <-tick:
 			if newFPS_orMinusOne != -1 {
 				newFPS := newFPS_orMinusOne
 				newFPS_orMinusOne = -1
 
 				if app.Verbose {
-					app.PrintfMsg("setting FPS to %f", newFPS)
+					if newFPS > 0 {
+						app.PrintfMsg("setting FPS to %f", newFPS)
+					} else {
+						app.PrintfMsg("setting FPS to unlimited")
+					}
 				}
-				ticker.Stop()
-				Drain(ticker)
-				ticker = time.NewTicker(time.Duration(1e9 / newFPS))
+				stopFrameTicker(ticker)
+				ticker, tick = newFrameTicker(newFPS)
 				fps = newFPS
 			}
 
 			//app.PrintfMsg("%d", time.Now().UnixNano()/1e6)
 			speccy.CommandChannel <- Cmd_RenderFrame{}
 
-		case newFPS := <-speccy.fpsCh:
-			if (newFPS != fps) && (newFPS > 0) {
+		case <-speccy.frameRateChanged:
+			speccy.currentFPS_mutex.Lock()
+			newFPS := speccy.frameRate()
+			speccy.currentFPS_mutex.Unlock()
+
+			if newFPS != fps {
 				newFPS_orMinusOne = newFPS
+			} else {
+				// The frame rate changed back before the previous change took effect
+				newFPS_orMinusOne = -1
+			}
+
+		case <-speccy.pausedChanged:
+			if stopped {
+				break
+			}
+
+			stopFrameTicker(ticker)
+			if speccy.IsPaused() {
+				ticker, tick = nil, nil
+				if app.Verbose {
+					app.PrintfMsg("emulation paused")
+				}
+
+				// No frames are emulated until the emulation is resumed
+				speccy.CommandChannel <- Cmd_ReleaseFrameWaiters{}
+			} else {
+				// Discard the audio buffered before the pause
+				speccy.CommandChannel <- Cmd_FlushAudio{}
+
+				ticker, tick = newFrameTicker(fps)
+				if app.Verbose {
+					app.PrintfMsg("emulation resumed")
+				}
 			}
 		}
 	}
@@ -379,12 +900,12 @@ func commandLoop(speccy *Spectrum48k) {
 		case untyped_cmd := <-speccy.commandChannel:
 			switch cmd := untyped_cmd.(type) {
 			case Cmd_Reset:
-				speccy.reset(cmd.SystemROMLoaded_orNil)
+				speccy.reset(cmd.Mode, cmd.SystemROMLoaded_orNil)
 
 			case Cmd_RenderFrame:
 				// Ugly hack to check whenever the system ROM has been loaded after a reset.
 				// I bet this won't work with custom ROMs.
-				if (speccy.Cpu.PC() == 0x10ac) && (speccy.systemROMLoaded_orNil != nil) {
+				if speccy.systemROMReady() && (speccy.systemROMLoaded_orNil != nil) {
 					// Note: This is a buffered channel, so the send won't block
 					speccy.systemROMLoaded_orNil <- true
 					speccy.systemROMLoaded_orNil = nil
@@ -404,6 +925,23 @@ func commandLoop(speccy *Spectrum48k) {
 					cmd.Finished <- 0
 				}()
 
+			case Cmd_RemoveDisplay:
+				if speccy.removeDisplay(cmd.Display) {
+					go func() {
+						cmd.Display.Close()
+						cmd.Finished <- 0
+					}()
+				} else {
+					go func() { cmd.Finished <- 0 }()
+				}
+
+			case Cmd_Repaint:
+				speccy.repaint()
+
+			case Cmd_SetPalette:
+				SetPalette(cmd.Palette)
+				speccy.repaint()
+
 			case Cmd_SetFPS:
 				speccy.currentFPS_mutex.Lock()
 				{
@@ -418,17 +956,67 @@ func commandLoop(speccy *Spectrum48k) {
 
 					if newFPS != speccy.currentFPS {
 						speccy.currentFPS = newFPS
+						speccy.notifyFrameRateChanged()
+					}
+				}
+				speccy.currentFPS_mutex.Unlock()
 
-						go func() {
-							speccy.fpsCh <- newFPS
-						}()
+			case Cmd_SetSpeed:
+				speccy.currentFPS_mutex.Lock()
+				{
+					newSpeed := cmd.NewSpeed
+					if newSpeed < 0 {
+						newSpeed = 1
+					}
+
+					if speccy.warp {
+						// The new speed takes effect when warp is disabled
+						if cmd.OldSpeed_orNil != nil {
+							cmd.OldSpeed_orNil <- speccy.speedBeforeWarp
+						}
+						speccy.speedBeforeWarp = newSpeed
+					} else {
+						if cmd.OldSpeed_orNil != nil {
+							cmd.OldSpeed_orNil <- speccy.speed
+						}
+						speccy.setSpeed(newSpeed)
 					}
 				}
 				speccy.currentFPS_mutex.Unlock()
 
+			case Cmd_SetWarp:
+				speccy.currentFPS_mutex.Lock()
+				if cmd.Enable && !speccy.warp {
+					speccy.warp = true
+					speccy.speedBeforeWarp = speccy.speed
+					speccy.setSpeed(0)
+				} else if !cmd.Enable && speccy.warp {
+					speccy.warp = false
+					speccy.setSpeed(speccy.speedBeforeWarp)
+				}
+				speccy.currentFPS_mutex.Unlock()
+
 			case Cmd_SetUlaEmulationAccuracy:
 				speccy.ula.setEmulationAccuracy(cmd.AccurateEmulation)
 
+			case Cmd_SetUlaTiming:
+				speccy.ula.setTiming(cmd.Timing)
+
+			case Cmd_SetContention:
+				speccy.contention = cmd.Enable
+
+			case Cmd_SetTapeSound:
+				speccy.tapeSound = cmd.Enable
+
+			case Cmd_SetIssue2:
+				speccy.Ports.issue2 = cmd.Enable
+
+			case Cmd_SetKempston:
+				speccy.kempston = cmd.Enable
+
+			case Cmd_SetRepaintMode:
+				speccy.repaintMode = cmd.Mode
+
 			case Cmd_GetNumAudioReceivers:
 				cmd.N <- uint(len(speccy.audioReceivers))
 
@@ -441,6 +1029,16 @@ func commandLoop(speccy *Spectrum48k) {
 					cmd.Finished <- 0
 				}()
 
+			case Cmd_RemoveAudioReceiver:
+				if speccy.removeAudioReceiver(cmd.Receiver) {
+					go func() {
+						cmd.Receiver.Close()
+						cmd.Finished <- 0
+					}()
+				} else {
+					go func() { cmd.Finished <- 0 }()
+				}
+
 			case Cmd_LoadSnapshot:
 				if speccy.app.Verbose {
 					if len(cmd.InformalFilename) > 0 {
@@ -465,7 +1063,11 @@ func commandLoop(speccy *Spectrum48k) {
 					}
 				}
 
+				atomic.AddUint32(&speccy.loadCount, 1)
 				err := speccy.load(cmd.Program)
+				if err == nil {
+					speccy.writeManifestEntry(cmd.InformalFilename, cmd.Program)
+				}
 
 				if cmd.ErrChan != nil {
 					cmd.ErrChan <- err
@@ -477,20 +1079,213 @@ func commandLoop(speccy *Spectrum48k) {
 			case Cmd_MakeVideoMemoryDump:
 				cmd.Chan <- speccy.makeVideoMemoryDump()
 
+			case Cmd_ReadMemory:
+				for i := range cmd.Data {
+					cmd.Data[i] = speccy.Memory.Read(cmd.Address + uint16(i))
+				}
+				cmd.Done <- true
+
+			case Cmd_WriteMemory:
+				for i, value := range cmd.Data {
+					speccy.Memory.Write(cmd.Address+uint16(i), value)
+				}
+				cmd.Done <- true
+
+			case Cmd_PlayInput:
+				speccy.inputPlayback = &inputPlayback{events: cmd.Events}
+
+			case Cmd_RecordInput:
+				cmd.Err <- speccy.startRZXRecording(cmd.FilePath)
+
+			case Cmd_StopRecordingInput:
+				cmd.Err <- speccy.stopRZXRecording()
+
+			case Cmd_SetManifest:
+				speccy.manifest_orNil = cmd.Manifest_orNil
+
+			case Cmd_RunZ80Test:
+				speccy.runZ80Test(cmd)
+
+			case Cmd_TraceDiff:
+				speccy.startTraceDiff(cmd)
+
+			case Cmd_ApplyIPS:
+				cmd.ErrChan <- speccy.applyIPS(cmd.Patch, cmd.ROM)
+
+			case Cmd_GetMachineModel:
+				cmd.Chan <- speccy.model
+
+			case Cmd_SetMachineModel:
+				cmd.ErrChan <- speccy.setMachineModel(cmd.Model)
+
+			case Cmd_SetROM:
+				rom := *cmd.ROM
+				speccy.roms[cmd.Model] = &rom
+
+			case Cmd_Out:
+				speccy.pendingPortAccesses = append(speccy.pendingPortAccesses, cmd)
+				if speccy.IsPaused() {
+					speccy.performPendingPortAccesses()
+				}
+
+			case Cmd_In:
+				speccy.pendingPortAccesses = append(speccy.pendingPortAccesses, cmd)
+				if speccy.IsPaused() {
+					speccy.performPendingPortAccesses()
+				}
+
+			case Cmd_WaitStable:
+				if speccy.IsPaused() && (speccy.stableFrames < cmd.Frames) {
+					cmd.Done <- false
+				} else {
+					speccy.stableScreenWaiters = append(speccy.stableScreenWaiters, cmd)
+					speccy.notifyStableScreenWaiters()
+				}
+
+			case Cmd_WaitTitle:
+				if speccy.IsPaused() {
+					cmd.Done <- false
+				} else {
+					speccy.addTitleWaiter(cmd)
+				}
+
+			case Cmd_AtBasicPrompt:
+				cmd.Chan <- speccy.atBasicPrompt()
+
+			case Cmd_GetBasicEditor:
+				cmd.Chan <- speccy.basicEditor()
+
+			case Cmd_AtMenu128:
+				cmd.Chan <- speccy.atMenu128()
+
+			case Cmd_Sync:
+				if speccy.IsPaused() {
+					cmd.Done <- false
+				} else {
+					speccy.syncWaiters = append(speccy.syncWaiters, cmd.Done)
+				}
+
+			case Cmd_CaptureScreens:
+				speccy.startScreenCapture(cmd)
+
+			case Cmd_GetInterruptCount:
+				cmd.Chan <- speccy.interruptCount
+
+			case Cmd_SetBreakpoint:
+				speccy.breakpoints.setBreakpoint(cmd.Address, cmd.Enable)
+
+			case Cmd_ClearBreakpoints:
+				speccy.breakpoints.clear()
+
+			case Cmd_GetBreakpoints:
+				cmd.Chan <- speccy.breakpoints.addresses()
+
+			case Cmd_SetWatch:
+				speccy.Memory.watches.set(cmd.From, cmd.To, cmd.Mode)
+
+			case Cmd_ClearWatches:
+				speccy.Memory.watches.clear()
+
+			case Cmd_GetWatches:
+				cmd.Chan <- speccy.Memory.watches.ranges()
+
+			case Cmd_GetRegisters:
+				cpu := speccy.cpuState()
+				cpu.Tstate = uint(speccy.ula.cpuTState())
+				cmd.Chan <- cpu
+
+			case Cmd_RewindTape:
+				if speccy.tapeDrive != nil {
+					speccy.tapeDrive.Rewind()
+				}
+
+			case Cmd_PlayTape:
+				if (speccy.tapeDrive != nil) && (speccy.tapeDrive.Tape() != nil) {
+					speccy.tapeDrive.Play()
+				}
+
+			case Cmd_SeekTape:
+				cmd.ErrChan <- speccy.tapeDrive.SeekToBlock(cmd.Block)
+
+			case Cmd_GetTapeProgress:
+				if speccy.tapeDrive != nil {
+					cmd.Chan <- speccy.tapeDrive.progress()
+				} else {
+					cmd.Chan <- TapeProgress{}
+				}
+
+			case Cmd_GetPagingState:
+				cmd.Chan <- speccy.Memory.PagingState()
+
 			case Cmd_SetAcceleratedLoad:
 				speccy.tapeDrive.AcceleratedLoad = cmd.Enable
 
+			case Cmd_ToggleAcceleratedLoad:
+				speccy.tapeDrive.AcceleratedLoad = !speccy.tapeDrive.AcceleratedLoad
+				if cmd.Chan != nil {
+					cmd.Chan <- speccy.tapeDrive.AcceleratedLoad
+				}
+
+			case Cmd_SetAY:
+				speccy.ay48k = cmd.Enable
+				speccy.connectAY()
+
+			case Cmd_FlushAudio:
+				speccy.flushAudio = true
+
+			case Cmd_ReleaseFrameWaiters:
+				if speccy.IsPaused() {
+					speccy.releaseFrameWaiters()
+				}
+
+			case Cmd_SetRewindBuffer:
+				speccy.rewind_orNil = newRewindBuffer(cmd.Seconds)
+
+			case Cmd_Rewind:
+				err := speccy.rewind(cmd.Frames)
+				if cmd.ErrChan != nil {
+					cmd.ErrChan <- err
+				}
+
 			}
 		}
 	}
 }
 
-func (speccy *Spectrum48k) reset(systemROMLoaded_orNil chan<- <-chan bool) error {
+// Resets the machine. The tape is stopped and all keys are released in both modes.
+func (speccy *Spectrum48k) reset(mode ResetMode, systemROMLoaded_orNil chan<- <-chan bool) error {
+	speccy.stopZ80Test(errors.New("the Z80 test has been aborted by a reset"))
+	speccy.stopTraceDiff(errors.New("the trace comparison has been aborted by a reset"))
+
 	speccy.Cpu.Reset()
-	speccy.Memory.reset()
+	speccy.interruptCount = 0
+	speccy.interruptPending = false
+	speccy.rzxPlayback = nil
+	if speccy.rzxRecording != nil {
+		if err := speccy.stopRZXRecording(); err != nil {
+			speccy.app.PrintfMsg("RZX: %s", err)
+		} else {
+			speccy.app.PrintfMsg("RZX: the recording has been stopped by a reset")
+		}
+	}
+	speccy.breakpoints.stopped = false
+	if mode == RESET_HARD {
+		speccy.Memory.reset()
+	}
+	speccy.Memory.setPagingAvailable(speccy.model != MODEL_48K)
 	speccy.ula.reset()
 	speccy.Keyboard.reset()
 	speccy.Ports.reset()
+	if speccy.ay_orNil != nil {
+		speccy.ay_orNil.reset()
+	}
+	speccy.flushAudio = true
+
+	// Stop the tape and rewind it to the beginning. The tape remains inserted.
+	if speccy.tapeDrive != nil {
+		speccy.tapeDrive.Stop()
+		speccy.tapeDrive.earBit = 0xbf
+	}
 
 	if speccy.systemROMLoaded_orNil != nil {
 		speccy.systemROMLoaded_orNil <- false
@@ -502,14 +1297,54 @@ func (speccy *Spectrum48k) reset(systemROMLoaded_orNil chan<- <-chan bool) error
 		systemROMLoaded_orNil <- speccy.systemROMLoaded_orNil
 	}
 
-	// Copy the ROM image into the first 16k of memory
-	copy(speccy.Memory.Data()[0:0x4000], speccy.rom[:])
-
-	speccy.romType = ROM48
+	// Copy the ROM image into the ROM banks
+	speccy.Memory.loadROM(speccy.rom[:])
 
 	return nil
 }
 
+// Switches the machine to the specified model and resets it.
+// The 128k model has the memory paging (port 0x7FFD), the AY sound chip
+// and its own frame timing.
+func (speccy *Spectrum48k) setMachineModel(model MachineModel) error {
+	if (model != MODEL_48K) && (model != MODEL_128K) {
+		return errors.New("machine model " + model.String() + " is not supported")
+	}
+	rom, ok := speccy.roms[model]
+	if !ok {
+		return errors.New("the ROM of machine model " + model.String() + " is not loaded")
+	}
+
+	speccy.model = model
+	speccy.rom = *rom
+	if model == MODEL_48K {
+		speccy.romType = ROM48
+	} else {
+		speccy.romType = ROM128
+	}
+	speccy.ula.timings = model.Timings()
+	speccy.connectAY()
+
+	err := speccy.applyROMPatches()
+	if err != nil {
+		return err
+	}
+
+	return speccy.reset(RESET_HARD, nil)
+}
+
+// Connects the AY chip if the machine model has one or if it has been added to the 48k machine,
+// and disconnects it otherwise
+func (speccy *Spectrum48k) connectAY() {
+	if (speccy.model != MODEL_48K) || speccy.ay48k {
+		if speccy.ay_orNil == nil {
+			speccy.ay_orNil = NewAY()
+		}
+	} else {
+		speccy.ay_orNil = nil
+	}
+}
+
 func (speccy *Spectrum48k) addDisplay(display DisplayReceiver) {
 	d := &DisplayInfo{
 		displayReceiver: display,
@@ -520,6 +1355,25 @@ func (speccy *Spectrum48k) addDisplay(display DisplayReceiver) {
 	speccy.displays = append(speccy.displays, d)
 }
 
+// Causes the next frame to be sent to all displays as fully repainted
+func (speccy *Spectrum48k) repaint() {
+	for _, display := range speccy.displays {
+		display.lastFrame = nil
+		display.repaint = true
+	}
+}
+
+// Returns false if the display is not in the list
+func (speccy *Spectrum48k) removeDisplay(display DisplayReceiver) bool {
+	for i, d := range speccy.displays {
+		if d.displayReceiver == display {
+			speccy.displays = append(speccy.displays[:i:i], speccy.displays[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (speccy *Spectrum48k) closeAllDisplays() {
 	displays := speccy.displays
 	speccy.displays = make([]*DisplayInfo, 0)
@@ -538,6 +1392,43 @@ func (speccy *Spectrum48k) addAudioReceiver(receiver AudioReceiver) {
 	speccy.audioReceivers = append(speccy.audioReceivers, receiver)
 }
 
+// Sends the audio data to all audio receivers.
+// Each receiver gets its own copy of the data,
+// so that a receiver modifying the data cannot affect the other receivers.
+func (speccy *Spectrum48k) sendAudioData(audioData *AudioData) {
+	for i, audioReceiver := range speccy.audioReceivers {
+		data := audioData
+		if i > 0 {
+			dataCopy := *audioData
+			dataCopy.BeeperEvents = make([]BeeperEvent, len(audioData.BeeperEvents))
+			copy(dataCopy.BeeperEvents, audioData.BeeperEvents)
+			if audioData.AYSamples != nil {
+				dataCopy.AYSamples = make([]float32, len(audioData.AYSamples))
+				copy(dataCopy.AYSamples, audioData.AYSamples)
+			}
+			for ch, samples := range audioData.AYChannels {
+				if samples != nil {
+					dataCopy.AYChannels[ch] = make([]float32, len(samples))
+					copy(dataCopy.AYChannels[ch], samples)
+				}
+			}
+			data = &dataCopy
+		}
+		audioReceiver.GetAudioDataChannel() <- data
+	}
+}
+
+// Returns false if the receiver is not in the list
+func (speccy *Spectrum48k) removeAudioReceiver(receiver AudioReceiver) bool {
+	for i, r := range speccy.audioReceivers {
+		if r == receiver {
+			speccy.audioReceivers = append(speccy.audioReceivers[:i:i], speccy.audioReceivers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (speccy *Spectrum48k) closeAllAudioReceivers() {
 	audioReceivers := speccy.audioReceivers
 	speccy.audioReceivers = make([]AudioReceiver, 0)
@@ -566,13 +1457,57 @@ func (speccy *Spectrum48k) close() {
 // Initializes state from the specified snapshot.
 // Returns nil on success.
 func (speccy *Spectrum48k) loadSnapshot(s formats.Snapshot) error {
-	speccy.reset(nil)
+	var mem128 *formats.Memory128
+	if s128, ok := s.(formats.Snapshot128); ok {
+		mem128 = s128.Memory128()
+	}
+
+	// 128k snapshots switch the machine to the 128k model
+	if (mem128 != nil) && (speccy.model == MODEL_48K) {
+		err := speccy.setMachineModel(MODEL_128K)
+		if err != nil {
+			return err
+		}
+	}
+
+	speccy.reset(RESET_HARD, nil)
 
-	cpu := s.CpuState()
 	ula := s.UlaState()
 	mem := s.Memory()
 
-	// Populate registers
+	speccy.setCpuState(s.CpuState())
+
+	// Border color
+	speccy.Ports.Write(0xfe, ula.Border&0x07)
+
+	// Populate memory
+	if mem128 != nil {
+		speccy.Memory.loadBanks(&mem128.Banks)
+		speccy.Memory.writePagingPort(mem128.Paging)
+	} else {
+		// 48k snapshots run in the 48k mode of the 128k machine: 48k BASIC is paged in and the paging is locked
+		if speccy.model != MODEL_48K {
+			speccy.Memory.writePagingPort(PAGING_ROM | PAGING_LOCK)
+		}
+
+		speccy.Memory.load(0x4000, mem[:])
+	}
+
+	if ay, ok := s.(formats.AYSnapshot); ok && (speccy.ay_orNil != nil) {
+		if state, present := ay.AYState(); present {
+			speccy.setAYState(state)
+		}
+	}
+
+	if issue2, ok := s.(formats.Issue2Snapshot); ok {
+		speccy.Ports.issue2 = issue2.Issue2Emulation()
+	}
+
+	return nil
+}
+
+// Populates the CPU registers
+func (speccy *Spectrum48k) setCpuState(cpu formats.CpuState) {
 	speccy.Cpu.A = cpu.A
 	speccy.Cpu.F = cpu.F
 	speccy.Cpu.B = cpu.B
@@ -604,54 +1539,77 @@ func (speccy *Spectrum48k) loadSnapshot(s formats.Snapshot) error {
 
 	speccy.Cpu.SetPC(cpu.PC)
 	speccy.Cpu.SetSP(cpu.SP)
+}
 
-	// Border color
-	speccy.Ports.Write(0xfe, ula.Border&0x07)
-
-	// Populate memory
-	copy(speccy.Memory.Data()[0x4000:], mem[:])
+// Sets the AY registers, discarding the pending register writes.
+// The caller has to check that the AY is enabled.
+func (speccy *Spectrum48k) setAYState(state formats.AYState) {
+	speccy.ay_orNil.reset()
+	for register, value := range state.Registers {
+		speccy.ay_orNil.setRegister(byte(register), value)
+	}
+	speccy.ay_orNil.selectRegister(state.SelectedRegister)
+}
 
-	return nil
+// Returns the CPU registers. The T-state counter is not included.
+func (speccy *Spectrum48k) cpuState() formats.CpuState {
+	var cpu formats.CpuState
+
+	cpu.A = speccy.Cpu.A
+	cpu.F = speccy.Cpu.F
+	cpu.B = speccy.Cpu.B
+	cpu.C = speccy.Cpu.C
+	cpu.D = speccy.Cpu.D
+	cpu.E = speccy.Cpu.E
+	cpu.H = speccy.Cpu.H
+	cpu.L = speccy.Cpu.L
+	cpu.A_ = speccy.Cpu.A_
+	cpu.F_ = speccy.Cpu.F_
+	cpu.B_ = speccy.Cpu.B_
+	cpu.C_ = speccy.Cpu.C_
+	cpu.D_ = speccy.Cpu.D_
+	cpu.E_ = speccy.Cpu.E_
+	cpu.H_ = speccy.Cpu.H_
+	cpu.L_ = speccy.Cpu.L_
+	cpu.IX = uint16(speccy.Cpu.IXL) | (uint16(speccy.Cpu.IXH) << 8)
+	cpu.IY = uint16(speccy.Cpu.IYL) | (uint16(speccy.Cpu.IYH) << 8)
+
+	cpu.I = speccy.Cpu.I
+	cpu.IFF1 = speccy.Cpu.IFF1
+	cpu.IFF2 = speccy.Cpu.IFF2
+	cpu.IM = speccy.Cpu.IM
+
+	cpu.R = byte(speccy.Cpu.R&0x7f) | (speccy.Cpu.R7 & 0x80)
+
+	cpu.SP = speccy.Cpu.SP()
+	cpu.PC = speccy.Cpu.PC()
+
+	return cpu
 }
 
 func (speccy *Spectrum48k) MakeSnapshot() *formats.FullSnapshot {
 	var s formats.FullSnapshot
 
 	// Save registers
-	s.Cpu.A = speccy.Cpu.A
-	s.Cpu.F = speccy.Cpu.F
-	s.Cpu.B = speccy.Cpu.B
-	s.Cpu.C = speccy.Cpu.C
-	s.Cpu.D = speccy.Cpu.D
-	s.Cpu.E = speccy.Cpu.E
-	s.Cpu.H = speccy.Cpu.H
-	s.Cpu.L = speccy.Cpu.L
-	s.Cpu.A_ = speccy.Cpu.A_
-	s.Cpu.F_ = speccy.Cpu.F_
-	s.Cpu.B_ = speccy.Cpu.B_
-	s.Cpu.C_ = speccy.Cpu.C_
-	s.Cpu.D_ = speccy.Cpu.D_
-	s.Cpu.E_ = speccy.Cpu.E_
-	s.Cpu.H_ = speccy.Cpu.H_
-	s.Cpu.L_ = speccy.Cpu.L_
-	s.Cpu.IX = uint16(speccy.Cpu.IXL) | (uint16(speccy.Cpu.IXH) << 8)
-	s.Cpu.IY = uint16(speccy.Cpu.IYL) | (uint16(speccy.Cpu.IYH) << 8)
-
-	s.Cpu.I = speccy.Cpu.I
-	s.Cpu.IFF1 = speccy.Cpu.IFF1
-	s.Cpu.IFF2 = speccy.Cpu.IFF2
-	s.Cpu.IM = speccy.Cpu.IM
-
-	s.Cpu.R = byte(speccy.Cpu.R&0x7f) | (speccy.Cpu.R7 & 0x80)
-
-	s.Cpu.SP = speccy.Cpu.SP()
-	s.Cpu.PC = speccy.Cpu.PC()
+	s.Cpu = speccy.cpuState()
 
 	// Border color
 	s.Ula.Border = speccy.ula.getBorderColor() & 0x07
 
 	// Memory
 	copy(s.Mem[:], speccy.Memory.Data()[0x4000:])
+	if speccy.Memory.pagingAvailable {
+		s.Mem128 = &formats.Memory128{
+			Paging: speccy.Memory.paging,
+			Banks:  speccy.Memory.ram,
+		}
+	}
+
+	if speccy.ay_orNil != nil {
+		s.AY.Registers, s.AY.SelectedRegister = speccy.ay_orNil.state()
+		s.AYPresent = true
+	}
+	s.Issue2 = speccy.Ports.issue2
 
 	return &s
 }
@@ -660,8 +1618,9 @@ func (speccy *Spectrum48k) doOpcodes() {
 
 	var z80_localInstructionCounter uint = 0
 
-	// Main instruction emulation loop
-	{
+	// Main instruction emulation loop.
+	// It is repeated if the interrupt ends a HALT before the end of the frame.
+	for {
 		var readFromTape bool = (speccy.readFromTape && (speccy.shouldPlayTheTape > 0) && (speccy.tapeDrive != nil))
 
 		if speccy.tapeDrive != nil && speccy.tapeDrive.NotifyLoadComplete && speccy.tapeDrive.notifyCpuLoadCompleted {
@@ -675,14 +1634,43 @@ func (speccy *Spectrum48k) doOpcodes() {
 			}
 		}
 
+		// Memory accesses are checked against the watchpoints only while instructions are executed
+		speccy.Memory.watches.active = (speccy.Memory.watches.modes != nil)
+		speccy.Memory.contentionActive = speccy.contention
+		speccy.Memory.cpuCycles = true
+
 		for (speccy.Cpu.GetTstates() < speccy.Cpu.EventNextEvent) && !speccy.Cpu.Halted {
 			//speccy.Cpu.DoHalt()
 			//z80.OpcodesMap[opcode](speccy.Cpu)
 			//opcode := speccy.Memory.Read(speccy.Cpu.PC())
 			//speccy.Cpu.IncPC(1)
+			if speccy.interruptPending {
+				speccy.checkInterrupt()
+			}
+			if speccy.z80test != nil {
+				speccy.z80testTrap()
+			}
+			if speccy.traceDiff != nil {
+				speccy.traceDiffTrap()
+			}
+			if (speccy.breakpoints.set != nil) && speccy.breakpointTrap() {
+				return
+			}
+			speccy.lastInstructionAddr = speccy.Cpu.PC()
+			r := speccy.Cpu.R
+			speccy.ula.instructionStart()
 			speccy.Cpu.DoOpcode()
 			z80_localInstructionCounter++
 
+			if speccy.rzxRecording != nil {
+				speccy.rzxRecording.fetches += speccy.fetchesSince(r)
+			}
+
+			if speccy.Memory.watches.hit != nil {
+				speccy.watchTrap()
+				return
+			}
+
 			if readFromTape {
 				endOfBlock := speccy.tapeDrive.doPlay()
 				if endOfBlock {
@@ -700,27 +1688,283 @@ func (speccy *Spectrum48k) doOpcodes() {
 				speccy.tapeDrive.decelerate()
 			}
 
-			// Repeat emulating the HALT instruction until 'speccy.Cpu.eventNextEvent'
+			// Repeat emulating the HALT instruction until 'speccy.Cpu.eventNextEvent',
+			// or until the interrupt starts
 			for speccy.Cpu.GetTstates() < speccy.Cpu.EventNextEvent {
+				if speccy.interruptPending && speccy.checkInterrupt() {
+					break
+				}
+				r := speccy.Cpu.R
+				speccy.ula.instructionStart()
 				speccy.Cpu.DoHalt()
 				z80_localInstructionCounter++
+
+				if speccy.rzxRecording != nil {
+					speccy.rzxRecording.fetches += speccy.fetchesSince(r)
+				}
 			}
 		}
+
+		if speccy.Cpu.GetTstates() >= speccy.Cpu.EventNextEvent {
+			break
+		}
 	}
 }
 
-func (speccy *Spectrum48k) renderFrame(completionTime_orNil chan<- time.Time) {
-	speccy.Ports.frame_begin()
-	speccy.ula.frame_begin()
+// Signals the maskable interrupt to the CPU if the ULA has started the interrupt of the current frame.
+// Returns true if the interrupt was signalled.
+func (speccy *Spectrum48k) checkInterrupt() bool {
+	if speccy.ula.cpuTState() < speccy.ula.interruptTState {
+		return false
+	}
+	speccy.interruptPending = false
+	if speccy.rzxRecording != nil {
+		speccy.rzxRecording.endFrame()
+	}
+	speccy.interrupt()
+	return true
+}
 
-	// Execute instructions corresponding to one screen frame
-	speccy.Cpu.ModTstates(TStatesPerFrame)
+// Returns true if the most recently executed instruction was LD A,I or LD A,R
+func (speccy *Spectrum48k) lastInstructionWasLdAIR() bool {
+	addr := speccy.lastInstructionAddr
+	if speccy.Memory.peek(addr) != 0xed {
+		return false
+	}
+	opcode := speccy.Memory.peek(addr + 1)
+	return (opcode == 0x57) || (opcode == 0x5f)
+}
+
+// Signals the maskable interrupt to the CPU.
+//
+// On a real Z80, the P/V flag set by LD A,I or LD A,R is a copy of IFF2.
+// If the interrupt is accepted immediately after one of these instructions,
+// IFF2 is reset while the instruction is still completing and P/V reads as 0.
+// Some programs rely on this to detect whether an interrupt occurred.
+func (speccy *Spectrum48k) interrupt() {
+	if speccy.Cpu.IFF1 != 0 {
+		if speccy.lastInstructionWasLdAIR() {
+			speccy.Cpu.F &^= 0x04
+		}
+		speccy.interruptCount++
+	}
 	speccy.Cpu.Interrupt()
-	speccy.Cpu.EventNextEvent = TStatesPerFrame
-	speccy.doOpcodes()
+}
+
+type screenCapture struct {
+	every, remaining uint
+
+	// Frames remaining until the next capture
+	countdown uint
+
+	ch chan<- []byte
+}
+
+func (speccy *Spectrum48k) startScreenCapture(cmd Cmd_CaptureScreens) {
+	if speccy.screenCapture != nil {
+		close(speccy.screenCapture.ch)
+		speccy.screenCapture = nil
+	}
+
+	if cmd.Count == 0 {
+		close(cmd.Chan)
+		return
+	}
+
+	every := cmd.Every
+	if every == 0 {
+		every = 1
+	}
+
+	speccy.screenCapture = &screenCapture{
+		every:     every,
+		remaining: cmd.Count,
+		countdown: every,
+		ch:        cmd.Chan,
+	}
+}
+
+// Called at the end of each frame while a 'Cmd_CaptureScreens' command is running
+func (speccy *Spectrum48k) captureScreen() {
+	capture := speccy.screenCapture
+
+	capture.countdown--
+	if capture.countdown > 0 {
+		return
+	}
+	capture.countdown = capture.every
+
+	vram := make([]byte, 6912)
+	copy(vram, speccy.makeVideoMemoryDump())
+	capture.ch <- vram
+
+	capture.remaining--
+	if capture.remaining == 0 {
+		close(capture.ch)
+		speccy.screenCapture = nil
+	}
+}
+
+// Sends a notification to every 'Cmd_WaitStable' command
+// whose number of frames has been reached
+func (speccy *Spectrum48k) notifyStableScreenWaiters() {
+	n := 0
+	for _, waiter := range speccy.stableScreenWaiters {
+		if speccy.stableFrames >= waiter.Frames {
+			waiter.Done <- true
+		} else {
+			speccy.stableScreenWaiters[n] = waiter
+			n++
+		}
+	}
+	speccy.stableScreenWaiters = speccy.stableScreenWaiters[0:n]
+}
+
+// Called when the emulation is paused. The commands waiting for frames would block
+// the goroutines which sent them until the emulation is resumed, so they fail instead.
+func (speccy *Spectrum48k) releaseFrameWaiters() {
+	if len(speccy.pendingPortAccesses) > 0 {
+		speccy.performPendingPortAccesses()
+	}
+
+	speccy.notifyStableScreenWaiters()
+	for _, waiter := range speccy.stableScreenWaiters {
+		waiter.Done <- false
+	}
+	speccy.stableScreenWaiters = nil
+
+	for _, waiter := range speccy.titleWaiters {
+		waiter.Done <- false
+	}
+	speccy.titleWaiters = nil
+
+	for _, waiter := range speccy.syncWaiters {
+		waiter <- false
+	}
+	speccy.syncWaiters = nil
+}
+
+// Executes the I/O operations requested via 'Cmd_In' and 'Cmd_Out'.
+// The operations are delayed until the start of a frame,
+// so that the T-states of the generated events fit into the frame.
+func (speccy *Spectrum48k) performPendingPortAccesses() {
+	for _, untyped_cmd := range speccy.pendingPortAccesses {
+		switch cmd := untyped_cmd.(type) {
+		case Cmd_Out:
+			speccy.Ports.Write(cmd.Port, cmd.Value)
+			cmd.Done <- true
+		case Cmd_In:
+			cmd.Chan <- speccy.Ports.Read(cmd.Port)
+		}
+	}
+	speccy.pendingPortAccesses = nil
+}
+
+// Returns whether the current frame should be fully repainted, according to 'speccy.repaintMode'
+func (speccy *Spectrum48k) fullRepaintNeeded() bool {
+	switch speccy.repaintMode {
+	case REPAINT_FULL:
+		return true
+	case REPAINT_AUTO:
+		return speccy.Ports.borderChanged() || (speccy.ula.numDirtyCells() >= repaintAuto_dirtyCellsThreshold)
+	}
+	return false
+}
+
+func (speccy *Spectrum48k) renderFrame(completionTime_orNil chan<- time.Time) {
+	if speccy.breakpoints.stopped {
+		if speccy.IsPaused() {
+			// The machine is frozen at a breakpoint
+			if completionTime_orNil != nil {
+				completionTime_orNil <- time.Now()
+			}
+			return
+		}
+
+		// Finish the frame interrupted by the breakpoint or watchpoint
+		speccy.breakpoints.stopped = false
+	} else {
+		speccy.Ports.frame_begin()
+		speccy.ula.frame_begin()
+
+		if speccy.inputPlayback != nil {
+			speccy.playInput()
+		}
+
+		// Execute instructions corresponding to one screen frame.
+		// The previous frame ended earlier in terms of the CPU's T-states if the CPU was delayed.
+		speccy.Cpu.ModTstates(speccy.ula.timings.TStatesPerFrame - speccy.ula.contentionTStates)
+		speccy.ula.contentionTStates = 0
+
+		if len(speccy.pendingPortAccesses) > 0 {
+			speccy.performPendingPortAccesses()
+		}
+		// The first frame of an RZX recording starts right after the snapshot.
+		// The frames of an RZX recording begin with the interrupt.
+		if speccy.rzxPlayback == nil {
+			speccy.interruptPending = true
+			speccy.checkInterrupt()
+		} else if speccy.rzxPlayback.frame > 0 {
+			speccy.interrupt()
+		}
+		speccy.Cpu.EventNextEvent = speccy.ula.timings.TStatesPerFrame
+	}
+	if speccy.rzxPlayback != nil {
+		speccy.doOpcodesRZX()
+		speccy.rzxFrameEnd()
+	} else {
+		if speccy.rzxRecording != nil {
+			speccy.rzxRecording.running = true
+		}
+		speccy.doOpcodes()
+		if speccy.rzxRecording != nil {
+			speccy.rzxRecording.running = false
+		}
+	}
+	speccy.Memory.watches.active = false
+	speccy.Memory.contentionActive = false
+	speccy.Memory.cpuCycles = false
+	if speccy.breakpoints.stopped {
+		if completionTime_orNil != nil {
+			completionTime_orNil <- time.Now()
+		}
+		return
+	}
+	atomic.AddUint64(&speccy.frameCount, 1)
+
+	if speccy.ula.screenChanged() || speccy.Ports.borderChanged() {
+		speccy.stableFrames = 0
+	} else {
+		speccy.stableFrames++
+	}
+	if len(speccy.stableScreenWaiters) > 0 {
+		speccy.notifyStableScreenWaiters()
+	}
+	if len(speccy.titleWaiters) > 0 {
+		speccy.checkTitleWaiters()
+	}
+	if speccy.screenCapture != nil {
+		speccy.captureScreen()
+	}
+	if speccy.rewind_orNil != nil {
+		speccy.recordRewindState()
+	}
+
+	var sync *frameSync
+	if len(speccy.syncWaiters) > 0 {
+		sync = speccy.beginFrameSync(completionTime_orNil)
+		completionTime_orNil = sync.rendered
+	}
 
 	// Send display data to display backend(s)
 	if len(speccy.displays) > 0 {
+		if speccy.fullRepaintNeeded() {
+			for _, display := range speccy.displays {
+				display.lastFrame = nil
+				display.repaint = true
+			}
+		}
+
 		firstDisplay := true
 		for _, display := range speccy.displays {
 			var tm chan<- time.Time
@@ -729,7 +1973,12 @@ func (speccy *Spectrum48k) renderFrame(completionTime_orNil chan<- time.Time) {
 			} else {
 				tm = nil
 			}
-			speccy.ula.sendScreenToDisplay(display, tm)
+			sent := speccy.ula.sendScreenToDisplay(display, tm)
+			if firstDisplay && !sent && (sync != nil) {
+				// The frame will not be rendered on its own, synchronize with the next one
+				speccy.syncWaiters = append(sync.waiters, speccy.syncWaiters...)
+				sync = nil
+			}
 			firstDisplay = false
 		}
 	} else {
@@ -738,16 +1987,42 @@ func (speccy *Spectrum48k) renderFrame(completionTime_orNil chan<- time.Time) {
 		}
 	}
 
-	// Send audio data to audio backend(s)
-	if len(speccy.audioReceivers) > 0 {
+	// The AY chip is emulated even if there are no audio receivers
+	var aySamples []float32
+	var ayChannels [3][]float32
+	if speccy.ay_orNil != nil {
+		aySamples, ayChannels = speccy.ay_orNil.frame_end(speccy.ula.timings.TStatesPerFrame)
+	}
+
+	// Send audio data to audio backend(s).
+	// The audio is muted if the emulation is running as fast as possible.
+	if (len(speccy.audioReceivers) > 0) && (speccy.speed != 0) {
 		audioData := AudioData{
-			FPS:          speccy.currentFPS,
-			BeeperEvents: speccy.Ports.getBeeperEvents(),
+			FPS:             speccy.currentFPS * speccy.speed,
+			TStatesPerFrame: speccy.ula.timings.TStatesPerFrame,
+			BeeperEvents:    speccy.Ports.getBeeperEvents(),
+			AYSamples:       aySamples,
+			AYChannels:      ayChannels,
+			Flush:           speccy.flushAudio,
 		}
 
-		for _, audioReceiver := range speccy.audioReceivers {
-			audioReceiver.GetAudioDataChannel() <- &audioData
+		sendAudio := true
+		if (speccy.tapeDrive != nil) && speccy.tapeDrive.accelerating {
+			// Accelerated tape loading. Frames in which the program produced a sound
+			// are played at the normal speed, so that the sound is not compressed
+			// into a fraction of its duration. Silent frames are skipped.
+			sendAudio = (len(audioData.BeeperEvents) > 2)
+			audioData.FPS = speccy.tapeDrive.normalFPS() * speccy.speed
 		}
+
+		if sendAudio {
+			speccy.sendAudioData(&audioData)
+			speccy.flushAudio = false
+		}
+	}
+
+	if sync != nil {
+		go sync.finish()
 	}
 
 	portFrameStatus := speccy.Ports.frame_end()
@@ -761,19 +2036,14 @@ func (speccy *Spectrum48k) renderFrame(completionTime_orNil chan<- time.Time) {
 	}
 }
 
-// Load the given tape
-func (speccy *Spectrum48k) loadTape(tap *formats.TAP) {
-	speccy.tapeDrive.Insert(NewTape(tap))
+// Insert the given tape. The tape is started by AutoLoadTape or by Cmd_PlayTape.
+func (speccy *Spectrum48k) loadTape(tape *Tape) {
+	speccy.tapeDrive.Insert(tape)
 	speccy.tapeDrive.Stop()
-	speccy.sendLOADCommand()
-	speccy.tapeDrive.Play()
-}
-
-// Send LOAD ""
-func (speccy *Spectrum48k) sendLOADCommand() {
-	speccy.Keyboard.CommandChannel <- Cmd_SendLoad{speccy.romType}
 }
 
 func (speccy *Spectrum48k) makeVideoMemoryDump() []byte {
-	return speccy.Memory.Data()[0x4000 : 0x4000+6912]
+	vram := make([]byte, 6912)
+	copy(vram, speccy.Memory.screenData())
+	return vram
 }
@@ -0,0 +1,2085 @@
+package spectrum
+
+import (
+	"github.com/guntars-lemps/gospeccy/formats"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSpectrum() *Spectrum48k {
+	var rom [0x8000]byte
+	return NewSpectrum48k(NewApplication(), rom)
+}
+
+func TestInterruptAfterLdAI(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	for _, opcode := range []byte{0x57, 0x5f} {
+		speccy.Memory.Write(0x8000, 0xed)
+		speccy.Memory.Write(0x8001, opcode)
+		speccy.lastInstructionAddr = 0x8000
+
+		// Interrupt accepted: P/V must be cleared
+		speccy.Cpu.IFF1, speccy.Cpu.IFF2 = 1, 1
+		speccy.Cpu.F = 0x04
+		speccy.interrupt()
+		if (speccy.Cpu.F & 0x04) != 0 {
+			t.Errorf("ED %02X: P/V flag not cleared by an accepted interrupt", opcode)
+		}
+
+		// Interrupts disabled: P/V must be left alone
+		speccy.Cpu.IFF1, speccy.Cpu.IFF2 = 0, 0
+		speccy.Cpu.F = 0x04
+		speccy.interrupt()
+		if (speccy.Cpu.F & 0x04) == 0 {
+			t.Errorf("ED %02X: P/V flag modified although interrupts are disabled", opcode)
+		}
+	}
+
+	// Inside the instruction loop, looking at the last instruction is not a memory access
+	// of the CPU: it is neither contended nor reported by a watchpoint
+	memory := speccy.Memory
+	memory.watches.set(0x4000, 0x4001, WATCH_READ)
+	memory.watches.active = true
+	memory.cpuCycles, memory.contentionActive = true, true
+	speccy.Cpu.EventNextEvent = TStatesPerFrame
+	speccy.ula.delayCPU(FIRST_CONTENDED_TSTATE)
+	speccy.ula.instructionStart()
+	before := speccy.ula.cpuTState()
+
+	speccy.lastInstructionAddr = 0x4000
+	speccy.Cpu.IFF1, speccy.Cpu.IFF2 = 1, 1
+	speccy.interrupt()
+	if delay := speccy.ula.cpuTState() - before; delay != 0 {
+		t.Errorf("the interrupt delayed the CPU by %d T-states", delay)
+	}
+	if memory.watches.hit != nil {
+		t.Errorf("unexpected watchpoint hit: %v", memory.watches.hit)
+	}
+}
+
+func TestUlaTiming(t *testing.T) {
+	ula := NewULA()
+
+	// The first screen byte is read at T-state 14336 with late timings
+	ula.setTiming(ULA_TIMING_LATE)
+	late := ula.bitmapReadTState(SCREEN_BASE_ADDR)
+	if late != FIRST_SCREEN_BYTE {
+		t.Errorf("late timings: expected T-state %d, got %d", FIRST_SCREEN_BYTE, late)
+	}
+
+	// With early timings, the screen is read one T-state sooner after the interrupt
+	ula.setTiming(ULA_TIMING_EARLY)
+	early := ula.bitmapReadTState(SCREEN_BASE_ADDR) - ula.interruptTState
+	if early != late-1 {
+		t.Errorf("early timings: expected T-state %d, got %d", late-1, early)
+	}
+
+	if _, err := ParseUlaTiming("medium"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestInterruptTiming(t *testing.T) {
+	for _, timing := range []UlaTiming{ULA_TIMING_LATE, ULA_TIMING_EARLY} {
+		speccy := newTestSpectrum()
+		speccy.ula.setTiming(timing)
+		speccy.Cpu.IFF1 = 1
+		speccy.Cpu.Halted = true
+
+		// The CPU samples the interrupt after each instruction,
+		// so with early timings the interrupt is accepted after the first HALT cycle
+		speccy.interruptPending = true
+		accepted := speccy.checkInterrupt()
+		if accepted != (timing == ULA_TIMING_LATE) {
+			t.Errorf("%s timings: interrupt accepted at T-state 0: %v", timing, accepted)
+		}
+		if !accepted {
+			speccy.Cpu.DoHalt()
+			if !speccy.checkInterrupt() {
+				t.Errorf("%s timings: interrupt not accepted at T-state %d", timing, speccy.Cpu.GetTstates())
+			}
+		}
+		if speccy.interruptCount != 1 {
+			t.Errorf("%s timings: expected 1 interrupt, got %d", timing, speccy.interruptCount)
+		}
+
+		// A whole frame, in which the CPU is halted
+		speccy.renderFrame(nil)
+		if speccy.interruptCount != 2 {
+			t.Errorf("%s timings: expected 2 interrupts, got %d", timing, speccy.interruptCount)
+		}
+	}
+}
+
+func TestSystemVariables(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	if err := speccy.SetSystemVariable("last k", 0x41); err != nil {
+		t.Fatal(err)
+	}
+	if err := speccy.SetSystemVariable("FRAMES", 0x123456); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := speccy.SystemVariable("LASTK"); value != 0x41 {
+		t.Errorf("LASTK: expected 0x41, got %#x", value)
+	}
+	if value, _ := speccy.SystemVariable("FRAMES"); value != 0x123456 {
+		t.Errorf("FRAMES: expected 0x123456, got %#x", value)
+	}
+	if speccy.Peek(0x5c78) != 0x56 {
+		t.Errorf("FRAMES is not stored in little-endian order")
+	}
+
+	if err := speccy.SetSystemVariable("ERR NR", 0x100); err == nil {
+		t.Errorf("expected an error for an out of range value")
+	}
+	if _, err := speccy.SystemVariable("NOSUCHVAR"); err == nil {
+		t.Errorf("expected an error for an unknown system variable")
+	}
+}
+
+func TestReadInputScript(t *testing.T) {
+	script := "# comment\n\n10 down a\n12 down kempston-fire\n20 up A\n"
+	events, err := ReadInputScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []InputEvent{
+		{Frame: 10, Down: true, Code: KEY_A},
+		{Frame: 12, Down: true, Joystick: true, Code: KEMPSTON_FIRE},
+		{Frame: 20, Down: false, Code: KEY_A},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+
+	for _, invalid := range []string{"10 down", "x down a", "10 press a", "10 down foo", "20 down a\n10 up a"} {
+		if _, err := ReadInputScript(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestInputPlayback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.txt")
+	script := "1 down a\n1 down kempston-fire\n3 up a\n4 up kempston-fire\n"
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := ReadInputScript(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	speccy := newTestSpectrum()
+	loadKeyboardReader(speccy)
+	speccy.inputPlayback = &inputPlayback{events: events}
+
+	// Whether the program read the key 'A' as pressed, and whether the fire button is pressed, after each frame
+	expected := []struct{ a, fire bool }{
+		{false, false},
+		{true, true},
+		{true, true},
+		{false, true},
+		{false, false},
+	}
+	for frame, e := range expected {
+		speccy.renderFrame(nil)
+
+		hl := uint16(speccy.Cpu.H)<<8 | uint16(speccy.Cpu.L)
+		a := (speccy.Memory.Read(hl-1) & 0x01) == 0
+		fire := (speccy.Joystick.GetState() & 0x10) != 0
+		if (a != e.a) || (fire != e.fire) {
+			t.Errorf("frame %d: expected A=%v fire=%v, got A=%v fire=%v", frame, e.a, e.fire, a, fire)
+		}
+	}
+
+	if speccy.inputPlayback != nil {
+		t.Errorf("the playback has not finished")
+	}
+}
+
+func TestScreenToASCII(t *testing.T) {
+	vram := make([]byte, 6912)
+
+	// Black paper: the darkest character
+	if s := ScreenToASCII(vram, 32); s[0] != ' ' {
+		t.Errorf("expected ' ', got %q", s[0])
+	}
+
+	// Bright white paper: the brightest character
+	for i := 6144; i < 6912; i++ {
+		vram[i] = 0x78
+	}
+	s := ScreenToASCII(vram, 32)
+	if s[0] != '@' {
+		t.Errorf("expected '@', got %q", s[0])
+	}
+
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if (len(lines) != 12) || (len(lines[0]) != 32) {
+		t.Errorf("expected 12 lines of 32 characters, got %d lines of %d characters", len(lines), len(lines[0]))
+	}
+}
+
+func TestEarBit(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	tests := []struct {
+		value  byte
+		issue2 bool
+		ear    byte
+	}{
+		{0x00, false, 0x00},
+		{0x08, false, 0x00},
+		{0x10, false, 0x40},
+		{0x18, false, 0x40},
+		{0x00, true, 0x00},
+		{0x08, true, 0x40},
+		{0x10, true, 0x40},
+		{0x18, true, 0x40},
+	}
+
+	for _, test := range tests {
+		speccy.Ports.issue2 = test.issue2
+		speccy.Ports.Write(0x00fe, test.value)
+		if ear := speccy.Ports.Read(0xfffe) & 0x40; ear != test.ear {
+			t.Errorf("issue2=%v, OUT %#02x: expected EAR bit %#02x, got %#02x", test.issue2, test.value, test.ear, ear)
+		}
+	}
+}
+
+func TestSnapshotIssue2(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	s := &formats.FullSnapshot{Issue2: true}
+	if err := speccy.loadSnapshot(s); err != nil {
+		t.Fatal(err)
+	}
+	if !speccy.Ports.issue2 {
+		t.Errorf("the snapshot did not select the Issue 2 machine")
+	}
+	if !speccy.MakeSnapshot().Issue2 {
+		t.Errorf("the Issue 2 machine is not saved in the snapshot")
+	}
+
+	// The SNA format does not record the issue of the machine
+	sna, err := formats.SnapshotData(make([]byte, 49179)).DecodeSNA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := speccy.loadSnapshot(sna); err != nil {
+		t.Fatal(err)
+	}
+	if !speccy.Ports.issue2 {
+		t.Errorf("an SNA snapshot changed the issue of the machine")
+	}
+}
+
+func TestTapeSound(t *testing.T) {
+	speccy := newTestSpectrum()
+	speccy.readFromTape = true
+	speccy.tapeDrive.state = TAPE_DRIVE_STOP
+
+	// The loader reads an edge of the tape signal, without writing to port 0xFE
+	speccy.tapeDrive.earBit = 0xff
+	speccy.Ports.Read(0xfefe)
+	if level := speccy.Ports.beeperLevel; level != 2 {
+		t.Errorf("expected the tape signal in the beeper level, got %d", level)
+	}
+
+	// The MIC output is kept
+	speccy.tapeDrive.earBit = 0xbf
+	speccy.Ports.Write(0x00fe, 0x08)
+	if level := speccy.Ports.beeperLevel; level != 1 {
+		t.Errorf("expected beeper level 1, got %d", level)
+	}
+
+	speccy.tapeSound = false
+	speccy.tapeDrive.earBit = 0xff
+	speccy.Ports.Read(0xfefe)
+	speccy.Ports.Write(0x00fe, 0x00)
+	if level := speccy.Ports.beeperLevel; level != 0 {
+		t.Errorf("the tape sound is disabled, but the beeper level is %d", level)
+	}
+}
+
+// Plays a tone using the BEEPER routine in the 48K ROM, which is also the core of many
+// simple beeper-music engines, and checks the timing of the beeper events
+func TestBeeperROM(t *testing.T) {
+	rom, err := ReadROM("../48.rom")
+	if err != nil {
+		t.Skip(err)
+	}
+	speccy := NewSpectrum48k(NewApplication(), *rom)
+	speccy.tapeSound = true
+
+	receiver := &testAudioReceiver{make(chan *AudioData, 2)}
+	speccy.addAudioReceiver(receiver)
+
+	// HL determines the frequency: one period of the tone takes 8*HL+236 T-states.
+	// The tone lasts DE+1 periods.
+	const hl, de = 0x0165, 2
+	const period = 8*hl + 236
+	program := []byte{
+		0x21, hl & 0xff, hl >> 8, // 8000 LD HL,hl
+		0x11, de, 0x00, // 8003 LD DE,de
+		0xcd, 0xb5, 0x03, // 8006 CALL BEEPER
+		0xf3, // 8009 DI
+		0x76, // 800A HALT
+	}
+	for i, b := range program {
+		speccy.Memory.Write(0x8000+uint16(i), b)
+	}
+	speccy.Memory.Write(0x5c48, 0x38) // BORDCR: white border
+	speccy.Cpu.SetSP(0xff00)
+	speccy.Cpu.SetPC(0x8000)
+
+	speccy.renderFrame(nil)
+	events := (<-receiver.data).BeeperEvents
+
+	// The ROM routine sets the MIC bit and toggles the EAR bit.
+	// The tape sound is enabled, but the tape is not playing, so it does not affect the levels.
+	// The tone ends before the contended T-states, so its timing is exact.
+	toggles := events[1 : len(events)-1]
+	if n := len(toggles); n != 2*(de+1) {
+		t.Fatalf("expected %d beeper events, got %d: %v", 2*(de+1), n, events)
+	}
+	if end := toggles[len(toggles)-1].TState; end >= FIRST_CONTENDED_TSTATE {
+		t.Fatalf("the tone ends at T-state %d, which is contended", end)
+	}
+	for i, e := range toggles {
+		level := byte(3)
+		if i%2 == 1 {
+			level = 1
+		}
+		if e.Level != level {
+			t.Errorf("event %d: expected level %d, got %d", i, level, e.Level)
+		}
+		if i >= 2 {
+			if p := e.TState - toggles[i-2].TState; p != period {
+				t.Errorf("event %d: expected a period of %d T-states, got %d", i, period, p)
+			}
+		}
+	}
+}
+
+func TestTraceDiff(t *testing.T) {
+	trace := "# reference\nPC=8000 AF=0144\nPC=8001 AF=01ec\n"
+
+	steps, err := ReadTrace(strings.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 {
+		t.Fatalf("expected 2 steps, got %d", len(steps))
+	}
+
+	speccy := newTestSpectrum()
+	speccy.Cpu.SetPC(0x8000)
+	speccy.Cpu.A, speccy.Cpu.F = 0x01, 0x44
+	actual := speccy.traceStep()
+	if register := steps[0].mismatch(&actual, 0xff); register != "" {
+		t.Errorf("step 0: unexpected mismatch of register %s", register)
+	}
+
+	// Differs only in the undocumented flags (bits 3 and 5)
+	speccy.Cpu.SetPC(0x8001)
+	speccy.Cpu.F = 0xc4
+	actual = speccy.traceStep()
+	if register := steps[1].mismatch(&actual, 0xff); register != "AF" {
+		t.Errorf("step 1: expected a mismatch of register AF, got %q", register)
+	}
+	if register := steps[1].mismatch(&actual, 0xd7); register != "" {
+		t.Errorf("step 1: unexpected mismatch of register %s with undocumented flags ignored", register)
+	}
+
+	if _, err := ReadTrace(strings.NewReader("PC=8000 XY=0000\n")); err == nil {
+		t.Errorf("expected an error for an unknown register")
+	}
+}
+
+type testAudioReceiver struct {
+	data chan *AudioData
+}
+
+func (r *testAudioReceiver) GetAudioDataChannel() chan<- *AudioData {
+	return r.data
+}
+
+func (r *testAudioReceiver) Close() {}
+
+func TestMultipleAudioReceivers(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	r1 := &testAudioReceiver{make(chan *AudioData, 1)}
+	r2 := &testAudioReceiver{make(chan *AudioData, 1)}
+	speccy.addAudioReceiver(r1)
+	speccy.addAudioReceiver(r2)
+
+	speccy.sendAudioData(&AudioData{
+		FPS:          DefaultFPS,
+		BeeperEvents: []BeeperEvent{{0, 0}, {1000, 2}, {TStatesPerFrame, 2}},
+	})
+
+	data1 := <-r1.data
+	data2 := <-r2.data
+	if !reflect.DeepEqual(data1, data2) {
+		t.Fatalf("the receivers got different data: %v, %v", data1, data2)
+	}
+
+	// A receiver modifying its data must not affect the other receiver
+	data1.BeeperEvents[1].Level = 0
+	if data2.BeeperEvents[1].Level != 2 {
+		t.Errorf("the receivers share the beeper events")
+	}
+}
+
+func TestIOContention(t *testing.T) {
+	ula := NewULA()
+
+	tests := []struct {
+		port    uint16
+		tstate  int
+		tstates int
+	}{
+		// Outside of the screen area, the I/O cycle is never contended
+		{0x00fe, 0, 4},
+		{0x40fe, 0, 4},
+
+		// OUT to 0xFE at the first contended T-state: N:1, C:3
+		{0x00fe, FIRST_CONTENDED_TSTATE, 1 + 5 + 3},
+
+		// High byte in contended memory: C:1, C:3
+		{0x40fe, FIRST_CONTENDED_TSTATE, 6 + 1 + 0 + 3},
+
+		// High byte in contended memory, not a ULA port: C:1, C:1, C:1, C:1
+		{0x40ff, FIRST_CONTENDED_TSTATE, 6 + 1 + 0 + 1 + 6 + 1 + 0 + 1},
+
+		// Neither the ULA nor contended memory
+		{0x00ff, FIRST_CONTENDED_TSTATE, 4},
+	}
+
+	for _, test := range tests {
+		if n := ula.ioCycleTStates(test.port, test.tstate); n != test.tstates {
+			t.Errorf("port %#04x at T-state %d: expected %d T-states, got %d", test.port, test.tstate, test.tstates, n)
+		}
+	}
+}
+
+func TestMemoryContention(t *testing.T) {
+	speccy := newTestSpectrum()
+	ula := speccy.ula
+	speccy.Cpu.EventNextEvent = TStatesPerFrame
+
+	// Move the CPU to the first contended T-state
+	ula.delayCPU(FIRST_CONTENDED_TSTATE)
+	start := ula.cpuTState()
+
+	// Inactive contention
+	speccy.Memory.cpuCycles = true
+	ula.instructionStart()
+	speccy.Memory.Read(0x4000)
+	if ula.cpuTState() != start {
+		t.Errorf("the CPU was delayed although the contention is not active")
+	}
+
+	speccy.Memory.contentionActive = true
+
+	ula.instructionStart()
+	speccy.Memory.Read(0x8000)
+	ula.instructionStart()
+	speccy.Memory.Write(0xc000, 0)
+	if ula.cpuTState() != start {
+		t.Errorf("the CPU was delayed by an access to uncontended memory")
+	}
+
+	ula.instructionStart()
+	speccy.Memory.Read(0x4000)
+	if delay := ula.cpuTState() - start; delay != 6 {
+		t.Errorf("expected a delay of 6 T-states, got %d", delay)
+	}
+	if speccy.Cpu.EventNextEvent != TStatesPerFrame-ula.contentionTStates {
+		t.Errorf("the end of the frame was not moved")
+	}
+
+	// In the 128k memory layout, the odd RAM banks are contended
+	speccy.Memory.setPagingAvailable(true)
+	speccy.Ports.Write(0x7ffd, 3)
+	ula.instructionStart()
+	before := ula.cpuTState()
+	speccy.Memory.Write(0xc000, 0)
+	if ula.cpuTState() == before {
+		t.Errorf("RAM 3 is not contended")
+	}
+}
+
+func TestFloatingBus(t *testing.T) {
+	speccy := newTestSpectrum()
+	ula := speccy.ula
+
+	// The attributes of the first line of cells, and the first pixel line
+	for column := uint16(0); column < ScreenWidth_Attr; column++ {
+		speccy.Memory.Write(ATTR_BASE_ADDR+column, 0x40+byte(column))
+		speccy.Memory.Write(SCREEN_BASE_ADDR+column, 0x80+byte(column))
+	}
+
+	// A common floating bus detection routine waits until a port read returns
+	// a known attribute value: here, the attribute of the third cell
+	found := -1
+	for tstate := 0; tstate < TStatesPerFrame; tstate++ {
+		if ula.floatingBus(tstate) == 0x42 {
+			found = tstate
+			break
+		}
+	}
+	if found != FIRST_FLOATING_BUS_TSTATE+8+1 {
+		t.Errorf("the attribute was read at T-state %d", found)
+	}
+
+	expected := []byte{0x80, 0x40, 0x81, 0x41, 0xff, 0xff, 0xff, 0xff, 0x82}
+	for i, value := range expected {
+		if v := ula.floatingBus(FIRST_FLOATING_BUS_TSTATE + i); v != value {
+			t.Errorf("T-state %d: expected %#02x, got %#02x", FIRST_FLOATING_BUS_TSTATE+i, value, v)
+		}
+	}
+
+	// The right border, the second pixel line, and the bottom border
+	if v := ula.floatingBus(FIRST_FLOATING_BUS_TSTATE + LINE_SCREEN); v != 0xff {
+		t.Errorf("the border returned %#02x", v)
+	}
+	if v := ula.floatingBus(FIRST_FLOATING_BUS_TSTATE + TSTATES_PER_LINE + 1); v != 0x40 {
+		t.Errorf("the second pixel line returned the attribute %#02x", v)
+	}
+	if v := ula.floatingBus(FIRST_FLOATING_BUS_TSTATE + ScreenHeight*TSTATES_PER_LINE); v != 0xff {
+		t.Errorf("the bottom border returned %#02x", v)
+	}
+
+	// Unassigned ports read the floating bus only if the contention is emulated
+	ula.delayCPU(FIRST_FLOATING_BUS_TSTATE + 1)
+	if v := speccy.Ports.Read(0x00ff); v != 0xff {
+		t.Errorf("the floating bus is emulated without the contention, got %#02x", v)
+	}
+	speccy.contention = true
+	if v := speccy.Ports.Read(0x00ff); v != 0x40 {
+		t.Errorf("expected the floating bus value 0x40, got %#02x", v)
+	}
+}
+
+func TestBasicLineKeys(t *testing.T) {
+	tests := []struct {
+		line string
+		keys []keyChord
+	}{
+		{"BORDER 2", []keyChord{{KEY_B}, {KEY_2}}},
+		{"print 2+2", []keyChord{{KEY_P}, {KEY_2}, {KEY_SymbolShift, KEY_K}, {KEY_2}}},
+		{"PRINT \"AT\"", []keyChord{
+			{KEY_P},
+			{KEY_SymbolShift, KEY_P}, {KEY_CapsShift, KEY_A}, {KEY_CapsShift, KEY_T}, {KEY_SymbolShift, KEY_P},
+		}},
+		{"IF a THEN STOP", []keyChord{{KEY_U}, {KEY_A}, {KEY_SymbolShift, KEY_G}, {KEY_SymbolShift, KEY_A}}},
+		{"PRINT CODE \"x\"", []keyChord{
+			{KEY_P},
+			{KEY_CapsShift, KEY_SymbolShift}, {KEY_I},
+			{KEY_SymbolShift, KEY_P}, {KEY_X}, {KEY_SymbolShift, KEY_P},
+		}},
+		{"PRINT FN a()", []keyChord{
+			{KEY_P},
+			{KEY_CapsShift, KEY_SymbolShift}, {KEY_SymbolShift, KEY_2},
+			{KEY_A}, {KEY_SymbolShift, KEY_8}, {KEY_SymbolShift, KEY_9},
+		}},
+		{"CAT", []keyChord{{KEY_CapsShift, KEY_SymbolShift}, {KEY_SymbolShift, KEY_9}}},
+		{"CLS: PRINT \"£:\"", []keyChord{
+			{KEY_V}, {KEY_SymbolShift, KEY_Z}, {KEY_P},
+			{KEY_SymbolShift, KEY_P}, {KEY_SymbolShift, KEY_X}, {KEY_SymbolShift, KEY_Z}, {KEY_SymbolShift, KEY_P},
+		}},
+		{"IF a<=1 THEN CLS", []keyChord{{KEY_U}, {KEY_A}, {KEY_SymbolShift, KEY_Q}, {KEY_1}, {KEY_SymbolShift, KEY_G}, {KEY_V}}},
+	}
+
+	for _, test := range tests {
+		keys, err := basicLineKeys(test.line)
+		if err != nil {
+			t.Errorf("%q: %s", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%q: expected %v, got %v", test.line, test.keys, keys)
+		}
+	}
+}
+
+type testDisplayReceiver struct {
+	data chan *DisplayData
+}
+
+func (r *testDisplayReceiver) GetDisplayDataChannel() chan<- *DisplayData {
+	return r.data
+}
+
+func (r *testDisplayReceiver) Close() {}
+
+// The border stripes of a tape loader must reach the display unchanged,
+// including when the display is busy and frames are merged
+func TestLoadingStripes(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	r := &testDisplayReceiver{make(chan *DisplayData, 1)}
+	speccy.addDisplay(r)
+	display := speccy.displays[0]
+
+	// The loader changes the border color on each edge of the pilot tone (2168 T-states)
+	stripes := func(offset int) []BorderEvent {
+		events := []BorderEvent{{0, 2}}
+		color := byte(5)
+		for tstate := offset; tstate < TStatesPerFrame; tstate += 2168 {
+			events = append(events, BorderEvent{tstate, color})
+			color ^= 2 ^ 5
+		}
+		return events
+	}
+	expected := func(offset int) []BorderEvent {
+		events := stripes(offset)
+		return append(events, BorderEvent{TStatesPerFrame, events[len(events)-1].Color})
+	}
+	renderFrame := func(offset int) {
+		speccy.Ports.borderEvents = stripes(offset)
+		speccy.ula.sendScreenToDisplay(display, nil)
+	}
+
+	renderFrame(100)
+	if data := <-r.data; !reflect.DeepEqual(data.BorderEvents, expected(100)) {
+		t.Fatalf("expected %v, got %v", expected(100), data.BorderEvents)
+	}
+
+	// The 3rd frame is missed because the display has not received the 2nd one yet
+	renderFrame(200)
+	renderFrame(300)
+	<-r.data
+	renderFrame(400)
+	if data := <-r.data; !reflect.DeepEqual(data.BorderEvents, expected(400)) {
+		t.Errorf("merged frame: expected %v, got %v", expected(400), data.BorderEvents)
+	}
+}
+
+func TestMemoryPaging(t *testing.T) {
+	speccy := newTestSpectrum()
+	memory := speccy.Memory
+	memory.setPagingAvailable(true)
+
+	memory.Write(0xc000, 0x11) // RAM 0
+	speccy.Ports.Write(0x7ffd, 1)
+	if memory.Read(0xc000) != 0 {
+		t.Errorf("RAM 1 is not paged in")
+	}
+	memory.Write(0xc000, 0x22)
+	speccy.Ports.Write(0x7ffd, 0)
+	if memory.Read(0xc000) != 0x11 {
+		t.Errorf("RAM 0 lost its contents")
+	}
+
+	// RAM 5 is always mapped at 0x4000
+	speccy.Ports.Write(0x7ffd, 5)
+	memory.Write(0x4010, 0x33)
+	if memory.Read(0xc010) != 0x33 {
+		t.Errorf("RAM 5 at 0xC000 does not mirror 0x4000")
+	}
+
+	// The shadow screen
+	speccy.Ports.Write(0x7ffd, 7|PAGING_SHADOW_SCREEN)
+	memory.Write(0xc000, 0xff)
+	if memory.screenData()[0] != 0xff {
+		t.Errorf("the shadow screen is not displayed")
+	}
+
+	// After locking, the writes are ignored
+	speccy.Ports.Write(0x7ffd, 3|PAGING_LOCK)
+	speccy.Ports.Write(0x7ffd, 4)
+	state := memory.PagingState()
+	if !state.Locked || (state.Slots[3].Bank != 3) || state.ShadowScreen {
+		t.Errorf("unexpected paging state after locking: %+v", state)
+	}
+
+	// The reset unlocks the paging
+	memory.reset()
+	speccy.Ports.Write(0x7ffd, 4)
+	if memory.PagingState().Slots[3].Bank != 4 {
+		t.Errorf("the paging is still locked after a reset")
+	}
+}
+
+func TestMachineModel128(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	if err := speccy.setMachineModel(MODEL_128K); err == nil {
+		t.Errorf("switched to the 128k model without its ROM")
+	}
+
+	var rom [0x8000]byte
+	rom[0], rom[0x4000] = 0x12, 0x34
+	speccy.roms[MODEL_128K] = &rom
+
+	if err := speccy.setMachineModel(MODEL_128K); err != nil {
+		t.Fatal(err)
+	}
+	if !speccy.Memory.PagingState().PagingAvailable || (speccy.ay_orNil == nil) {
+		t.Errorf("the 128k model has no paging or no AY")
+	}
+	if speccy.Memory.Read(0) != 0x12 {
+		t.Errorf("ROM 0 is not paged in after a reset")
+	}
+	speccy.Ports.Write(0x7ffd, PAGING_ROM)
+	if speccy.Memory.Read(0) != 0x34 {
+		t.Errorf("ROM 1 is not paged in")
+	}
+
+	if err := speccy.setMachineModel(MODEL_48K); err != nil {
+		t.Fatal(err)
+	}
+	if speccy.Memory.PagingState().PagingAvailable || (speccy.Memory.Read(0) != 0) {
+		t.Errorf("the 48k model has the 128k paging or ROM")
+	}
+
+	if model, err := ParseMachineModel("128"); (err != nil) || (model != MODEL_128K) {
+		t.Errorf("ParseMachineModel(\"128\") = %v, %v", model, err)
+	}
+}
+
+// Returns a test machine switched to the 128k model
+func newTestSpectrum128(t *testing.T) *Spectrum48k {
+	speccy := newTestSpectrum()
+	var rom [0x8000]byte
+	speccy.roms[MODEL_128K] = &rom
+	if err := speccy.setMachineModel(MODEL_128K); err != nil {
+		t.Fatal(err)
+	}
+	return speccy
+}
+
+func TestTimings128k(t *testing.T) {
+	speccy := newTestSpectrum128(t)
+	ula := speccy.ula
+
+	if ula.timings != Timings128k {
+		t.Fatalf("expected the 128k timings, got %v", ula.timings)
+	}
+
+	// The contention starts one T-state before the first byte of the screen is read
+	if d := ula.contentionDelay(Timings128k.FirstScreenByte - 1); d != 6 {
+		t.Errorf("expected delay 6 at the start of the screen, got %d", d)
+	}
+	if d := ula.contentionDelay(FIRST_CONTENDED_TSTATE); d != 0 {
+		t.Errorf("expected no delay at the first contended T-state of the 48k, got %d", d)
+	}
+	if d := ula.contentionDelay(Timings128k.FirstScreenByte - 1 + 228); d != 6 {
+		t.Errorf("expected delay 6 at the start of the second line, got %d", d)
+	}
+
+	if tstate := ula.bitmapReadTState(SCREEN_BASE_ADDR + 0x100); tstate != Timings128k.FirstScreenByte+228 {
+		t.Errorf("the second line is read at T-state %d", tstate)
+	}
+
+	// The beeper events end at the end of the longer frame
+	events := speccy.Ports.getBeeperEvents()
+	if last := events[len(events)-1].TState; last != 70908 {
+		t.Errorf("expected the last beeper event at T-state 70908, got %d", last)
+	}
+
+	if err := speccy.setMachineModel(MODEL_48K); err != nil {
+		t.Fatal(err)
+	}
+	if ula.timings != Timings48k {
+		t.Errorf("expected the 48k timings, got %v", ula.timings)
+	}
+}
+
+func TestAYConnection(t *testing.T) {
+	speccy := newTestSpectrum128(t)
+	if speccy.ay_orNil == nil {
+		t.Fatal("the 128k model has no AY")
+	}
+
+	if err := speccy.setMachineModel(MODEL_48K); err != nil {
+		t.Fatal(err)
+	}
+	if speccy.ay_orNil != nil {
+		t.Errorf("the AY stays connected to the 48k model")
+	}
+
+	speccy.CommandChannel <- Cmd_SetAY{true}
+	modelCh := make(chan MachineModel)
+	speccy.CommandChannel <- Cmd_GetMachineModel{modelCh}
+	<-modelCh
+	if speccy.ay_orNil == nil {
+		t.Errorf("the AY is not connected to the 48k model")
+	}
+}
+
+func TestShadowScreenDuringFrame(t *testing.T) {
+	speccy := newTestSpectrum128(t)
+	ula := speccy.ula
+
+	lastLine := xy_to_screenAddr(0, ScreenHeight-1) - SCREEN_BASE_ADDR
+	speccy.Memory.ram[5][0], speccy.Memory.ram[7][0] = 0x55, 0xaa
+	speccy.Memory.ram[5][lastLine], speccy.Memory.ram[7][lastLine] = 0x55, 0xaa
+
+	// Switch to the shadow screen after the ULA has read the first line
+	ula.frame_begin()
+	ula.contentionTStates = Timings128k.FirstScreenByte + 100
+	speccy.Ports.Write(0x7ffd, PAGING_SHADOW_SCREEN)
+
+	screen := ula.prepare(&DisplayInfo{})
+	if screen.Bitmap[0] != 0x55 {
+		t.Errorf("the first line shows 0x%02x, expected the normal screen", screen.Bitmap[0])
+	}
+	if b := screen.Bitmap[(ScreenHeight-1)*BytesPerLine]; b != 0xaa {
+		t.Errorf("the last line shows 0x%02x, expected the shadow screen", b)
+	}
+}
+
+func TestMenu128Detection(t *testing.T) {
+	speccy := newTestSpectrum128(t)
+
+	if speccy.atMenu128() {
+		t.Errorf("menu detected before the ROM displayed it")
+	}
+
+	speccy.Memory.ram[7][rom128_EDITOR_FLAGS-0xc000] |= rom128_EDITOR_FLAGS_MENU
+	if !speccy.atMenu128() || !speccy.systemROMReady() {
+		t.Errorf("the menu is not detected")
+	}
+
+	// 48k BASIC selected from the menu
+	speccy.Memory.ram[5][rom128_FLAGS3-0x4000] |= rom128_FLAGS3_BASIC
+	if speccy.atMenu128() {
+		t.Errorf("menu detected in the 48k BASIC mode")
+	}
+	speccy.Memory.ram[5][rom128_FLAGS3-0x4000] &^= rom128_FLAGS3_BASIC
+
+	// The 48k ROM paged in
+	speccy.Ports.Write(0x7ffd, PAGING_ROM)
+	if speccy.atMenu128() {
+		t.Errorf("menu detected with the 48k ROM paged in")
+	}
+}
+
+// Puts the 48k line editor at the "0 OK" prompt
+func setUp48kPrompt(speccy *Spectrum48k) {
+	errSP := uint16(0xff00)
+	speccy.Memory.Write(SystemVariables["ERRSP"].Address, byte(errSP))
+	speccy.Memory.Write(SystemVariables["ERRSP"].Address+1, byte(errSP>>8))
+	speccy.Memory.Write(errSP, byte(rom48_ED_ERROR&0xff))
+	speccy.Memory.Write(errSP+1, byte(rom48_ED_ERROR>>8))
+}
+
+func TestBasicEditorDetection(t *testing.T) {
+	speccy := newTestSpectrum()
+	if speccy.basicEditor() != BASIC_EDITOR_NONE {
+		t.Errorf("the 48k editor detected before it runs")
+	}
+	setUp48kPrompt(speccy)
+	if speccy.basicEditor() != BASIC_EDITOR_48K {
+		t.Errorf("the 48k editor is not detected")
+	}
+
+	speccy = newTestSpectrum128(t)
+	if speccy.basicEditor() != BASIC_EDITOR_NONE {
+		t.Errorf("the 128k editor detected before the ROM initialized it")
+	}
+
+	// The 128k editor after the ROM initialized the system variables
+	speccy.Memory.Write(SystemVariables["CHANS"].Address, 0xb6)
+	speccy.Memory.Write(SystemVariables["CHANS"].Address+1, 0x5c)
+	speccy.Memory.ram[7][rom128_EDITOR_FLAGS-0xc000] |= rom128_EDITOR_FLAGS_MENU
+	if speccy.basicEditor() != BASIC_EDITOR_NONE {
+		t.Errorf("the 128k editor detected in the menu")
+	}
+	speccy.Memory.ram[7][rom128_EDITOR_FLAGS-0xc000] &^= rom128_EDITOR_FLAGS_MENU
+	if speccy.basicEditor() != BASIC_EDITOR_128K {
+		t.Errorf("the 128k editor is not detected")
+	}
+	speccy.readFromTape = true
+	if speccy.basicEditor() != BASIC_EDITOR_NONE {
+		t.Errorf("the 128k editor detected while loading from tape")
+	}
+	speccy.readFromTape = false
+
+	// 48 BASIC: the 48k ROM is paged in
+	speccy.Memory.ram[5][rom128_FLAGS3-0x4000] |= rom128_FLAGS3_BASIC
+	speccy.Ports.Write(0x7ffd, PAGING_ROM)
+	if speccy.basicEditor() != BASIC_EDITOR_NONE {
+		t.Errorf("an editor detected before the 48k editor runs")
+	}
+	setUp48kPrompt(speccy)
+	if speccy.basicEditor() != BASIC_EDITOR_48K {
+		t.Errorf("the 48k editor is not detected in the 48 BASIC mode")
+	}
+}
+
+func TestBasicLineInput128(t *testing.T) {
+	events, err := BasicLineInput("PRINT 1", BASIC_EDITOR_128K)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []uint
+	for _, event := range events {
+		if event.Down {
+			keys = append(keys, event.Code)
+		}
+	}
+	expected := []uint{
+		KEY_CapsShift, KEY_P, KEY_CapsShift, KEY_R, KEY_CapsShift, KEY_I, KEY_CapsShift, KEY_N,
+		KEY_CapsShift, KEY_T, KEY_Space, KEY_1, KEY_Enter,
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected the keys %v, got %v", expected, keys)
+	}
+}
+
+// The patch of the 48k BASIC ROM is applied to the ROM of the current model
+// and applied again after the model changes
+func TestROMPatch(t *testing.T) {
+	speccy := newTestSpectrum()
+	var rom128 [0x8000]byte
+	speccy.roms[MODEL_128K] = &rom128
+
+	patch, err := formats.NewIPS([]byte("PATCH\x00\x10\x00\x00\x01\xaaEOF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := speccy.applyIPS(patch, true); err != nil {
+		t.Fatal(err)
+	}
+	if value := speccy.Memory.Read(0x1000); value != 0xaa {
+		t.Errorf("the 48k ROM is not patched, read 0x%02x", value)
+	}
+
+	if err := speccy.setMachineModel(MODEL_128K); err != nil {
+		t.Fatal(err)
+	}
+	if speccy.Memory.rom[1][0x1000] != 0xaa {
+		t.Errorf("the 48k BASIC ROM of the 128k is not patched")
+	}
+	if speccy.Memory.rom[0][0x1000] != 0x00 {
+		t.Errorf("the 128k editor ROM is patched")
+	}
+
+	if err := speccy.setMachineModel(MODEL_48K); err != nil {
+		t.Fatal(err)
+	}
+	if value := speccy.Memory.Read(0x1000); value != 0xaa {
+		t.Errorf("the 48k ROM is not patched after the model changed, read 0x%02x", value)
+	}
+}
+
+func TestSnapshot128(t *testing.T) {
+	speccy := newTestSpectrum()
+	var rom [0x8000]byte
+	speccy.roms[MODEL_128K] = &rom
+
+	// Shadow screen, bank 3 at 0xc000
+	s := &formats.FullSnapshot{}
+	s.Cpu.PC = 0x8000
+	s.Mem128 = &formats.Memory128{Paging: PAGING_SHADOW_SCREEN | 3}
+	for bank := range s.Mem128.Banks {
+		s.Mem128.Banks[bank][0] = byte(0x10 + bank)
+	}
+
+	// The machine switches to the 128k model
+	if err := speccy.loadSnapshot(s); err != nil {
+		t.Fatal(err)
+	}
+	if speccy.model != MODEL_128K {
+		t.Fatalf("expected the 128k model, got %v", speccy.model)
+	}
+	if value := speccy.Memory.Read(0xc000); value != 0x13 {
+		t.Errorf("expected bank 3 at 0xc000, read 0x%02x", value)
+	}
+	if speccy.Memory.screenBank() != 7 {
+		t.Errorf("the shadow screen is not displayed")
+	}
+
+	saved := speccy.MakeSnapshot()
+	if (saved.Mem128 == nil) || (*saved.Mem128 != *s.Mem128) {
+		t.Errorf("the 128k memory is not saved")
+	}
+	if _, err := saved.EncodeSNA(); err == nil {
+		t.Errorf("saved the state of a 128k machine in the SNA format")
+	}
+}
+
+func TestAY_EnvelopeShapes(t *testing.T) {
+	// The envelope volume during the first three 16-step periods
+	down := "fedcba9876543210"
+	up := "0123456789abcdef"
+	low := "0000000000000000"
+	high := "ffffffffffffffff"
+	expected := map[byte]string{
+		0x00: down + low + low,
+		0x04: up + low + low,
+		0x08: down + down + down,
+		0x09: down + low + low,
+		0x0a: down + up + down,
+		0x0b: down + high + high,
+		0x0c: up + up + up,
+		0x0d: up + high + high,
+		0x0e: up + down + up,
+		0x0f: up + low + low,
+	}
+
+	ay := NewAY()
+	for shape, pattern := range expected {
+		ay.setRegister(13, shape)
+
+		volumes := ""
+		for i := 0; i < len(pattern); i++ {
+			volumes += strconv.FormatUint(uint64(ay.envVolume), 16)
+			ay.envelopeStep()
+		}
+		if volumes != pattern {
+			t.Errorf("shape 0x%02x: expected %s, got %s", shape, pattern, volumes)
+		}
+	}
+}
+
+func TestAY_RegisterWrites(t *testing.T) {
+	speccy := newTestSpectrum()
+	speccy.ay_orNil = NewAY()
+
+	// Channel A: tone disabled, constant volume
+	speccy.Ports.Write(0xfffd, 7)
+	speccy.Ports.Write(0xbffd, 0x3f)
+	speccy.Ports.Write(0xfffd, 8)
+	speccy.Ports.Write(0xbffd, 0xef)
+	if value := speccy.Ports.Read(0xfffd); value != 0x0f {
+		t.Errorf("expected the masked value 0x0f, got 0x%02x", value)
+	}
+
+	samples, channels := speccy.ay_orNil.frame_end(TStatesPerFrame)
+	if len(samples) != AY_SAMPLES_PER_FRAME {
+		t.Fatalf("expected %d samples, got %d", AY_SAMPLES_PER_FRAME, len(samples))
+	}
+	if last := samples[len(samples)-1]; last != AY_VolumeTable[15] {
+		t.Errorf("expected the level %f, got %f", AY_VolumeTable[15], last)
+	}
+
+	// Only channel A produces a sound
+	expected := [3]float32{AY_VolumeTable[15], 0, 0}
+	for ch := range channels {
+		if len(channels[ch]) != AY_SAMPLES_PER_FRAME {
+			t.Fatalf("channel %d: expected %d samples, got %d", ch, AY_SAMPLES_PER_FRAME, len(channels[ch]))
+		}
+		if last := channels[ch][AY_SAMPLES_PER_FRAME-1]; last != expected[ch] {
+			t.Errorf("channel %d: expected the level %f, got %f", ch, expected[ch], last)
+		}
+	}
+}
+
+func TestKempstonMouse(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	if value := speccy.Ports.Read(0xfbdf); value != 0xff {
+		t.Errorf("a disconnected mouse responded with 0x%02x", value)
+	}
+
+	speccy.Mouse.SetEnabled(true)
+	speccy.Mouse.Move(-3, 5)
+	if x, y := speccy.Ports.Read(0xfbdf), speccy.Ports.Read(0xffdf); (x != 0xfd) || (y != 0xfb) {
+		t.Errorf("expected the position 0xfd,0xfb after wrapping around, got 0x%02x,0x%02x", x, y)
+	}
+
+	speccy.Mouse.ButtonDown(MOUSE_LEFT)
+	if buttons := speccy.Ports.Read(0xfadf); buttons != 0xfd {
+		t.Errorf("expected the buttons 0xfd, got 0x%02x", buttons)
+	}
+	speccy.Mouse.ButtonUp(MOUSE_LEFT)
+	if buttons := speccy.Ports.Read(0xfadf); buttons != 0xff {
+		t.Errorf("expected the buttons 0xff, got 0x%02x", buttons)
+	}
+}
+
+func TestJoystickModes(t *testing.T) {
+	type keyBit struct {
+		row  uint
+		mask byte
+	}
+	directions := []uint{KEMPSTON_LEFT, KEMPSTON_RIGHT, KEMPSTON_DOWN, KEMPSTON_UP, KEMPSTON_FIRE}
+	expected := map[JoystickMode][]keyBit{
+		// 6, 7, 8, 9, 0
+		JOYSTICK_SINCLAIR1: {{4, 0x10}, {4, 0x08}, {4, 0x04}, {4, 0x02}, {4, 0x01}},
+		// 1, 2, 3, 4, 5
+		JOYSTICK_SINCLAIR2: {{3, 0x01}, {3, 0x02}, {3, 0x04}, {3, 0x08}, {3, 0x10}},
+		// 5, 8, 6, 7, 0
+		JOYSTICK_CURSOR: {{3, 0x10}, {4, 0x04}, {4, 0x10}, {4, 0x08}, {4, 0x01}},
+	}
+
+	speccy := newTestSpectrum()
+	joystick := speccy.Joystick
+	keyboard := speccy.Keyboard
+
+	for mode, keys := range expected {
+		joystick.SetMode(mode)
+		for i, direction := range directions {
+			joystick.KempstonDown(direction)
+			if (keyboard.GetKeyState(keys[i].row) & keys[i].mask) != 0 {
+				t.Errorf("%s: direction %d does not press the key in row %d, mask 0x%02x", mode, direction, keys[i].row, keys[i].mask)
+			}
+			if joystick.kempstonState() != 0 {
+				t.Errorf("%s: direction %d is visible on the Kempston port", mode, direction)
+			}
+			joystick.KempstonUp(direction)
+			if (keyboard.GetKeyState(keys[i].row) & keys[i].mask) == 0 {
+				t.Errorf("%s: direction %d does not release the key", mode, direction)
+			}
+		}
+	}
+
+	joystick.SetMode(JOYSTICK_KEMPSTON)
+	joystick.KempstonDown(KEMPSTON_FIRE)
+	if joystick.kempstonState() != kempstonMask[KEMPSTON_FIRE] {
+		t.Errorf("kempston: fire is not visible on the Kempston port")
+	}
+	for row := uint(0); row < 8; row++ {
+		if keyboard.GetKeyState(row) != 0xff {
+			t.Errorf("kempston: a key is pressed in row %d", row)
+		}
+	}
+}
+
+func TestJoystickPorts(t *testing.T) {
+	// Fire, up, down, left, right
+	directions := []uint{KEMPSTON_FIRE, KEMPSTON_UP, KEMPSTON_DOWN, KEMPSTON_LEFT, KEMPSTON_RIGHT}
+	kempstonBits := []byte{0x10, 0x08, 0x04, 0x02, 0x01}
+	fullerBits := []byte{0x80, 0x01, 0x02, 0x04, 0x08}
+	// Keys 0, 9, 8, 6, 7 in the half-row read through port 0xEFFE
+	interface2Bits := []byte{0x01, 0x02, 0x04, 0x10, 0x08}
+
+	speccy := newTestSpectrum()
+	joystick := speccy.Joystick
+	ports := speccy.Ports
+
+	for combination := 0; combination < (1 << uint(len(directions))); combination++ {
+		var kempston byte = 0x00
+		var fuller, interface2 byte = 0xff, 0xff
+		for i := range directions {
+			if (combination & (1 << uint(i))) != 0 {
+				kempston |= kempstonBits[i]
+				fuller &^= fullerBits[i]
+				interface2 &^= interface2Bits[i]
+			}
+		}
+
+		check := func(mode JoystickMode, port uint16, expected byte) {
+			joystick.SetMode(mode)
+			for i, direction := range directions {
+				if (combination & (1 << uint(i))) != 0 {
+					joystick.KempstonDown(direction)
+				}
+			}
+			if value := ports.Read(port); value != expected {
+				t.Errorf("%s, directions 0x%02x: port 0x%04x returned 0x%02x, expected 0x%02x", mode, combination, port, value, expected)
+			}
+		}
+
+		check(JOYSTICK_KEMPSTON, 0x001f, kempston)
+		check(JOYSTICK_FULLER, 0x007f, fuller)
+		// Bit 6 of the keyboard port is the EAR input, which reads 0 without a tape
+		check(JOYSTICK_SINCLAIR1, 0xeffe, interface2&0xbf)
+	}
+
+	// The joystick drives the Fuller Box, the Kempston interface stays idle
+	joystick.SetMode(JOYSTICK_FULLER)
+	joystick.KempstonDown(KEMPSTON_FIRE)
+	if value := ports.Read(0x001f); value != 0x00 {
+		t.Errorf("fuller: port 0x1f returned 0x%02x", value)
+	}
+	joystick.SetMode(JOYSTICK_KEMPSTON)
+	if value := ports.Read(0x007f); value != 0xff {
+		t.Errorf("kempston: port 0x7f returned 0x%02x", value)
+	}
+
+	if mode, err := ParseJoystickMode("interface2"); (err != nil) || (mode != JOYSTICK_SINCLAIR1) {
+		t.Errorf("ParseJoystickMode(\"interface2\") = %v, %v", mode, err)
+	}
+}
+
+func TestTwoPlayerJoysticks(t *testing.T) {
+	speccy := newTestSpectrum()
+	ports := speccy.Ports
+
+	// Player 1 on the Kempston interface, player 2 on the Interface 2 (keys 1-5)
+	speccy.Joystick.SetMode(JOYSTICK_KEMPSTON)
+	speccy.Joystick2.SetMode(JOYSTICK_SINCLAIR2)
+
+	speccy.Joystick.KempstonDown(KEMPSTON_UP)
+	speccy.Joystick2.KempstonDown(KEMPSTON_FIRE)
+	if value := ports.Read(0x001f); value != 0x08 {
+		t.Errorf("Kempston port: expected 0x08, got 0x%02x", value)
+	}
+	// Fire of player 2 is the key 5
+	if value := ports.Read(0xf7fe); value != 0xaf {
+		t.Errorf("keys 1-5: expected 0xaf, got 0x%02x", value)
+	}
+
+	// Both players on the Kempston interface
+	speccy.Joystick2.SetMode(JOYSTICK_KEMPSTON)
+	speccy.Joystick2.KempstonDown(KEMPSTON_LEFT)
+	if value := ports.Read(0x001f); value != 0x0a {
+		t.Errorf("Kempston port: expected 0x0a, got 0x%02x", value)
+	}
+	if value := ports.Read(0xf7fe); value != 0xbf {
+		t.Errorf("keys 1-5: expected no keys, got 0x%02x", value)
+	}
+
+	// Both players on keys: the Kempston interface reads as idle, not as an unassigned port
+	speccy.Joystick.SetMode(JOYSTICK_SINCLAIR1)
+	speccy.Joystick2.SetMode(JOYSTICK_SINCLAIR2)
+	if value := ports.Read(0x001f); value != 0x00 {
+		t.Errorf("Kempston port: expected 0x00, got 0x%02x", value)
+	}
+
+	speccy.kempston = false
+	if value := ports.Read(0x001f); value != 0xff {
+		t.Errorf("disconnected Kempston port: expected 0xff, got 0x%02x", value)
+	}
+}
+
+func TestWarp(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	// Waits until the previous command has been executed
+	sync := func() {
+		ch := make(chan uint64)
+		speccy.CommandChannel <- Cmd_GetInterruptCount{ch}
+		<-ch
+	}
+
+	speccy.CommandChannel <- Cmd_SetWarp{true}
+	sync()
+	if speed := speccy.GetCurrentSpeed(); speed != 0 {
+		t.Errorf("expected an unlimited speed during warp, got %f", speed)
+	}
+
+	// A speed change during warp takes effect after warp
+	oldSpeed := make(chan float32, 1)
+	speccy.CommandChannel <- Cmd_SetSpeed{2, oldSpeed}
+	if speed := <-oldSpeed; speed != 1 {
+		t.Errorf("expected the speed before warp 1, got %f", speed)
+	}
+	if speed := speccy.GetCurrentSpeed(); speed != 0 {
+		t.Errorf("the speed changed during warp to %f", speed)
+	}
+
+	speccy.CommandChannel <- Cmd_SetWarp{false}
+	sync()
+	if speed := speccy.GetCurrentSpeed(); speed != 2 {
+		t.Errorf("expected the speed 2 after warp, got %f", speed)
+	}
+}
+
+func TestRewindBuffer(t *testing.T) {
+	// 4 states
+	b := newRewindBuffer(4 * REWIND_INTERVAL / float32(DefaultFPS))
+
+	// State i has PC=i and the byte i at address 0x4000+i*1000
+	var ram [8][0x4000]byte
+	for i := 0; i < 6; i++ {
+		ram[5][i*1000] = byte(i)
+		var state rewindState
+		state.cpu.PC = uint16(i)
+		b.record(state, &ram)
+		b.framesSinceLastState = REWIND_INTERVAL - 1
+	}
+
+	// Back to state 4
+	if state := b.rewind(REWIND_INTERVAL); state.cpu.PC != 4 {
+		t.Fatalf("expected the state 4, got %d", state.cpu.PC)
+	}
+	if (b.ram[5][4000] != 4) || (b.ram[5][5000] != 0) {
+		t.Errorf("the memory of the state 4 was not restored")
+	}
+
+	// States 0 and 1 have been dropped
+	state := b.rewind(100 * REWIND_INTERVAL)
+	if state.cpu.PC != 2 {
+		t.Fatalf("expected the oldest state 2, got %d", state.cpu.PC)
+	}
+	for i := 0; i < 6; i++ {
+		expected := byte(0)
+		if i <= 2 {
+			expected = byte(i)
+		}
+		if b.ram[5][i*1000] != expected {
+			t.Errorf("address 0x%04x: expected %d, got %d", 0x4000+i*1000, expected, b.ram[5][i*1000])
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	var notifications []bool
+	speccy.AddPauseListener(func(paused bool) {
+		notifications = append(notifications, paused)
+	})
+
+	// The emulator loop is not running, toggling must not block
+	for i := 0; i < 10; i++ {
+		speccy.Pause()
+		speccy.Pause()
+		speccy.Resume()
+	}
+	speccy.Pause()
+
+	if !speccy.IsPaused() {
+		t.Errorf("expected the emulation to be paused")
+	}
+	if len(notifications) != 21 {
+		t.Errorf("expected 21 notifications, got %d", len(notifications))
+	}
+}
+
+func TestTapeFromTZX(t *testing.T) {
+	data := append([]byte("ZXTape!\x1a"), 1, 20)
+	data = append(data, formats.TZX_BLOCK_TEXT, 1, 'x')
+	data = append(data, formats.TZX_BLOCK_PURE_TONE, 100, 0, 3, 0)
+	data = append(data, formats.TZX_BLOCK_PULSES, 2, 200, 0, 250, 0)
+	data = append(data, formats.TZX_BLOCK_PURE_DATA, 10, 0, 20, 0, 3, 1, 0, 1, 0, 0, 0xa0)
+	tzx, err := formats.NewTZX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	speccy := newTestSpectrum()
+	tapeDrive := speccy.tapeDrive
+	tapeDrive.Insert(NewTapeFromTZX(tzx))
+
+	// The text block carries no signal
+	if n := tapeDrive.tape.NumBlocks(); n != 3 {
+		t.Fatalf("expected 3 blocks, got %d", n)
+	}
+
+	// Collect the pulses of each block
+	var pulses []int
+	for tapeDrive.currBlockId = 0; tapeDrive.currBlockId < 3; tapeDrive.currBlockId++ {
+		tapeDrive.state = TAPE_DRIVE_START
+		for tapeDrive.nextPulse() {
+			pulses = append(pulses, tapeDrive.timeout)
+		}
+		if tapeDrive.endBlock() != (tapeDrive.currBlockId == 2) {
+			t.Errorf("block %d: unexpected end of block", tapeDrive.currBlockId)
+		}
+	}
+
+	// Only the 3 most significant bits of 0xa0 are played: 1, 0, 1
+	expected := []int{100, 100, 100, 200, 250, 20, 20, 10, 10, 20, 20}
+	if !reflect.DeepEqual(pulses, expected) {
+		t.Errorf("expected pulses %v, got %v", expected, pulses)
+	}
+	if tapeDrive.state != TAPE_DRIVE_PRE_STOP {
+		t.Errorf("expected the tape to stop after the last block")
+	}
+}
+
+func TestAutoLoadSuperseded(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	// The machine without a ROM never reaches the BASIC prompt
+	result := make(chan error)
+	go func() {
+		result <- speccy.AutoLoadTape()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	errChan := make(chan error)
+	speccy.CommandChannel <- Cmd_Load{"", &formats.TAP{}, errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("expected the auto-load to be cancelled, got %s", err)
+		}
+	case <-time.After(autoLoadTimeout / 2):
+		t.Errorf("the auto-load was not cancelled by loading another program")
+	}
+}
+
+// Returns a tape with a header block followed by a data block
+func newTestTAP(t *testing.T) *formats.TAP {
+	header := []byte{formats.TAP_BLOCK_HEADER, formats.TAP_FILE_CODE}
+	header = append(header, "screen    "...)
+	header = append(header, 0x00, 0x1b, 0x00, 0x40, 0x00, 0x80)
+	data := []byte{formats.TAP_BLOCK_DATA, 1, 2, 3}
+	var tapData []byte
+	for _, block := range [][]byte{header, data} {
+		checksum := byte(0)
+		for _, b := range block {
+			checksum ^= b
+		}
+		block = append(block, checksum)
+		tapData = append(tapData, byte(len(block)), byte(len(block)>>8))
+		tapData = append(tapData, block...)
+	}
+	tap, err := formats.NewTAP(tapData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tap
+}
+
+func TestTapeSeek(t *testing.T) {
+	speccy := newTestSpectrum()
+	speccy.tapeDrive.Insert(NewTape(newTestTAP(t)))
+
+	expected := []TapeBlockInfo{{19, "Bytes", "screen"}, {5, "", ""}}
+	if blocks := speccy.tapeDrive.Tape().Blocks(); !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("expected %v, got %v", expected, blocks)
+	}
+
+	errChan := make(chan error)
+	speccy.CommandChannel <- Cmd_SeekTape{1, errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan TapeProgress)
+	speccy.CommandChannel <- Cmd_GetTapeProgress{ch}
+	if progress := <-ch; progress.Block != 1 {
+		t.Errorf("expected the tape at block 1, got %d", progress.Block)
+	}
+
+	// Playing the tape keeps the position
+	speccy.CommandChannel <- Cmd_PlayTape{}
+	speccy.CommandChannel <- Cmd_GetTapeProgress{ch}
+	if progress := <-ch; !progress.Playing || (progress.Block != 1) || (progress.Percent != float32(100*19)/24) {
+		t.Errorf("expected the tape playing at block 1 (%.1f%%), got block %d (%.1f%%)", float32(100*19)/24, progress.Block, progress.Percent)
+	}
+	speccy.tapeDrive.Stop()
+
+	speccy.CommandChannel <- Cmd_SeekTape{2, errChan}
+	if err := <-errChan; err == nil {
+		t.Errorf("expected an error")
+	}
+
+}
+
+func TestTapeLoadProgress(t *testing.T) {
+	speccy := newTestSpectrum()
+	tapeDrive := speccy.tapeDrive
+	tapeDrive.AcceleratedLoad = false
+	tapeDrive.Insert(NewTape(newTestTAP(t)))
+
+	// A program which keeps reading the EAR bit, so that the tape is played
+	program := []byte{
+		0xf3,       // 8000 DI
+		0x3e, 0x7f, // 8001 LD A,0x7f
+		0xdb, 0xfe, // 8003 IN A,(0xfe)
+		0x18, 0xfa, // 8005 JR 0x8001
+	}
+	for i, b := range program {
+		speccy.Memory.Write(0x8000+uint16(i), b)
+	}
+	speccy.Cpu.SetPC(0x8000)
+
+	tapeDrive.Play()
+
+	// The highest progress of each block seen at the end of a frame
+	var blockPercent [2]float32
+	var status string
+	var percent float32
+	for frame := 0; speccy.readFromTape; frame++ {
+		if frame == 2000 {
+			t.Fatalf("the tape is still playing: %s", tapeDrive.progress())
+		}
+		speccy.renderFrame(nil)
+
+		progress := tapeDrive.progress()
+		if progress.Percent < percent {
+			t.Fatalf("the progress of the tape went back from %.1f%% to %.1f%%", percent, progress.Percent)
+		}
+		percent = progress.Percent
+
+		if progress.Block < 2 {
+			// The data block is named after the header
+			if progress.BlockName != "screen" {
+				t.Errorf("block %d: expected the name \"screen\", got \"%s\"", progress.Block, progress.BlockName)
+			}
+			if (progress.Block == 1) && (progress.BlockPercent > 0) && (status == "") {
+				status = progress.String()
+			}
+			if progress.BlockPercent > blockPercent[progress.Block] {
+				blockPercent[progress.Block] = progress.BlockPercent
+			}
+		}
+	}
+
+	if blockPercent != [2]float32{100, 100} {
+		t.Errorf("expected both blocks to be loaded, got %v", blockPercent)
+	}
+	if !strings.HasPrefix(status, "playing, block 2 of 2 \"screen\": ") {
+		t.Errorf("unexpected status while loading the data block: %q", status)
+	}
+	if s := tapeDrive.progress().String(); s != "stopped, block 2 of 2 \"screen\": 100% of the block, 100% of the tape" {
+		t.Errorf("unexpected status at the end: %q", s)
+	}
+	if percent != 100 {
+		t.Errorf("expected 100%% at the end, got %.1f%%", percent)
+	}
+
+	tapeDrive.Stop()
+	if s := tapeDrive.progress().String(); s != "stopped, block 1 of 2 \"screen\": 0% of the block, 0% of the tape" {
+		t.Errorf("unexpected status of the stopped tape: %q", s)
+	}
+}
+
+func TestJoystickControls(t *testing.T) {
+	speccy := newTestSpectrum()
+	joystick := speccy.Joystick
+	keyboard := speccy.Keyboard
+
+	// Up=Q, Down=A, Fire=Space. Left and right stay on the Kempston port.
+	preset, err := ParseControlPreset("test", "q,a,kempston,kempston,space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := preset.KeysString(); s != "q,a,kempston,kempston,space" {
+		t.Errorf("unexpected textual form \"%s\"", s)
+	}
+	joystick.SetControls(preset)
+
+	// Diagonal up-left, while firing
+	joystick.KempstonDown(KEMPSTON_UP)
+	joystick.KempstonDown(KEMPSTON_LEFT)
+	joystick.KempstonDown(KEMPSTON_FIRE)
+
+	if (keyboard.GetKeyState(2) & 0x01) != 0 {
+		t.Errorf("Q is not pressed")
+	}
+	if (keyboard.GetKeyState(7) & 0x01) != 0 {
+		t.Errorf("Space is not pressed")
+	}
+	if (keyboard.GetKeyState(1) & 0x01) == 0 {
+		t.Errorf("A is pressed")
+	}
+	if state := joystick.kempstonState(); state != kempstonMask[KEMPSTON_LEFT] {
+		t.Errorf("expected only left on the Kempston port, got 0x%02x", state)
+	}
+
+	// Switching back to the Kempston interface releases the keys
+	joystick.SetControls(nil)
+	for row := uint(0); row < 8; row++ {
+		if keyboard.GetKeyState(row) != 0xff {
+			t.Errorf("a key remains pressed in row %d", row)
+		}
+	}
+}
+
+func TestResetModes(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	write := func() {
+		done := make(chan bool)
+		speccy.CommandChannel <- Cmd_WriteMemory{0x8000, []byte{0x42}, done}
+		<-done
+	}
+	read := func() byte {
+		data := make([]byte, 1)
+		done := make(chan bool)
+		speccy.CommandChannel <- Cmd_ReadMemory{0x8000, data, done}
+		<-done
+		return data[0]
+	}
+
+	write()
+	speccy.CommandChannel <- Cmd_Reset{nil, RESET_SOFT}
+	if value := read(); value != 0x42 {
+		t.Errorf("soft reset: expected the RAM to be preserved, got 0x%02x", value)
+	}
+
+	speccy.CommandChannel <- Cmd_Reset{nil, RESET_HARD}
+	if value := read(); value != 0 {
+		t.Errorf("hard reset: expected the RAM to be cleared, got 0x%02x", value)
+	}
+}
+
+func TestReadPalette(t *testing.T) {
+	var text string
+	for i := 0; i < 16; i++ {
+		text += "# color " + strconv.Itoa(i) + "\n" + strconv.Itoa(i) + ", 0x10 255\n"
+	}
+
+	path := filepath.Join(t.TempDir(), "palette.txt")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadPalette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p[15] != (RGBA{15, 0x10, 255, 255}.value32()) {
+		t.Errorf("unexpected color 15: 0x%08x", p[15])
+	}
+
+	if err := os.WriteFile(path, []byte("1 2 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPalette(path); err == nil {
+		t.Errorf("expected an error for an incomplete palette")
+	}
+}
+
+func TestStringToKeys(t *testing.T) {
+	sequences, unmapped := stringToKeys("aB\"\n~")
+
+	expected := [][]uint{
+		{KEY_A},
+		{KEY_CapsShift, KEY_B},
+		{KEY_SymbolShift, KEY_P},
+		{KEY_Enter},
+	}
+	if len(sequences) != len(expected) {
+		t.Fatalf("expected %d key sequences, got %v", len(expected), sequences)
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(sequences[i], expected[i]) {
+			t.Errorf("character %d: expected %v, got %v", i, expected[i], sequences[i])
+		}
+	}
+
+	if (len(unmapped) != 1) || (unmapped[0] != '~') {
+		t.Errorf("expected '~' to be unmapped, got %q", unmapped)
+	}
+}
+
+func TestFormatRegisters(t *testing.T) {
+	cpu := formats.CpuState{A: 0x12, F: 0xc1, IX: 0xabcd, PC: 0x10ac, IM: 1}
+
+	s := FormatRegisters(cpu)
+	for _, expected := range []string{"AF 12c1", "F SZ.....C", "IX abcd", "PC  10ac", "IM 1"} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("expected %q in:\n%s", expected, s)
+		}
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	b := &speccy.breakpoints
+	b.setBreakpoint(0x8000, true)
+	b.setBreakpoint(0x1234, true)
+	b.setBreakpoint(0x1234, true)
+	if addresses := b.addresses(); !reflect.DeepEqual(addresses, []uint16{0x1234, 0x8000}) {
+		t.Errorf("unexpected breakpoints: %v", addresses)
+	}
+
+	speccy.Cpu.SetPC(0x1234)
+	if !speccy.breakpointTrap() || !b.stopped || !speccy.IsPaused() {
+		t.Errorf("expected the emulation to stop at the breakpoint")
+	}
+
+	// After resuming, the instruction at the breakpoint is executed
+	b.stopped = false
+	if speccy.breakpointTrap() {
+		t.Errorf("expected the breakpoint to be skipped once")
+	}
+
+	b.setBreakpoint(0x1234, false)
+	b.setBreakpoint(0x8000, false)
+	if b.set != nil {
+		t.Errorf("expected no breakpoints")
+	}
+}
+
+func TestWatchpoints(t *testing.T) {
+	speccy := newTestSpectrum()
+	memory := speccy.Memory
+	w := &memory.watches
+
+	w.set(0x8000, 0x8003, WATCH_WRITE)
+	w.set(0x8002, 0x8002, WATCH_READ|WATCH_WRITE)
+	expected := []WatchRange{
+		{0x8000, 0x8001, WATCH_WRITE},
+		{0x8002, 0x8002, WATCH_READ | WATCH_WRITE},
+		{0x8003, 0x8003, WATCH_WRITE},
+	}
+	if ranges := w.ranges(); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected %v, got %v", expected, ranges)
+	}
+
+	// Accesses are not checked outside of the instruction loop
+	memory.Write(0x8000, 1)
+	if w.hit != nil {
+		t.Fatalf("unexpected hit: %v", w.hit)
+	}
+
+	w.active = true
+	memory.Read(0x8001)
+	memory.Write(0x9000, 2)
+	if w.hit != nil {
+		t.Fatalf("unexpected hit: %v", w.hit)
+	}
+	memory.Write(0x8001, 3)
+	if (w.hit == nil) || (*w.hit != WatchHit{Address: 0x8001, Mode: WATCH_WRITE, OldValue: 0, NewValue: 3}) {
+		t.Errorf("unexpected hit: %v", w.hit)
+	}
+
+	speccy.lastInstructionAddr = 0x6000
+	speccy.watchTrap()
+	if !speccy.breakpoints.stopped || !speccy.IsPaused() || (w.hit != nil) {
+		t.Errorf("expected the emulation to stop")
+	}
+
+	w.set(0x8000, 0x8003, 0)
+	if w.modes != nil {
+		t.Errorf("expected no watchpoints")
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	rom, err := os.ReadFile("../48.rom")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	expected := "" +
+		"0000  F3           DI\n" +
+		"0001  AF           XOR A\n" +
+		"0002  11 FF FF     LD DE,$FFFF\n" +
+		"0005  C3 CB 11     JP $11CB\n" +
+		"0008  2A 5D 5C     LD HL,($5C5D)\n" +
+		"000B  22 5F 5C     LD ($5C5F),HL\n" +
+		"000E  18 43        JR $0053\n" +
+		"0010  C3 F2 15     JP $15F2\n"
+	if listing := DisassembleListing(rom, 0, 8); listing != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, listing)
+	}
+
+	tests := []struct {
+		code   []byte
+		text   string
+		length uint
+	}{
+		{[]byte{0xdd, 0x7c}, "LD A,IXH", 2},
+		{[]byte{0xfd, 0x45}, "LD B,IYL", 2},
+		{[]byte{0xdd, 0x66, 0xfe}, "LD H,(IX-$02)", 3},
+		{[]byte{0xfd, 0x36, 0x05, 0x42}, "LD (IY+$05),$42", 4},
+		{[]byte{0xdd, 0xcb, 0x05, 0x06}, "RLC (IX+$05)", 4},
+		{[]byte{0xdd, 0xcb, 0x05, 0x00}, "RLC (IX+$05),B", 4},
+		{[]byte{0xfd, 0xcb, 0x01, 0x4e}, "BIT 1,(IY+$01)", 4},
+		{[]byte{0xdd, 0xe9}, "JP (IX)", 2},
+		{[]byte{0xdd, 0xdd, 0x00}, "NOP*", 1},
+		{[]byte{0xcb, 0x30}, "SLL B", 2},
+		{[]byte{0xed, 0x70}, "IN (C)", 2},
+		{[]byte{0xed, 0x71}, "OUT (C),0", 2},
+		{[]byte{0xed, 0xb0}, "LDIR", 2},
+		{[]byte{0xed, 0x5e}, "IM 2", 2},
+		{[]byte{0xed, 0x73, 0x34, 0x12}, "LD ($1234),SP", 4},
+		{[]byte{0x10, 0xfe}, "DJNZ $0000", 2},
+	}
+	for _, test := range tests {
+		read := func(address uint16) byte {
+			if int(address) < len(test.code) {
+				return test.code[address]
+			}
+			return 0
+		}
+		text, length := Disassemble(read, 0)
+		if (text != test.text) || (length != test.length) {
+			t.Errorf("% X: expected %q (%d bytes), got %q (%d bytes)", test.code, test.text, test.length, text, length)
+		}
+	}
+}
+
+func TestStateSlots(t *testing.T) {
+	oldUserDir := DefaultUserDir
+	DefaultUserDir = t.TempDir()
+	defer func() { DefaultUserDir = oldUserDir }()
+
+	speccy := newTestSpectrum()
+
+	write := func(value byte) {
+		done := make(chan bool)
+		speccy.CommandChannel <- Cmd_WriteMemory{0x8000, []byte{value}, done}
+		<-done
+	}
+	read := func() byte {
+		data := make([]byte, 1)
+		done := make(chan bool)
+		speccy.CommandChannel <- Cmd_ReadMemory{0x8000, data, done}
+		<-done
+		return data[0]
+	}
+
+	if err := speccy.LoadState(3); (err == nil) || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("expected an error about an empty slot, got %v", err)
+	}
+	if err := speccy.SaveState(NumStateSlots); err == nil {
+		t.Errorf("expected an error about an invalid slot")
+	}
+
+	write(0x42)
+	if err := speccy.SaveState(3); err != nil {
+		t.Fatal(err)
+	}
+	write(0x24)
+
+	if err := speccy.LoadState(3); err != nil {
+		t.Fatal(err)
+	}
+	if value := read(); value != 0x42 {
+		t.Errorf("expected the saved value 0x42, got 0x%02x", value)
+	}
+
+	// The slots of a loaded program are kept in its settings directory
+	programPath := filepath.Join(t.TempDir(), "game.tap")
+	if err := os.WriteFile(programPath, []byte{1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetLoadedProgramPath(programPath)
+	defer SetLoadedProgramPath("")
+
+	if err := speccy.LoadState(3); (err == nil) || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("expected an error about an empty slot of the program, got %v", err)
+	}
+	if err := speccy.SaveState(3); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := GameSettingsPath(programPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "states", "slot3.z80")); err != nil {
+		t.Errorf("the slot is not in the settings directory of the program: %s", err)
+	}
+}
+
+func TestStateSlots128k(t *testing.T) {
+	oldUserDir := DefaultUserDir
+	DefaultUserDir = t.TempDir()
+	defer func() { DefaultUserDir = oldUserDir }()
+
+	speccy := newTestSpectrum128(t)
+	speccy.Memory.writePagingPort(0x03)
+	speccy.Memory.Write(0xc000, 0x42)
+
+	if err := speccy.SaveState(0); err != nil {
+		t.Fatal(err)
+	}
+
+	speccy.Memory.writePagingPort(0x00)
+	speccy.Memory.ram[3][0] = 0x24
+
+	if err := speccy.LoadState(0); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan MachineModel)
+	speccy.CommandChannel <- Cmd_GetMachineModel{ch}
+	if model := <-ch; model != MODEL_128K {
+		t.Errorf("expected the 128k model, got %v", model)
+	}
+	if paging := speccy.Memory.paging; paging != 0x03 {
+		t.Errorf("expected the paging 0x03, got 0x%02x", paging)
+	}
+	if value := speccy.Memory.ram[3][0]; value != 0x42 {
+		t.Errorf("expected the saved value 0x42 in bank 3, got 0x%02x", value)
+	}
+}
+
+func TestRZXPlayback(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	rzx := &formats.RZX{
+		Frames: []formats.RZXFrame{
+			{FetchCount: 100, InValues: []byte{0x1f, 0xbf}},
+			{FetchCount: 100, InValues: []byte{0x00}},
+		},
+	}
+	speccy.rzxPlayback = newRZXPlayback(rzx)
+
+	// Reads outside of the program execution are not fed from the recording
+	if value := speccy.Ports.Read(0x00ff); value != 0xff {
+		t.Errorf("expected 0xff, got 0x%02x", value)
+	}
+
+	playback := speccy.rzxPlayback
+	playback.running = true
+	for _, expected := range []byte{0x1f, 0xbf} {
+		if value := speccy.Ports.Read(0xfefe); value != expected {
+			t.Errorf("expected 0x%02x, got 0x%02x", expected, value)
+		}
+	}
+	playback.running = false
+	speccy.rzxFrameEnd()
+	if playback.outOfSync {
+		t.Errorf("the playback should be in sync")
+	}
+
+	// The second frame reads more values than recorded
+	playback.running = true
+	speccy.Ports.Read(0xfefe)
+	speccy.Ports.Read(0xfefe)
+	playback.running = false
+	if !playback.outOfSync {
+		t.Errorf("the playback should be out of sync")
+	}
+
+	speccy.rzxFrameEnd()
+	if speccy.rzxPlayback != nil {
+		t.Errorf("the playback should have ended")
+	}
+}
+
+func TestRZXRecording(t *testing.T) {
+	speccy := newTestSpectrum()
+	speccy.Cpu.SetSP(0xff00)
+
+	filePath := filepath.Join(t.TempDir(), "demo.rzx")
+	if err := speccy.startRZXRecording(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := speccy.startRZXRecording(filePath); err == nil {
+		t.Errorf("expected an error about a recording in progress")
+	}
+
+	// Only the reads by the running program are recorded
+	speccy.Ports.Read(0x00ff)
+
+	if err := speccy.stopRZXRecording(); err != nil {
+		t.Fatal(err)
+	}
+	if speccy.rzxRecording != nil {
+		t.Errorf("the recording should have stopped")
+	}
+
+	program, err := formats.ReadProgram(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rzx, ok := program.(*formats.RZX)
+	if !ok {
+		t.Fatalf("expected an RZX, got %T", program)
+	}
+	expected := []formats.RZXFrame{{FetchCount: 0, InValues: []byte{}}}
+	if !reflect.DeepEqual(rzx.Frames, expected) {
+		t.Errorf("expected frames %v, got %v", expected, rzx.Frames)
+	}
+}
+
+// Loads a program which reads the keyboard row of the key A in a loop
+// and stores the values at 0x9000 onwards
+func loadKeyboardReader(speccy *Spectrum48k) {
+	program := []byte{
+		0xf3,       // 8000 DI
+		0x3e, 0xfd, // 8001 LD A,0xfd
+		0xdb, 0xfe, // 8003 IN A,(0xfe)
+		0x77,       // 8005 LD (HL),A
+		0x23,       // 8006 INC HL
+		0x18, 0xf8, // 8007 JR 0x8001
+	}
+	for i, b := range program {
+		speccy.Memory.Write(0x8000+uint16(i), b)
+	}
+	speccy.Cpu.SetPC(0x8000)
+	speccy.Cpu.SetSP(0xff00)
+	speccy.Cpu.H, speccy.Cpu.L = 0x90, 0x00
+}
+
+func TestRZXRecordAndPlayback(t *testing.T) {
+	speccy := newTestSpectrum()
+	loadKeyboardReader(speccy)
+
+	filePath := filepath.Join(t.TempDir(), "keys.rzx")
+	if err := speccy.startRZXRecording(filePath); err != nil {
+		t.Fatal(err)
+	}
+	speccy.renderFrame(nil)
+	speccy.Keyboard.KeyDown(KEY_A)
+	speccy.renderFrame(nil)
+	speccy.Keyboard.KeyUp(KEY_A)
+	speccy.renderFrame(nil)
+	if err := speccy.stopRZXRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	program, err := formats.ReadProgram(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rzx := program.(*formats.RZX)
+	if len(rzx.Frames) != 4 {
+		t.Fatalf("expected 4 frames, got %d", len(rzx.Frames))
+	}
+	if rzx.Frames[2].InValues[0] == rzx.Frames[3].InValues[0] {
+		t.Errorf("the key press should change the recorded values")
+	}
+
+	// Play the recording back on another machine, without touching the keyboard
+	replay := newTestSpectrum()
+	if err := replay.loadRZX(rzx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; (replay.rzxPlayback != nil) && (i < 10); i++ {
+		playback := replay.rzxPlayback
+		replay.renderFrame(nil)
+		if playback.outOfSync {
+			t.Fatalf("the playback is out of sync at frame %d", playback.frame)
+		}
+	}
+	if replay.rzxPlayback != nil {
+		t.Fatalf("the playback should have ended")
+	}
+
+	if (replay.Cpu.PC() != speccy.Cpu.PC()) || (replay.Cpu.H != speccy.Cpu.H) || (replay.Cpu.L != speccy.Cpu.L) {
+		t.Errorf("expected PC=%04x HL=%02x%02x, got PC=%04x HL=%02x%02x",
+			speccy.Cpu.PC(), speccy.Cpu.H, speccy.Cpu.L, replay.Cpu.PC(), replay.Cpu.H, replay.Cpu.L)
+	}
+	for addr := 0x9000; addr < 0xc000; addr++ {
+		if expected, value := speccy.Memory.Read(uint16(addr)), replay.Memory.Read(uint16(addr)); value != expected {
+			t.Fatalf("memory at 0x%04x: expected 0x%02x, got 0x%02x", addr, expected, value)
+		}
+	}
+}
+
+func TestRZXRecording128k(t *testing.T) {
+	speccy := newTestSpectrum128(t)
+	speccy.Memory.writePagingPort(0x03)
+	speccy.Memory.Write(0xc000, 0x5a)
+
+	filePath := filepath.Join(t.TempDir(), "128k.rzx")
+	if err := speccy.startRZXRecording(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := speccy.stopRZXRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	program, err := formats.ReadProgram(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s128, ok := program.(*formats.RZX).Snapshot.(formats.Snapshot128)
+	if !ok || (s128.Memory128() == nil) {
+		t.Fatalf("expected a 128k snapshot in the recording")
+	}
+	if mem := s128.Memory128(); (mem.Paging != 0x03) || (mem.Banks[3][0] != 0x5a) {
+		t.Errorf("expected paging 0x03 and 0x5a in bank 3, got 0x%02x and 0x%02x", mem.Paging, mem.Banks[3][0])
+	}
+}
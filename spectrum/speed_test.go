@@ -0,0 +1,37 @@
+package spectrum
+
+import (
+	"testing"
+)
+
+func TestFrameRateNotification(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	// A quick warp toggle, as by a short tap of the warp key
+	speccy.CommandChannel <- Cmd_SetWarp{true}
+	oldSpeed := make(chan float32, 1)
+	speccy.CommandChannel <- Cmd_SetSpeed{1, oldSpeed}
+	<-oldSpeed
+	speccy.CommandChannel <- Cmd_SetWarp{false}
+	speccy.CommandChannel <- Cmd_SetSpeed{1, oldSpeed}
+	<-oldSpeed
+
+	// The emulator loop receives a single notification and reads the latest frame rate
+	select {
+	case <-speccy.frameRateChanged:
+	default:
+		t.Fatalf("expected a notification")
+	}
+	select {
+	case <-speccy.frameRateChanged:
+		t.Errorf("expected a single notification")
+	default:
+	}
+
+	speccy.currentFPS_mutex.Lock()
+	frameRate := speccy.frameRate()
+	speccy.currentFPS_mutex.Unlock()
+	if frameRate != DefaultFPS {
+		t.Errorf("expected the frame rate %d, got %f", DefaultFPS, frameRate)
+	}
+}
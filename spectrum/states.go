@@ -0,0 +1,78 @@
+package spectrum
+
+import (
+	"fmt"
+	"github.com/guntars-lemps/gospeccy/formats"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// The number of quick-save slots, numbered from 0
+const NumStateSlots = 10
+
+// Returns the path of the file which holds the state saved in the specified slot.
+// The slots belong to the most recently loaded program and are kept in its settings
+// directory (see ProgramSettingsDir) as DIR/states/slotN.z80. If no program has been loaded,
+// the directory is $HOME/.config/gospeccy. The Z80 format holds the state of all machine models.
+func StateSlotPath(slot int) (string, error) {
+	if (slot < 0) || (slot >= NumStateSlots) {
+		return "", fmt.Errorf("invalid state slot %d, the slots are numbered from 0 to %d", slot, NumStateSlots-1)
+	}
+
+	dir, err := ProgramSettingsDir()
+	if err != nil {
+		dir = DefaultUserDir
+	}
+	return path.Join(dir, "states", fmt.Sprintf("slot%d.z80", slot)), nil
+}
+
+// Saves the state of the machine into the specified quick-save slot,
+// replacing the previous contents of the slot.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) SaveState(slot int) error {
+	filePath, err := StateSlotPath(slot)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *formats.FullSnapshot)
+	speccy.CommandChannel <- Cmd_MakeSnapshot{ch}
+	data, err := (<-ch).EncodeZ80()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filePath, data, 0600)
+}
+
+// Restores the state of the machine from the specified quick-save slot.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) LoadState(slot int) error {
+	filePath, err := StateSlotPath(slot)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("state slot %d is empty", slot)
+	}
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := formats.SnapshotData(data).DecodeZ80()
+	if err != nil {
+		return fmt.Errorf("state slot %d: %s", slot, err)
+	}
+
+	errChan := make(chan error)
+	speccy.CommandChannel <- Cmd_LoadSnapshot{filePath, snapshot, errChan}
+	return <-errChan
+}
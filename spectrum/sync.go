@@ -0,0 +1,50 @@
+package spectrum
+
+import "time"
+
+type Cmd_Sync struct {
+	// Receives true after the next frame has been emulated,
+	// its screen has been rendered by the first display
+	// and its audio data has been handed over to the audio receivers.
+	// After that, the screen and the memory reflect exactly that frame
+	// until the emulation continues with the frame after it.
+	// Receives false if the emulation is paused.
+	Done chan<- bool
+}
+
+// Synchronization of the frame being rendered with 'Cmd_Sync' commands
+type frameSync struct {
+	waiters []chan<- bool
+
+	// Receives the completion time of the frame from the first display
+	rendered chan time.Time
+
+	// The original recipient of the completion time, or nil
+	completionTime_orNil chan<- time.Time
+}
+
+// Takes over the pending 'Cmd_Sync' commands.
+// The returned frameSync's 'rendered' channel should be used in place of 'completionTime_orNil'.
+func (speccy *Spectrum48k) beginFrameSync(completionTime_orNil chan<- time.Time) *frameSync {
+	sync := &frameSync{
+		waiters:              speccy.syncWaiters,
+		rendered:             make(chan time.Time, 1),
+		completionTime_orNil: completionTime_orNil,
+	}
+	speccy.syncWaiters = nil
+	return sync
+}
+
+// Notifies the waiters after the display has finished rendering the frame.
+// This function runs in its own goroutine because the display
+// may complete the rendering after the emulation has moved on.
+func (sync *frameSync) finish() {
+	t := <-sync.rendered
+	if sync.completionTime_orNil != nil {
+		sync.completionTime_orNil <- t
+	}
+
+	for _, waiter := range sync.waiters {
+		waiter <- true
+	}
+}
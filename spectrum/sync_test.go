@@ -0,0 +1,68 @@
+package spectrum
+
+import (
+	"testing"
+	"time"
+)
+
+// Receives a value from 'ch', or fails the test if no value arrives in a second
+func receiveBool(t *testing.T, ch <-chan bool) bool {
+	select {
+	case value := <-ch:
+		return value
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	return false
+}
+
+func TestFrameWaitersWhilePaused(t *testing.T) {
+	speccy := newTestSpectrum()
+	speccy.Pause()
+
+	done := make(chan bool, 1)
+	speccy.CommandChannel <- Cmd_Sync{done}
+	if receiveBool(t, done) {
+		t.Errorf("sync: expected false")
+	}
+
+	speccy.CommandChannel <- Cmd_WaitStable{10, done}
+	if receiveBool(t, done) {
+		t.Errorf("waitStable: expected false")
+	}
+
+	speccy.CommandChannel <- Cmd_WaitTitle{0, 10, done}
+	if receiveBool(t, done) {
+		t.Errorf("waitTitle: expected false")
+	}
+
+	// The port accesses do not wait for the next frame
+	speccy.CommandChannel <- Cmd_Out{0x00fe, 0x02, done}
+	receiveBool(t, done)
+	if color := speccy.ula.getBorderColor(); color != 2 {
+		t.Errorf("expected border color 2, got %d", color)
+	}
+}
+
+func TestFrameWaitersReleasedByPause(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	syncDone := make(chan bool, 1)
+	speccy.CommandChannel <- Cmd_Sync{syncDone}
+	stableDone := make(chan bool, 1)
+	speccy.CommandChannel <- Cmd_WaitStable{10, stableDone}
+	portDone := make(chan bool, 1)
+	speccy.CommandChannel <- Cmd_Out{0x00fe, 0x03, portDone}
+
+	// Sent by the emulator loop when the emulation is paused
+	speccy.Pause()
+	speccy.CommandChannel <- Cmd_ReleaseFrameWaiters{}
+
+	if receiveBool(t, syncDone) || receiveBool(t, stableDone) {
+		t.Errorf("expected the waiters to fail")
+	}
+	receiveBool(t, portDone)
+	if color := speccy.ula.getBorderColor(); color != 3 {
+		t.Errorf("expected border color 3, got %d", color)
+	}
+}
@@ -0,0 +1,281 @@
+package spectrum
+
+import (
+	"errors"
+	"strings"
+)
+
+// A system variable of the 48k ROM
+type SystemVariable struct {
+	Address uint16
+	Size    uint // Number of bytes, little-endian
+}
+
+// System variables of the 48k ROM, indexed by their names as printed in the
+// Spectrum manual with spaces removed. Variables which aren't 1, 2 or 3 bytes
+// long (such as KSTATE, STRMS and MEMBOT) are not included.
+var SystemVariables = map[string]SystemVariable{
+	"LASTK":  {0x5c08, 1},
+	"REPDEL": {0x5c09, 1},
+	"REPPER": {0x5c0a, 1},
+	"DEFADD": {0x5c0b, 2},
+	"KDATA":  {0x5c0d, 1},
+	"TVDATA": {0x5c0e, 2},
+	"CHARS":  {0x5c36, 2},
+	"RASP":   {0x5c38, 1},
+	"PIP":    {0x5c39, 1},
+	"ERRNR":  {0x5c3a, 1},
+	"FLAGS":  {0x5c3b, 1},
+	"TVFLAG": {0x5c3c, 1},
+	"ERRSP":  {0x5c3d, 2},
+	"LISTSP": {0x5c3f, 2},
+	"MODE":   {0x5c41, 1},
+	"NEWPPC": {0x5c42, 2},
+	"NSPPC":  {0x5c44, 1},
+	"PPC":    {0x5c45, 2},
+	"SUBPPC": {0x5c47, 1},
+	"BORDCR": {0x5c48, 1},
+	"EPPC":   {0x5c49, 2},
+	"VARS":   {0x5c4b, 2},
+	"DEST":   {0x5c4d, 2},
+	"CHANS":  {0x5c4f, 2},
+	"CURCHL": {0x5c51, 2},
+	"PROG":   {0x5c53, 2},
+	"NXTLIN": {0x5c55, 2},
+	"DATADD": {0x5c57, 2},
+	"ELINE":  {0x5c59, 2},
+	"KCUR":   {0x5c5b, 2},
+	"CHADD":  {0x5c5d, 2},
+	"XPTR":   {0x5c5f, 2},
+	"WORKSP": {0x5c61, 2},
+	"STKBOT": {0x5c63, 2},
+	"STKEND": {0x5c65, 2},
+	"BREG":   {0x5c67, 1},
+	"MEM":    {0x5c68, 2},
+	"FLAGS2": {0x5c6a, 1},
+	"DFSZ":   {0x5c6b, 1},
+	"STOP":   {0x5c6c, 2},
+	"OLDPPC": {0x5c6e, 2},
+	"OSPPC":  {0x5c70, 1},
+	"FLAGX":  {0x5c71, 1},
+	"STRLEN": {0x5c72, 2},
+	"TADDR":  {0x5c74, 2},
+	"SEED":   {0x5c76, 2},
+	"FRAMES": {0x5c78, 3},
+	"UDG":    {0x5c7b, 2},
+	"COORDS": {0x5c7d, 2},
+	"PPOSN":  {0x5c7f, 1},
+	"PRCC":   {0x5c80, 2},
+	"ECHOE":  {0x5c82, 2},
+	"DFCC":   {0x5c84, 2},
+	"DFCCL":  {0x5c86, 2},
+	"SPOSN":  {0x5c88, 2},
+	"SPOSNL": {0x5c8a, 2},
+	"SCRCT":  {0x5c8c, 1},
+	"ATTRP":  {0x5c8d, 1},
+	"MASKP":  {0x5c8e, 1},
+	"ATTRT":  {0x5c8f, 1},
+	"MASKT":  {0x5c90, 1},
+	"PFLAG":  {0x5c91, 1},
+	"NMIADD": {0x5cb0, 2},
+	"RAMTOP": {0x5cb2, 2},
+	"PRAMT":  {0x5cb4, 2},
+}
+
+// Finds a system variable by name. The name is case-insensitive
+// and may contain spaces, for example: "LAST K".
+func LookupSystemVariable(name string) (SystemVariable, error) {
+	key := strings.ToUpper(strings.Replace(name, " ", "", -1))
+	sysvar, ok := SystemVariables[key]
+	if !ok {
+		return SystemVariable{}, errors.New("unknown system variable \"" + name + "\"")
+	}
+	return sysvar, nil
+}
+
+// Returns the value of the named system variable
+func (speccy *Spectrum48k) SystemVariable(name string) (uint, error) {
+	sysvar, err := LookupSystemVariable(name)
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, sysvar.Size)
+	done := make(chan bool)
+	speccy.CommandChannel <- Cmd_ReadMemory{sysvar.Address, data, done}
+	<-done
+
+	var value uint
+	for i := len(data) - 1; i >= 0; i-- {
+		value = (value << 8) | uint(data[i])
+	}
+	return value, nil
+}
+
+// Sets the value of the named system variable
+func (speccy *Spectrum48k) SetSystemVariable(name string, value uint) error {
+	sysvar, err := LookupSystemVariable(name)
+	if err != nil {
+		return err
+	}
+	if value >= (1 << (8 * sysvar.Size)) {
+		return errors.New("value too large for system variable \"" + name + "\"")
+	}
+
+	data := make([]byte, sysvar.Size)
+	for i := range data {
+		data[i] = byte(value >> (8 * uint(i)))
+	}
+
+	done := make(chan bool)
+	speccy.CommandChannel <- Cmd_WriteMemory{sysvar.Address, data, done}
+	<-done
+
+	return nil
+}
+
+// Address of the ED-ERROR routine in the 48k ROM.
+// While the line editor is running, the error stack pointer (ERR SP) points to it.
+const rom48_ED_ERROR = 0x107f
+
+// The BASIC line editors
+type BasicEditor int
+
+const (
+	BASIC_EDITOR_NONE BasicEditor = iota
+
+	// The line editor of the 48k ROM, also used in the 48 BASIC mode of the 128k
+	BASIC_EDITOR_48K
+
+	// The full-screen editor of the 128k ROM
+	BASIC_EDITOR_128K
+)
+
+type Cmd_AtBasicPrompt struct {
+	// Receives true if a BASIC editor is waiting for a command (see Cmd_GetBasicEditor)
+	Chan chan<- bool
+}
+
+type Cmd_GetBasicEditor struct {
+	// Receives the editor which is waiting for a BASIC command.
+	// The 48k editor waits at the "0 OK" prompt and after a report.
+	// While a BASIC program is running, is loading from tape, is waiting
+	// for the response to an INPUT statement, or the 128k ROM displays
+	// a menu, the value is BASIC_EDITOR_NONE.
+	Chan chan<- BasicEditor
+}
+
+func (speccy *Spectrum48k) atBasicPrompt() bool {
+	return speccy.basicEditor() != BASIC_EDITOR_NONE
+}
+
+func (speccy *Spectrum48k) basicEditor() BasicEditor {
+	if speccy.readFromTape {
+		return BASIC_EDITOR_NONE
+	}
+	if speccy.romType == ROM48 {
+		if speccy.at48kPrompt() {
+			return BASIC_EDITOR_48K
+		}
+		return BASIC_EDITOR_NONE
+	}
+
+	switch speccy.Memory.slotPages[0] {
+	case MemoryPage{ROM: true, Bank: 0}:
+		if speccy.at128kPrompt() {
+			return BASIC_EDITOR_128K
+		}
+	case MemoryPage{ROM: true, Bank: 1}:
+		// The 48k BASIC ROM
+		if speccy.at48kPrompt() {
+			return BASIC_EDITOR_48K
+		}
+	}
+	return BASIC_EDITOR_NONE
+}
+
+// Returns whether the line editor of the 48k BASIC ROM is waiting for a command
+func (speccy *Spectrum48k) at48kPrompt() bool {
+	memory := speccy.Memory
+	readWord := func(address uint16) uint16 {
+		return uint16(memory.Read(address)) | (uint16(memory.Read(address+1)) << 8)
+	}
+
+	// Is the editor running?
+	errSP := readWord(SystemVariables["ERRSP"].Address)
+	if readWord(errSP) != rom48_ED_ERROR {
+		return false
+	}
+
+	// Bit 5 of FLAGX is set if the editor is handling an INPUT statement
+	return (memory.Read(SystemVariables["FLAGX"].Address) & 0x20) == 0
+}
+
+// Returns whether the editor of the 128k ROM is waiting for a command.
+// The editor ROM must be paged in.
+func (speccy *Spectrum48k) at128kPrompt() bool {
+	memory := speccy.Memory
+
+	// A program is running, or the 48 BASIC mode has been selected
+	if (memory.ram[5][rom128_FLAGS3-0x4000] & rom128_FLAGS3_BASIC) != 0 {
+		return false
+	}
+
+	// The ROM initializes the channels before it displays the menu
+	chans := SystemVariables["CHANS"].Address - 0x4000
+	if (memory.ram[5][chans] == 0) && (memory.ram[5][chans+1] == 0) {
+		return false
+	}
+
+	return (memory.ram[7][rom128_EDITOR_FLAGS-0xc000] & rom128_EDITOR_FLAGS_MENU) == 0
+}
+
+// The editor flags of the 128k ROM (at 0xEC0D in RAM bank 7).
+// Bit 1 is set while the ROM displays a menu.
+const (
+	rom128_EDITOR_FLAGS      = 0xec0d
+	rom128_EDITOR_FLAGS_MENU = 0x02
+)
+
+// FLAGS3, a system variable of the 128k ROM.
+// Bit 0 is set in the 48k BASIC and calculator modes, and reset in the editor and the menus.
+const (
+	rom128_FLAGS3       = 0x5b66
+	rom128_FLAGS3_BASIC = 0x01
+)
+
+// The address at which the 48k ROM waits for a key in the line editor (KEY-INPUT)
+const rom48_KEY_INPUT = 0x10ac
+
+type Cmd_AtMenu128 struct {
+	// Receives true if the 128k editor ROM displays a menu, such as the menu
+	// displayed after a reset, and the machine is not loading from tape.
+	Chan chan<- bool
+}
+
+func (speccy *Spectrum48k) atMenu128() bool {
+	return speccy.menu128Displayed() && !speccy.readFromTape
+}
+
+// Returns whether the 128k editor ROM is paged in and displays a menu
+func (speccy *Spectrum48k) menu128Displayed() bool {
+	memory := speccy.Memory
+	if (speccy.romType != ROM128) || (memory.slotPages[0] != MemoryPage{ROM: true, Bank: 0}) {
+		return false
+	}
+
+	// The system variables are in RAM bank 5 (0x4000), and the editor keeps
+	// its variables in RAM bank 7, whichever bank is paged in at 0xc000
+	if (memory.ram[5][rom128_FLAGS3-0x4000] & rom128_FLAGS3_BASIC) != 0 {
+		return false
+	}
+	return (memory.ram[7][rom128_EDITOR_FLAGS-0xc000] & rom128_EDITOR_FLAGS_MENU) != 0
+}
+
+// Returns whether the system ROM has finished the initialization after a reset
+func (speccy *Spectrum48k) systemROMReady() bool {
+	if speccy.romType == ROM128 {
+		return speccy.menu128Displayed()
+	}
+	return speccy.Cpu.PC() == rom48_KEY_INPUT
+}
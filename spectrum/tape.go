@@ -1,6 +1,8 @@
 package spectrum
 
 import (
+	"errors"
+	"fmt"
 	"github.com/guntars-lemps/gospeccy/formats"
 	"io/ioutil"
 	"sync"
@@ -33,30 +35,165 @@ const (
 
 const TAPE_ACCELERATION_IN_FPS = DefaultFPS * 20
 
+// A block of the tape signal: a pilot tone, a sequence of sync pulses and data,
+// followed by a pause. Each of these parts can be empty. The lengths are in T-states.
+type tapeBlock struct {
+	pilotPulse, pilotPulses int
+	syncPulses              []int
+	zeroPulse, onePulse     int
+
+	// Data bits are played starting from the most significant bit
+	data               []byte
+	usedBitsInLastByte uint
+
+	pause int
+}
+
 type Tape struct {
-	tap *formats.TAP
+	blocks []tapeBlock
+
+	// The number of data bytes on the tape
+	len uint
 }
 
+// Creates a tape from a TAP file. The blocks are played with the timings of the ROM loader.
 func NewTape(tap *formats.TAP) *Tape {
-	return &Tape{tap}
+	tape := &Tape{}
+	for i := 0; i < tap.NumBlocks(); i++ {
+		block := tap.GetBlock(i)
+
+		pilotPulses := TAPE_DATA_LEADER_PULSES
+		if block.BlockType() == formats.TAP_BLOCK_HEADER {
+			pilotPulses = TAPE_HEADER_LEADER_PULSES
+		}
+
+		tape.add(tapeBlock{
+			pilotPulse:         TAPE_LEADER,
+			pilotPulses:        pilotPulses,
+			syncPulses:         []int{TAPE_FIRST_SYNC, TAPE_SECOND_SYNC},
+			zeroPulse:          TAPE_UNSET_BIT,
+			onePulse:           TAPE_SET_BIT,
+			data:               block.Data(),
+			usedBitsInLastByte: 8,
+			pause:              TAPE_PAUSE,
+		})
+	}
+	return tape
+}
+
+// Creates a tape from a TZX file, with the timings specified by the file.
+// The blocks which carry neither a signal nor a pause are omitted.
+//
+// A pause of 0 ms, which in block 0x20 means "stop the tape", is ignored.
+func NewTapeFromTZX(tzx *formats.TZX) *Tape {
+	tape := &Tape{}
+	for i := 0; i < tzx.NumBlocks(); i++ {
+		b := tzx.GetBlock(i)
+
+		block := tapeBlock{
+			pilotPulse:         int(b.PilotPulse),
+			pilotPulses:        int(b.PilotPulses),
+			zeroPulse:          int(b.ZeroPulse),
+			onePulse:           int(b.OnePulse),
+			data:               b.Data,
+			usedBitsInLastByte: uint(b.UsedBitsInLastByte),
+			pause:              int(b.Pause) * formats.TZX_TSTATES_PER_MILLISECOND,
+		}
+		for _, pulse := range b.SyncPulses {
+			block.syncPulses = append(block.syncPulses, int(pulse))
+		}
+
+		if (block.pilotPulses > 0) || (len(block.syncPulses) > 0) || (len(block.data) > 0) || (block.pause > 0) {
+			tape.add(block)
+		}
+	}
+	return tape
 }
 
+// Reads a TAP or a TZX file
 func NewTapeFromFile(filename string) (*Tape, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
+	if formats.IsTZX(data) {
+		tzx, err := formats.NewTZX(data)
+		if err != nil {
+			return nil, err
+		}
+		return NewTapeFromTZX(tzx), nil
+	}
+
 	tap, err := formats.NewTAP(data)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Tape{tap}, nil
+	return NewTape(tap), nil
 }
 
-func (tape *Tape) At(pos uint) byte {
-	return tape.tap.At(pos)
+func (tape *Tape) add(block tapeBlock) {
+	tape.blocks = append(tape.blocks, block)
+	tape.len += uint(len(block.data))
+}
+
+// Returns the number of blocks on the tape
+func (tape *Tape) NumBlocks() int {
+	return len(tape.blocks)
+}
+
+// Returns the data payload of the n-th block (counting from 0),
+// without the flag byte and the checksum byte
+func (tape *Tape) BlockPayload(n int) (payload []byte, checksumOK bool, err error) {
+	if (n < 0) || (n >= tape.NumBlocks()) {
+		return nil, false, errors.New("invalid tape block number")
+	}
+
+	payload, checksumOK = formats.BlockPayload(tape.blocks[n].data)
+	return payload, checksumOK, nil
+}
+
+// Describes a block of a tape
+type TapeBlockInfo struct {
+	// The number of data bytes, including the flag byte and the checksum
+	Length int
+
+	// The file type and the file name of a standard header block, or empty strings
+	FileType, Filename string
+}
+
+// Returns a description of each block on the tape
+func (tape *Tape) Blocks() []TapeBlockInfo {
+	blocks := make([]TapeBlockInfo, len(tape.blocks))
+	for i, block := range tape.blocks {
+		blocks[i].Length = len(block.data)
+		blocks[i].FileType, blocks[i].Filename, _ = formats.DecodeHeader(block.data)
+	}
+	return blocks
+}
+
+// Returns the file name of the n-th block: from the block itself if it is a standard header,
+// or from the preceding header if it is the data block of a file. Returns "" if there is no header.
+func (tape *Tape) blockName(n int) string {
+	if _, name, ok := formats.DecodeHeader(tape.blocks[n].data); ok {
+		return name
+	}
+	if n > 0 {
+		if _, name, ok := formats.DecodeHeader(tape.blocks[n-1].data); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// Returns the number of data bytes preceding the n-th block
+func (tape *Tape) offset(n int) uint {
+	offset := uint(0)
+	for _, block := range tape.blocks[0:n] {
+		offset += uint(len(block.data))
+	}
+	return offset
 }
 
 type TapeDrive struct {
@@ -70,8 +207,9 @@ type TapeDrive struct {
 	tstate, lastIn                        uint64
 	earBit                                byte
 	timeout                               int
-	timeLastIn, currBlockLen, currBlockId int
-	leaderPulses, bitTime                 uint16
+	timeLastIn, currBlockPos, currBlockId int
+	leaderPulses, syncPulse, bitTime      int
+	bitsLeft                              uint
 	state, mask                           byte
 	accelerating                          bool
 	fpsBeforeAcceleration                 float32
@@ -94,12 +232,112 @@ func (tapeDrive *TapeDrive) init(speccy *Spectrum48k) {
 }
 
 func (tapeDrive *TapeDrive) Insert(tape *Tape) {
+	tapeDrive.mutex.Lock()
 	tapeDrive.tape = tape
+	tapeDrive.mutex.Unlock()
 }
 
+// Returns the inserted tape, or nil
+func (tapeDrive *TapeDrive) Tape() *Tape {
+	tapeDrive.mutex.RLock()
+	defer tapeDrive.mutex.RUnlock()
+	return tapeDrive.tape
+}
+
+type TapeProgress struct {
+	// Whether the tape is playing
+	Playing bool
+
+	// The block being played (counting from 0), and the number of blocks on the tape
+	Block, NumBlocks int
+
+	// Progress of the whole tape, 0 .. 100
+	Percent float32
+
+	// Progress of the data of the block being played, 0 .. 100.
+	// It stays at 0 while the pilot tone is playing.
+	BlockPercent float32
+
+	// The file name of the block being played, see 'Tape.blockName'
+	BlockName string
+}
+
+// Describes the progress to the user. The blocks are numbered from 1.
+func (p TapeProgress) String() string {
+	if p.NumBlocks == 0 {
+		return "no tape inserted"
+	}
+
+	state := "stopped"
+	if p.Playing {
+		state = "playing"
+	}
+	if p.Block >= p.NumBlocks {
+		return state + ", at the end of the tape"
+	}
+
+	name := ""
+	if p.BlockName != "" {
+		name = " \"" + p.BlockName + "\""
+	}
+	return fmt.Sprintf("%s, block %d of %d%s: %.0f%% of the block, %.0f%% of the tape",
+		state, p.Block+1, p.NumBlocks, name, p.BlockPercent, p.Percent)
+}
+
+// Returns the progress of the inserted tape.
+// With accelerated loading, the frames pass too quickly for the position within a block
+// to be of any use, so the percentage is based on the number of blocks already loaded.
+func (tapeDrive *TapeDrive) progress() TapeProgress {
+	tape := tapeDrive.Tape()
+	if tape == nil {
+		return TapeProgress{}
+	}
+
+	p := TapeProgress{
+		Playing:   tapeDrive.speccy.readFromTape,
+		Block:     tapeDrive.currBlockId,
+		NumBlocks: tape.NumBlocks(),
+	}
+
+	switch {
+	case tapeDrive.pos >= tape.len:
+		p.Percent = 100
+	case tapeDrive.AcceleratedLoad:
+		p.Percent = 100 * float32(tapeDrive.currBlockId) / float32(p.NumBlocks)
+	default:
+		p.Percent = 100 * float32(tapeDrive.pos) / float32(tape.len)
+	}
+
+	if p.Block < p.NumBlocks {
+		p.BlockName = tape.blockName(p.Block)
+
+		switch tapeDrive.state {
+		case TAPE_DRIVE_NEWBYTE, TAPE_DRIVE_NEWBIT, TAPE_DRIVE_HALF2:
+			if n := len(tape.blocks[p.Block].data); n > 0 {
+				p.BlockPercent = 100 * float32(tapeDrive.currBlockPos) / float32(n)
+			}
+		case TAPE_DRIVE_PAUSE, TAPE_DRIVE_PAUSE_STOP:
+			// A stopped tape is in the PAUSE_STOP state as well, at the beginning of the block
+			if p.Playing {
+				p.BlockPercent = 100
+			}
+		case TAPE_DRIVE_PRE_STOP, TAPE_DRIVE_STOP:
+			// The last block has been played
+			p.BlockPercent = 100
+		}
+	}
+
+	return p
+}
+
+// Starts playing the tape from the beginning of the current block,
+// which is the first block unless the tape has been moved by SeekToBlock.
 func (tapeDrive *TapeDrive) Play() {
 	tapeDrive.speccy.readFromTape = true
 	tapeDrive.pos = 0
+	if tape := tapeDrive.Tape(); (tape != nil) && (tapeDrive.currBlockId < tape.NumBlocks()) {
+		tapeDrive.pos = tape.offset(tapeDrive.currBlockId)
+	}
 	tapeDrive.state = TAPE_DRIVE_START
 	tapeDrive.timeout = 0
 	tapeDrive.timeLastIn = 0
@@ -114,6 +352,38 @@ func (tapeDrive *TapeDrive) Stop() {
 	tapeDrive.currBlockId = 0
 }
 
+// Moves the tape to the beginning of the first block.
+// If the tape is playing, it continues playing from there.
+func (tapeDrive *TapeDrive) Rewind() {
+	playing := tapeDrive.speccy.readFromTape
+
+	tapeDrive.Stop()
+	tapeDrive.earBit = 0xbf
+
+	if playing {
+		tapeDrive.Play()
+	}
+}
+
+// Moves the tape to the beginning of the n-th block (counting from 0).
+// If the tape is playing, it continues playing from there,
+// and the block which was being loaded is abandoned.
+func (tapeDrive *TapeDrive) SeekToBlock(n int) error {
+	tape := tapeDrive.Tape()
+	if tape == nil {
+		return errors.New("no tape inserted")
+	}
+	if (n < 0) || (n >= tape.NumBlocks()) {
+		return errors.New("invalid tape block number")
+	}
+
+	tapeDrive.Rewind()
+	tapeDrive.currBlockId = n
+	tapeDrive.pos = tape.offset(n)
+
+	return nil
+}
+
 func (tapeDrive *TapeDrive) accelerate() {
 	if !tapeDrive.accelerating {
 		tapeDrive.accelerating = true
@@ -142,8 +412,21 @@ func (tapeDrive *TapeDrive) decelerate() {
 	}
 }
 
+// Returns the FPS which was in effect before the tape loading was accelerated
+func (tapeDrive *TapeDrive) normalFPS() float32 {
+	tapeDrive.mutex.RLock()
+	fps := tapeDrive.fpsBeforeAcceleration
+	tapeDrive.mutex.RUnlock()
+
+	if fps <= 0 {
+		// The acceleration has just started and the old FPS is not known yet
+		fps = DefaultFPS
+	}
+	return fps
+}
+
 func (tapeDrive *TapeDrive) doPlay() (endOfBlock bool) {
-	now := int(tapeDrive.speccy.ula.frame)*TStatesPerFrame + tapeDrive.speccy.Cpu.GetTstates()
+	now := int(tapeDrive.speccy.ula.frame)*tapeDrive.speccy.ula.timings.TStatesPerFrame + tapeDrive.speccy.ula.cpuTState()
 
 	tapeDrive.timeout -= now - tapeDrive.timeLastIn
 	tapeDrive.timeLastIn = now
@@ -161,104 +444,138 @@ func (tapeDrive *TapeDrive) doPlay() (endOfBlock bool) {
 	}
 
 	switch tapeDrive.state {
-	case TAPE_DRIVE_START:
-		currBlock := tapeDrive.tape.tap.GetBlock(tapeDrive.currBlockId)
-		tapeDrive.currBlockLen = currBlock.Len()
-
-		if currBlock.BlockType() == formats.TAP_BLOCK_HEADER {
-			tapeDrive.leaderPulses = TAPE_HEADER_LEADER_PULSES
-		} else {
-			tapeDrive.leaderPulses = TAPE_DATA_LEADER_PULSES
+	case TAPE_DRIVE_START, TAPE_DRIVE_LEADER, TAPE_DRIVE_SYNC, TAPE_DRIVE_NEWBYTE, TAPE_DRIVE_NEWBIT, TAPE_DRIVE_HALF2:
+		if tapeDrive.currBlockId >= tapeDrive.tape.NumBlocks() {
+			// Nothing to play
+			tapeDrive.state = TAPE_DRIVE_PRE_STOP
+			break
 		}
 
-		tapeDrive.earBit = 0xbf
-		tapeDrive.timeout = TAPE_LEADER
-		tapeDrive.state = TAPE_DRIVE_LEADER
-	case TAPE_DRIVE_LEADER:
-		if tapeDrive.earBit == 0xbf {
-			tapeDrive.earBit = 0xff
-		} else {
-			tapeDrive.earBit = 0xbf
-		}
-		tapeDrive.leaderPulses--
-		if tapeDrive.leaderPulses > 0 {
-			tapeDrive.timeout = TAPE_LEADER
-		} else {
-			tapeDrive.timeout = TAPE_FIRST_SYNC
-			tapeDrive.state = TAPE_DRIVE_SYNC
+		start := (tapeDrive.state == TAPE_DRIVE_START)
+		if !tapeDrive.nextPulse() {
+			endOfBlock = tapeDrive.endBlock()
+			break
 		}
 
-	case TAPE_DRIVE_SYNC:
-		if tapeDrive.earBit == 0xbf {
+		// Each pulse begins with an edge. After a pause, the first edge is a falling one.
+		if start && tapeDrive.afterPause() {
+			tapeDrive.earBit = 0xbf
+		} else if tapeDrive.earBit == 0xbf {
 			tapeDrive.earBit = 0xff
 		} else {
 			tapeDrive.earBit = 0xbf
 		}
-		tapeDrive.timeout = TAPE_SECOND_SYNC
-		tapeDrive.state = TAPE_DRIVE_NEWBYTE
 
-	case TAPE_DRIVE_NEWBYTE:
-		tapeDrive.mask = 0x80
-		fallthrough
+	case TAPE_DRIVE_PRE_STOP:
+		tapeDrive.earBit = 0xbf // release ear bit
+		tapeDrive.state = TAPE_DRIVE_STOP
+		tapeDrive.speccy.readFromTape = false
+		tapeDrive.notifyCpuLoadCompleted = true
 
-	case TAPE_DRIVE_NEWBIT:
-		if tapeDrive.earBit == 0xbf {
-			tapeDrive.earBit = 0xff
-		} else {
-			tapeDrive.earBit = 0xbf
-		}
-		if (tapeDrive.tape.At(tapeDrive.pos) & tapeDrive.mask) == 0 {
-			tapeDrive.bitTime = TAPE_UNSET_BIT
-		} else {
-			tapeDrive.bitTime = TAPE_SET_BIT
-		}
-		tapeDrive.timeout = int(tapeDrive.bitTime)
-		tapeDrive.state = TAPE_DRIVE_HALF2
+	case TAPE_DRIVE_PAUSE_STOP:
+		tapeDrive.currBlockId++
+		tapeDrive.state = TAPE_DRIVE_START
 
-	case TAPE_DRIVE_HALF2:
-		if tapeDrive.earBit == 0xbf {
-			tapeDrive.earBit = 0xff
-		} else {
-			tapeDrive.earBit = 0xbf
-		}
-		tapeDrive.timeout = int(tapeDrive.bitTime)
-		tapeDrive.mask >>= 1
-		if tapeDrive.mask == 0 {
-			tapeDrive.pos++
-			tapeDrive.currBlockLen--
-			if tapeDrive.currBlockLen > 0 {
+	}
+
+	return endOfBlock
+}
+
+// Starts the next pulse of the current block: sets 'timeout' to the length of the pulse,
+// and 'state' to the part of the block which follows the pulse.
+// Returns false if the block has no more pulses.
+func (tapeDrive *TapeDrive) nextPulse() bool {
+	block := &tapeDrive.tape.blocks[tapeDrive.currBlockId]
+
+	for {
+		switch tapeDrive.state {
+		case TAPE_DRIVE_START:
+			tapeDrive.leaderPulses = block.pilotPulses
+			tapeDrive.syncPulse = 0
+			tapeDrive.currBlockPos = 0
+			tapeDrive.state = TAPE_DRIVE_LEADER
+
+		case TAPE_DRIVE_LEADER:
+			if tapeDrive.leaderPulses > 0 {
+				tapeDrive.leaderPulses--
+				tapeDrive.timeout = block.pilotPulse
+				return true
+			}
+			tapeDrive.state = TAPE_DRIVE_SYNC
+
+		case TAPE_DRIVE_SYNC:
+			if tapeDrive.syncPulse < len(block.syncPulses) {
+				tapeDrive.timeout = block.syncPulses[tapeDrive.syncPulse]
+				tapeDrive.syncPulse++
+				return true
+			}
+			tapeDrive.state = TAPE_DRIVE_NEWBYTE
+
+		case TAPE_DRIVE_NEWBYTE:
+			if tapeDrive.currBlockPos >= len(block.data) {
+				tapeDrive.state = TAPE_DRIVE_PAUSE
+				return false
+			}
+			tapeDrive.mask = 0x80
+			tapeDrive.bitsLeft = 8
+			if tapeDrive.currBlockPos == len(block.data)-1 {
+				tapeDrive.bitsLeft = block.usedBitsInLastByte
+			}
+			tapeDrive.state = TAPE_DRIVE_NEWBIT
+
+		case TAPE_DRIVE_NEWBIT:
+			if tapeDrive.bitsLeft == 0 {
+				tapeDrive.pos++
+				tapeDrive.currBlockPos++
 				tapeDrive.state = TAPE_DRIVE_NEWBYTE
+				break
+			}
+			if (block.data[tapeDrive.currBlockPos] & tapeDrive.mask) == 0 {
+				tapeDrive.bitTime = block.zeroPulse
 			} else {
-				tapeDrive.state = TAPE_DRIVE_PAUSE
+				tapeDrive.bitTime = block.onePulse
 			}
-		} else {
+			tapeDrive.timeout = tapeDrive.bitTime
+			tapeDrive.state = TAPE_DRIVE_HALF2
+			return true
+
+		case TAPE_DRIVE_HALF2:
+			tapeDrive.timeout = tapeDrive.bitTime
+			tapeDrive.mask >>= 1
+			tapeDrive.bitsLeft--
 			tapeDrive.state = TAPE_DRIVE_NEWBIT
+			return true
+
+		default:
+			return false
 		}
+	}
+}
 
-	case TAPE_DRIVE_PAUSE:
-		tapeDrive.earBit = 0xff
+// Returns whether the current block follows a pause, or is the first block
+func (tapeDrive *TapeDrive) afterPause() bool {
+	return (tapeDrive.currBlockId == 0) || (tapeDrive.tape.blocks[tapeDrive.currBlockId-1].pause > 0)
+}
+
+// Called after the last pulse of the current block.
+// Blocks without a pause are followed immediately by the next block,
+// without affecting the ear bit. Returns whether the tape has reached a pause.
+func (tapeDrive *TapeDrive) endBlock() (endOfBlock bool) {
+	block := &tapeDrive.tape.blocks[tapeDrive.currBlockId]
+	lastBlock := (tapeDrive.currBlockId+1 >= len(tapeDrive.tape.blocks))
 
+	if (block.pause > 0) || lastBlock {
+		tapeDrive.earBit = 0xff
 		endOfBlock = true
 		tapeDrive.decelerate()
+	}
 
-		if tapeDrive.pos < tapeDrive.tape.tap.Len() {
-			tapeDrive.timeout = TAPE_PAUSE
-			tapeDrive.state = TAPE_DRIVE_PAUSE_STOP
-		} else {
-			tapeDrive.timeout = TAPE_WAIT_PRE_STOP // hold ear bit 1 for some time
-			tapeDrive.state = TAPE_DRIVE_PRE_STOP
-		}
-
-	case TAPE_DRIVE_PRE_STOP:
-		tapeDrive.earBit = 0xbf // release ear bit
-		tapeDrive.state = TAPE_DRIVE_STOP
-		tapeDrive.speccy.readFromTape = false
-		tapeDrive.notifyCpuLoadCompleted = true
-
-	case TAPE_DRIVE_PAUSE_STOP:
-		tapeDrive.currBlockId++
-		tapeDrive.state = TAPE_DRIVE_START
-
+	if !lastBlock {
+		tapeDrive.timeout = block.pause
+		tapeDrive.state = TAPE_DRIVE_PAUSE_STOP
+	} else {
+		tapeDrive.timeout = TAPE_WAIT_PRE_STOP // hold ear bit 1 for some time
+		tapeDrive.state = TAPE_DRIVE_PRE_STOP
 	}
 
 	return endOfBlock
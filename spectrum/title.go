@@ -0,0 +1,46 @@
+package spectrum
+
+// Heuristic detection of a game's title screen.
+//
+// A game loaded from tape usually shows a loading screen, which is painted
+// while the tape is playing. When the game starts, it replaces the whole screen
+// in a short time. The title screen is assumed to be the first screen
+// which stays unchanged for a while after such a full-screen repaint.
+
+// Default value of 'Cmd_WaitTitle.ChangedCells', 3/4 of the screen
+const DefaultTitleChangedCells = ScreenWidth_Attr * ScreenHeight_Attr * 3 / 4
+
+type titleWaiter struct {
+	Cmd_WaitTitle
+
+	// Whether the full-screen repaint has already happened
+	repainted bool
+}
+
+func (speccy *Spectrum48k) addTitleWaiter(cmd Cmd_WaitTitle) {
+	if cmd.ChangedCells == 0 {
+		cmd.ChangedCells = DefaultTitleChangedCells
+	}
+	speccy.titleWaiters = append(speccy.titleWaiters, &titleWaiter{Cmd_WaitTitle: cmd})
+}
+
+// Called at the end of each frame while there are pending 'Cmd_WaitTitle' commands
+func (speccy *Spectrum48k) checkTitleWaiters() {
+	loading := speccy.readFromTape
+	changedCells := uint(speccy.ula.numDirtyCells())
+
+	n := 0
+	for _, waiter := range speccy.titleWaiters {
+		if !loading && !waiter.repainted && (changedCells >= waiter.ChangedCells) {
+			waiter.repainted = true
+		}
+
+		if waiter.repainted && (speccy.stableFrames >= waiter.StableFrames) {
+			waiter.Done <- true
+		} else {
+			speccy.titleWaiters[n] = waiter
+			n++
+		}
+	}
+	speccy.titleWaiters = speccy.titleWaiters[0:n]
+}
@@ -0,0 +1,249 @@
+package spectrum
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Registers which can appear in an instruction trace, in the order in which they are printed
+var traceRegisterNames = []string{"PC", "SP", "AF", "BC", "DE", "HL", "IX", "IY", "AF'", "BC'", "DE'", "HL'", "I", "R"}
+
+const (
+	trace_PC = iota
+	trace_SP
+	trace_AF
+	trace_BC
+	trace_DE
+	trace_HL
+	trace_IX
+	trace_IY
+	trace_AF_
+	trace_BC_
+	trace_DE_
+	trace_HL_
+	trace_I
+	trace_R
+	trace_numRegisters
+)
+
+// The state of the CPU before executing an instruction.
+//
+// In a trace file, each step is a single line of NAME=VALUE pairs separated by spaces,
+// where NAME is one of PC, SP, AF, BC, DE, HL, IX, IY, AF', BC', DE', HL', I, R
+// and VALUE is a hexadecimal number. For example:
+//
+//	PC=8000 SP=ff4a AF=0044 BC=0000 DE=0000 HL=5c3a
+//
+// Registers missing from a line are not compared.
+// Empty lines and lines starting with '#' are ignored.
+type TraceStep struct {
+	Values [trace_numRegisters]uint16
+
+	// Bit N is set if the value of register N is known
+	Present uint
+}
+
+func (step *TraceStep) String() string {
+	var fields []string
+	for i, name := range traceRegisterNames {
+		if (step.Present & (1 << uint(i))) == 0 {
+			continue
+		}
+		if (i == trace_I) || (i == trace_R) {
+			fields = append(fields, fmt.Sprintf("%s=%02x", name, step.Values[i]))
+		} else {
+			fields = append(fields, fmt.Sprintf("%s=%04x", name, step.Values[i]))
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// Returns the name of the first register which differs between the steps,
+// or an empty string if the steps match.
+// Only the registers present in the expected step are compared.
+// Bits of the F register which are zero in 'flagsMask' are ignored.
+func (expected *TraceStep) mismatch(actual *TraceStep, flagsMask byte) string {
+	for i := 0; i < trace_numRegisters; i++ {
+		if (expected.Present & (1 << uint(i))) == 0 {
+			continue
+		}
+
+		mask := uint16(0xffff)
+		if (i == trace_AF) || (i == trace_AF_) {
+			mask = 0xff00 | uint16(flagsMask)
+		}
+
+		if (expected.Values[i] & mask) != (actual.Values[i] & mask) {
+			return traceRegisterNames[i]
+		}
+	}
+	return ""
+}
+
+func parseTraceStep(line string) (TraceStep, error) {
+	var step TraceStep
+	for _, field := range strings.Fields(line) {
+		nameValue := strings.SplitN(field, "=", 2)
+		if len(nameValue) != 2 {
+			return step, errors.New("invalid field \"" + field + "\"")
+		}
+
+		name := strings.ToUpper(nameValue[0])
+		reg := -1
+		for i, regName := range traceRegisterNames {
+			if regName == name {
+				reg = i
+				break
+			}
+		}
+		if reg == -1 {
+			return step, errors.New("unknown register \"" + nameValue[0] + "\"")
+		}
+
+		value, err := strconv.ParseUint(nameValue[1], 16, 16)
+		if err != nil {
+			return step, errors.New("invalid value of register " + name + ": \"" + nameValue[1] + "\"")
+		}
+
+		step.Values[reg] = uint16(value)
+		step.Present |= 1 << uint(reg)
+	}
+	return step, nil
+}
+
+// Reads an instruction trace in the format described at 'TraceStep'
+func ReadTrace(r io.Reader) ([]TraceStep, error) {
+	var steps []TraceStep
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		step, err := parseTraceStep(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return steps, nil
+}
+
+// Returns the current state of the CPU, including all registers
+func (speccy *Spectrum48k) traceStep() TraceStep {
+	cpu := speccy.Cpu
+
+	join := func(h, l byte) uint16 {
+		return (uint16(h) << 8) | uint16(l)
+	}
+
+	var step TraceStep
+	step.Values[trace_PC] = cpu.PC()
+	step.Values[trace_SP] = cpu.SP()
+	step.Values[trace_AF] = join(cpu.A, cpu.F)
+	step.Values[trace_BC] = join(cpu.B, cpu.C)
+	step.Values[trace_DE] = join(cpu.D, cpu.E)
+	step.Values[trace_HL] = join(cpu.H, cpu.L)
+	step.Values[trace_IX] = join(cpu.IXH, cpu.IXL)
+	step.Values[trace_IY] = join(cpu.IYH, cpu.IYL)
+	step.Values[trace_AF_] = join(cpu.A_, cpu.F_)
+	step.Values[trace_BC_] = join(cpu.B_, cpu.C_)
+	step.Values[trace_DE_] = join(cpu.D_, cpu.E_)
+	step.Values[trace_HL_] = join(cpu.H_, cpu.L_)
+	step.Values[trace_I] = uint16(cpu.I)
+	step.Values[trace_R] = uint16(byte(cpu.R&0x7f) | (cpu.R7 & 0x80))
+	step.Present = (1 << trace_numRegisters) - 1
+
+	return step
+}
+
+// Describes the first step at which the emulation diverged from the reference trace
+type TraceMismatch struct {
+	// Index of the step in the reference trace, starting from 0
+	Step int
+
+	// The name of the first register which differs
+	Register string
+
+	Expected TraceStep
+	Actual   TraceStep
+}
+
+func (m *TraceMismatch) Error() string {
+	return fmt.Sprintf("step %d: register %s differs\nexpected: %s\nactual:   %s", m.Step, m.Register, &m.Expected, &m.Actual)
+}
+
+// State of a running comparison against a reference trace
+type traceDiff struct {
+	reference []TraceStep
+	flagsMask byte
+	step      int
+	done      chan<- error
+}
+
+type Cmd_TraceDiff struct {
+	// The reference trace. Its first step is compared
+	// with the state of the CPU before the next instruction executes.
+	Reference []TraceStep
+
+	// Bits of the F register which are zero in this mask are not compared.
+	// For example, 0xd7 ignores the undocumented flags (bits 3 and 5).
+	FlagsMask byte
+
+	// Receives nil if the whole trace matched, a *TraceMismatch if the emulation diverged,
+	// or another error if the comparison was aborted
+	Done chan<- error
+}
+
+func (speccy *Spectrum48k) startTraceDiff(cmd Cmd_TraceDiff) {
+	speccy.stopTraceDiff(errors.New("the trace comparison has been replaced by a new one"))
+
+	if len(cmd.Reference) == 0 {
+		cmd.Done <- nil
+		return
+	}
+
+	speccy.traceDiff = &traceDiff{
+		reference: cmd.Reference,
+		flagsMask: cmd.FlagsMask,
+		done:      cmd.Done,
+	}
+}
+
+// Ends the running comparison, if any
+func (speccy *Spectrum48k) stopTraceDiff(err error) {
+	if speccy.traceDiff != nil {
+		speccy.traceDiff.done <- err
+		speccy.traceDiff = nil
+	}
+}
+
+// Called before executing an instruction while a trace comparison is running
+func (speccy *Spectrum48k) traceDiffTrap() {
+	diff := speccy.traceDiff
+
+	expected := &diff.reference[diff.step]
+	actual := speccy.traceStep()
+	if register := expected.mismatch(&actual, diff.flagsMask); register != "" {
+		speccy.stopTraceDiff(&TraceMismatch{diff.step, register, *expected, actual})
+		return
+	}
+
+	diff.step++
+	if diff.step == len(diff.reference) {
+		speccy.stopTraceDiff(nil)
+	}
+}
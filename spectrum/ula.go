@@ -1,6 +1,7 @@
 package spectrum
 
 import (
+	"errors"
 	"github.com/guntars-lemps/z80"
 	"time"
 )
@@ -16,6 +17,77 @@ type ula_attr_t struct {
 	tstate int
 }
 
+// The 48k ULA exists in two variants which differ in the T-state
+// at which the ULA starts reading the screen memory, relative to the interrupt.
+// With "early" timings, the screen is read and the CPU is contended
+// one T-state sooner after the interrupt than with "late" timings.
+//
+// The timing tables (ULATimings) describe the late variant.
+// The early variant is emulated by starting the interrupt one T-state later in the frame.
+type UlaTiming int
+
+const (
+	ULA_TIMING_LATE UlaTiming = iota
+	ULA_TIMING_EARLY
+)
+
+func ParseUlaTiming(s string) (UlaTiming, error) {
+	switch s {
+	case "late":
+		return ULA_TIMING_LATE, nil
+	case "early":
+		return ULA_TIMING_EARLY, nil
+	}
+	return ULA_TIMING_LATE, errors.New("invalid ULA timing \"" + s + "\", expected \"early\" or \"late\"")
+}
+
+func (timing UlaTiming) String() string {
+	if timing == ULA_TIMING_EARLY {
+		return "early"
+	}
+	return "late"
+}
+
+// Determines which parts of the screen are sent to the display receivers as changed
+type RepaintMode int
+
+const (
+	// Repaint only the regions modified by the emulated program
+	REPAINT_CHANGES RepaintMode = iota
+
+	// Repaint the whole screen in every frame
+	REPAINT_FULL
+
+	// Repaint the whole screen in frames which look like color-cycling effects
+	// (the border changing during the frame, or a large part of the attributes being modified)
+	REPAINT_AUTO
+)
+
+func ParseRepaintMode(s string) (RepaintMode, error) {
+	switch s {
+	case "changes":
+		return REPAINT_CHANGES, nil
+	case "full":
+		return REPAINT_FULL, nil
+	case "auto":
+		return REPAINT_AUTO, nil
+	}
+	return REPAINT_CHANGES, errors.New("invalid repaint mode \"" + s + "\", expected \"changes\", \"full\" or \"auto\"")
+}
+
+func (mode RepaintMode) String() string {
+	switch mode {
+	case REPAINT_FULL:
+		return "full"
+	case REPAINT_AUTO:
+		return "auto"
+	}
+	return "changes"
+}
+
+// In REPAINT_AUTO mode, the whole screen is repainted if at least this many 8x8 cells changed
+const repaintAuto_dirtyCellsThreshold = ScreenWidth_Attr * ScreenHeight_Attr / 2
+
 type ULA struct {
 	// Frame number
 	frame uint
@@ -27,6 +99,13 @@ type ULA struct {
 	// The default value is 'true'.
 	accurateEmulation bool
 
+	// T-state of the frame at which the ULA starts the interrupt.
+	// The ULA timing tables are defined in terms of the late timing model.
+	interruptTState int
+
+	// The timings of the machine model
+	timings ULATimings
+
 	// Screen bitmap data read by ULA, if they differ from data in memory at the end of a frame.
 	// Spectrum y-coordinate.
 	bitmap [BytesPerLine * ScreenHeight]ula_byte_t
@@ -38,13 +117,27 @@ type ULA struct {
 	// Whether the 8x8 rectangular screen area was modified during the current frame
 	dirtyScreen [ScreenWidth_Attr * ScreenHeight_Attr]bool
 
+	// The number of T-states by which the contended memory and I/O accesses
+	// delayed the CPU in the current frame
+	contentionTStates int
+
+	// The T-states taken by the memory and I/O cycles which the current instruction
+	// has already made, see memoryCycle
+	cycleTStates int
+
+	// Whether the next memory cycle of the current instruction is an opcode fetch
+	m1Cycle bool
+
+	// Whether the last opcode fetch read the prefix DD or FD
+	indexPrefix bool
+
 	z80    *z80.Z80
 	memory *Memory
 	ports  *Ports
 }
 
 func NewULA() *ULA {
-	return &ULA{accurateEmulation: true}
+	return &ULA{accurateEmulation: true, timings: Timings48k}
 }
 
 func (ula *ULA) init(z80 *z80.Z80, memory *Memory, ports *Ports) {
@@ -55,6 +148,7 @@ func (ula *ULA) init(z80 *z80.Z80, memory *Memory, ports *Ports) {
 
 func (ula *ULA) reset() {
 	ula.frame = 0
+	ula.contentionTStates = 0
 }
 
 func (ula *ULA) getBorderColor() byte {
@@ -69,6 +163,25 @@ func (ula *ULA) setEmulationAccuracy(accurateEmulation bool) {
 	ula.accurateEmulation = accurateEmulation
 }
 
+func (ula *ULA) setTiming(timing UlaTiming) {
+	if timing == ULA_TIMING_EARLY {
+		ula.interruptTState = 1
+	} else {
+		ula.interruptTState = 0
+	}
+}
+
+// Returns the T-state when the ULA reads the specified screen bitmap address
+func (ula *ULA) bitmapReadTState(address uint16) int {
+	x, y := screenAddr_to_xy(address)
+	return ula.timings.FirstScreenByte + int(y)*ula.timings.TStatesPerLine + int(x>>PIXELS_PER_TSTATE_LOG2)
+}
+
+// Returns the T-state when the ULA reads the attribute of the specified pixel line of a 8x8 cell
+func (ula *ULA) attrReadTState(attr_x, y uint) int {
+	return ula.timings.FirstScreenByte + int(y)*ula.timings.TStatesPerLine + int((8*attr_x)>>PIXELS_PER_TSTATE_LOG2)
+}
+
 // This function is called at the beginning of each frame
 func (ula *ULA) frame_begin() {
 	ula.frame++
@@ -105,6 +218,58 @@ func (ula *ULA) frame_begin() {
 	}
 }
 
+// Called when the ULA switches to displaying a different RAM bank.
+// The parts of the screen which the ULA has already read during the current frame
+// keep showing 'oldScreen', the contents of the previously displayed bank.
+func (ula *ULA) screenBankChanged(oldScreen []byte) {
+	for i := range ula.dirtyScreen {
+		ula.dirtyScreen[i] = true
+	}
+
+	if !ula.accurateEmulation {
+		return
+	}
+
+	cpuTState := ula.cpuTState()
+
+	for ofs := range ula.bitmap {
+		address := uint16(SCREEN_BASE_ADDR + ofs)
+		if !ula.bitmap[ofs].valid && (ula.bitmapReadTState(address) <= cpuTState) {
+			ula.bitmap[ofs] = ula_byte_t{true, oldScreen[ofs]}
+		}
+	}
+
+	for ofs := range ula.attr {
+		attr_x := uint(ofs) & 0x001f
+		y := uint(ofs) >> BytesPerLine_log2
+		if !ula.attr[ofs].valid && (ula.attrReadTState(attr_x, y) <= cpuTState) {
+			oldValue := oldScreen[ATTR_BASE_ADDR-SCREEN_BASE_ADDR+(y>>3)*ScreenWidth_Attr+attr_x]
+			ula.attr[ofs] = ula_attr_t{true, oldValue, cpuTState}
+		}
+	}
+}
+
+// Returns whether any part of the screen was modified during the current frame
+func (ula *ULA) screenChanged() bool {
+	for _, dirty := range ula.dirtyScreen {
+		if dirty {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number of 8x8 cells which changed during the current frame
+func (ula *ULA) numDirtyCells() int {
+	n := 0
+	for _, dirty := range ula.dirtyScreen {
+		if dirty {
+			n++
+		}
+	}
+	return n
+}
+
 func (ula *ULA) screenBitmapTouch(address uint16) {
 	var attr_x, attr_y uint8 = screenAddr_to_attrXY(address)
 	ula.dirtyScreen[uint(attr_y)*ScreenWidth_Attr+uint(attr_x)] = true
@@ -115,16 +280,15 @@ func (ula *ULA) screenAttrTouch(address uint16) {
 }
 
 // Handle a write to an address in range (SCREEN_BASE_ADDR ... SCREEN_BASE_ADDR+0x1800-1)
-func (ula *ULA) screenBitmapWrite(address uint16, oldValue byte, newValue byte) {
+// made by the CPU at the specified T-state
+func (ula *ULA) screenBitmapWrite(address uint16, oldValue byte, newValue byte, cpuTState int) {
 	if oldValue != newValue {
 		ula.screenBitmapTouch(address)
 
 		if ula.accurateEmulation {
 			rel_addr := address - SCREEN_BASE_ADDR
-			ula_lineStart_tstate := screenline_start_tstates[rel_addr>>BytesPerLine_log2]
-			x, _ := screenAddr_to_xy(address)
-			ula_tstate := ula_lineStart_tstate + int(x>>PIXELS_PER_TSTATE_LOG2)
-			if ula_tstate <= ula.z80.GetTstates() {
+			ula_tstate := ula.bitmapReadTState(address)
+			if ula_tstate <= cpuTState {
 				// Remember the value read by ULA
 				ula.bitmap[rel_addr] = ula_byte_t{true, oldValue}
 			}
@@ -133,30 +297,28 @@ func (ula *ULA) screenBitmapWrite(address uint16, oldValue byte, newValue byte)
 }
 
 // Handle a write to an address in range (ATTR_BASE_ADDR ... ATTR_BASE_ADDR+0x300-1)
-func (ula *ULA) screenAttrWrite(address uint16, oldValue byte, newValue byte) {
+// made by the CPU at the specified T-state
+func (ula *ULA) screenAttrWrite(address uint16, oldValue byte, newValue byte, cpuTState int) {
 	if oldValue != newValue {
 		ula.screenAttrTouch(address)
 
 		if ula.accurateEmulation {
-			CPU := ula.z80
-
 			attr_x := uint(address & 0x001f)
 			attr_y := uint((address - ATTR_BASE_ADDR) >> ScreenWidth_Attr_log2)
 
-			x := 8 * attr_x
 			y := 8 * attr_y
 
 			ofs := (y << BytesPerLine_log2) + attr_x
-			ula_tstate := int(FIRST_SCREEN_BYTE + y*TSTATES_PER_LINE + (x >> PIXELS_PER_TSTATE_LOG2))
+			ula_tstate := ula.attrReadTState(attr_x, y)
 
 			for i := 0; i < 8; i++ {
-				if ula_tstate <= CPU.GetTstates() {
+				if ula_tstate <= cpuTState {
 					ula_attr := &ula.attr[ofs]
 					if !ula_attr.valid || (ula_tstate > ula_attr.tstate) {
-						*ula_attr = ula_attr_t{true, oldValue, CPU.GetTstates()}
+						*ula_attr = ula_attr_t{true, oldValue, cpuTState}
 					}
 					ofs += BytesPerLine
-					ula_tstate += TSTATES_PER_LINE
+					ula_tstate += ula.timings.TStatesPerLine
 				} else {
 					break
 				}
@@ -188,7 +350,7 @@ func (ula *ULA) prepare(display *DisplayInfo) *DisplayData {
 
 		// Fill screen.bitmap & screen.attr, but only the dirty regions.
 
-		var memory_data = ula.memory.Data()
+		var screen_data = ula.memory.screenData()
 		ula_bitmap := &ula.bitmap
 		ula_attr := &ula.attr
 		screen_dirty := &screen.Dirty
@@ -207,7 +369,7 @@ func (ula *ULA) prepare(display *DisplayInfo) *DisplayData {
 					for y := 0; y < 8; y++ {
 						var attr byte
 						if !ula_attr[linearY_ofs].valid {
-							attr = memory_data[ATTR_BASE_ADDR+attr_ofs]
+							attr = screen_data[ATTR_BASE_ADDR-SCREEN_BASE_ADDR+attr_ofs]
 						} else {
 							attr = ula_attr[linearY_ofs].value
 						}
@@ -232,7 +394,7 @@ func (ula *ULA) prepare(display *DisplayInfo) *DisplayData {
 
 					for y := 0; y < 8; y++ {
 						if !ula_bitmap[screen_addr-SCREEN_BASE_ADDR].valid {
-							screen_bitmap[linearY_ofs] = memory_data[screen_addr]
+							screen_bitmap[linearY_ofs] = screen_data[screen_addr-SCREEN_BASE_ADDR]
 						} else {
 							screen_bitmap[linearY_ofs] = ula_bitmap[screen_addr-SCREEN_BASE_ADDR].value
 						}
@@ -249,7 +411,7 @@ func (ula *ULA) prepare(display *DisplayInfo) *DisplayData {
 					for y := 0; y < 8; y++ {
 						var attr byte
 						if !ula_attr[linearY_ofs].valid {
-							attr = memory_data[ATTR_BASE_ADDR+attr_ofs]
+							attr = screen_data[ATTR_BASE_ADDR-SCREEN_BASE_ADDR+attr_ofs]
 						} else {
 							attr = ula_attr[linearY_ofs].value
 						}
@@ -272,12 +434,16 @@ func (ula *ULA) prepare(display *DisplayInfo) *DisplayData {
 
 		// screen.borderEvents
 		screen.BorderEvents = ula.ports.getBorderEvents()
+		screen.Timings = ula.timings
+
+		screen.Repaint = display.repaint
 	}
 
 	return &screen
 }
 
-func (ula *ULA) sendScreenToDisplay(display *DisplayInfo, completionTime_orNil chan<- time.Time) {
+// Returns false if the display was busy and the frame has been merged into the next one
+func (ula *ULA) sendScreenToDisplay(display *DisplayInfo, completionTime_orNil chan<- time.Time) bool {
 	displayData := ula.prepare(display)
 	displayData.CompletionTime_orNil = completionTime_orNil
 
@@ -304,6 +470,7 @@ func (ula *ULA) sendScreenToDisplay(display *DisplayInfo, completionTime_orNil c
 			display.lastFrame = new(uint)
 		}
 		*(display.lastFrame) = ula.frame
+		display.repaint = false
 	} else {
 		// Nothing was sent over the 'displayChannel', because the send would block.
 		// Avoiding the blocking allows the CPU emulation to proceed when the next tick arrives,
@@ -312,6 +479,8 @@ func (ula *ULA) sendScreenToDisplay(display *DisplayInfo, completionTime_orNil c
 		display.numMissedFrames++
 		display.missedChanges = displayData
 	}
+
+	return nonBlockingSend
 }
 
 // Adds the change-set 'b' to the change-set 'a'.
@@ -346,4 +515,6 @@ func (a *DisplayData) add(b *DisplayData) {
 	}
 
 	a.BorderEvents = b.BorderEvents
+	a.Timings = b.Timings
+	a.Repaint = a.Repaint || b.Repaint
 }
@@ -0,0 +1,183 @@
+package spectrum
+
+import (
+	"fmt"
+	"github.com/guntars-lemps/gospeccy/formats"
+)
+
+// The kinds of memory accesses reported by a watchpoint
+type WatchMode byte
+
+const (
+	WATCH_READ WatchMode = 1 << iota
+	WATCH_WRITE
+)
+
+func (mode WatchMode) String() string {
+	switch mode {
+	case WATCH_READ:
+		return "read"
+	case WATCH_WRITE:
+		return "write"
+	case WATCH_READ | WATCH_WRITE:
+		return "read/write"
+	}
+	return "none"
+}
+
+type Cmd_SetWatch struct {
+	// Sets the watch mode of the addresses From ... To (inclusive).
+	// The mode 0 removes the watchpoints.
+	From, To uint16
+	Mode     WatchMode
+}
+type Cmd_ClearWatches struct{}
+type Cmd_GetWatches struct {
+	Chan chan<- []WatchRange
+}
+
+// A range of addresses with the same watch mode
+type WatchRange struct {
+	From, To uint16
+	Mode     WatchMode
+}
+
+// Describes a memory access which triggered a watchpoint
+type WatchHit struct {
+	Address uint16
+	Mode    WatchMode // WATCH_READ or WATCH_WRITE
+
+	// The value before and after the access. Both are the same for a read.
+	OldValue, NewValue byte
+
+	// The address of the instruction which accessed the memory
+	PC uint16
+}
+
+func (hit WatchHit) String() string {
+	if hit.Mode == WATCH_WRITE {
+		return fmt.Sprintf("write to 0x%04x: 0x%02x -> 0x%02x by the instruction at 0x%04x", hit.Address, hit.OldValue, hit.NewValue, hit.PC)
+	}
+	return fmt.Sprintf("read from 0x%04x: 0x%02x by the instruction at 0x%04x", hit.Address, hit.NewValue, hit.PC)
+}
+
+type memoryWatches struct {
+	// The watch mode of each address. Nil if there are no watchpoints.
+	modes *[0x10000]WatchMode
+	count int
+
+	// Whether the memory accesses are being checked.
+	// True only while the CPU is executing instructions and there are watchpoints,
+	// so that reads and writes performed by commands are not reported.
+	active bool
+
+	// The first access which triggered a watchpoint during the current instruction, or nil
+	hit *WatchHit
+
+	// Protected by the 'paused_mutex' of the Spectrum
+	listeners []func(hit WatchHit, cpu formats.CpuState)
+}
+
+func (w *memoryWatches) check(address uint16, mode WatchMode, oldValue, newValue byte) {
+	if ((w.modes[address] & mode) != 0) && (w.hit == nil) {
+		w.hit = &WatchHit{Address: address, Mode: mode, OldValue: oldValue, NewValue: newValue}
+	}
+}
+
+func (w *memoryWatches) set(from, to uint16, mode WatchMode) {
+	if w.modes == nil {
+		if mode == 0 {
+			return
+		}
+		w.modes = new([0x10000]WatchMode)
+	}
+
+	for address := uint(from); address <= uint(to); address++ {
+		if (w.modes[address] == 0) && (mode != 0) {
+			w.count++
+		} else if (w.modes[address] != 0) && (mode == 0) {
+			w.count--
+		}
+		w.modes[address] = mode
+	}
+
+	if w.count == 0 {
+		w.modes = nil
+	}
+}
+
+func (w *memoryWatches) clear() {
+	w.modes = nil
+	w.count = 0
+}
+
+func (w *memoryWatches) ranges() []WatchRange {
+	ranges := []WatchRange{}
+	if w.modes == nil {
+		return ranges
+	}
+
+	for address := 0; address < len(w.modes); address++ {
+		mode := w.modes[address]
+		if mode == 0 {
+			continue
+		}
+		if n := len(ranges); (n > 0) && (ranges[n-1].Mode == mode) && (int(ranges[n-1].To) == address-1) {
+			ranges[n-1].To = uint16(address)
+		} else {
+			ranges = append(ranges, WatchRange{uint16(address), uint16(address), mode})
+		}
+	}
+	return ranges
+}
+
+// Pauses the emulation after an instruction accessed a watched address.
+// The hit is reported to the watch listeners.
+func (speccy *Spectrum48k) watchTrap() {
+	hit := *speccy.Memory.watches.hit
+	hit.PC = speccy.lastInstructionAddr
+	speccy.Memory.watches.hit = nil
+
+	speccy.breakpoints.stopped = true
+	speccy.Pause()
+	speccy.releaseFrameWaiters()
+
+	cpu := speccy.cpuState()
+	cpu.Tstate = uint(speccy.ula.cpuTState())
+
+	speccy.paused_mutex.Lock()
+	listeners := speccy.Memory.watches.listeners
+	speccy.paused_mutex.Unlock()
+	for _, f := range listeners {
+		go f(hit, cpu)
+	}
+}
+
+// Pauses the emulation when the CPU accesses an address in the range From ... To (inclusive),
+// in the same way as a breakpoint does. The mode 0 removes the watchpoints from the range.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) Watch(from, to uint16, mode WatchMode) {
+	speccy.CommandChannel <- Cmd_SetWatch{from, to, mode}
+}
+
+// This function must not be called from the emulation goroutine
+func (speccy *Spectrum48k) ClearWatches() {
+	speccy.CommandChannel <- Cmd_ClearWatches{}
+}
+
+// Returns the watched address ranges, in ascending order.
+// This function must not be called from the emulation goroutine.
+func (speccy *Spectrum48k) Watches() []WatchRange {
+	ch := make(chan []WatchRange)
+	speccy.CommandChannel <- Cmd_GetWatches{ch}
+	return <-ch
+}
+
+// Registers a function to be called whenever a watchpoint is hit.
+// The function receives the access and the CPU registers after the instruction,
+// and runs in a separate goroutine.
+func (speccy *Spectrum48k) AddWatchListener(f func(hit WatchHit, cpu formats.CpuState)) {
+	speccy.paused_mutex.Lock()
+	speccy.Memory.watches.listeners = append(speccy.Memory.watches.listeners, f)
+	speccy.paused_mutex.Unlock()
+}
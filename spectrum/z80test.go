@@ -0,0 +1,120 @@
+package spectrum
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Address where CP/M programs are loaded
+const CPM_PROGRAM_ADDR = 0x0100
+
+// Address of the CP/M BDOS entry point
+const cpm_BDOS_ADDR = 0x0005
+
+// Stack top used when running a CP/M program
+const cpm_STACK_TOP = 0xfe00
+
+// State of a raw Z80 program running without the Spectrum ROM
+type z80test struct {
+	// Receives the output of BDOS calls.
+	// If nil, BDOS calls are not intercepted.
+	output_orNil io.Writer
+
+	done chan<- error
+}
+
+type Cmd_RunZ80Test struct {
+	// The raw binary, loaded at 'Address'.
+	// The program terminates by jumping to address 0.
+	Program []byte
+	Address uint16
+
+	// If not nil, the CP/M BDOS console output functions (C=2 and C=9)
+	// are emulated and their output is written to this writer.
+	// The BDOS entry point occupies addresses 0x0005-0x0007.
+	Output_orNil io.Writer
+
+	// Receives nil when the program jumps to address 0.
+	// It receives an error if the test is aborted.
+	Done chan<- error
+}
+
+// Starts running a raw Z80 program with no ROM. The whole 64k address space is RAM.
+// The emulated machine should be reset after the test is done.
+func (speccy *Spectrum48k) runZ80Test(cmd Cmd_RunZ80Test) {
+	speccy.reset(RESET_HARD, nil)
+
+	memory := speccy.Memory
+	memory.load(0x0000, make([]byte, 0x4000))
+	memory.romWritable = true
+
+	if int(cmd.Address)+len(cmd.Program) > 0x10000 {
+		memory.romWritable = false
+		cmd.Done <- errors.New("the program doesn't fit into memory")
+		return
+	}
+	memory.load(cmd.Address, cmd.Program)
+
+	if cmd.Output_orNil != nil {
+		// BDOS entry point: the call is trapped before the RET instruction executes.
+		// The word at address 6 is the top of the usable memory.
+		memory.load(cpm_BDOS_ADDR, []byte{
+			0xc9, // RET
+			cpm_STACK_TOP & 0xff,
+			cpm_STACK_TOP >> 8,
+		})
+	}
+
+	speccy.Cpu.SetPC(cmd.Address)
+	speccy.Cpu.SetSP(cpm_STACK_TOP)
+
+	speccy.z80test = &z80test{
+		output_orNil: cmd.Output_orNil,
+		done:         cmd.Done,
+	}
+}
+
+// Ends the running test, if any.
+// The CPU is halted, so that it does not run into the memory after the program.
+func (speccy *Spectrum48k) stopZ80Test(err error) {
+	if speccy.z80test != nil {
+		speccy.z80test.done <- err
+		speccy.z80test = nil
+		speccy.Memory.romWritable = false
+		speccy.Cpu.Halted = true
+	}
+}
+
+// Called before executing an instruction while a test is running
+func (speccy *Spectrum48k) z80testTrap() {
+	switch speccy.Cpu.PC() {
+	case 0x0000:
+		speccy.stopZ80Test(nil)
+
+	case cpm_BDOS_ADDR:
+		out := speccy.z80test.output_orNil
+		if out == nil {
+			return
+		}
+
+		switch speccy.Cpu.C {
+		case 2:
+			// Console output of the character in register E
+			fmt.Fprintf(out, "%c", speccy.Cpu.E)
+
+		case 9:
+			// Output of the '$'-terminated string at address DE.
+			// Without the terminator, the output stops after the whole memory.
+			addr := uint16(speccy.Cpu.D)<<8 | uint16(speccy.Cpu.E)
+			for i := 0; i < 0x10000; i++ {
+				c := speccy.Memory.Read(addr)
+				if c == '$' {
+					break
+				}
+				fmt.Fprintf(out, "%c", c)
+				addr++
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package spectrum
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestZ80TestCPM(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	program := []byte{
+		0x0e, 0x09, // 0100 LD C,9
+		0x11, 0x12, 0x01, // 0102 LD DE,0x0112
+		0xcd, 0x05, 0x00, // 0105 CALL 5
+		0x0e, 0x02, // 0108 LD C,2
+		0x1e, '!', // 010A LD E,'!'
+		0xcd, 0x05, 0x00, // 010C CALL 5
+		0xc3, 0x00, 0x00, // 010F JP 0
+		'O', 'K', '$', // 0112
+	}
+
+	var output bytes.Buffer
+	done := make(chan error, 1)
+	speccy.runZ80Test(Cmd_RunZ80Test{program, CPM_PROGRAM_ADDR, &output, done})
+	defer speccy.stopZ80Test(nil)
+
+	for frame := 0; (speccy.z80test != nil) && (frame < 10); frame++ {
+		speccy.renderFrame(nil)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("the program did not finish")
+	}
+
+	if output.String() != "OK!" {
+		t.Errorf("expected the output \"OK!\", got %q", output.String())
+	}
+}
+
+// A string without the terminating '$' is printed up to the size of the memory
+func TestZ80TestUnterminatedString(t *testing.T) {
+	speccy := newTestSpectrum()
+
+	var output bytes.Buffer
+	done := make(chan error, 1)
+	speccy.runZ80Test(Cmd_RunZ80Test{nil, CPM_PROGRAM_ADDR, &output, done})
+	defer speccy.stopZ80Test(nil)
+
+	speccy.Memory.load(0x0000, []byte(strings.Repeat("x", 0x10000)))
+	speccy.Cpu.C = 9
+	speccy.Cpu.SetPC(cpm_BDOS_ADDR)
+	speccy.z80testTrap()
+
+	if output.Len() != 0x10000 {
+		t.Errorf("expected 65536 characters, got %d", output.Len())
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A minimal WebSocket (RFC 6455) server connection.
+// Fragmented messages are reassembled, pings are answered,
+// and the extensions and subprotocols are not supported.
+
+const (
+	ws_OPCODE_CONTINUATION = 0x0
+	ws_OPCODE_TEXT         = 0x1
+	ws_OPCODE_BINARY       = 0x2
+	ws_OPCODE_CLOSE        = 0x8
+	ws_OPCODE_PING         = 0x9
+	ws_OPCODE_PONG         = 0xa
+)
+
+// The largest message accepted from a client
+const ws_MAX_MESSAGE_SIZE = 64 * 1024
+
+// Appended to the client's key to compute the Sec-WebSocket-Accept header
+const ws_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Serializes the writes, the pongs are sent by the reading goroutine
+	writeMutex sync.Mutex
+}
+
+// Takes over the HTTP connection and completes the WebSocket handshake.
+// Handshakes from web pages of other sites are rejected, because browsers
+// do not apply the same-origin policy to WebSockets.
+func websocketUpgrade(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || (key == "") {
+		return nil, errors.New("expected a WebSocket handshake")
+	}
+	if !sameOrigin(r) {
+		return nil, errors.New("the WebSocket origin \"" + r.Header.Get("Origin") + "\" is not allowed")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("the connection cannot be taken over")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + ws_GUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+accept+"\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+func (ws *websocketConn) writeFrame(opcode byte, data []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode // FIN
+	switch n := len(data); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	_, err := ws.conn.Write(append(header, data...))
+	return err
+}
+
+// Sends a binary message
+func (ws *websocketConn) WriteBinary(data []byte) error {
+	return ws.writeFrame(ws_OPCODE_BINARY, data)
+}
+
+// Reads the next text or binary message.
+// Returns io.EOF after the client closes the connection.
+func (ws *websocketConn) ReadMessage() (opcode byte, data []byte, err error) {
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+			return 0, nil, err
+		}
+
+		fin := (header[0] & 0x80) != 0
+		frameOpcode := header[0] & 0x0f
+		masked := (header[1] & 0x80) != 0
+
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+
+		if !masked {
+			return 0, nil, errors.New("websocket: unmasked frame from the client")
+		}
+		if uint64(len(data))+length > ws_MAX_MESSAGE_SIZE {
+			return 0, nil, errors.New("websocket: the message is too large")
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+
+		switch frameOpcode {
+		case ws_OPCODE_PING:
+			if err := ws.writeFrame(ws_OPCODE_PONG, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case ws_OPCODE_PONG:
+			continue
+		case ws_OPCODE_CLOSE:
+			ws.writeFrame(ws_OPCODE_CLOSE, nil)
+			return 0, nil, io.EOF
+		case ws_OPCODE_CONTINUATION:
+			if opcode == 0 {
+				return 0, nil, errors.New("websocket: unexpected continuation frame")
+			}
+		default:
+			if opcode != 0 {
+				return 0, nil, errors.New("websocket: expected a continuation frame")
+			}
+			opcode = frameOpcode
+		}
+
+		data = append(data, payload...)
+		if fin {
+			return opcode, data, nil
+		}
+	}
+}
+
+func (ws *websocketConn) Close() error {
+	return ws.conn.Close()
+}